@@ -0,0 +1,326 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type returnAdminVM struct {
+	ID                   uint64     `json:"id"`
+	CreatedAt            time.Time  `json:"created_at"`
+	Status               string     `json:"status"`
+	Name                 string     `json:"name"`
+	Notes                string     `json:"notes"`
+	Cores                uint       `json:"cores"`
+	RAM                  uint       `json:"ram"`
+	Disk                 uint       `json:"disk"`
+	LifeTime             time.Time  `json:"lifetime"`
+	IncludeGlobalSSHKeys bool       `json:"include_global_ssh_keys"`
+	Node                 string     `json:"node"`
+	LastError            string     `json:"last_error,omitempty"`
+	Attempts             uint       `json:"attempts"`
+	NextRetryAt          *time.Time `json:"next_retry_at,omitempty"`
+	OwnerID              uint       `json:"owner_id"`
+	OwnerType            string     `json:"owner_type"`
+	OwnerName            string     `json:"owner_name"`
+}
+
+type adminVMLifetimeRequest struct {
+	LifeTime time.Time `json:"lifetime"`
+}
+
+type adminVMStatusRequest struct {
+	Status string `json:"status"`
+}
+
+type adminImportVMRequest struct {
+	VMID                 uint64 `json:"vmid"`
+	UserID               uint   `json:"user_id"`
+	GroupID              *uint  `json:"group_id,omitempty"`
+	Name                 string `json:"name"`
+	LifeTime             uint   `json:"lifetime"`
+	IncludeGlobalSSHKeys bool   `json:"include_global_ssh_keys"`
+	Renumber             bool   `json:"renumber"`
+	Cluster              string `json:"cluster"`
+}
+
+// parseVMFilter reads the filters of the admin VM listing from the query
+func parseVMFilter(r *http.Request) (db.VMFilter, string) {
+	q := r.URL.Query()
+	f := db.VMFilter{
+		Status: q.Get("status"),
+		Node:   q.Get("node"),
+	}
+
+	if ownerType := q.Get("owner_type"); ownerType != "" {
+		if ownerType != "User" && ownerType != "Group" {
+			return f, "Invalid owner type"
+		}
+		f.OwnerType = ownerType
+	}
+
+	uintParams := map[string]*uint{
+		"owner_id":  &f.OwnerID,
+		"min_cores": &f.MinCores,
+		"min_ram":   &f.MinRAM,
+		"min_disk":  &f.MinDisk,
+	}
+	for name, dst := range uintParams {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return f, "Invalid " + name
+		}
+		*dst = uint(v)
+	}
+
+	timeParams := map[string]**time.Time{
+		"lifetime_before": &f.LifetimeBefore,
+		"lifetime_after":  &f.LifetimeAfter,
+	}
+	for name, dst := range timeParams {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, "Invalid " + name + ", RFC3339 expected"
+		}
+		*dst = &t
+	}
+
+	return f, ""
+}
+
+func adminListVMs(w http.ResponseWriter, r *http.Request) {
+	filter, msg := parseVMFilter(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	vms, err := proxmox.GetAllVMs(filter)
+	if err != nil {
+		http.Error(w, "Failed to get VMs", http.StatusInternalServerError)
+		return
+	}
+
+	users, err := db.GetAllUsers()
+	if err != nil {
+		http.Error(w, "Failed to get users", http.StatusInternalServerError)
+		return
+	}
+	usernames := make(map[uint]string, len(users))
+	for _, u := range users {
+		usernames[u.ID] = u.Username
+	}
+
+	groups, err := db.GetAllGroups()
+	if err != nil {
+		http.Error(w, "Failed to get groups", http.StatusInternalServerError)
+		return
+	}
+	groupNames := make(map[uint]string, len(groups))
+	for _, g := range groups {
+		groupNames[g.ID] = g.Name
+	}
+
+	resp := make([]returnAdminVM, len(vms))
+	for i, vm := range vms {
+		ownerName := usernames[vm.OwnerID]
+		if vm.OwnerType == "Group" {
+			ownerName = groupNames[vm.OwnerID]
+		}
+		resp[i] = returnAdminVM{
+			ID:                   vm.ID,
+			CreatedAt:            vm.CreatedAt,
+			Status:               vm.Status,
+			Name:                 vm.Name,
+			Notes:                vm.Notes,
+			Cores:                vm.Cores,
+			RAM:                  vm.RAM,
+			Disk:                 vm.Disk,
+			LifeTime:             vm.LifeTime,
+			IncludeGlobalSSHKeys: vm.IncludeGlobalSSHKeys,
+			Node:                 vm.Node,
+			LastError:            vm.LastError,
+			Attempts:             vm.Attempts,
+			NextRetryAt:          vm.NextRetryAt,
+			OwnerID:              vm.OwnerID,
+			OwnerType:            vm.OwnerType,
+			OwnerName:            ownerName,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode VMs to JSON", "error", err)
+		http.Error(w, "Failed to encode VMs to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func writeAdminVMError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, proxmox.ErrVMNotFound) {
+		http.Error(w, "VM not found", http.StatusNotFound)
+	} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+		http.Error(w, "Invalid VM state for this action", http.StatusConflict)
+	} else if errors.Is(err, proxmox.ErrVMMigrating) {
+		http.Error(w, "The VM is migrating", http.StatusConflict)
+	} else if errors.Is(err, proxmox.ErrInsufficientResources) {
+		http.Error(w, "Insufficient resources", http.StatusForbidden)
+	} else if errors.Is(err, proxmox.ErrInvalidOwner) {
+		http.Error(w, "Owner not found", http.StatusBadRequest)
+	} else if errors.Is(err, proxmox.ErrClusterNotFound) {
+		http.Error(w, "Cluster not found", http.StatusNotFound)
+	} else {
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
+
+func adminChangeVMState(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sVMID := chi.URLParam(r, "vmid")
+		vmID, err := strconv.ParseUint(sVMID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+			return
+		}
+
+		m := getVMMutex(uint(vmID))
+		m.Lock()
+		defer m.Unlock()
+
+		if err = proxmox.AdminChangeVMStatus(vmID, action); err != nil {
+			logger.Error("Failed to change VM state by admin", "vmID", vmID, "action", action, "error", err)
+			writeAdminVMError(w, err, "Failed to change VM state")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func adminDeleteVM(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err = proxmox.AdminDeleteVM(vmID); err != nil {
+		logger.Error("Failed to delete VM by admin", "vmID", vmID, "error", err)
+		writeAdminVMError(w, err, "Failed to delete VM")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminUpdateVMLifetime(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req adminVMLifetimeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.LifeTime.IsZero() {
+		http.Error(w, "A lifetime is required", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err = proxmox.AdminSetVMLifetime(vmID, req.LifeTime); err != nil {
+		logger.Error("Failed to update VM lifetime by admin", "vmID", vmID, "error", err)
+		writeAdminVMError(w, err, "Failed to update VM lifetime")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminResetVMStatus(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req adminVMStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err = proxmox.AdminResetVMStatus(vmID, proxmox.VMStatus(req.Status)); err != nil {
+		logger.Error("Failed to reset VM status by admin", "vmID", vmID, "status", req.Status, "error", err)
+		writeAdminVMError(w, err, "Failed to reset VM status")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminImportVM(w http.ResponseWriter, r *http.Request) {
+	var req adminImportVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if (req.UserID == 0) == (req.GroupID == nil) {
+		http.Error(w, "Exactly one of user_id and group_id is required", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(req.VMID))
+	m.Lock()
+	defer m.Unlock()
+
+	vm, err := proxmox.ImportVM(req.Cluster, req.VMID, req.UserID, req.GroupID, req.Name, req.LifeTime, req.IncludeGlobalSSHKeys, req.Renumber)
+	if err != nil {
+		logger.Error("Failed to import VM by admin", "vmID", req.VMID, "error", err)
+		writeAdminVMError(w, err, "Failed to import VM")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(vm); err != nil {
+		logger.Error("Failed to encode VM to JSON", "error", err)
+		return
+	}
+}
@@ -82,28 +82,60 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 		r.Get("/", routeRoot)
 		r.Post("/login", login)
 		r.Get("/login/realms", listRealms) // This is a duplicate of the admin route, but it's necessary for the login.
+		r.Get("/maintenance", getMaintenance)
+	})
+
+	// Routes that accept also the personal tokens
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(verifierWithPersonalTokens(tokenAuth))
+		r.Use(jwtauth.Authenticator(tokenAuth))
+
+		r.Get("/inventory", getInventory)
+	})
+
+	// Auth routes that don't change anything, so they are allowed also during
+	// the maintenance
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(tokenAuth))
+		r.Use(jwtauth.Authenticator(tokenAuth))
+
+		r.Post("/ip-check", checkIfIPInUse)
+		r.Post("/notify/telegram/{id}/test", testTelegramBot)
 	})
 
 	// Auth routes
 	apiRouter.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(tokenAuth))
 		r.Use(jwtauth.Authenticator(tokenAuth))
+		r.Use(maintenanceGuard())
+		r.Use(wakeUpWorker())
 
 		r.Get("/whoami", whoami)
 
 		r.Get("/vm", vms)
 		r.Post("/vm", newVM)
+		r.Get("/clusters", listClusters)
+		r.Get("/templates", listTemplates)
+		r.Get("/templates/private", listPrivateTemplates)
+		r.Delete("/templates/private/{id}", deleteTemplate)
 
 		// Group VM-specific endpoints with additional middleware
 		r.Route("/vm/{vmid}", func(r chi.Router) {
 			r.Use(validateVMOwnership())
 
 			r.Get("/", getVM)
+			r.Patch("/", updateVM)
 			r.Delete("/", deleteVM)
 
 			r.Post("/start", changeVMState("start"))
 			r.Post("/stop", changeVMState("stop"))
 			r.Post("/restart", changeVMState("restart"))
+			r.Post("/shutdown", changeVMState("shutdown"))
+			r.Post("/suspend", changeVMState("suspend"))
+			r.Post("/resume", changeVMState("resume"))
+			r.Post("/hibernate", changeVMState("hibernate"))
+			r.Post("/rebuild", rebuildVM)
+			r.Post("/template", createTemplate)
 
 			r.Get("/interface", getInterfacesForVM)
 			r.Post("/interface", addInterface)
@@ -127,9 +159,40 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 			r.Get("/backup/request/{requestid}", getBackupRequest)
 
 			r.Patch("/lifetime", updateVMLifetime)
+			r.Get("/lifetime/requests", listVMLifetimeRequests)
 			r.Patch("/resources", updateVMResources)
+			r.Patch("/idle", updateVMIdleStop)
+
+			r.Get("/labels", getVMLabels)
+			r.Put("/labels", setVMLabels)
+		})
+
+		r.Get("/ct", listContainers)
+		r.Post("/ct", newContainer)
+
+		r.Route("/ct/{ctid}", func(r chi.Router) {
+			r.Use(validateContainerOwnership())
+
+			r.Get("/", getContainer)
+			r.Delete("/", deleteContainer)
+
+			r.Post("/start", changeContainerState("start"))
+			r.Post("/stop", changeContainerState("stop"))
+			r.Post("/restart", changeContainerState("restart"))
+			r.Post("/shutdown", changeContainerState("shutdown"))
+
+			r.Patch("/resources", updateContainerResources)
+
+			r.Get("/interface", getContainerInterfaces)
+			r.Post("/interface", addContainerInterface)
+			r.Delete("/interface/{ifaceid}", deleteContainerInterface)
 		})
 
+		r.Get("/stacks", listStacks)
+		r.Post("/stacks", applyStack)
+		r.Get("/stacks/{id}", getStack)
+		r.Delete("/stacks/{id}", deleteStack)
+
 		r.Post("/net", createNet)
 		r.Get("/net", listNets)
 		r.Put("/net/{id}", updateNet)
@@ -137,6 +200,10 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 
 		r.Get("/interfaces", getAllInterfaces)
 
+		r.Get("/tokens", listPersonalTokens)
+		r.Post("/tokens", createPersonalToken)
+		r.Delete("/tokens/{id}", deletePersonalToken)
+
 		r.Get("/ssh-keys", getSSHKeys)
 		r.Post("/ssh-keys", addSSHKey)
 		r.Delete("/ssh-keys/{id}", deleteSSHKey)
@@ -157,12 +224,17 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 		r.Delete("/port-forwards/{id}", deletePortForward)
 
 		r.Get("/resources", getUserResources)
+		r.Get("/lifetime-policy", getMyLifetimePolicy)
+
+		r.Get("/quota-requests", listMyQuotaRequests)
+		r.Post("/quota-requests", addUserQuotaRequest)
+
+		r.Get("/usage", getMyUsage)
 
 		r.Get("/notify/telegram", listTelegramBots)
 		r.Post("/notify/telegram", createTelegramBot)
 		r.Patch("/notify/telegram/{id}", enableDisableTelegramBot)
 		r.Delete("/notify/telegram/{id}", deleteTelegramBot)
-		r.Post("/notify/telegram/{id}/test", testTelegramBot)
 
 		r.Get("/groups", listUserGroups)
 		r.Post("/groups", createGroup)
@@ -194,10 +266,10 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 			r.Post("/resources", addGroupResources)
 			r.Put("/resources", modifyGroupResources)
 			r.Delete("/resources", revokeGroupResources)
+			r.Post("/quota-requests", addGroupQuotaRequest)
+			r.Get("/usage", getGroupUsage)
 		})
 
-		r.Post("/ip-check", checkIfIPInUse)
-
 		r.Get("/settings", getUserSettings)
 		r.Put("/settings", updateUserSettings)
 	})
@@ -206,6 +278,7 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 	apiRouter.Group(func(r chi.Router) {
 		r.Use(jwtauth.Verifier(tokenAuth))
 		r.Use(AdminAuthenticator(tokenAuth))
+		r.Use(wakeUpWorker())
 
 		r.Get("/admin/users", internalListUsers)
 		r.Get("/admin/users/{id}", getUser)
@@ -228,6 +301,63 @@ func Init(apiLogger *slog.Logger, key []byte, secret string, frontFS fs.FS, publ
 
 		r.Get("/admin/port-forwards", listAllPortForwards)
 		r.Put("/admin/port-forwards/{id}", approvePortForward)
+
+		r.Get("/admin/node-policies", listNodePolicies)
+		r.Post("/admin/node-policies", addNodePolicy)
+		r.Delete("/admin/node-policies/{id}", deleteNodePolicy)
+
+		r.Get("/admin/migrations", listMigrations)
+		r.Get("/admin/migrations/{id}", getMigration)
+		r.Post("/admin/vms/{vmid}/migrate", adminMigrateVM)
+		r.Post("/admin/nodes/{node}/drain", adminDrainNode)
+
+		r.Get("/admin/drift", listDrifts)
+
+		r.Get("/admin/orphans", listOrphans)
+		r.Post("/admin/orphans/vms/{vmid}/adopt", adoptOrphanVM)
+		r.Delete("/admin/orphans/vms/{vmid}", deleteOrphanVM)
+		r.Post("/admin/orphans/vnets/{name}/adopt", adoptOrphanVNet)
+		r.Delete("/admin/orphans/vnets/{name}", deleteOrphanVNet)
+		r.Delete("/admin/orphans/backups/{id}", deleteOrphanBackup)
+
+		r.Get("/admin/maintenance", getMaintenance)
+		r.Put("/admin/maintenance", updateMaintenance)
+
+		r.Get("/admin/vms", adminListVMs)
+		r.Post("/admin/vms/import", adminImportVM)
+		r.Delete("/admin/vms/{vmid}", adminDeleteVM)
+		r.Post("/admin/vms/{vmid}/stop", adminChangeVMState("stop"))
+		r.Put("/admin/vms/{vmid}/lifetime", adminUpdateVMLifetime)
+		r.Put("/admin/vms/{vmid}/status", adminResetVMStatus)
+
+		r.Get("/admin/lifetime-policies", listLifetimePolicies)
+		r.Post("/admin/lifetime-policies", addLifetimePolicy)
+		r.Put("/admin/lifetime-policies/{id}", updateLifetimePolicy)
+		r.Delete("/admin/lifetime-policies/{id}", deleteLifetimePolicy)
+
+		r.Get("/admin/idle-policies", listIdlePolicies)
+		r.Post("/admin/idle-policies", addIdlePolicy)
+		r.Put("/admin/idle-policies/{id}", updateIdlePolicy)
+		r.Delete("/admin/idle-policies/{id}", deleteIdlePolicy)
+
+		r.Get("/admin/quota-requests", listQuotaRequests)
+		r.Post("/admin/quota-requests/{id}/approve", approveQuotaRequest)
+		r.Post("/admin/quota-requests/{id}/deny", denyQuotaRequest)
+
+		r.Get("/admin/usage/users/{id}", adminGetUsage("user"))
+		r.Get("/admin/usage/groups/{id}", adminGetUsage("group"))
+		r.Get("/admin/usage/realms/{id}", adminGetUsage("realm"))
+	})
+
+	// Maintainer Auth routes
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(tokenAuth))
+		r.Use(MaintainerAuthenticator(tokenAuth))
+		r.Use(wakeUpWorker())
+
+		r.Get("/admin/lifetime-requests", listLifetimeRequests)
+		r.Post("/admin/lifetime-requests/{id}/approve", reviewLifetimeRequest(true))
+		r.Post("/admin/lifetime-requests/{id}/reject", reviewLifetimeRequest(false))
 	})
 
 	// Internal routes
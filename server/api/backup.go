@@ -225,6 +225,10 @@ type BackupRequest struct {
 	Type   string `json:"type"`
 	Status string `json:"status"`
 	VMID   uint   `json:"vm_id"`
+
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    uint       `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
 }
 
 func listBackupRequests(w http.ResponseWriter, r *http.Request) {
@@ -260,6 +264,10 @@ func listBackupRequests(w http.ResponseWriter, r *http.Request) {
 			Type:      b.Type,
 			Status:    b.Status,
 			VMID:      b.VMID,
+
+			LastError:   b.LastError,
+			Attempts:    b.Attempts,
+			NextRetryAt: b.NextRetryAt,
 		})
 	}
 	err = json.NewEncoder(w).Encode(resp)
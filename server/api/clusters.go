@@ -0,0 +1,17 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"samuelemusiani/sasso/server/proxmox"
+)
+
+func listClusters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(proxmox.ListClusters()); err != nil {
+		logger.Error("Failed to encode clusters to JSON", "error", err)
+		http.Error(w, "Failed to encode clusters to JSON", http.StatusInternalServerError)
+		return
+	}
+}
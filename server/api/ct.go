@@ -0,0 +1,320 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func listContainers(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	containers, err := proxmox.GetContainersByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get containers", "userID", userID, "error", err)
+		http.Error(w, "Failed to get containers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(containers); err != nil {
+		logger.Error("Failed to encode containers to JSON", "error", err)
+		http.Error(w, "Failed to encode containers to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+type newContainerRequest struct {
+	Name                 string `json:"name"`
+	Notes                string `json:"notes"`
+	Cores                uint   `json:"cores"`
+	RAM                  uint   `json:"ram"`
+	Disk                 uint   `json:"disk"`
+	IncludeGlobalSSHKeys bool   `json:"include_global_ssh_keys"`
+
+	GroupID *uint `json:"group_id,omitempty"`
+	// If empty the first cluster with containers enabled is chosen
+	Cluster string `json:"cluster"`
+}
+
+func newContainer(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	var req newContainerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Containers share the resources of the VMs
+	m := getUserResourceMutex(userID)
+	m.Lock()
+	defer m.Unlock()
+
+	ct, err := proxmox.NewContainer(userID, req.GroupID, req.Name, req.Notes, req.Cores, req.RAM, req.Disk, req.IncludeGlobalSSHKeys, req.Cluster)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrInsufficientResources) {
+			http.Error(w, "Insufficient resources", http.StatusForbidden)
+		} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrClusterNotFound) {
+			http.Error(w, "Cluster not found", http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrContainersNotEnabled) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrNotFound) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else {
+			logger.Error("Failed to create new container", "userID", userID, "error", err)
+			http.Error(w, "Failed to create new container", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(ct); err != nil {
+		logger.Error("Failed to encode new container to JSON", "error", err)
+		return
+	}
+}
+
+func getContainer(w http.ResponseWriter, r *http.Request) {
+	ct := mustGetContainerFromContext(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ct); err != nil {
+		logger.Error("Failed to encode container to JSON", "ctID", ct.ID, "error", err)
+		http.Error(w, "Failed to encode container to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// canManageContainer returns false if the user is only a member of the group
+// that owns the container
+func canManageContainer(ct *proxmox.Container) bool {
+	return ct.OwnerType != "Group" || ct.GroupRole == "admin" || ct.GroupRole == "owner"
+}
+
+func deleteContainer(w http.ResponseWriter, r *http.Request) {
+	ct := mustGetContainerFromContext(r)
+	if !canManageContainer(ct) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	// Containers and VMs have IDs in the same range, so the mutexes of the
+	// VMs can be used
+	m := getVMMutex(uint(ct.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err := proxmox.DeleteContainer(ct.ID); err != nil {
+		if errors.Is(err, proxmox.ErrContainerNotFound) {
+			http.Error(w, "Container not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "Invalid container state for deletion", http.StatusConflict)
+		} else {
+			logger.Error("Failed to delete container", "ctID", ct.ID, "error", err)
+			http.Error(w, "Failed to delete container", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func changeContainerState(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct := mustGetContainerFromContext(r)
+		if !canManageContainer(ct) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		m := getVMMutex(uint(ct.ID))
+		m.Lock()
+		defer m.Unlock()
+
+		if err := proxmox.ChangeContainerStatus(ct.ID, action); err != nil {
+			logger.Error("Failed to change container state", "ctID", ct.ID, "action", action, "error", err)
+			if errors.Is(err, proxmox.ErrContainerNotFound) {
+				http.Error(w, "Failed to change container state", http.StatusNotFound)
+			} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+				http.Error(w, "Invalid container state for this action", http.StatusConflict)
+			} else {
+				http.Error(w, "Failed to change container state", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func updateContainerResources(w http.ResponseWriter, r *http.Request) {
+	var request updateResourcesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ct := mustGetContainerFromContext(r)
+	if !canManageContainer(ct) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	userID := mustGetUserIDFromContext(r)
+
+	m := getVMMutex(uint(ct.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	m2 := getUserResourceMutex(userID)
+	m2.Lock()
+	defer m2.Unlock()
+
+	err := proxmox.UpdateContainerResources(ct.ID, request.Cores, request.RAM, request.Disk)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrInsufficientResources) {
+			http.Error(w, "Insufficient resources", http.StatusForbidden)
+		} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "Invalid container state for this action", http.StatusConflict)
+		} else {
+			logger.Error("Failed to update container resources", "ctID", ct.ID, "error", err)
+			http.Error(w, "Failed to update container resources", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getContainerInterfaces(w http.ResponseWriter, r *http.Request) {
+	ct := mustGetContainerFromContext(r)
+
+	ifaces, err := proxmox.GetContainerInterfaces(ct.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ifaces)
+}
+
+func addContainerInterface(w http.ResponseWriter, r *http.Request) {
+	ct := mustGetContainerFromContext(r)
+	if !canManageContainer(ct) {
+		http.Error(w, "user does not have permission to add interface to this container", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		VNetID  uint   `json:"vnet_id"`
+		VlanTag uint16 `json:"vlan_tag"`
+		IPAdd   string `json:"ip_add"`
+		Gateway string `json:"gateway"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.IPAdd = strings.TrimSpace(req.IPAdd)
+	req.Gateway = strings.TrimSpace(req.Gateway)
+
+	userID := mustGetUserIDFromContext(r)
+
+	n, err := db.GetNetByID(req.VNetID)
+	if err != nil {
+		http.Error(w, "vnet not found", http.StatusBadRequest)
+		return
+	}
+
+	// Like for the VMs, the vnet must have the same owner of the container
+	if n.OwnerType == "User" {
+		if n.OwnerID != userID {
+			http.Error(w, "vnet does not belong to the user", http.StatusForbidden)
+			return
+		} else if ct.OwnerType == "Group" || ct.OwnerID != n.OwnerID {
+			http.Error(w, "container does not belong to the same user as the vnet", http.StatusForbidden)
+			return
+		}
+	} else if n.OwnerType == "Group" {
+		role, err := db.GetUserRoleInGroup(userID, n.OwnerID)
+		if err != nil {
+			if err == db.ErrNotFound {
+				http.Error(w, "group not found or user not in group", http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if role == "member" {
+			http.Error(w, "user does not have permission to use this vnet", http.StatusForbidden)
+			return
+		}
+		if ct.OwnerType != "Group" || ct.OwnerID != n.OwnerID {
+			http.Error(w, "container does not belong to the same group as the vnet", http.StatusForbidden)
+			return
+		}
+	}
+
+	m := getVMMutex(uint(ct.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	iface, err := proxmox.AddContainerInterface(ct.ID, n, req.VlanTag, req.IPAdd, req.Gateway)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrInvalidInterfaceConfig) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) || errors.Is(err, proxmox.ErrMaxNumberOfInterfaces) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(iface)
+}
+
+func deleteContainerInterface(w http.ResponseWriter, r *http.Request) {
+	ct := mustGetContainerFromContext(r)
+	if !canManageContainer(ct) {
+		http.Error(w, "user does not have permission to delete interface to this container", http.StatusForbidden)
+		return
+	}
+
+	ifaceID, err := strconv.ParseUint(chi.URLParam(r, "ifaceid"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid interface id", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(ct.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err := proxmox.DeleteContainerInterface(ct.ID, uint(ifaceID)); err != nil {
+		if errors.Is(err, proxmox.ErrInterfaceNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
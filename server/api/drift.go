@@ -0,0 +1,23 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"samuelemusiani/sasso/server/proxmox"
+)
+
+func listDrifts(w http.ResponseWriter, r *http.Request) {
+	drifts, err := proxmox.GetDrifts()
+	if err != nil {
+		http.Error(w, "Failed to get drifts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(drifts); err != nil {
+		logger.Error("Failed to encode drifts to JSON", "error", err)
+		http.Error(w, "Failed to encode drifts to JSON", http.StatusInternalServerError)
+		return
+	}
+}
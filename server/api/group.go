@@ -113,6 +113,16 @@ func deleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cc, err := db.CountContainersByGroupID(group.ID)
+	if err != nil {
+		http.Error(w, "Failed to check group containers", http.StatusInternalServerError)
+		return
+	}
+	if cc > 0 {
+		http.Error(w, "Cannot delete group: group has containers", http.StatusForbidden)
+		return
+	}
+
 	cn, err := db.CountNetsByGroupID(group.ID)
 	if err != nil {
 		http.Error(w, "Failed to check group networks", http.StatusInternalServerError)
@@ -123,6 +133,16 @@ func deleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ct, err := db.CountTemplatesByGroupID(group.ID)
+	if err != nil {
+		http.Error(w, "Failed to check group templates", http.StatusInternalServerError)
+		return
+	}
+	if ct > 0 {
+		http.Error(w, "Cannot delete group: group has templates", http.StatusForbidden)
+		return
+	}
+
 	if err := db.DeleteGroup(group.ID); err != nil {
 		if err == db.ErrNotFound {
 			http.Error(w, "Group not found", http.StatusNotFound)
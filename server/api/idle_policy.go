@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type idlePolicyRequest struct {
+	RealmID      *uint   `json:"realm_id"`
+	Enabled      bool    `json:"enabled"`
+	IdleHours    uint    `json:"idle_hours"`
+	GracePeriod  uint    `json:"grace_period"`
+	CPUThreshold float64 `json:"cpu_threshold"`
+	NetThreshold uint    `json:"net_threshold"`
+}
+
+type returnIdlePolicy struct {
+	ID           uint    `json:"id"`
+	RealmID      *uint   `json:"realm_id,omitempty"`
+	Enabled      bool    `json:"enabled"`
+	IdleHours    uint    `json:"idle_hours"`
+	GracePeriod  uint    `json:"grace_period"`
+	CPUThreshold float64 `json:"cpu_threshold"`
+	NetThreshold uint    `json:"net_threshold"`
+}
+
+func convertDBIdlePolicy(p *db.IdlePolicy) returnIdlePolicy {
+	return returnIdlePolicy{
+		ID:           p.ID,
+		RealmID:      p.RealmID,
+		Enabled:      p.Enabled,
+		IdleHours:    p.IdleHours,
+		GracePeriod:  p.GracePeriod,
+		CPUThreshold: p.CPUThreshold,
+		NetThreshold: p.NetThreshold,
+	}
+}
+
+// validateIdlePolicyRequest returns a message for the user if the request is
+// not valid, or an empty string
+func validateIdlePolicyRequest(req *idlePolicyRequest) string {
+	if req.IdleHours == 0 {
+		return "Idle hours must be greater than 0"
+	}
+	if req.CPUThreshold < 0 || req.CPUThreshold > 100 {
+		return "The CPU threshold must be between 0 and 100"
+	}
+	return ""
+}
+
+func listIdlePolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := db.GetAllIdlePolicies()
+	if err != nil {
+		logger.Error("Failed to get idle policies", "error", err)
+		http.Error(w, "Failed to get idle policies", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]returnIdlePolicy, len(policies))
+	for i := range policies {
+		resp[i] = convertDBIdlePolicy(&policies[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode idle policies to JSON", "error", err)
+		http.Error(w, "Failed to encode idle policies to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func addIdlePolicy(w http.ResponseWriter, r *http.Request) {
+	var req idlePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateIdlePolicyRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if req.RealmID == nil {
+		http.Error(w, "A realm is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.GetRealmByID(*req.RealmID); err != nil {
+		http.Error(w, "Realm not found", http.StatusNotFound)
+		return
+	}
+
+	policy := db.IdlePolicy{
+		RealmID:      req.RealmID,
+		Enabled:      req.Enabled,
+		IdleHours:    req.IdleHours,
+		GracePeriod:  req.GracePeriod,
+		CPUThreshold: req.CPUThreshold,
+		NetThreshold: req.NetThreshold,
+	}
+
+	if err := db.CreateIdlePolicy(&policy); err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			http.Error(w, "A policy for this realm already exists", http.StatusConflict)
+			return
+		}
+		logger.Error("Failed to create idle policy", "error", err)
+		http.Error(w, "Failed to create idle policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(convertDBIdlePolicy(&policy)); err != nil {
+		logger.Error("Failed to encode idle policy to JSON", "error", err)
+		http.Error(w, "Failed to encode idle policy to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func updateIdlePolicy(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid idle policy ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req idlePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateIdlePolicyRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	policy := db.IdlePolicy{
+		ID:           uint(id),
+		Enabled:      req.Enabled,
+		IdleHours:    req.IdleHours,
+		GracePeriod:  req.GracePeriod,
+		CPUThreshold: req.CPUThreshold,
+		NetThreshold: req.NetThreshold,
+	}
+
+	if err := db.UpdateIdlePolicy(&policy); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Idle policy not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to update idle policy", "id", id, "error", err)
+		http.Error(w, "Failed to update idle policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteIdlePolicy(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid idle policy ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteIdlePolicy(uint(id)); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Idle policy not found", http.StatusNotFound)
+		} else if errors.Is(err, db.ErrDefaultIdlePolicy) {
+			http.Error(w, "The default idle policy cannot be deleted", http.StatusBadRequest)
+		} else {
+			logger.Error("Failed to delete idle policy", "id", id, "error", err)
+			http.Error(w, "Failed to delete idle policy", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type updateVMIdleStopRequest struct {
+	OptOut bool `json:"opt_out"`
+}
+
+func updateVMIdleStop(w http.ResponseWriter, r *http.Request) {
+	var req updateVMIdleStopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	vm := mustGetVMFromContext(r)
+	if vm.OwnerType == "Group" {
+		role := mustGetUserRoleInGroupFromContext(r)
+		if role != "admin" && role != "owner" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	m := getVMMutex(uint(vm.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err := proxmox.SetVMIdleStopOptOut(vm.ID, req.OptOut); err != nil {
+		if errors.Is(err, proxmox.ErrVMNotFound) {
+			http.Error(w, "VM not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to update VM", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
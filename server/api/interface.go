@@ -133,6 +133,11 @@ func addInterface(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if n.Cluster != vm.Cluster {
+		http.Error(w, "vnet is on another cluster than the VM", http.StatusBadRequest)
+		return
+	}
+
 	if err := proxmox.InterfacesChecks(n, &tmpFace); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -227,6 +232,11 @@ func updateInterface(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if n.Cluster != vm.Cluster {
+		http.Error(w, "vnet is on another cluster than the VM", http.StatusBadRequest)
+		return
+	}
+
 	if err := proxmox.InterfacesChecks(n, &piface); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -283,6 +293,10 @@ type returnedGenericInterface struct {
 	VMID     uint   `json:"vm_id"`
 	VMName   string `json:"vm_name"`
 
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    uint       `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+
 	GroupID   uint   `json:"group_id,omitempty"`
 	GroupName string `json:"group_name,omitempty"`
 	// User role in the group (e.g., "member", "admin").
@@ -301,18 +315,21 @@ func getAllInterfaces(w http.ResponseWriter, r *http.Request) {
 	pIfaces := make([]returnedGenericInterface, len(ifaces))
 	for i, iface := range ifaces {
 		pIfaces[i] = returnedGenericInterface{
-			ID:        iface.ID,
-			VNetID:    iface.VNetID,
-			VNetName:  iface.VNetName,
-			VlanTag:   iface.VlanTag,
-			IPAdd:     iface.IPAdd,
-			Gateway:   iface.Gateway,
-			Status:    iface.Status,
-			VMID:      uint(iface.VMID),
-			VMName:    iface.VMName,
-			GroupID:   iface.GroupID,
-			GroupName: iface.GroupName,
-			GroupRole: iface.GroupRole,
+			ID:          iface.ID,
+			VNetID:      iface.VNetID,
+			VNetName:    iface.VNetName,
+			VlanTag:     iface.VlanTag,
+			IPAdd:       iface.IPAdd,
+			Gateway:     iface.Gateway,
+			Status:      iface.Status,
+			VMID:        uint(iface.VMID),
+			VMName:      iface.VMName,
+			LastError:   iface.LastError,
+			Attempts:    iface.Attempts,
+			NextRetryAt: iface.NextRetryAt,
+			GroupID:     iface.GroupID,
+			GroupName:   iface.GroupName,
+			GroupRole:   iface.GroupRole,
 		}
 	}
 
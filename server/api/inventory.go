@@ -0,0 +1,225 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Characters that are not valid in the name of an Ansible group
+var inventoryGroupRegex = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+type inventoryGroup struct {
+	Hosts    []string       `json:"hosts,omitempty"`
+	Children []string       `json:"children,omitempty"`
+	Vars     map[string]any `json:"vars,omitempty"`
+}
+
+type inventoryInterface struct {
+	VNet    string `json:"vnet"`
+	VNetID  uint   `json:"vnet_id"`
+	IPAdd   string `json:"ip_add"`
+	Address string `json:"address"`
+	Gateway string `json:"gateway"`
+	VlanTag uint16 `json:"vlan_tag"`
+	// True if the address can be reached from the VPN of the user
+	VPNReachable bool `json:"vpn_reachable"`
+}
+
+func inventoryGroupName(prefix, name string) string {
+	return prefix + "_" + inventoryGroupRegex.ReplaceAllString(name, "_")
+}
+
+// getInventory returns the VMs of the user, and of the groups of the user, as
+// an Ansible dynamic inventory. The hosts are grouped by owner, label and
+// vnet.
+func getInventory(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	vms, err := proxmox.GetVMsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get VMs for inventory", "userID", userID, "error", err)
+		http.Error(w, "Failed to get VMs", http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(vms, func(a, b proxmox.VM) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	vpnConfigs, err := db.GetVPNConfigsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get VPN configs for inventory", "userID", userID, "error", err)
+		http.Error(w, "Failed to get VPN configs", http.StatusInternalServerError)
+		return
+	}
+	hasVPN := len(vpnConfigs) > 0
+
+	groups := map[string]*inventoryGroup{}
+	addHost := func(group, host string) *inventoryGroup {
+		g, ok := groups[group]
+		if !ok {
+			g = &inventoryGroup{}
+			groups[group] = g
+		}
+		g.Hosts = append(g.Hosts, host)
+		return g
+	}
+
+	// Different names can be the same once they are made valid, like "a-b"
+	// and "a_b". The group of the second object is disambiguated with its ID
+	groupOwners := map[string]string{}
+	groupName := func(prefix, name string, id uint) string {
+		key := prefix + "/" + strconv.FormatUint(uint64(id), 10)
+		g := inventoryGroupName(prefix, name)
+		for {
+			owner, ok := groupOwners[g]
+			if !ok {
+				groupOwners[g] = key
+				return g
+			} else if owner == key {
+				return g
+			}
+			g += "_" + strconv.FormatUint(uint64(id), 10)
+		}
+	}
+
+	hostvars := map[string]map[string]any{}
+	nets := map[uint]*db.Net{}
+	usernames := map[uint]string{}
+
+	for _, vm := range vms {
+		host := vm.Name
+		if _, ok := hostvars[host]; ok || host == "" {
+			host = vm.Name + "-" + strconv.FormatUint(vm.ID, 10)
+		}
+
+		var owner string
+		if vm.OwnerType == "Group" {
+			owner = vm.GroupName
+			addHost(groupName("owner_group", owner, vm.OwnerID), host)
+		} else {
+			name, ok := usernames[vm.OwnerID]
+			if !ok {
+				user, err := db.GetUserByID(vm.OwnerID)
+				if err != nil {
+					logger.Error("Failed to get owner of VM", "vmID", vm.ID, "userID", vm.OwnerID, "error", err)
+					http.Error(w, "Failed to get owner of VM", http.StatusInternalServerError)
+					return
+				}
+				name = user.Username
+				usernames[vm.OwnerID] = name
+			}
+			owner = name
+			addHost(groupName("owner_user", owner, vm.OwnerID), host)
+		}
+
+		labels, err := db.GetVMLabels(vm.ID)
+		if err != nil {
+			logger.Error("Failed to get VM labels for inventory", "vmID", vm.ID, "error", err)
+			http.Error(w, "Failed to get VM labels", http.StatusInternalServerError)
+			return
+		}
+		for _, l := range labels {
+			addHost(inventoryGroupName("label", l), host)
+		}
+		if labels == nil {
+			labels = []string{}
+		}
+
+		ifaces, err := db.GetInterfacesByVMID(vm.ID)
+		if err != nil {
+			logger.Error("Failed to get VM interfaces for inventory", "vmID", vm.ID, "error", err)
+			http.Error(w, "Failed to get VM interfaces", http.StatusInternalServerError)
+			return
+		}
+
+		invIfaces := make([]inventoryInterface, 0, len(ifaces))
+		ips := []string{}
+		ansibleHost := ""
+		for _, iface := range ifaces {
+			n, ok := nets[iface.VNetID]
+			if !ok {
+				n, err = db.GetNetByID(iface.VNetID)
+				if err != nil {
+					logger.Error("Failed to get vnet of interface for inventory", "vnetID", iface.VNetID, "error", err)
+					http.Error(w, "Failed to get vnet of interface", http.StatusInternalServerError)
+					return
+				}
+				nets[iface.VNetID] = n
+			}
+
+			address, _, _ := strings.Cut(iface.IPAdd, "/")
+			reachable := hasVPN && address != "" && n.Status == string(proxmox.VNetStatusReady)
+
+			invIfaces = append(invIfaces, inventoryInterface{
+				VNet:         n.Name,
+				VNetID:       n.ID,
+				IPAdd:        iface.IPAdd,
+				Address:      address,
+				Gateway:      iface.Gateway,
+				VlanTag:      iface.VlanTag,
+				VPNReachable: reachable,
+			})
+			if address != "" {
+				ips = append(ips, address)
+			}
+			if reachable && ansibleHost == "" {
+				ansibleHost = address
+			}
+
+			g := addHost(groupName("vnet", n.Name, n.ID), host)
+			if g.Vars == nil {
+				g.Vars = map[string]any{
+					"sasso_vnet_alias": n.Alias,
+					"sasso_subnet":     n.Subnet,
+				}
+			}
+		}
+
+		vars := map[string]any{
+			"sasso_vm_id":         vm.ID,
+			"sasso_status":        vm.Status,
+			"sasso_cluster":       vm.Cluster,
+			"sasso_node":          vm.Node,
+			"sasso_owner_type":    vm.OwnerType,
+			"sasso_owner":         owner,
+			"sasso_labels":        labels,
+			"sasso_interfaces":    invIfaces,
+			"sasso_ips":           ips,
+			"sasso_vpn_reachable": ansibleHost != "",
+		}
+		if ansibleHost != "" {
+			vars["ansible_host"] = ansibleHost
+		}
+		hostvars[host] = vars
+	}
+
+	// A VM with more interfaces on the same vnet must be listed only once
+	children := make([]string, 0, len(groups))
+	for name, g := range groups {
+		g.Hosts = slices.Compact(g.Hosts)
+		children = append(children, name)
+	}
+	slices.Sort(children)
+
+	resp := map[string]any{
+		"_meta": map[string]any{"hostvars": hostvars},
+		"all":   inventoryGroup{Children: children},
+	}
+	for name, g := range groups {
+		resp[name] = g
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode inventory to JSON", "error", err)
+		http.Error(w, "Failed to encode inventory to JSON", http.StatusInternalServerError)
+		return
+	}
+}
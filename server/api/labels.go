@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"samuelemusiani/sasso/server/db"
+	"slices"
+	"strings"
+)
+
+const maxVMLabels = 16
+
+var vmLabelRegex = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+type vmLabels struct {
+	Labels []string `json:"labels"`
+}
+
+func getVMLabels(w http.ResponseWriter, r *http.Request) {
+	vm := mustGetVMFromContext(r)
+
+	labels, err := db.GetVMLabels(vm.ID)
+	if err != nil {
+		logger.Error("Failed to get VM labels", "vmID", vm.ID, "error", err)
+		http.Error(w, "Failed to get VM labels", http.StatusInternalServerError)
+		return
+	}
+	if labels == nil {
+		labels = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vmLabels{Labels: labels}); err != nil {
+		logger.Error("Failed to encode VM labels to JSON", "error", err)
+		http.Error(w, "Failed to encode VM labels to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// setVMLabels replaces all the labels of the VM
+func setVMLabels(w http.ResponseWriter, r *http.Request) {
+	vm := mustGetVMFromContext(r)
+	if vm.OwnerType == "Group" {
+		role := mustGetUserRoleInGroupFromContext(r)
+		if role != "admin" && role != "owner" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	var req vmLabels
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	labels := make([]string, 0, len(req.Labels))
+	for _, l := range req.Labels {
+		l = strings.ToLower(strings.TrimSpace(l))
+		if !vmLabelRegex.MatchString(l) {
+			http.Error(w, "Labels must be 1 to 32 lowercase letters, digits or underscores", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(labels, l) {
+			labels = append(labels, l)
+		}
+	}
+	if len(labels) > maxVMLabels {
+		http.Error(w, "Too many labels", http.StatusBadRequest)
+		return
+	}
+	slices.Sort(labels)
+
+	m := getVMMutex(uint(vm.ID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err := db.SetVMLabels(vm.ID, labels); err != nil {
+		logger.Error("Failed to set VM labels", "vmID", vm.ID, "error", err)
+		http.Error(w, "Failed to set VM labels", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vmLabels{Labels: labels}); err != nil {
+		logger.Error("Failed to encode VM labels to JSON", "error", err)
+		http.Error(w, "Failed to encode VM labels to JSON", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type lifetimePolicyRequest struct {
+	RealmID          *uint   `json:"realm_id"`
+	Role             *string `json:"role"`
+	GroupID          *uint   `json:"group_id"`
+	AllowedDurations []uint  `json:"allowed_durations"`
+	MaxTotalLifetime uint    `json:"max_total_lifetime"`
+	GracePeriod      uint    `json:"grace_period"`
+	ReminderDays     []uint  `json:"reminder_days"`
+
+	ApprovalThreshold uint `json:"approval_threshold"`
+}
+
+type returnLifetimePolicy struct {
+	ID               uint    `json:"id"`
+	RealmID          *uint   `json:"realm_id,omitempty"`
+	Role             *string `json:"role,omitempty"`
+	GroupID          *uint   `json:"group_id,omitempty"`
+	AllowedDurations []uint  `json:"allowed_durations"`
+	MaxTotalLifetime uint    `json:"max_total_lifetime"`
+	GracePeriod      uint    `json:"grace_period"`
+	ReminderDays     []uint  `json:"reminder_days"`
+
+	ApprovalThreshold uint `json:"approval_threshold"`
+}
+
+func convertDBLifetimePolicy(p *db.LifetimePolicy) returnLifetimePolicy {
+	rp := returnLifetimePolicy{
+		ID:               p.ID,
+		RealmID:          p.RealmID,
+		GroupID:          p.GroupID,
+		AllowedDurations: p.AllowedDurations,
+		MaxTotalLifetime: p.MaxTotalLifetime,
+		GracePeriod:      p.GracePeriod,
+		ReminderDays:     p.ReminderDays,
+
+		ApprovalThreshold: p.ApprovalThreshold,
+	}
+	if p.Role != nil {
+		role := string(*p.Role)
+		rp.Role = &role
+	}
+	return rp
+}
+
+// validateLifetimePolicyRequest returns a message for the user if the request
+// is not valid, or an empty string
+func validateLifetimePolicyRequest(req *lifetimePolicyRequest) string {
+	if len(req.AllowedDurations) == 0 {
+		return "At least one allowed duration is required"
+	}
+	for _, d := range req.AllowedDurations {
+		if d == 0 {
+			return "Allowed durations must be greater than 0"
+		}
+		if req.MaxTotalLifetime > 0 && d > req.MaxTotalLifetime {
+			return "Allowed durations can't exceed the max total lifetime"
+		}
+	}
+	if req.MaxTotalLifetime > 0 && req.ApprovalThreshold > req.MaxTotalLifetime {
+		return "The approval threshold can't exceed the max total lifetime"
+	}
+	for _, d := range req.ReminderDays {
+		if d == 0 {
+			return "Reminder days must be greater than 0"
+		}
+	}
+	return ""
+}
+
+func listLifetimePolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := db.GetAllLifetimePolicies()
+	if err != nil {
+		logger.Error("Failed to get lifetime policies", "error", err)
+		http.Error(w, "Failed to get lifetime policies", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]returnLifetimePolicy, len(policies))
+	for i := range policies {
+		resp[i] = convertDBLifetimePolicy(&policies[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode lifetime policies to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime policies to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func addLifetimePolicy(w http.ResponseWriter, r *http.Request) {
+	var req lifetimePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateLifetimePolicyRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if req.GroupID == nil && req.RealmID == nil && req.Role == nil {
+		http.Error(w, "A realm, a role or a group is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.GroupID != nil && (req.RealmID != nil || req.Role != nil) {
+		http.Error(w, "Group policies can't have a realm or a role", http.StatusBadRequest)
+		return
+	}
+
+	policy := db.LifetimePolicy{
+		RealmID:          req.RealmID,
+		GroupID:          req.GroupID,
+		AllowedDurations: req.AllowedDurations,
+		MaxTotalLifetime: req.MaxTotalLifetime,
+		GracePeriod:      req.GracePeriod,
+		ReminderDays:     req.ReminderDays,
+
+		ApprovalThreshold: req.ApprovalThreshold,
+	}
+
+	if req.ReminderDays == nil {
+		policy.ReminderDays = []uint{}
+	}
+
+	if req.Role != nil {
+		role := db.UserRole(*req.Role)
+		if !role.IsValid() {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		policy.Role = &role
+	}
+
+	if req.RealmID != nil {
+		if _, err := db.GetRealmByID(*req.RealmID); err != nil {
+			http.Error(w, "Realm not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if req.GroupID != nil {
+		if _, err := db.GetGroupByID(*req.GroupID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Group not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to get group", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	if err := db.CreateLifetimePolicy(&policy); err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			http.Error(w, "A policy with the same scope already exists", http.StatusConflict)
+			return
+		}
+		logger.Error("Failed to create lifetime policy", "error", err)
+		http.Error(w, "Failed to create lifetime policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(convertDBLifetimePolicy(&policy)); err != nil {
+		logger.Error("Failed to encode lifetime policy to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime policy to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func updateLifetimePolicy(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid lifetime policy ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req lifetimePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateLifetimePolicyRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	policy := db.LifetimePolicy{
+		ID:               uint(id),
+		AllowedDurations: req.AllowedDurations,
+		MaxTotalLifetime: req.MaxTotalLifetime,
+		GracePeriod:      req.GracePeriod,
+		ReminderDays:     req.ReminderDays,
+
+		ApprovalThreshold: req.ApprovalThreshold,
+	}
+
+	if req.ReminderDays == nil {
+		policy.ReminderDays = []uint{}
+	}
+
+	if err := db.UpdateLifetimePolicy(&policy); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Lifetime policy not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to update lifetime policy", "id", id, "error", err)
+		http.Error(w, "Failed to update lifetime policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteLifetimePolicy(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid lifetime policy ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteLifetimePolicy(uint(id)); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Lifetime policy not found", http.StatusNotFound)
+		} else if errors.Is(err, db.ErrDefaultLifetimePolicy) {
+			http.Error(w, "The default lifetime policy cannot be deleted", http.StatusBadRequest)
+		} else {
+			logger.Error("Failed to delete lifetime policy", "id", id, "error", err)
+			http.Error(w, "Failed to delete lifetime policy", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMyLifetimePolicy returns the policy that applies to the new VMs of the
+// user, or of a group if the group_id query parameter is set
+func getMyLifetimePolicy(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	var groupID *uint
+	if sGroupID := r.URL.Query().Get("group_id"); sGroupID != "" {
+		id, err := strconv.ParseUint(sGroupID, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid group ID format", http.StatusBadRequest)
+			return
+		}
+
+		belongs, err := db.DoesUserBelongToGroup(userID, uint(id))
+		if err != nil {
+			logger.Error("Failed to check group membership", "userID", userID, "groupID", id, "error", err)
+			http.Error(w, "Failed to get lifetime policy", http.StatusInternalServerError)
+			return
+		}
+		if !belongs {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+
+		gID := uint(id)
+		groupID = &gID
+	}
+
+	policy, err := proxmox.GetLifetimePolicy(userID, groupID)
+	if err != nil {
+		http.Error(w, "Failed to get lifetime policy", http.StatusInternalServerError)
+		return
+	}
+
+	// Users don't need to know where the policy comes from
+	resp := convertDBLifetimePolicy(policy)
+	resp.RealmID = nil
+	resp.Role = nil
+	resp.GroupID = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode lifetime policy to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime policy to JSON", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type reviewLifetimeRequestRequest struct {
+	Notes string `json:"notes"`
+}
+
+func listVMLifetimeRequests(w http.ResponseWriter, r *http.Request) {
+	vmID := mustGetVMFromContext(r).ID
+
+	requests, err := proxmox.ListLifetimeRequestsByVMID(vmID)
+	if err != nil {
+		http.Error(w, "Failed to get lifetime requests", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		logger.Error("Failed to encode lifetime requests to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime requests to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func listLifetimeRequests(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	validStatuses := []string{db.LifetimeRequestStatusPending, db.LifetimeRequestStatusApproved, db.LifetimeRequestStatusRejected}
+	if status != "" && !slices.Contains(validStatuses, status) {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	requests, err := proxmox.ListLifetimeRequests(status)
+	if err != nil {
+		http.Error(w, "Failed to get lifetime requests", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		logger.Error("Failed to encode lifetime requests to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime requests to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func reviewLifetimeRequest(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sID := chi.URLParam(r, "id")
+		id, err := strconv.ParseUint(sID, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid lifetime request ID format", http.StatusBadRequest)
+			return
+		}
+
+		var req reviewLifetimeRequestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		reviewerID := mustGetUserIDFromContext(r)
+
+		var lr *proxmox.LifetimeRequest
+		if approve {
+			lr, err = proxmox.ApproveLifetimeRequest(uint(id), reviewerID, req.Notes)
+		} else {
+			lr, err = proxmox.RejectLifetimeRequest(uint(id), reviewerID, req.Notes)
+		}
+		if err != nil {
+			if errors.Is(err, proxmox.ErrNotFound) {
+				http.Error(w, "Pending lifetime request not found", http.StatusNotFound)
+			} else if errors.Is(err, proxmox.ErrVMNotFound) {
+				http.Error(w, "VM not found", http.StatusNotFound)
+			} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, "Failed to review lifetime request", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lr); err != nil {
+			logger.Error("Failed to encode lifetime request to JSON", "error", err)
+			http.Error(w, "Failed to encode lifetime request to JSON", http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+type returnMaintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// maintenanceGuard rejects the requests that would change something while
+// the maintenance mode is enabled. Read only requests are always allowed.
+func maintenanceGuard() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			m, err := db.GetMaintenance()
+			if err != nil {
+				logger.Error("Failed to get maintenance state", "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if m.Enabled {
+				msg := "Sasso is in maintenance, please try again later"
+				if m.Message != "" {
+					msg += ": " + m.Message
+				}
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// getMaintenance is public, so that the frontend can show a banner even
+// before the login
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	m, err := db.GetMaintenance()
+	if err != nil {
+		logger.Error("Failed to get maintenance state", "error", err)
+		http.Error(w, "Failed to get maintenance state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(returnMaintenance{Enabled: m.Enabled, Message: m.Message}); err != nil {
+		logger.Error("Failed to encode maintenance state to JSON", "error", err)
+		http.Error(w, "Failed to encode maintenance state to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func updateMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.SetMaintenance(req.Enabled, req.Message); err != nil {
+		logger.Error("Failed to update maintenance state", "error", err)
+		http.Error(w, "Failed to update maintenance state", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Maintenance mode updated", "enabled", req.Enabled, "message", req.Message)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type migrateVMRequest struct {
+	// If empty the target node is chosen with the placement strategy
+	TargetNode string `json:"target_node"`
+}
+
+func listMigrations(w http.ResponseWriter, r *http.Request) {
+	migrations, err := proxmox.ListMigrations()
+	if err != nil {
+		http.Error(w, "Failed to get migrations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(migrations); err != nil {
+		logger.Error("Failed to encode migrations to JSON", "error", err)
+		http.Error(w, "Failed to encode migrations to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func getMigration(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid migration ID format", http.StatusBadRequest)
+		return
+	}
+
+	migration, err := proxmox.GetMigration(uint(id))
+	if err != nil {
+		if errors.Is(err, proxmox.ErrNotFound) {
+			http.Error(w, "Migration not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get migration", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(migration); err != nil {
+		logger.Error("Failed to encode migration to JSON", "error", err)
+		http.Error(w, "Failed to encode migration to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func adminMigrateVM(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req migrateVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	migration, err := proxmox.MigrateVM(vmID, req.TargetNode)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrVMNotFound) {
+			http.Error(w, "VM not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "Invalid VM state for migration", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrVMMigrating) {
+			http.Error(w, "VM is already migrating", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrSameNode) {
+			http.Error(w, "VM is already on the target node", http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrInvalidTargetNode) {
+			http.Error(w, "Target node does not exist or is offline", http.StatusBadRequest)
+		} else {
+			logger.Error("Failed to migrate VM", "vmID", vmID, "error", err)
+			http.Error(w, "Failed to migrate VM", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(migration); err != nil {
+		logger.Error("Failed to encode migration to JSON", "error", err)
+		http.Error(w, "Failed to encode migration to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func adminDrainNode(w http.ResponseWriter, r *http.Request) {
+	node := chi.URLParam(r, "node")
+	if node == "" {
+		http.Error(w, "Node is required", http.StatusBadRequest)
+		return
+	}
+
+	migrations, err := proxmox.DrainNode(r.URL.Query().Get("cluster"), node)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrClusterNotFound) {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to drain node", "node", node, "error", err)
+		http.Error(w, "Failed to drain node", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(migrations); err != nil {
+		logger.Error("Failed to encode migrations to JSON", "error", err)
+		http.Error(w, "Failed to encode migrations to JSON", http.StatusInternalServerError)
+		return
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"samuelemusiani/sasso/server/proxmox"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/seancfoley/ipaddress-go/ipaddr"
@@ -18,6 +19,8 @@ type createNetRequest struct {
 	Name      string `json:"name"`
 	VlanAware bool   `json:"vlanaware"`
 	GroupID   *uint  `json:"group_id,omitempty"`
+	// If empty the cluster is chosen with the placement policies
+	Cluster string `json:"cluster"`
 }
 
 type returnNet struct {
@@ -25,11 +28,16 @@ type returnNet struct {
 	Name      string `json:"name"`
 	Status    string `json:"status"`
 	VlanAware bool   `json:"vlanaware"`
+	Cluster   string `json:"cluster"`
 
 	Subnet    string `json:"subnet"`
 	Gateway   string `json:"gateway"`
 	Broadcast string `json:"broadcast"`
 
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    uint       `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+
 	GroupID   uint   `json:"group_id,omitempty"` // If the net belongs to a
 	GroupName string `json:"group_name,omitempty"`
 	GroupRole string `json:"group_role,omitempty"`
@@ -49,7 +57,7 @@ func createNet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	net, err := proxmox.CreateNewNet(userID, req.Name, req.VlanAware, req.GroupID)
+	net, err := proxmox.CreateNewNet(userID, req.Name, req.VlanAware, req.GroupID, req.Cluster)
 	if err != nil {
 		if err == proxmox.ErrInsufficientResources {
 			http.Error(w, "Insufficient resources", http.StatusForbidden)
@@ -59,6 +67,8 @@ func createNet(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Network name already exists", http.StatusBadRequest)
 		} else if err == proxmox.ErrPermissionDenied {
 			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else if err == proxmox.ErrClusterNotFound {
+			http.Error(w, "Cluster not found", http.StatusBadRequest)
 		} else {
 			http.Error(w, "Failed to create network", http.StatusInternalServerError)
 		}
@@ -70,6 +80,7 @@ func createNet(w http.ResponseWriter, r *http.Request) {
 		Name:      net.Alias, // This is correct. For the user the name is the alias.
 		Status:    net.Status,
 		VlanAware: net.VlanAware,
+		Cluster:   net.Cluster,
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -108,13 +119,17 @@ func listNets(w http.ResponseWriter, r *http.Request) {
 		}
 
 		returnableNets[i] = returnNet{
-			ID:        net.ID,
-			Name:      net.Alias,
-			Status:    net.Status,
-			VlanAware: net.VlanAware,
-			Subnet:    net.Subnet,
-			Gateway:   gtw,
-			Broadcast: broad,
+			ID:          net.ID,
+			Name:        net.Alias,
+			Status:      net.Status,
+			VlanAware:   net.VlanAware,
+			Cluster:     net.Cluster,
+			Subnet:      net.Subnet,
+			Gateway:     gtw,
+			Broadcast:   broad,
+			LastError:   net.LastError,
+			Attempts:    net.Attempts,
+			NextRetryAt: net.NextRetryAt,
 		}
 	}
 
@@ -127,15 +142,19 @@ func listNets(w http.ResponseWriter, r *http.Request) {
 		}
 		for _, net := range groupNets {
 			returnableNets = append(returnableNets, returnNet{
-				ID:        net.ID,
-				Name:      net.Alias,
-				Status:    net.Status,
-				VlanAware: net.VlanAware,
-				Subnet:    net.Subnet,
-				Gateway:   net.Gateway,
-				GroupID:   g.ID,
-				GroupName: g.Name,
-				GroupRole: g.Role,
+				ID:          net.ID,
+				Name:        net.Alias,
+				Status:      net.Status,
+				VlanAware:   net.VlanAware,
+				Cluster:     net.Cluster,
+				Subnet:      net.Subnet,
+				Gateway:     net.Gateway,
+				LastError:   net.LastError,
+				Attempts:    net.Attempts,
+				NextRetryAt: net.NextRetryAt,
+				GroupID:     g.ID,
+				GroupName:   g.Name,
+				GroupRole:   g.Role,
 			})
 		}
 	}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type nodePolicyRequest struct {
+	// If empty the policy applies to the nodes of every cluster
+	Cluster string `json:"cluster"`
+	Node    string `json:"node"`
+	Action  string `json:"action"`
+	RealmID *uint  `json:"realm_id"`
+	GroupID *uint  `json:"group_id"`
+}
+
+type returnNodePolicy struct {
+	ID      uint   `json:"id"`
+	Cluster string `json:"cluster,omitempty"`
+	Node    string `json:"node"`
+	Action  string `json:"action"`
+	RealmID uint   `json:"realm_id,omitempty"`
+	GroupID uint   `json:"group_id,omitempty"`
+}
+
+func convertDBNodePolicy(p *db.NodePolicy) returnNodePolicy {
+	rp := returnNodePolicy{
+		ID:      p.ID,
+		Cluster: p.Cluster,
+		Node:    p.Node,
+		Action:  p.Action,
+	}
+	if p.OwnerType == "Group" {
+		rp.GroupID = p.OwnerID
+	} else {
+		rp.RealmID = p.OwnerID
+	}
+	return rp
+}
+
+func listNodePolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := db.GetAllNodePolicies()
+	if err != nil {
+		logger.Error("Failed to get node policies", "error", err)
+		http.Error(w, "Failed to get node policies", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]returnNodePolicy, len(policies))
+	for i := range policies {
+		resp[i] = convertDBNodePolicy(&policies[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode node policies to JSON", "error", err)
+		http.Error(w, "Failed to encode node policies to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func addNodePolicy(w http.ResponseWriter, r *http.Request) {
+	var req nodePolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Node == "" {
+		http.Error(w, "Node is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Action != db.NodePolicyAllow && req.Action != db.NodePolicyDeny {
+		http.Error(w, "Action must be 'allow' or 'deny'", http.StatusBadRequest)
+		return
+	}
+
+	if req.Cluster != "" && !proxmox.ClusterExists(req.Cluster) {
+		http.Error(w, "Cluster not found", http.StatusBadRequest)
+		return
+	}
+
+	if exists, err := proxmox.NodeExists(req.Cluster, req.Node); err != nil {
+		logger.Error("Failed to check if node exists", "cluster", req.Cluster, "node", req.Node, "error", err)
+		http.Error(w, "Failed to check if node exists", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "Node not found", http.StatusBadRequest)
+		return
+	}
+
+	if (req.RealmID == nil) == (req.GroupID == nil) {
+		http.Error(w, "Exactly one of realm_id and group_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var policy *db.NodePolicy
+	var err error
+	if req.GroupID != nil {
+		if _, err := db.GetGroupByID(*req.GroupID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Group not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to get group", http.StatusInternalServerError)
+			}
+			return
+		}
+		policy, err = db.NewNodePolicyForGroup(*req.GroupID, req.Cluster, req.Node, req.Action)
+	} else {
+		if _, err := db.GetRealmByID(*req.RealmID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Realm not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to get realm", http.StatusInternalServerError)
+			}
+			return
+		}
+		policy, err = db.NewNodePolicyForRealm(*req.RealmID, req.Cluster, req.Node, req.Action)
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			http.Error(w, "A policy for this node already exists", http.StatusConflict)
+			return
+		}
+		logger.Error("Failed to add node policy", "error", err)
+		http.Error(w, "Failed to add node policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(convertDBNodePolicy(policy)); err != nil {
+		logger.Error("Failed to encode node policy to JSON", "error", err)
+		http.Error(w, "Failed to encode node policy to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func deleteNodePolicy(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid node policy ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteNodePolicy(uint(id)); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Node policy not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to delete node policy", "id", id, "error", err)
+		http.Error(w, "Failed to delete node policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type adoptOrphanVMRequest struct {
+	Name                 string `json:"name"`
+	LifeTime             uint   `json:"lifetime"`
+	IncludeGlobalSSHKeys bool   `json:"include_global_ssh_keys"`
+}
+
+type adoptOrphanVNetRequest struct {
+	UserID  uint   `json:"user_id"`
+	GroupID *uint  `json:"group_id,omitempty"`
+	Alias   string `json:"alias"`
+}
+
+func listOrphans(w http.ResponseWriter, r *http.Request) {
+	orphans, err := proxmox.ListOrphans()
+	if err != nil {
+		http.Error(w, "Failed to get orphans", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(orphans); err != nil {
+		logger.Error("Failed to encode orphans to JSON", "error", err)
+		http.Error(w, "Failed to encode orphans to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func writeOrphanError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, proxmox.ErrOrphanNotFound) {
+		http.Error(w, "Orphan not found", http.StatusNotFound)
+	} else if errors.Is(err, proxmox.ErrClusterNotFound) {
+		http.Error(w, "Cluster not found", http.StatusNotFound)
+	} else if errors.Is(err, proxmox.ErrInvalidOwner) {
+		http.Error(w, "Owner not found", http.StatusBadRequest)
+	} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, proxmox.ErrVNetNameExists) {
+		http.Error(w, "The tag of the network is already used", http.StatusConflict)
+	} else if errors.Is(err, proxmox.ErrCantDeleteBackup) {
+		http.Error(w, "The backup is protected", http.StatusConflict)
+	} else {
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
+
+func adoptOrphanVM(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req adoptOrphanVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	vm, err := proxmox.AdoptOrphanVM(r.URL.Query().Get("cluster"), vmID, req.Name, req.LifeTime, req.IncludeGlobalSSHKeys)
+	if err != nil {
+		logger.Error("Failed to adopt orphan VM", "vmID", vmID, "error", err)
+		writeOrphanError(w, err, "Failed to adopt VM")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(vm); err != nil {
+		logger.Error("Failed to encode VM to JSON", "error", err)
+		return
+	}
+}
+
+func deleteOrphanVM(w http.ResponseWriter, r *http.Request) {
+	sVMID := chi.URLParam(r, "vmid")
+	vmID, err := strconv.ParseUint(sVMID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid VM ID format", http.StatusBadRequest)
+		return
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	if err := proxmox.DeleteOrphanVM(r.URL.Query().Get("cluster"), vmID); err != nil {
+		logger.Error("Failed to delete orphan VM", "vmID", vmID, "error", err)
+		writeOrphanError(w, err, "Failed to delete VM")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adoptOrphanVNet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	var req adoptOrphanVNetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if (req.UserID == 0) == (req.GroupID == nil) {
+		http.Error(w, "Exactly one of user_id and group_id is required", http.StatusBadRequest)
+		return
+	}
+
+	net, err := proxmox.AdoptOrphanVNet(r.URL.Query().Get("cluster"), name, req.UserID, req.GroupID, req.Alias)
+	if err != nil {
+		logger.Error("Failed to adopt orphan VNet", "vnet", name, "error", err)
+		writeOrphanError(w, err, "Failed to adopt network")
+		return
+	}
+
+	returnableNet := returnNet{
+		ID:        net.ID,
+		Name:      net.Alias,
+		Status:    net.Status,
+		VlanAware: net.VlanAware,
+		Cluster:   net.Cluster,
+	}
+	if net.OwnerType == "Group" {
+		returnableNet.GroupID = net.OwnerID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(returnableNet); err != nil {
+		logger.Error("Failed to encode net to JSON", "error", err)
+		return
+	}
+}
+
+func deleteOrphanVNet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if err := proxmox.DeleteOrphanVNet(r.URL.Query().Get("cluster"), name); err != nil {
+		logger.Error("Failed to delete orphan VNet", "vnet", name, "error", err)
+		writeOrphanError(w, err, "Failed to delete network")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteOrphanBackup(w http.ResponseWriter, r *http.Request) {
+	backupID := chi.URLParam(r, "id")
+
+	if err := proxmox.DeleteOrphanBackup(r.URL.Query().Get("cluster"), backupID); err != nil {
+		logger.Error("Failed to delete orphan backup", "backupID", backupID, "error", err)
+		writeOrphanError(w, err, "Failed to delete backup")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -7,8 +7,8 @@ import (
 	"samuelemusiani/sasso/internal"
 	"samuelemusiani/sasso/server/db"
 	"samuelemusiani/sasso/server/notify"
+	"samuelemusiani/sasso/server/proxmox"
 	"strconv"
-	"sync"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/seancfoley/ipaddress-go/ipaddr"
@@ -92,8 +92,6 @@ type createPortForwardRequest struct {
 	DestIP   string `json:"dest_ip"`
 }
 
-var randomPortMutex = sync.Mutex{}
-
 func addPortForward(w http.ResponseWriter, r *http.Request) {
 	userID := mustGetUserIDFromContext(r)
 
@@ -179,29 +177,17 @@ func addPortForward(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	randomPortMutex.Lock()
-	defer randomPortMutex.Unlock()
-
-	// TODO: Make this values configurable
-	randPort, err := db.GetRandomAvailableOutPort(20000, 40000)
-	if err != nil {
-		http.Error(w, "Failed to get random available out port", http.StatusInternalServerError)
-		return
-	}
-
 	net, err := db.GetVNetBySubnet(foundSubnet)
 	if err != nil {
 		http.Error(w, "Failed to get VNet for subnet", http.StatusInternalServerError)
 		return
 	}
 
-	var pf *db.PortForward
+	ownerID := userID
 	if net.OwnerType == "Group" {
-		pf, err = db.AddPortForwardForGroup(randPort, req.DestPort, req.DestIP, foundSubnet, net.OwnerID)
-	} else {
-		pf, err = db.AddPortForwardForUser(randPort, req.DestPort, req.DestIP, foundSubnet, userID)
+		ownerID = net.OwnerID
 	}
-
+	pf, err := proxmox.NewPortForward(ownerID, net.OwnerType, req.DestPort, req.DestIP, foundSubnet)
 	if err != nil {
 		http.Error(w, "Failed to add port forward", http.StatusInternalServerError)
 		return
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/notify"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type quotaRequestRequest struct {
+	Cores     uint       `json:"cores"`
+	RAM       uint       `json:"ram"`
+	Disk      uint       `json:"disk"`
+	Nets      uint       `json:"nets"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Nil values mean that what was requested is granted
+type approveQuotaRequestRequest struct {
+	Cores        *uint      `json:"cores"`
+	RAM          *uint      `json:"ram"`
+	Disk         *uint      `json:"disk"`
+	Nets         *uint      `json:"nets"`
+	GrantedUntil *time.Time `json:"granted_until"`
+	Notes        string     `json:"notes"`
+}
+
+type denyQuotaRequestRequest struct {
+	Notes string `json:"notes"`
+}
+
+type returnQuotaRequest struct {
+	ID          uint       `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RequesterID uint       `json:"requester_id"`
+	OwnerID     uint       `json:"owner_id"`
+	OwnerType   string     `json:"owner_type"`
+	Cores       uint       `json:"cores"`
+	RAM         uint       `json:"ram"`
+	Disk        uint       `json:"disk"`
+	Nets        uint       `json:"nets"`
+	Reason      string     `json:"reason"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Status      string     `json:"status"`
+
+	GrantedCores uint       `json:"granted_cores"`
+	GrantedRAM   uint       `json:"granted_ram"`
+	GrantedDisk  uint       `json:"granted_disk"`
+	GrantedNets  uint       `json:"granted_nets"`
+	GrantedUntil *time.Time `json:"granted_until,omitempty"`
+	ReviewerID   *uint      `json:"reviewer_id,omitempty"`
+	ReviewNotes  string     `json:"review_notes,omitempty"`
+}
+
+func convertDBQuotaRequest(qr *db.QuotaRequest) returnQuotaRequest {
+	return returnQuotaRequest{
+		ID:          qr.ID,
+		CreatedAt:   qr.CreatedAt,
+		RequesterID: qr.RequesterID,
+		OwnerID:     qr.OwnerID,
+		OwnerType:   qr.OwnerType,
+		Cores:       qr.Cores,
+		RAM:         qr.RAM,
+		Disk:        qr.Disk,
+		Nets:        qr.Nets,
+		Reason:      qr.Reason,
+		ExpiresAt:   qr.ExpiresAt,
+		Status:      qr.Status,
+
+		GrantedCores: qr.GrantedCores,
+		GrantedRAM:   qr.GrantedRAM,
+		GrantedDisk:  qr.GrantedDisk,
+		GrantedNets:  qr.GrantedNets,
+		GrantedUntil: qr.GrantedUntil,
+		ReviewerID:   qr.ReviewerID,
+		ReviewNotes:  qr.ReviewNotes,
+	}
+}
+
+func encodeQuotaRequests(w http.ResponseWriter, requests []db.QuotaRequest) {
+	resp := make([]returnQuotaRequest, len(requests))
+	for i := range requests {
+		resp[i] = convertDBQuotaRequest(&requests[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode quota requests to JSON", "error", err)
+		http.Error(w, "Failed to encode quota requests to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// validateQuotaRequest returns a message for the user if the request is not
+// valid, or an empty string
+func validateQuotaRequest(req *quotaRequestRequest) string {
+	if req.Cores == 0 && req.RAM == 0 && req.Disk == 0 && req.Nets == 0 {
+		return "At least one resource must be requested"
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return "A reason is required"
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return "The expiration must be in the future"
+	}
+	return ""
+}
+
+func createQuotaRequest(w http.ResponseWriter, qr *db.QuotaRequest, target string) {
+	if err := db.NewQuotaRequest(qr); err != nil {
+		logger.Error("Failed to create quota request", "error", err)
+		http.Error(w, "Failed to create quota request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(convertDBQuotaRequest(qr)); err != nil {
+		logger.Error("Failed to encode quota request to JSON", "error", err)
+		http.Error(w, "Failed to encode quota request to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	requester, err := db.GetUserByID(qr.RequesterID)
+	if err != nil {
+		logger.Error("Failed to get requester of quota request", "userID", qr.RequesterID, "error", err)
+		return
+	}
+	if err := notify.SendNewQuotaRequestNotificationToAdmins(requester.Username, target, qr.Reason); err != nil {
+		logger.Error("Failed to send new quota request notification", "requestID", qr.ID, "error", err)
+	}
+}
+
+func addUserQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	var req quotaRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateQuotaRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	qr := db.QuotaRequest{
+		RequesterID: userID,
+		OwnerID:     userID,
+		OwnerType:   "User",
+		Cores:       req.Cores,
+		RAM:         req.RAM,
+		Disk:        req.Disk,
+		Nets:        req.Nets,
+		Reason:      req.Reason,
+		ExpiresAt:   req.ExpiresAt,
+	}
+	createQuotaRequest(w, &qr, "their account")
+}
+
+func addGroupQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+	group := mustGetGroupFromContext(r)
+	role := mustGetUserRoleInGroupFromContext(r)
+
+	if role != "admin" && role != "owner" {
+		http.Error(w, "Only group admins and owners can request resources", http.StatusForbidden)
+		return
+	}
+
+	var req quotaRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateQuotaRequest(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	qr := db.QuotaRequest{
+		RequesterID: userID,
+		OwnerID:     group.ID,
+		OwnerType:   "Group",
+		Cores:       req.Cores,
+		RAM:         req.RAM,
+		Disk:        req.Disk,
+		Nets:        req.Nets,
+		Reason:      req.Reason,
+		ExpiresAt:   req.ExpiresAt,
+	}
+	createQuotaRequest(w, &qr, fmt.Sprintf("the group \"%s\"", group.Name))
+}
+
+func listMyQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	requests, err := db.GetQuotaRequestsByRequesterID(userID)
+	if err != nil {
+		logger.Error("Failed to get quota requests", "userID", userID, "error", err)
+		http.Error(w, "Failed to get quota requests", http.StatusInternalServerError)
+		return
+	}
+
+	encodeQuotaRequests(w, requests)
+}
+
+func listQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	validStatuses := []string{
+		db.QuotaRequestStatusPending, db.QuotaRequestStatusApproved, db.QuotaRequestStatusPartiallyApproved,
+		db.QuotaRequestStatusDenied, db.QuotaRequestStatusReverted,
+	}
+	if status != "" && !slices.Contains(validStatuses, status) {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	requests, err := db.GetQuotaRequests(status)
+	if err != nil {
+		logger.Error("Failed to get quota requests", "error", err)
+		http.Error(w, "Failed to get quota requests", http.StatusInternalServerError)
+		return
+	}
+
+	encodeQuotaRequests(w, requests)
+}
+
+func approveQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid quota request ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req approveQuotaRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	qr, err := db.GetQuotaRequestByID(uint(id))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Quota request not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to get quota request", "id", id, "error", err)
+		http.Error(w, "Failed to get quota request", http.StatusInternalServerError)
+		return
+	}
+
+	cores, ram, disk, nets := qr.Cores, qr.RAM, qr.Disk, qr.Nets
+	if req.Cores != nil {
+		cores = *req.Cores
+	}
+	if req.RAM != nil {
+		ram = *req.RAM
+	}
+	if req.Disk != nil {
+		disk = *req.Disk
+	}
+	if req.Nets != nil {
+		nets = *req.Nets
+	}
+	if cores == 0 && ram == 0 && disk == 0 && nets == 0 {
+		http.Error(w, "At least one resource must be granted, deny the request instead", http.StatusBadRequest)
+		return
+	}
+
+	grantedUntil := qr.ExpiresAt
+	if req.GrantedUntil != nil {
+		if req.GrantedUntil.Before(time.Now()) {
+			http.Error(w, "The expiration must be in the future", http.StatusBadRequest)
+			return
+		}
+		grantedUntil = req.GrantedUntil
+	}
+
+	reviewerID := mustGetUserIDFromContext(r)
+	qr, err = db.ApproveQuotaRequest(uint(id), reviewerID, cores, ram, disk, nets, grantedUntil, req.Notes)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Pending quota request not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to approve quota request", "id", id, "error", err)
+		http.Error(w, "Failed to approve quota request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(convertDBQuotaRequest(qr)); err != nil {
+		logger.Error("Failed to encode quota request to JSON", "error", err)
+		http.Error(w, "Failed to encode quota request to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	if err := notify.SendQuotaRequestReviewedNotification(qr.RequesterID, qr); err != nil {
+		logger.Error("Failed to send quota request notification", "requestID", qr.ID, "error", err)
+	}
+}
+
+func denyQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid quota request ID format", http.StatusBadRequest)
+		return
+	}
+
+	var req denyQuotaRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	reviewerID := mustGetUserIDFromContext(r)
+	qr, err := db.DenyQuotaRequest(uint(id), reviewerID, req.Notes)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Pending quota request not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to deny quota request", "id", id, "error", err)
+		http.Error(w, "Failed to deny quota request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(convertDBQuotaRequest(qr)); err != nil {
+		logger.Error("Failed to encode quota request to JSON", "error", err)
+		http.Error(w, "Failed to encode quota request to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	if err := notify.SendQuotaRequestReviewedNotification(qr.RequesterID, qr); err != nil {
+		logger.Error("Failed to send quota request notification", "requestID", qr.ID, "error", err)
+	}
+}
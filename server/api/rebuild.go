@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+)
+
+type rebuildVMRequest struct {
+	// Name of the catalog template. If empty the default template is used
+	Template string `json:"template"`
+}
+
+func listTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := proxmox.ListCatalogTemplates(r.URL.Query().Get("cluster"))
+	if err != nil {
+		if errors.Is(err, proxmox.ErrClusterNotFound) {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get templates", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(templates); err != nil {
+		logger.Error("Failed to encode templates to JSON", "error", err)
+		http.Error(w, "Failed to encode templates to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func rebuildVM(w http.ResponseWriter, r *http.Request) {
+	var req rebuildVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	vm := mustGetVMFromContext(r)
+	vmID := vm.ID
+
+	if vm.OwnerType == "Group" {
+		role := mustGetUserRoleInGroupFromContext(r)
+		if role != "admin" && role != "owner" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	bkPending, err := db.IsAPendingBackupRequest(uint(vmID))
+	if err != nil {
+		logger.Error("Failed to check for pending backup requests", "vmID", vmID, "error", err)
+		http.Error(w, "Failed to rebuild VM", http.StatusInternalServerError)
+		return
+	}
+
+	if bkPending {
+		http.Error(w, "Cannot rebuild VM with pending backup requests", http.StatusConflict)
+		return
+	}
+
+	if err := proxmox.RebuildVM(vmID, req.Template); err != nil {
+		if errors.Is(err, proxmox.ErrVMNotFound) {
+			http.Error(w, "VM not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrTemplateNotFound) {
+			http.Error(w, "Template not found", http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "Invalid VM state for rebuild", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrVMMigrating) {
+			http.Error(w, "Cannot rebuild a VM while it is migrating", http.StatusConflict)
+		} else {
+			logger.Error("Failed to rebuild VM", "vmID", vmID, "error", err)
+			http.Error(w, "Failed to rebuild VM", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"samuelemusiani/sasso/server/proxmox"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Maximum size of a stack document
+const maxStackDocumentSize = 1 << 20
+
+type applyStackResponse struct {
+	// Nil with dry_run
+	Stack   *proxmox.Stack        `json:"stack,omitempty"`
+	Changes []proxmox.StackChange `json:"changes"`
+}
+
+func listStacks(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	stacks, err := proxmox.GetStacksByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get stacks", "userID", userID, "error", err)
+		http.Error(w, "Failed to get stacks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stacks); err != nil {
+		logger.Error("Failed to encode stacks to JSON", "error", err)
+		http.Error(w, "Failed to encode stacks to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// applyStack accepts a YAML or JSON document. With ?dry_run=true it only
+// returns the changes that would be applied.
+func applyStack(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	dryRun := false
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, "Invalid dry_run", http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStackDocumentSize))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	stack, changes, err := proxmox.ApplyStack(userID, string(body), dryRun)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrInvalidStack) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrNotFound) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else if errors.Is(err, proxmox.ErrStackDeleting) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			logger.Error("Failed to apply stack", "userID", userID, "error", err)
+			http.Error(w, "Failed to apply stack", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !dryRun {
+		// The changes are applied by the worker
+		w.WriteHeader(http.StatusAccepted)
+	}
+	if err := json.NewEncoder(w).Encode(applyStackResponse{Stack: stack, Changes: changes}); err != nil {
+		logger.Error("Failed to encode stack changes to JSON", "error", err)
+		return
+	}
+}
+
+func getStackIDFromURL(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid stack ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func getStack(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+	id, ok := getStackIDFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	stack, err := proxmox.GetStackByID(id, userID)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrStackNotFound) {
+			http.Error(w, "Stack not found", http.StatusNotFound)
+		} else {
+			logger.Error("Failed to get stack", "stackID", id, "error", err)
+			http.Error(w, "Failed to get stack", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stack); err != nil {
+		logger.Error("Failed to encode stack to JSON", "stackID", id, "error", err)
+		http.Error(w, "Failed to encode stack to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// deleteStack deletes the stack and all the resources it created
+func deleteStack(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+	id, ok := getStackIDFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := proxmox.DeleteStack(id, userID); err != nil {
+		if errors.Is(err, proxmox.ErrStackNotFound) {
+			http.Error(w, "Stack not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else {
+			logger.Error("Failed to delete stack", "stackID", id, "error", err)
+			http.Error(w, "Failed to delete stack", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
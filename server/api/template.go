@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type createTemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// If true the VM itself becomes the template, otherwise a copy is made
+	Convert bool `json:"convert"`
+}
+
+func listPrivateTemplates(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	templates, err := proxmox.ListPrivateTemplates(userID)
+	if err != nil {
+		http.Error(w, "Failed to get templates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(templates); err != nil {
+		logger.Error("Failed to encode templates to JSON", "error", err)
+		http.Error(w, "Failed to encode templates to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func createTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	var req createTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	vm := mustGetVMFromContext(r)
+	vmID := vm.ID
+
+	if vm.OwnerType == "Group" {
+		role := mustGetUserRoleInGroupFromContext(r)
+		if role != "admin" && role != "owner" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	bkPending, err := db.IsAPendingBackupRequest(uint(vmID))
+	if err != nil {
+		logger.Error("Failed to check for pending backup requests", "vmID", vmID, "error", err)
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
+
+	if bkPending {
+		http.Error(w, "Cannot create a template from a VM with pending backup requests", http.StatusConflict)
+		return
+	}
+
+	rm := getUserResourceMutex(userID)
+	rm.Lock()
+	defer rm.Unlock()
+
+	template, err := proxmox.CreateTemplate(vmID, req.Name, req.Description, req.Convert)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrVMNotFound) {
+			http.Error(w, "VM not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "The VM must be stopped", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrVMMigrating) {
+			http.Error(w, "Cannot create a template while the VM is migrating", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrInsufficientResources) {
+			http.Error(w, "Insufficient resources", http.StatusForbidden)
+		} else {
+			logger.Error("Failed to create template", "vmID", vmID, "error", err)
+			http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(template); err != nil {
+		logger.Error("Failed to encode template to JSON", "error", err)
+		return
+	}
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	sID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(sID, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid template ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := proxmox.DeleteTemplate(userID, uint(id)); err != nil {
+		if errors.Is(err, proxmox.ErrTemplateNotFound) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		} else if errors.Is(err, proxmox.ErrTemplateInUse) {
+			http.Error(w, "Template is used by some VMs", http.StatusConflict)
+		} else if errors.Is(err, proxmox.ErrInvalidVMState) {
+			http.Error(w, "Invalid template state for deletion", http.StatusConflict)
+		} else {
+			logger.Error("Failed to delete template", "templateID", id, "error", err)
+			http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"samuelemusiani/sasso/server/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// Personal tokens start with this prefix, so they can be told apart from the
+// JWTs
+const personalTokenPrefix = "sasso_"
+
+// Minimum interval between two updates of the last use of a personal token
+const personalTokenLastUsedInterval = time.Minute
+
+type returnPersonalToken struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Returned only when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func hashPersonalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func listPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	tokens, err := db.GetPersonalTokensByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get personal tokens", "userID", userID, "error", err)
+		http.Error(w, "Failed to get personal tokens", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]returnPersonalToken, len(tokens))
+	for i, t := range tokens {
+		resp[i] = returnPersonalToken{
+			ID:         t.ID,
+			Name:       t.Name,
+			CreatedAt:  t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			LastUsedAt: t.LastUsedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode personal tokens to JSON", "error", err)
+		http.Error(w, "Failed to encode personal tokens to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+type createPersonalTokenRequest struct {
+	Name string `json:"name"`
+	// Days of validity of the token. 0 means that the token doesn't expire
+	ExpiresInDays uint `json:"expires_in_days"`
+}
+
+func createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	var req createPersonalTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error("Failed to generate personal token", "error", err)
+		http.Error(w, "Failed to create personal token", http.StatusInternalServerError)
+		return
+	}
+	token := personalTokenPrefix + hex.EncodeToString(secret)
+
+	t := &db.PersonalToken{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: hashPersonalToken(token),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, int(req.ExpiresInDays))
+		t.ExpiresAt = &expiresAt
+	}
+	if err := db.NewPersonalToken(t); err != nil {
+		logger.Error("Failed to create personal token", "userID", userID, "error", err)
+		http.Error(w, "Failed to create personal token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err := json.NewEncoder(w).Encode(returnPersonalToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+		Token:     token,
+	})
+	if err != nil {
+		logger.Error("Failed to encode personal token to JSON", "error", err)
+		return
+	}
+}
+
+func deletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeletePersonalToken(userID, uint(id)); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to delete personal token", "userID", userID, "tokenID", id, "error", err)
+		http.Error(w, "Failed to delete personal token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifierWithPersonalTokens is like jwtauth.Verifier, but it also accepts
+// the personal tokens of the users. It must be followed by
+// jwtauth.Authenticator.
+func verifierWithPersonalTokens(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	verifier := jwtauth.Verifier(ja)
+	return func(next http.Handler) http.Handler {
+		jwtNext := verifier(next)
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			s := jwtauth.TokenFromHeader(r)
+			if !strings.HasPrefix(s, personalTokenPrefix) {
+				jwtNext.ServeHTTP(w, r)
+				return
+			}
+
+			t, err := db.GetPersonalTokenByHash(hashPersonalToken(s))
+			if err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					http.Error(w, "Invalid token", http.StatusUnauthorized)
+					return
+				}
+				logger.Error("Failed to get personal token", "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+				http.Error(w, "Token expired", http.StatusUnauthorized)
+				return
+			}
+
+			// The last use is saved at most once a minute, to not write on the
+			// DB on every request
+			if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) > personalTokenLastUsedInterval {
+				if err := db.UpdatePersonalTokenLastUsed(t.ID); err != nil {
+					logger.Error("Failed to update last use of personal token", "tokenID", t.ID, "error", err)
+				}
+			}
+
+			// The user ID is a float64, like in the decoded JWTs
+			token, _, err := ja.Encode(map[string]any{CLAIM_USER_ID: float64(t.UserID)})
+			if err != nil {
+				logger.Error("Failed to create token for personal token", "tokenID", t.ID, "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := jwtauth.NewContext(r.Context(), token, nil)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
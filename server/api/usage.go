@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type returnUsage struct {
+	VMID       uint64  `json:"vm_id,omitempty"`
+	VMName     string  `json:"vm_name,omitempty"`
+	OwnerID    uint    `json:"owner_id"`
+	OwnerType  string  `json:"owner_type"`
+	CoreHours  float64 `json:"core_hours"`
+	RAMGBHours float64 `json:"ram_gb_hours"`
+	DiskGBDays float64 `json:"disk_gb_days"`
+}
+
+// parseUsagePeriod reads the from and to query parameters, formatted as
+// YYYY-MM-DD. Both days are included. By default the last 30 days are used.
+// It returns a message for the user if the parameters are not valid, or an
+// empty string
+func parseUsagePeriod(r *http.Request) (time.Time, time.Time, string) {
+	today := time.Now().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -30)
+	to := today
+
+	var err error
+	if s := r.URL.Query().Get("from"); s != "" {
+		from, err = time.Parse(time.DateOnly, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, "Invalid from date, expected YYYY-MM-DD"
+		}
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		to, err = time.Parse(time.DateOnly, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, "Invalid to date, expected YYYY-MM-DD"
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, "The from date must be before the to date"
+	}
+	return from, to.AddDate(0, 0, 1), ""
+}
+
+// writeUsage writes the usage as JSON, or as CSV if the format query
+// parameter is 'csv'
+func writeUsage(w http.ResponseWriter, r *http.Request, usage []db.UsageSummary, name string) {
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", name))
+
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"vm_id", "vm_name", "owner_id", "owner_type", "core_hours", "ram_gb_hours", "disk_gb_days"})
+		for _, u := range usage {
+			_ = cw.Write([]string{
+				strconv.FormatUint(u.VMID, 10),
+				u.VMName,
+				strconv.FormatUint(uint64(u.OwnerID), 10),
+				u.OwnerType,
+				strconv.FormatFloat(u.CoreHours, 'f', 2, 64),
+				strconv.FormatFloat(u.RAMGBHours, 'f', 2, 64),
+				strconv.FormatFloat(u.DiskGBDays, 'f', 2, 64),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			logger.Error("Failed to write usage as CSV", "error", err)
+		}
+		return
+	}
+
+	resp := make([]returnUsage, len(usage))
+	for i, u := range usage {
+		resp[i] = returnUsage{
+			VMID:       u.VMID,
+			VMName:     u.VMName,
+			OwnerID:    u.OwnerID,
+			OwnerType:  u.OwnerType,
+			CoreHours:  u.CoreHours,
+			RAMGBHours: u.RAMGBHours,
+			DiskGBDays: u.DiskGBDays,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode usage to JSON", "error", err)
+		http.Error(w, "Failed to encode usage to JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func getMyUsage(w http.ResponseWriter, r *http.Request) {
+	userID := mustGetUserIDFromContext(r)
+
+	from, to, msg := parseUsagePeriod(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	usage, err := db.GetUsageByUserID(userID, from, to)
+	if err != nil {
+		logger.Error("Failed to get usage of user", "userID", userID, "error", err)
+		http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	writeUsage(w, r, usage, "usage")
+}
+
+func getGroupUsage(w http.ResponseWriter, r *http.Request) {
+	group := mustGetGroupFromContext(r)
+
+	from, to, msg := parseUsagePeriod(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	usage, err := db.GetUsageByGroupID(group.ID, from, to)
+	if err != nil {
+		logger.Error("Failed to get usage of group", "groupID", group.ID, "error", err)
+		http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	writeUsage(w, r, usage, fmt.Sprintf("usage-group-%d", group.ID))
+}
+
+// adminGetUsage returns the usage of a user, a group or a realm, depending
+// on the scope
+func adminGetUsage(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sID := chi.URLParam(r, "id")
+		id, err := strconv.ParseUint(sID, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		from, to, msg := parseUsagePeriod(r)
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		var usage []db.UsageSummary
+		switch scope {
+		case "user":
+			usage, err = db.GetUsageByUserID(uint(id), from, to)
+		case "group":
+			usage, err = db.GetUsageByGroupID(uint(id), from, to)
+		case "realm":
+			usage, err = db.GetUsageByRealmID(uint(id), from, to)
+		default:
+			http.Error(w, "Invalid scope", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to get usage", "scope", scope, "id", id, "error", err)
+			http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+			return
+		}
+
+		writeUsage(w, r, usage, fmt.Sprintf("usage-%s-%d", scope, id))
+	}
+}
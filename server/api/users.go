@@ -360,6 +360,10 @@ type returnUserSettings struct {
 	MailUserInvitationNotification       bool `json:"mail_user_invitation_notification"`
 	MailUserRemovalFromGroupNotification bool `json:"mail_user_removal_from_group_notification"`
 	MailLifetimeOfVMExpiredNotification  bool `json:"mail_lifetime_of_vm_expired_notification"`
+	MailRequestReviewedNotification      bool `json:"mail_request_reviewed_notification"`
+	MailNewRequestNotification           bool `json:"mail_new_request_notification"`
+	MailVMIdleNotification               bool `json:"mail_vm_idle_notification"`
+	MailOperationFailedNotification      bool `json:"mail_operation_failed_notification"`
 
 	TelegramPortForwardNotification          bool `json:"telegram_port_forward_notification"`
 	TelegramVMStatusUpdateNotification       bool `json:"telegram_vm_status_update_notification"`
@@ -371,6 +375,10 @@ type returnUserSettings struct {
 	TelegramUserInvitationNotification       bool `json:"telegram_user_invitation_notification"`
 	TelegramUserRemovalFromGroupNotification bool `json:"telegram_user_removal_from_group_notification"`
 	TelegramLifetimeOfVMExpiredNotification  bool `json:"telegram_lifetime_of_vm_expired_notification"`
+	TelegramRequestReviewedNotification      bool `json:"telegram_request_reviewed_notification"`
+	TelegramNewRequestNotification           bool `json:"telegram_new_request_notification"`
+	TelegramVMIdleNotification               bool `json:"telegram_vm_idle_notification"`
+	TelegramOperationFailedNotification      bool `json:"telegram_operation_failed_notification"`
 }
 
 func getUserSettings(w http.ResponseWriter, r *http.Request) {
@@ -394,6 +402,10 @@ func getUserSettings(w http.ResponseWriter, r *http.Request) {
 		MailUserInvitationNotification:       settings.MailUserInvitationNotification,
 		MailUserRemovalFromGroupNotification: settings.MailUserRemovalFromGroupNotification,
 		MailLifetimeOfVMExpiredNotification:  settings.MailLifetimeOfVMExpiredNotification,
+		MailRequestReviewedNotification:      settings.MailRequestReviewedNotification,
+		MailNewRequestNotification:           settings.MailNewRequestNotification,
+		MailVMIdleNotification:               settings.MailVMIdleNotification,
+		MailOperationFailedNotification:      settings.MailOperationFailedNotification,
 
 		TelegramPortForwardNotification:          settings.TelegramPortForwardNotification,
 		TelegramVMStatusUpdateNotification:       settings.TelegramVMStatusUpdateNotification,
@@ -405,6 +417,10 @@ func getUserSettings(w http.ResponseWriter, r *http.Request) {
 		TelegramUserInvitationNotification:       settings.TelegramUserInvitationNotification,
 		TelegramUserRemovalFromGroupNotification: settings.TelegramUserRemovalFromGroupNotification,
 		TelegramLifetimeOfVMExpiredNotification:  settings.TelegramLifetimeOfVMExpiredNotification,
+		TelegramRequestReviewedNotification:      settings.TelegramRequestReviewedNotification,
+		TelegramNewRequestNotification:           settings.TelegramNewRequestNotification,
+		TelegramVMIdleNotification:               settings.TelegramVMIdleNotification,
+		TelegramOperationFailedNotification:      settings.TelegramOperationFailedNotification,
 	}
 
 	if err := json.NewEncoder(w).Encode(returnSettings); err != nil {
@@ -441,6 +457,10 @@ func updateUserSettings(w http.ResponseWriter, r *http.Request) {
 	s.MailUserInvitationNotification = req.MailUserInvitationNotification
 	s.MailUserRemovalFromGroupNotification = req.MailUserRemovalFromGroupNotification
 	s.MailLifetimeOfVMExpiredNotification = req.MailUserRemovalFromGroupNotification
+	s.MailRequestReviewedNotification = req.MailRequestReviewedNotification
+	s.MailNewRequestNotification = req.MailNewRequestNotification
+	s.MailVMIdleNotification = req.MailVMIdleNotification
+	s.MailOperationFailedNotification = req.MailOperationFailedNotification
 
 	s.TelegramPortForwardNotification = req.TelegramPortForwardNotification
 	s.TelegramVMStatusUpdateNotification = req.TelegramVMStatusUpdateNotification
@@ -452,6 +472,10 @@ func updateUserSettings(w http.ResponseWriter, r *http.Request) {
 	s.TelegramUserInvitationNotification = req.TelegramUserInvitationNotification
 	s.TelegramUserRemovalFromGroupNotification = req.TelegramUserRemovalFromGroupNotification
 	s.TelegramLifetimeOfVMExpiredNotification = req.TelegramUserRemovalFromGroupNotification
+	s.TelegramRequestReviewedNotification = req.TelegramRequestReviewedNotification
+	s.TelegramNewRequestNotification = req.TelegramNewRequestNotification
+	s.TelegramVMIdleNotification = req.TelegramVMIdleNotification
+	s.TelegramOperationFailedNotification = req.TelegramOperationFailedNotification
 
 	if err := db.UpdateSettings(s); err != nil {
 		logger.Error("failed to update user settings", "error", err)
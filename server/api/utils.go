@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"samuelemusiani/sasso/server/db"
 	"samuelemusiani/sasso/server/proxmox"
+	"slices"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
@@ -40,6 +41,16 @@ func mustGetUserIDFromContext(r *http.Request) uint {
 // Verifier middleware request context values. The Authenticator sends a 401 Unauthorized
 // response for any unverified tokens and passes the good ones through.
 func AdminAuthenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	return roleAuthenticator(ja, "Forbidden: Admin access required", db.RoleAdmin)
+}
+
+// MaintainerAuthenticator works like AdminAuthenticator, but lets through
+// both maintainers and admins.
+func MaintainerAuthenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	return roleAuthenticator(ja, "Forbidden: Maintainer access required", db.RoleAdmin, db.RoleMaintainer)
+}
+
+func roleAuthenticator(ja *jwtauth.JWTAuth, forbiddenMsg string, roles ...db.UserRole) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
 			token, claims, err := jwtauth.FromContext(r.Context())
@@ -70,9 +81,9 @@ func AdminAuthenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Check if the user has admin role
-			if user.Role != db.RoleAdmin {
-				http.Error(w, "Forbidden: Admin access required", http.StatusForbidden)
+			// Check if the user has one of the required roles
+			if !slices.Contains(roles, user.Role) {
+				http.Error(w, forbiddenMsg, http.StatusForbidden)
 				return
 			}
 
@@ -146,6 +157,52 @@ func mustGetVMFromContext(r *http.Request) *proxmox.VM {
 	return vm
 }
 
+func validateContainerOwnership() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			userID, err := getUserIDFromContext(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			sctID := chi.URLParam(r, "ctid")
+			ctID, err := strconv.ParseUint(sctID, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid container id", http.StatusBadRequest)
+				return
+			}
+
+			// The ownership and the role in the group are checked by proxmox
+			ct, err := proxmox.GetContainerByID(ctID, userID)
+			if err != nil {
+				if errors.Is(err, proxmox.ErrContainerNotFound) {
+					http.Error(w, "container not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, "ct_id", ct)
+			ctx = context.WithValue(ctx, "group_user_role", ct.GroupRole)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(hfn)
+	}
+}
+
+func mustGetContainerFromContext(r *http.Request) *proxmox.Container {
+	ct, ok := r.Context().Value("ct_id").(*proxmox.Container)
+	if !ok {
+		panic("mustGetContainerFromContext: ct_id not found in context")
+	}
+	return ct
+}
+
 func mustGetUserRoleInGroupFromContext(r *http.Request) string {
 	role, ok := r.Context().Value("group_user_role").(string)
 	if !ok {
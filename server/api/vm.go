@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"samuelemusiani/sasso/server/db"
 	"samuelemusiani/sasso/server/proxmox"
+	"strings"
 	"time"
 )
 
@@ -38,6 +39,10 @@ type newVMRequest struct {
 	IncludeGlobalSSHKeys bool `json:"include_global_ssh_keys"`
 
 	GroupID *uint `json:"group_id,omitempty"`
+	// Private template to clone instead of the default one
+	TemplateID *uint `json:"template_id,omitempty"`
+	// If empty the cluster is chosen with the placement policies
+	Cluster string `json:"cluster"`
 }
 
 func newVM(w http.ResponseWriter, r *http.Request) {
@@ -53,12 +58,18 @@ func newVM(w http.ResponseWriter, r *http.Request) {
 	m.Lock()
 	defer m.Unlock()
 
-	vm, err := proxmox.NewVM(userID, req.GroupID, req.Name, req.Notes, req.Cores, req.RAM, req.Disk, req.LifeTime, req.IncludeGlobalSSHKeys)
+	vm, err := proxmox.NewVM(userID, req.GroupID, req.Name, req.Notes, req.Cores, req.RAM, req.Disk, req.LifeTime, req.IncludeGlobalSSHKeys, req.TemplateID, req.Cluster)
 	if err != nil {
 		if errors.Is(err, proxmox.ErrInsufficientResources) {
 			http.Error(w, "Insufficient resources", http.StatusForbidden)
 		} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrTemplateNotFound) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrClusterNotFound) {
+			http.Error(w, "Cluster not found", http.StatusBadRequest)
+		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
 		} else {
 			logger.Error("Failed to create new VM", "userID", userID, "error", err)
 			http.Error(w, "Failed to create new VM", http.StatusInternalServerError)
@@ -87,6 +98,48 @@ func getVM(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type updateVMRequest struct {
+	// Nil values are not changed
+	Name  *string `json:"name"`
+	Notes *string `json:"notes"`
+}
+
+func updateVM(w http.ResponseWriter, r *http.Request) {
+	var request updateVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	vm := mustGetVMFromContext(r)
+	vmID := vm.ID
+
+	if vm.OwnerType == "Group" {
+		role := mustGetUserRoleInGroupFromContext(r)
+		if role != "admin" && role != "owner" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	m := getVMMutex(uint(vmID))
+	m.Lock()
+	defer m.Unlock()
+
+	err := proxmox.UpdateVMNameAndNotes(vmID, request.Name, request.Notes)
+	if err != nil {
+		if errors.Is(err, proxmox.ErrVMNotFound) {
+			http.Error(w, "VM not found", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrInvalidVMParam) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to update VM", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func deleteVM(w http.ResponseWriter, r *http.Request) {
 	userID := mustGetUserIDFromContext(r)
 	vm := mustGetVMFromContext(r)
@@ -123,6 +176,8 @@ func deleteVM(w http.ResponseWriter, r *http.Request) {
 		logger.Error("Failed to delete VM", "userID", userID, "vmID", vmID, "error", err)
 		if errors.Is(err, proxmox.ErrVMNotFound) {
 			http.Error(w, "Failed to delete VM", http.StatusNotFound)
+		} else if errors.Is(err, proxmox.ErrVMMigrating) {
+			http.Error(w, "Cannot delete a VM while it is migrating", http.StatusConflict)
 		} else if errors.Is(err, proxmox.ErrPermissionDenied) {
 			http.Error(w, "Permission denied", http.StatusForbidden)
 		} else {
@@ -171,7 +226,7 @@ func changeVMState(action string) http.HandlerFunc {
 		}
 
 		switch action {
-		case "start", "stop", "restart":
+		case "start", "stop", "restart", "shutdown", "suspend", "resume", "hibernate":
 			err = proxmox.ChangeVMStatus(isGroup, ownerID, userID, vm.ID, action)
 		default:
 			http.Error(w, "Invalid action", http.StatusBadRequest)
@@ -184,6 +239,8 @@ func changeVMState(action string) http.HandlerFunc {
 				http.Error(w, "Failed to change VM state", http.StatusNotFound)
 			} else if errors.Is(err, proxmox.ErrInvalidVMState) {
 				http.Error(w, "Invalid VM state for this action", http.StatusConflict)
+			} else if errors.Is(err, proxmox.ErrVMMigrating) {
+				http.Error(w, "VM is migrating", http.StatusConflict)
 			} else if errors.Is(err, proxmox.ErrPermissionDenied) {
 				http.Error(w, "Permission denied", http.StatusForbidden)
 			} else {
@@ -199,6 +256,8 @@ func changeVMState(action string) http.HandlerFunc {
 type updateVMLifetimeRequest struct {
 	// Number of months to extend the VM lifetime
 	ExtendBy uint `json:"extend_by"`
+	// Required only if the extension must be approved
+	Justification string `json:"justification"`
 }
 
 func updateVMLifetime(w http.ResponseWriter, r *http.Request) {
@@ -215,16 +274,46 @@ func updateVMLifetime(w http.ResponseWriter, r *http.Request) {
 	defer m.Unlock()
 
 	err := proxmox.UpdateVMLifetime(vmID, request.ExtendBy)
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if errors.Is(err, proxmox.ErrInvalidVMParam) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !errors.Is(err, proxmox.ErrApprovalRequired) {
+		logger.Error("Failed to update VM lifetime", "vmID", vmID, "error", err)
+		http.Error(w, "Failed to update VM lifetime", http.StatusInternalServerError)
+		return
+	}
+
+	// The extension must be approved by a maintainer or an admin
+	if strings.TrimSpace(request.Justification) == "" {
+		http.Error(w, "This extension requires approval, a justification is required", http.StatusBadRequest)
+		return
+	}
+
+	userID := mustGetUserIDFromContext(r)
+	lr, err := proxmox.RequestVMLifetimeExtension(vmID, userID, request.ExtendBy, request.Justification)
 	if err != nil {
 		if errors.Is(err, proxmox.ErrInvalidVMParam) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		} else if errors.Is(err, proxmox.ErrLifetimeRequestPending) {
+			http.Error(w, "A lifetime request for this VM is already pending", http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to create lifetime request", http.StatusInternalServerError)
 		}
-		logger.Error("Failed to update VM lifetime", "vmID", vmID, "error", err)
-		http.Error(w, "Failed to update VM lifetime", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(lr); err != nil {
+		logger.Error("Failed to encode lifetime request to JSON", "error", err)
+		http.Error(w, "Failed to encode lifetime request to JSON", http.StatusInternalServerError)
+		return
+	}
 }
 
 type updateResourcesRequest struct {
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"samuelemusiani/sasso/server/proxmox"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// wakeUpWorker wakes up the Proxmox worker after every successful request
+// that could have changed something, so the change is applied without waiting
+// for the next periodic cycle.
+func wakeUpWorker() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			if ww.Status() < http.StatusBadRequest {
+				proxmox.WakeUpWorker()
+			}
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
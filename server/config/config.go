@@ -12,6 +12,7 @@ type Config struct {
 	Proxmox       Proxmox       `toml:"proxmox"`
 	Notifications Notifications `toml:"notifications"`
 	PortForwards  PortForwards  `toml:"port_forwards"`
+	Maintenance   Maintenance   `toml:"maintenance"`
 }
 
 type Server struct {
@@ -34,14 +35,43 @@ type Secrets struct {
 }
 
 type Proxmox struct {
-	Url                string          `toml:"url"`
-	TokenID            string          `toml:"token_id"`
-	Secret             string          `toml:"secret"`
-	InsecureSkipVerify bool            `toml:"insecure_skip_verify"`
-	Template           ProxmoxTemplate `toml:"template"`
-	Clone              ProxmoxClone    `toml:"clone"`
-	Network            ProxmoxNetwork  `toml:"network"`
-	Backup             ProxmoxBackup   `toml:"backup"`
+	// Name of the main cluster. If empty it's "default"
+	Name               string           `toml:"name"`
+	Url                string           `toml:"url"`
+	TokenID            string           `toml:"token_id"`
+	Secret             string           `toml:"secret"`
+	InsecureSkipVerify bool             `toml:"insecure_skip_verify"`
+	Template           ProxmoxTemplate  `toml:"template"`
+	Catalog            []ProxmoxCatalog `toml:"catalog"`
+	Clone              ProxmoxClone     `toml:"clone"`
+	Network            ProxmoxNetwork   `toml:"network"`
+	Backup             ProxmoxBackup    `toml:"backup"`
+	Placement          ProxmoxPlacement `toml:"placement"`
+	Container          ProxmoxContainer `toml:"container"`
+	Worker             ProxmoxWorker    `toml:"worker"`
+	Drift              ProxmoxDrift     `toml:"drift"`
+
+	// Additional clusters. The clone ID template, the worker limits and the
+	// drift check of the main cluster are used for all of them
+	Clusters []ProxmoxCluster `toml:"clusters"`
+}
+
+// ProxmoxCluster is a Proxmox cluster other than the main one
+type ProxmoxCluster struct {
+	Name               string           `toml:"name"`
+	Url                string           `toml:"url"`
+	TokenID            string           `toml:"token_id"`
+	Secret             string           `toml:"secret"`
+	InsecureSkipVerify bool             `toml:"insecure_skip_verify"`
+	Template           ProxmoxTemplate  `toml:"template"`
+	Catalog            []ProxmoxCatalog `toml:"catalog"`
+	// The node where the clones are created when the placement strategy is
+	// "pinned"
+	TargetNode string           `toml:"target_node"`
+	Network    ProxmoxNetwork   `toml:"network"`
+	Backup     ProxmoxBackup    `toml:"backup"`
+	Placement  ProxmoxPlacement `toml:"placement"`
+	Container  ProxmoxContainer `toml:"container"`
 }
 
 type ProxmoxTemplate struct {
@@ -49,6 +79,15 @@ type ProxmoxTemplate struct {
 	VMID int    `toml:"vmid"`
 }
 
+// ProxmoxCatalog is a template that users can choose instead of the default
+// one
+type ProxmoxCatalog struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	Node        string `toml:"node"`
+	VMID        int    `toml:"vmid"`
+}
+
 type ProxmoxClone struct {
 	TargetNode     string `toml:"target_node"`
 	IDTemplate     string `toml:"id_template"`
@@ -77,6 +116,39 @@ type ProxmoxBackup struct {
 	Storage string `toml:"storage"`
 }
 
+type ProxmoxPlacement struct {
+	Strategy string   `toml:"strategy"`
+	Nodes    []string `toml:"nodes"`
+	Storage  string   `toml:"storage"`
+}
+
+// ProxmoxContainer configures the LXC containers. Containers can't be created
+// on a cluster without a template.
+type ProxmoxContainer struct {
+	// Volume of the CT template, like
+	// "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst"
+	Template string `toml:"template"`
+	// Storage of the root filesystem
+	Storage      string `toml:"storage"`
+	Unprivileged bool   `toml:"unprivileged"`
+}
+
+// ProxmoxWorker limits the Proxmox tasks that the worker runs at the same
+// time. Zero values use the defaults.
+type ProxmoxWorker struct {
+	MaxTasks        int `toml:"max_tasks"`
+	MaxTasksPerNode int `toml:"max_tasks_per_node"`
+}
+
+// ProxmoxDrift configures the periodic check of the differences between the
+// DB and the configuration on Proxmox.
+type ProxmoxDrift struct {
+	IntervalMinutes int `toml:"interval_minutes"`
+	// Object types whose drift is corrected automatically: "vm", "interface"
+	// and "ssh_keys"
+	AutoCorrect []string `toml:"auto_correct"`
+}
+
 type Notifications struct {
 	Enabled      bool `toml:"enabled"`
 	RateLimits   bool `toml:"rate_limits"`
@@ -97,6 +169,11 @@ type PortForwards struct {
 	PublicIP string `toml:"public_ip"`
 }
 
+type Maintenance struct {
+	Enabled bool   `toml:"enabled"`
+	Message string `toml:"message"`
+}
+
 var config Config = Config{}
 
 func Get() *Config {
@@ -16,6 +16,17 @@ type BackupRequest struct {
 	Volid  *string `gorm:"default:null"`
 	VMID   uint    `gorm:"not null"`
 
+	// Proxmox task running on the request and the node where it runs. They are
+	// empty when no task is tracked
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+	TaskNode string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Last error of the worker on the request, the number of failed attempts and
+	// when the next attempt is made. They are reset when an attempt succeeds
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
 	OwnerID   uint   `gorm:"not null;index"`
 	OwnerType string `gorm:"not null;index"`
 
@@ -91,6 +102,25 @@ func UpdateBackupRequestStatus(id uint, status string) error {
 	return nil
 }
 
+// SetBackupRequestTask updates the status of the request together with the
+// tracked Proxmox task. Empty upid and node stop the tracking
+func SetBackupRequestTask(id uint, status, upid, node string) error {
+	return db.Model(&BackupRequest{ID: id}).Updates(map[string]interface{}{
+		"status":    status,
+		"task_upid": upid,
+		"task_node": node,
+	}).Error
+}
+
+func GetBackupRequestsWithTask() ([]BackupRequest, error) {
+	var backupRequests []BackupRequest
+	result := db.Where("task_upid <> ''").Find(&backupRequests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return backupRequests, nil
+}
+
 func GetBackupRequestWithStatusAndType(status, t string) ([]BackupRequest, error) {
 	var backupRequests []BackupRequest
 	result := db.Where(&BackupRequest{Status: status, Type: t}).Find(&backupRequests)
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// AssignDefaultCluster moves the objects created before the clusters were
+// introduced, that have an empty cluster, to the main cluster
+func AssignDefaultCluster(cluster string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&VM{}, &Net{}, &Template{}, &Drift{}} {
+			err := tx.Model(model).Where("cluster = ?", "").UpdateColumn("cluster", cluster).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetVMIDsByCluster returns the IDs of the VMs placed on a cluster
+func GetVMIDsByCluster(cluster string) ([]uint64, error) {
+	var ids []uint64
+	if err := db.Model(&VM{}).Where("cluster = ?", cluster).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
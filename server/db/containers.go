@@ -0,0 +1,327 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Container is an LXC container. Containers have a VMID in the same range of
+// the VMs of the owner and they share the same resource limits.
+type Container struct {
+	ID        uint64 `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Status string `gorm:"type:varchar(20);not null;default:'unknown';check:status IN ('running','stopped','unknown','pre-creating','creating','pre-configuring','pre-deleting','deleting')"`
+
+	Name  string `gorm:"type:varchar(20);not null"`
+	Notes string `gorm:"type:text;not null;default:''"`
+	Cores uint   `gorm:"not null;default:1"`
+	RAM   uint   `gorm:"not null;default:512"`
+	Disk  uint   `gorm:"not null;default:4"`
+
+	IncludeGlobalSSHKeys bool `gorm:"not null"`
+
+	// Proxmox cluster and node where the container has been placed
+	Cluster string `gorm:"type:varchar(64);not null;default:'';index"`
+	Node    string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Proxmox task running on the container and the node where it runs. They
+	// are empty when no task is tracked
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+	TaskNode string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Last error of the worker on the container, the number of failed attempts
+	// and when the next attempt is made. They are reset when an attempt
+	// succeeds
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
+	OwnerID   uint   `gorm:"not null;index"`
+	OwnerType string `gorm:"not null;index"`
+
+	Interfaces []ContainerInterface `gorm:"foreignKey:ContainerID;constraint:OnDelete:CASCADE"`
+}
+
+// ContainerInterface is a NIC of a container on a VNet. The NICs are part of
+// the configuration of the container, so they don't have their own status:
+// the container is configured again when they change.
+type ContainerInterface struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	ContainerID uint64 `gorm:"not null;index"`
+	// Index of the netX option and of the ethX device in the container
+	LocalID uint   `gorm:"not null"`
+	VNetID  uint   `gorm:"not null;index"`
+	VlanTag uint16 `gorm:"not null;default:0"` // 0 means untagged
+	IPAdd   string `gorm:"not null"`
+	Gateway string `gorm:"not null"`
+}
+
+func initContainers() error {
+	if err := db.AutoMigrate(&Container{}, &ContainerInterface{}); err != nil {
+		logger.Error("Failed to migrate containers tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetContainersByUserID(userID uint) ([]Container, error) {
+	return getContainersByOwner(userID, "User")
+}
+
+func GetContainersByGroupID(groupID uint) ([]Container, error) {
+	return getContainersByOwner(groupID, "Group")
+}
+
+func getContainersByOwner(ownerID uint, ownerType string) ([]Container, error) {
+	var containers []Container
+	result := db.Where(&Container{OwnerID: ownerID, OwnerType: ownerType}).
+		Order("id ASC").
+		Find(&containers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return containers, nil
+}
+
+func GetContainerByID(id uint64) (*Container, error) {
+	var container Container
+	result := db.First(&container, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &container, nil
+}
+
+func GetContainersWithStatus(status string) ([]Container, error) {
+	var containers []Container
+	result := db.Where(&Container{Status: status}).Find(&containers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return containers, nil
+}
+
+func GetContainersWithStates(states []string) ([]Container, error) {
+	var containers []Container
+	result := db.Where("status IN ?", states).Find(&containers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return containers, nil
+}
+
+func GetContainersWithTask() ([]Container, error) {
+	var containers []Container
+	result := db.Where("task_upid <> ''").Find(&containers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return containers, nil
+}
+
+func ExistsContainerWithOwnerAndName(ownerID uint, ownerType, name string) (bool, error) {
+	var count int64
+	result := db.Model(&Container{}).
+		Where(&Container{OwnerID: ownerID, OwnerType: ownerType, Name: name}).
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+func NewContainer(container *Container) error {
+	return db.Create(container).Error
+}
+
+func DeleteContainerByID(id uint64) error {
+	result := db.Delete(&Container{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func UpdateContainerStatus(id uint64, status string) error {
+	return db.Model(&Container{ID: id}).Update("status", status).Error
+}
+
+func UpdateContainerNameAndNotes(id uint64, name, notes string) error {
+	result := db.Model(&Container{ID: id}).Updates(map[string]interface{}{
+		"name":  name,
+		"notes": notes,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateContainerResources changes the resources of the container and sets
+// it to status, so that the worker applies them
+func UpdateContainerResources(id uint64, cores, ram, disk uint, status string) error {
+	return db.Model(&Container{ID: id}).Updates(map[string]interface{}{
+		"cores":  cores,
+		"ram":    ram,
+		"disk":   disk,
+		"status": status,
+	}).Error
+}
+
+// SetContainerTask updates the status of the container together with the
+// tracked Proxmox task. Empty upid and node stop the tracking
+func SetContainerTask(id uint64, status, upid, node string) error {
+	return db.Model(&Container{ID: id}).Updates(map[string]interface{}{
+		"status":    status,
+		"task_upid": upid,
+		"task_node": node,
+	}).Error
+}
+
+// UpdateContainerNode does not touch updated_at, as it is used to detect
+// recent status changes
+func UpdateContainerNode(id uint64, node string) error {
+	return db.Model(&Container{ID: id}).UpdateColumn("node", node).Error
+}
+
+func CountContainers() (int64, error) {
+	var count int64
+	if err := db.Model(&Container{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func CountContainersByGroupID(groupID uint) (int64, error) {
+	var count int64
+	result := db.Model(&Container{}).Where(&Container{OwnerID: groupID, OwnerType: "Group"}).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
+
+func GetContainerInterfaces(containerID uint64) ([]ContainerInterface, error) {
+	var ifaces []ContainerInterface
+	result := db.Where("container_id = ?", containerID).Order("local_id ASC").Find(&ifaces)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return ifaces, nil
+}
+
+// NewContainerInterface adds the NIC on the first free index of the
+// container, up to maxInterfaces, and sets the container to status. It
+// returns ErrAlreadyExists if all the indexes are used.
+func NewContainerInterface(iface *ContainerInterface, maxInterfaces uint, status string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var used []uint
+		if err := tx.Model(&ContainerInterface{}).
+			Where("container_id = ?", iface.ContainerID).
+			Pluck("local_id", &used).Error; err != nil {
+			return err
+		}
+
+		free := false
+		for i := range maxInterfaces {
+			if !slices.Contains(used, i) {
+				iface.LocalID = i
+				free = true
+				break
+			}
+		}
+		if !free {
+			return ErrAlreadyExists
+		}
+
+		if err := tx.Create(iface).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Container{ID: iface.ContainerID}).Update("status", status).Error
+	})
+}
+
+// DeleteContainerInterface removes the NIC and sets the container to status
+func DeleteContainerInterface(containerID uint64, id uint, status string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("container_id = ? AND id = ?", containerID, id).Delete(&ContainerInterface{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Model(&Container{ID: containerID}).Update("status", status).Error
+	})
+}
+
+func CountContainerInterfacesByVNetID(vnetID uint) (int64, error) {
+	var count int64
+	if err := db.Model(&ContainerInterface{}).Where("v_net_id = ?", vnetID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func existsContainerIPInVNetWithVlanTag(vnetID uint, vlanTag uint16, ipAdd string) (bool, error) {
+	if slashIndex := strings.Index(ipAdd, "/"); slashIndex != -1 {
+		ipAdd = ipAdd[:slashIndex]
+	}
+
+	var count int64
+	if err := db.Model(&ContainerInterface{}).
+		Where("v_net_id = ? AND vlan_tag = ? AND ip_add LIKE ?", vnetID, vlanTag, ipAdd+"/%").
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// getContainersResourcesByOwner returns the resources of the containers of an
+// owner. If status is not empty only the containers in that status are
+// counted.
+func getContainersResourcesByOwner(ownerID uint, ownerType, status string) (uint, uint, uint, error) {
+	var result struct {
+		Cores uint
+		RAM   uint
+		Disk  uint
+	}
+
+	err := db.Model(&Container{}).
+		Select("COALESCE(SUM(cores), 0) as cores, COALESCE(SUM(ram), 0) as ram, COALESCE(SUM(disk), 0) as disk").
+		Where(&Container{OwnerID: ownerID, OwnerType: ownerType, Status: status}).
+		Scan(&result).Error
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return result.Cores, result.RAM, result.Disk, nil
+}
+
+func getContainersIDsByOwner(ownerID uint, ownerType string) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&Container{}).
+		Where(&Container{OwnerID: ownerID, OwnerType: ownerType}).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
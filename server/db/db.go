@@ -32,6 +32,7 @@ func Init(dbLogger *slog.Logger, c config.Database) error {
 	var err error
 
 	url := fmt.Sprintf("host=%s user=%s password=%s dbname=sasso port=%d sslmode=disable", c.Host, c.User, c.Password, c.Port)
+	dsn = url
 
 	logger.Debug("Connecting to database", "url", url)
 
@@ -93,6 +94,12 @@ func Init(dbLogger *slog.Logger, c config.Database) error {
 		return err
 	}
 
+	err = initLifetimeRequests()
+	if err != nil {
+		logger.Error("Failed to initialize lifetime requests in database", "error", err)
+		return err
+	}
+
 	err = initGroups()
 	if err != nil {
 		logger.Error("Failed to initialize groups in database", "error", err)
@@ -117,6 +124,12 @@ func Init(dbLogger *slog.Logger, c config.Database) error {
 		return err
 	}
 
+	err = initContainers()
+	if err != nil {
+		logger.Error("Failed to initialize containers in database", "error", err)
+		return err
+	}
+
 	err = initPortForwards()
 	if err != nil {
 		logger.Error("Failed to initialize port forwards in database", "error", err)
@@ -147,6 +160,78 @@ func Init(dbLogger *slog.Logger, c config.Database) error {
 		return err
 	}
 
+	err = initNodePolicies()
+	if err != nil {
+		logger.Error("Failed to initialize node policies in database", "error", err)
+		return err
+	}
+
+	err = initMigrations()
+	if err != nil {
+		logger.Error("Failed to initialize migrations in database", "error", err)
+		return err
+	}
+
+	err = initLifetimePolicies()
+	if err != nil {
+		logger.Error("Failed to initialize lifetime policies in database", "error", err)
+		return err
+	}
+
+	err = initQuotaRequests()
+	if err != nil {
+		logger.Error("Failed to initialize quota requests in database", "error", err)
+		return err
+	}
+
+	err = initIdlePolicies()
+	if err != nil {
+		logger.Error("Failed to initialize idle policies in database", "error", err)
+		return err
+	}
+
+	err = initTemplates()
+	if err != nil {
+		logger.Error("Failed to initialize templates in database", "error", err)
+		return err
+	}
+
+	err = initUsageRecords()
+	if err != nil {
+		logger.Error("Failed to initialize usage records in database", "error", err)
+		return err
+	}
+
+	err = initMaintenance()
+	if err != nil {
+		logger.Error("Failed to initialize maintenance in database", "error", err)
+		return err
+	}
+
+	err = initDrifts()
+	if err != nil {
+		logger.Error("Failed to initialize drifts in database", "error", err)
+		return err
+	}
+
+	err = initStacks()
+	if err != nil {
+		logger.Error("Failed to initialize stacks in database", "error", err)
+		return err
+	}
+
+	err = initVMLabels()
+	if err != nil {
+		logger.Error("Failed to initialize VM labels in database", "error", err)
+		return err
+	}
+
+	err = initPersonalTokens()
+	if err != nil {
+		logger.Error("Failed to initialize personal tokens in database", "error", err)
+		return err
+	}
+
 	err = applyFixes()
 	if err != nil {
 		logger.Error("Failed to apply fixes to database", "error", err)
@@ -214,6 +299,26 @@ func applyFixes() error {
 			}
 		}
 
+		// AutoMigrate does not update existing check constraints, so the ones on
+		// the status of the VMs and of the templates are recreated to allow the
+		// statuses added after the tables were created.
+		if err := tx.Migrator().DropConstraint(&VM{}, "chk_vms_status"); err != nil {
+			logger.Error("Failed to drop VM status constraint during fixes application", "error", err)
+			return err
+		}
+		if err := tx.Migrator().CreateConstraint(&VM{}, "chk_vms_status"); err != nil {
+			logger.Error("Failed to create VM status constraint during fixes application", "error", err)
+			return err
+		}
+		if err := tx.Migrator().DropConstraint(&Template{}, "chk_templates_status"); err != nil {
+			logger.Error("Failed to drop template status constraint during fixes application", "error", err)
+			return err
+		}
+		if err := tx.Migrator().CreateConstraint(&Template{}, "chk_templates_status"); err != nil {
+			logger.Error("Failed to create template status constraint during fixes application", "error", err)
+			return err
+		}
+
 		return nil
 	})
 	return err
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Drift is a difference between the configuration of an object in the DB and
+// on Proxmox, found by the last drift check. The table only holds the drifts
+// of the last check.
+type Drift struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Cluster string `gorm:"type:varchar(64);not null;default:'';index"`
+
+	// Type of the object: "vm", "interface" or "ssh_keys"
+	ObjectType string `gorm:"type:varchar(20);not null"`
+	ObjectID   uint64 `gorm:"not null"`
+	VMID       uint64 `gorm:"not null;index"`
+
+	Field    string `gorm:"type:varchar(32);not null"`
+	Expected string `gorm:"type:text;not null;default:''"`
+	Actual   string `gorm:"type:text;not null;default:''"`
+
+	// The drift has been scheduled for correction by the worker
+	Corrected bool `gorm:"not null;default:false"`
+}
+
+func initDrifts() error {
+	err := db.AutoMigrate(&Drift{})
+	if err != nil {
+		logger.Error("Failed to migrate Drifts table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetDrifts() ([]Drift, error) {
+	var drifts []Drift
+	result := db.Order("vm_id ASC, id ASC").Find(&drifts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return drifts, nil
+}
+
+// ReplaceDrifts replaces the drifts of the previous check of a cluster
+func ReplaceDrifts(cluster string, drifts []Drift) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("cluster = ?", cluster).Delete(&Drift{}).Error; err != nil {
+			return err
+		}
+		if len(drifts) == 0 {
+			return nil
+		}
+		for i := range drifts {
+			drifts[i].Cluster = cluster
+		}
+		return tx.Create(&drifts).Error
+	})
+}
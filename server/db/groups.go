@@ -199,6 +199,21 @@ func DeleteGroup(groupID uint) error {
 		}
 		err = tx.Where("group_id = ?", groupID).Delete(&GroupResource{}).Error
 
+		if err := deleteNodePoliciesByOwnerTransaction(tx, groupID, "Group"); err != nil {
+			logger.Error("Failed to delete group node policies", "error", err)
+			return err
+		}
+
+		if err := deleteLifetimePoliciesByGroupTransaction(tx, groupID); err != nil {
+			logger.Error("Failed to delete group lifetime policies", "error", err)
+			return err
+		}
+
+		if err := deleteQuotaRequestsByGroupTransaction(tx, groupID); err != nil {
+			logger.Error("Failed to delete group quota requests", "error", err)
+			return err
+		}
+
 		// Delete the group
 		result := tx.Delete(&Group{}, groupID)
 		if result.Error != nil {
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrDefaultIdlePolicy = errors.New("the default idle policy cannot be deleted")
+
+// IdlePolicy describes when a running VM is considered idle and is stopped. A
+// policy can be scoped to a realm. The policy with no realm is the default one
+// and always exists. Group VMs always use the default policy.
+type IdlePolicy struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	RealmID *uint `gorm:"uniqueIndex"`
+
+	Enabled bool `gorm:"not null;default:false"`
+	// Hours a VM must be idle before the owner is warned
+	IdleHours uint `gorm:"not null;default:72"`
+	// Hours between the warning and the stop of the VM
+	GracePeriod uint `gorm:"not null;default:24"`
+	// CPU usage, in percent, under which a VM is idle
+	CPUThreshold float64 `gorm:"not null;default:5"`
+	// Network traffic, in KB/s, under which a VM is idle
+	NetThreshold uint `gorm:"not null;default:10"`
+}
+
+func initIdlePolicies() error {
+	err := db.AutoMigrate(&IdlePolicy{})
+	if err != nil {
+		logger.Error("Failed to migrate IdlePolicies table", "error", err)
+		return err
+	}
+
+	var count int64
+	err = db.Model(&IdlePolicy{}).Where("realm_id IS NULL").Count(&count).Error
+	if err != nil {
+		logger.Error("Failed to check default idle policy", "error", err)
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// The detection is disabled until an admin enables it
+	defaultPolicy := IdlePolicy{
+		Enabled:      false,
+		IdleHours:    72,
+		GracePeriod:  24,
+		CPUThreshold: 5,
+		NetThreshold: 10,
+	}
+	if err := db.Create(&defaultPolicy).Error; err != nil {
+		logger.Error("Failed to create default idle policy", "error", err)
+		return err
+	}
+
+	logger.Debug("Default idle policy initialized successfully")
+	return nil
+}
+
+func GetAllIdlePolicies() ([]IdlePolicy, error) {
+	var policies []IdlePolicy
+	result := db.Order("id ASC").Find(&policies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policies, nil
+}
+
+func GetIdlePolicyByID(id uint) (*IdlePolicy, error) {
+	var policy IdlePolicy
+	result := db.First(&policy, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &policy, nil
+}
+
+// GetIdlePolicyForRealm returns the policy of the realm, or the default one if
+// the realm has none. If realmID is nil the default policy is returned.
+func GetIdlePolicyForRealm(realmID *uint) (*IdlePolicy, error) {
+	var policy IdlePolicy
+	if realmID != nil {
+		err := db.Where("realm_id = ?", *realmID).First(&policy).Error
+		if err == nil {
+			return &policy, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	err := db.Where("realm_id IS NULL").First(&policy).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func CreateIdlePolicy(policy *IdlePolicy) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&IdlePolicy{}).Where("realm_id = ?", policy.RealmID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+		return tx.Create(policy).Error
+	})
+}
+
+// UpdateIdlePolicy updates the values of a policy. The realm can't be changed.
+func UpdateIdlePolicy(policy *IdlePolicy) error {
+	result := db.Model(&IdlePolicy{ID: policy.ID}).
+		Select("enabled", "idle_hours", "grace_period", "cpu_threshold", "net_threshold").
+		Updates(policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func DeleteIdlePolicy(id uint) error {
+	policy, err := GetIdlePolicyByID(id)
+	if err != nil {
+		return err
+	}
+	if policy.RealmID == nil {
+		return ErrDefaultIdlePolicy
+	}
+	return db.Delete(&IdlePolicy{}, id).Error
+}
+
+func deleteIdlePoliciesByRealmTransaction(tx *gorm.DB, realmID uint) error {
+	return tx.Where("realm_id = ?", realmID).Delete(&IdlePolicy{}).Error
+}
@@ -19,6 +19,17 @@ type Interface struct {
 
 	Status string `gorm:"type:varchar(20);not null;default:'creating';check:status IN ('unknown','pre-creating','creating','pre-deleting','deleting','ready','pre-configuring','configuring')"`
 
+	// Proxmox task running on the interface and the node where it runs. They are
+	// empty when no task is tracked
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+	TaskNode string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Last error of the worker on the interface, the number of failed attempts and
+	// when the next attempt is made. They are reset when an attempt succeeds
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
 	// read-only, not stored in DB
 	VNetName  string `gorm:"->;-:migration"` // Name of the VNet
 	VMName    string `gorm:"->;-:migration"` // Name of the VM
@@ -87,6 +98,25 @@ func UpdateInterfaceStatus(id uint, status string) error {
 	return db.Model(&Interface{}).Where("id = ?", id).Update("status", status).Error
 }
 
+// SetInterfaceTask updates the status of the interface together with the
+// tracked Proxmox task. Empty upid and node stop the tracking
+func SetInterfaceTask(id uint, status, upid, node string) error {
+	return db.Model(&Interface{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":    status,
+		"task_upid": upid,
+		"task_node": node,
+	}).Error
+}
+
+func GetInterfacesWithTask() ([]Interface, error) {
+	var interfaces []Interface
+	result := db.Where("task_upid <> ''").Find(&interfaces)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return interfaces, nil
+}
+
 func DeleteInterfaceByID(id uint) error {
 	return db.Delete(&Interface{}, id).Error
 }
@@ -114,6 +144,14 @@ func AreThereInterfacesWithVlanTagsByVNetID(vnetID uint) (bool, error) {
 		logger.Error("Failed to count interfaces with VLAN tag for VNet", "vnetID", vnetID, "error", err)
 		return false, err
 	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if err := db.Model(&ContainerInterface{}).Where("v_net_id = ? AND vlan_tag != 0", vnetID).Count(&count).Error; err != nil {
+		logger.Error("Failed to count container interfaces with VLAN tag for VNet", "vnetID", vnetID, "error", err)
+		return false, err
+	}
 	return count > 0, nil
 }
 
@@ -167,5 +205,15 @@ func ExistsIPInVNetWithVlanTag(vnetID uint, vlanTag uint16, ipAdd string) (bool,
 		logger.Error("Failed to check existence of IP in VNet with VLAN tag", "vnetID", vnetID, "vlanTag", vlanTag, "ipAdd", ipAdd, "error", err)
 		return false, err
 	}
-	return count > 0, nil
+	if count > 0 {
+		return true, nil
+	}
+
+	// The NICs of the containers are on the same VNets
+	exists, err := existsContainerIPInVNetWithVlanTag(vnetID, vlanTag, ipAdd)
+	if err != nil {
+		logger.Error("Failed to check existence of IP in VNet with VLAN tag on containers", "vnetID", vnetID, "vlanTag", vlanTag, "ipAdd", ipAdd, "error", err)
+		return false, err
+	}
+	return exists, nil
 }
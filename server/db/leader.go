@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Only one sasso instance runs the workers. The leader is the instance that
+// holds a session level advisory lock on Postgres, so the lock is released as
+// soon as the instance stops or loses its connection.
+const leaderLockKey int64 = 0x5a550
+
+var (
+	// Interval between two attempts to acquire the lock and between two
+	// checks of the connection holding it
+	leaderCheckInterval = 5 * time.Second
+
+	errLeadershipLost = errors.New("leadership lost")
+
+	// Connection holding the lock while this instance is the leader, and the
+	// cancel function of the context passed to lead. A pgx connection can't
+	// be used concurrently, so they are guarded by leaderMutex.
+	leaderMutex  sync.Mutex
+	leaderConn   *pgx.Conn
+	leaderCancel context.CancelFunc
+)
+
+// IsLeader returns true if this instance still holds the leader lock. The
+// lock is checked on Postgres, so the workers call it before the actions that
+// must not run on two instances at once. If the lock is lost the leadership
+// ends right away, without waiting for the periodic check.
+func IsLeader() bool {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+
+	if leaderConn == nil {
+		return false
+	}
+
+	// A bigint advisory lock is split into classid and objid on pg_locks
+	var held bool
+	ctx, cancel := context.WithTimeout(context.Background(), leaderCheckInterval)
+	err := leaderConn.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND granted
+			AND pid = pg_backend_pid() AND classid = $1 AND objid = $2 AND objsubid = 1)`,
+		uint32(leaderLockKey>>32), uint32(leaderLockKey)).Scan(&held)
+	cancel()
+	if err != nil || !held {
+		logger.Error("Leader lock is not held anymore", "error", err)
+		leaderCancel()
+		leaderConn = nil
+		return false
+	}
+	return true
+}
+
+// RunAsLeader waits until this instance is elected as the leader and then
+// calls lead. The context passed to lead is canceled when the leadership is
+// lost, and the lock is released only after lead returns. RunAsLeader tries
+// to become the leader again until ctx is done.
+func RunAsLeader(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		err := runAsLeader(ctx, lead)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("Leader election failed, retrying", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderCheckInterval):
+		}
+	}
+}
+
+func runAsLeader(ctx context.Context, lead func(ctx context.Context)) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for {
+		var acquired bool
+		err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&acquired)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leaderCheckInterval):
+		}
+	}
+
+	logger.Info("Elected as leader")
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	leaderMutex.Lock()
+	leaderConn = conn
+	leaderCancel = cancel
+	leaderMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leaderCtx)
+	}()
+	defer func() {
+		leaderMutex.Lock()
+		leaderConn = nil
+		leaderMutex.Unlock()
+
+		cancel()
+		<-done
+	}()
+
+	// The lock is held as long as the connection is alive
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case <-leaderCtx.Done():
+			return errLeadershipLost
+		case <-time.After(leaderCheckInterval):
+		}
+
+		if !IsLeader() {
+			return errLeadershipLost
+		}
+	}
+}
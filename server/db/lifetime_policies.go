@@ -0,0 +1,246 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrDefaultLifetimePolicy = errors.New("the default lifetime policy cannot be deleted")
+
+// LifetimePolicy describes how long VMs can live. A policy can be scoped to a
+// realm, a role, a realm and a role together or a group. The policy with no
+// scope is the default one and always exists.
+type LifetimePolicy struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	RealmID *uint     `gorm:"index"`
+	Role    *UserRole `gorm:"type:varchar(20)"`
+	GroupID *uint     `gorm:"index"`
+
+	// Lifetimes, in months, that can be chosen when creating a VM
+	AllowedDurations []uint `gorm:"type:text;not null;serializer:json"`
+	// Maximum lifetime, in months from the creation of the VM. 0 means no
+	// limit
+	MaxTotalLifetime uint `gorm:"not null;default:0"`
+	// Days after the expiration before the VM is deleted
+	GracePeriod uint `gorm:"not null;default:7"`
+	// Days before the expiration when a reminder is sent to the owner
+	ReminderDays []uint `gorm:"type:text;not null;serializer:json"`
+	// Lifetime, in months from the creation of the VM, after which an
+	// extension must be approved by a maintainer or an admin. 0 means that
+	// approvals are never required
+	ApprovalThreshold uint `gorm:"not null;default:0"`
+}
+
+func initLifetimePolicies() error {
+	err := db.AutoMigrate(&LifetimePolicy{})
+	if err != nil {
+		logger.Error("Failed to migrate LifetimePolicies table", "error", err)
+		return err
+	}
+
+	var count int64
+	err = db.Model(&LifetimePolicy{}).
+		Where("realm_id IS NULL AND role IS NULL AND group_id IS NULL").
+		Count(&count).Error
+	if err != nil {
+		logger.Error("Failed to check default lifetime policy", "error", err)
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// These are the values used before the policies were configurable
+	defaultPolicy := LifetimePolicy{
+		AllowedDurations: []uint{1, 3, 6, 12},
+		MaxTotalLifetime: 0,
+		GracePeriod:      7,
+		ReminderDays:     []uint{1, 2, 4, 7, 15, 30, 60, 90},
+	}
+	if err := db.Create(&defaultPolicy).Error; err != nil {
+		logger.Error("Failed to create default lifetime policy", "error", err)
+		return err
+	}
+
+	logger.Debug("Default lifetime policy initialized successfully")
+	return nil
+}
+
+func (p *LifetimePolicy) IsDefault() bool {
+	return p.RealmID == nil && p.Role == nil && p.GroupID == nil
+}
+
+func GetAllLifetimePolicies() ([]LifetimePolicy, error) {
+	var policies []LifetimePolicy
+	result := db.Order("id ASC").Find(&policies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policies, nil
+}
+
+func GetLifetimePolicyByID(id uint) (*LifetimePolicy, error) {
+	var policy LifetimePolicy
+	result := db.First(&policy, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &policy, nil
+}
+
+func scopeLifetimePolicy(tx *gorm.DB, realmID *uint, role *UserRole, groupID *uint) *gorm.DB {
+	if realmID == nil {
+		tx = tx.Where("realm_id IS NULL")
+	} else {
+		tx = tx.Where("realm_id = ?", *realmID)
+	}
+	if role == nil {
+		tx = tx.Where("role IS NULL")
+	} else {
+		tx = tx.Where("role = ?", *role)
+	}
+	if groupID == nil {
+		tx = tx.Where("group_id IS NULL")
+	} else {
+		tx = tx.Where("group_id = ?", *groupID)
+	}
+	return tx
+}
+
+func CreateLifetimePolicy(policy *LifetimePolicy) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := scopeLifetimePolicy(tx.Model(&LifetimePolicy{}), policy.RealmID, policy.Role, policy.GroupID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+		return tx.Create(policy).Error
+	})
+}
+
+// UpdateLifetimePolicy updates the values of a policy. The scope can't be
+// changed.
+func UpdateLifetimePolicy(policy *LifetimePolicy) error {
+	result := db.Model(&LifetimePolicy{ID: policy.ID}).
+		Select("allowed_durations", "max_total_lifetime", "grace_period", "reminder_days", "approval_threshold").
+		Updates(policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func DeleteLifetimePolicy(id uint) error {
+	policy, err := GetLifetimePolicyByID(id)
+	if err != nil {
+		return err
+	}
+	if policy.IsDefault() {
+		return ErrDefaultLifetimePolicy
+	}
+	return db.Delete(&LifetimePolicy{}, id).Error
+}
+
+// GetLifetimePolicyForUser returns the most specific policy for the user. A
+// policy with both realm and role wins over one with only the realm, that
+// wins over one with only the role, that wins over the default one.
+func GetLifetimePolicyForUser(userID uint) (*LifetimePolicy, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []LifetimePolicy
+	err = db.Where("group_id IS NULL").
+		Where("realm_id IS NULL OR realm_id = ?", user.RealmID).
+		Where("role IS NULL OR role = ?", user.Role).
+		Find(&policies).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var best *LifetimePolicy
+	bestScore := -1
+	for i := range policies {
+		score := 0
+		if policies[i].RealmID != nil {
+			score += 2
+		}
+		if policies[i].Role != nil {
+			score += 1
+		}
+		if score > bestScore {
+			best = &policies[i]
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNotFound
+	}
+	return best, nil
+}
+
+// GetLifetimePolicyForGroup returns the policy of the group, or the default
+// one if the group has none.
+func GetLifetimePolicyForGroup(groupID uint) (*LifetimePolicy, error) {
+	var policy LifetimePolicy
+	err := db.Where("group_id = ?", groupID).First(&policy).Error
+	if err == nil {
+		return &policy, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	err = scopeLifetimePolicy(db, nil, nil, nil).First(&policy).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// GetMaxLifetimeReminderDays returns the furthest reminder of all the
+// policies, in days
+func GetMaxLifetimeReminderDays() (uint, error) {
+	policies, err := GetAllLifetimePolicies()
+	if err != nil {
+		return 0, err
+	}
+
+	var max uint
+	for _, p := range policies {
+		for _, d := range p.ReminderDays {
+			if d > max {
+				max = d
+			}
+		}
+	}
+	return max, nil
+}
+
+func deleteLifetimePoliciesByRealmTransaction(tx *gorm.DB, realmID uint) error {
+	return tx.Where("realm_id = ?", realmID).Delete(&LifetimePolicy{}).Error
+}
+
+func deleteLifetimePoliciesByGroupTransaction(tx *gorm.DB, groupID uint) error {
+	return tx.Where("group_id = ?", groupID).Delete(&LifetimePolicy{}).Error
+}
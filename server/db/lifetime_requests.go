@@ -0,0 +1,155 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	LifetimeRequestStatusPending  = "pending"
+	LifetimeRequestStatusApproved = "approved"
+	LifetimeRequestStatusRejected = "rejected"
+)
+
+// LifetimeRequest is a request to extend the lifetime of a VM beyond the
+// approval threshold of its lifetime policy. It must be reviewed by a
+// maintainer or an admin.
+type LifetimeRequest struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	VMID          uint64 `gorm:"not null;index"`
+	UserID        uint   `gorm:"not null;index"`
+	ExtendBy      uint   `gorm:"not null"`
+	Justification string `gorm:"type:text;not null"`
+
+	Status      string `gorm:"type:varchar(20);not null;default:'pending';check:status IN ('pending','approved','rejected')"`
+	ReviewerID  *uint
+	ReviewNotes string `gorm:"type:text;not null;default:''"`
+}
+
+func initLifetimeRequests() error {
+	err := db.AutoMigrate(&LifetimeRequest{})
+	if err != nil {
+		logger.Error("Failed to migrate LifetimeRequests table", "error", err)
+		return err
+	}
+	return nil
+}
+
+// NewLifetimeRequest creates a pending request. Only one pending request per
+// VM is allowed.
+func NewLifetimeRequest(vmID uint64, userID uint, extendBy uint, justification string) (*LifetimeRequest, error) {
+	lr := &LifetimeRequest{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&LifetimeRequest{}).
+			Where("vm_id = ? AND status = ?", vmID, LifetimeRequestStatusPending).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+
+		lr.VMID = vmID
+		lr.UserID = userID
+		lr.ExtendBy = extendBy
+		lr.Justification = justification
+		lr.Status = LifetimeRequestStatusPending
+		return tx.Create(lr).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+func GetLifetimeRequestByID(id uint) (*LifetimeRequest, error) {
+	var lr LifetimeRequest
+	result := db.First(&lr, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &lr, nil
+}
+
+// GetLifetimeRequests returns all the requests with the given status, or all
+// the requests if status is empty
+func GetLifetimeRequests(status string) ([]LifetimeRequest, error) {
+	var requests []LifetimeRequest
+	result := db.Where(&LifetimeRequest{Status: status}).Order("id DESC").Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func GetLifetimeRequestsByVMID(vmID uint64) ([]LifetimeRequest, error) {
+	var requests []LifetimeRequest
+	result := db.Where(&LifetimeRequest{VMID: vmID}).Order("id DESC").Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+// ApproveLifetimeRequest approves a pending request and extends the lifetime
+// of the VM in the same transaction. ErrNotFound is returned if there is no
+// pending request with the given ID.
+func ApproveLifetimeRequest(id uint, reviewerID uint, notes string) (*LifetimeRequest, error) {
+	return reviewLifetimeRequest(id, LifetimeRequestStatusApproved, reviewerID, notes)
+}
+
+// RejectLifetimeRequest rejects a pending request. ErrNotFound is returned if
+// there is no pending request with the given ID.
+func RejectLifetimeRequest(id uint, reviewerID uint, notes string) (*LifetimeRequest, error) {
+	return reviewLifetimeRequest(id, LifetimeRequestStatusRejected, reviewerID, notes)
+}
+
+func reviewLifetimeRequest(id uint, status string, reviewerID uint, notes string) (*LifetimeRequest, error) {
+	var lr LifetimeRequest
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ? AND status = ?", id, LifetimeRequestStatusPending).First(&lr).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if status == LifetimeRequestStatusApproved {
+			var vm VM
+			if err := tx.First(&vm, lr.VMID).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					return ErrNotFound
+				}
+				return err
+			}
+			newLifetime := vm.LifeTime.AddDate(0, int(lr.ExtendBy), 0)
+			if err := tx.Model(&vm).Update("life_time", newLifetime).Error; err != nil {
+				return err
+			}
+			if err := deleteVMExpirationNotifications(tx, vm.ID); err != nil {
+				return err
+			}
+		}
+
+		lr.Status = status
+		lr.ReviewerID = &reviewerID
+		lr.ReviewNotes = notes
+		return tx.Model(&lr).
+			Select("status", "reviewer_id", "review_notes").
+			Updates(&lr).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
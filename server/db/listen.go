@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Sasso instances notify each other on this channel when something changes
+// that the worker should handle, so the worker of every instance wakes up
+// without waiting for the next cycle.
+const workerChannel = "sasso_worker"
+
+var (
+	dsn string = ""
+
+	// instanceID identifies the notifications sent by this instance, which
+	// are ignored by its listener
+	instanceID string = newInstanceID()
+)
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NotifyWorker notifies the workers of the other instances
+func NotifyWorker() error {
+	return db.Exec("SELECT pg_notify(?, ?)", workerChannel, instanceID).Error
+}
+
+// ListenWorkerNotifications calls f every time another instance notifies the
+// workers. It reconnects to the database on errors and returns when ctx is
+// done.
+func ListenWorkerNotifications(ctx context.Context, f func()) {
+	for {
+		err := listenWorkerNotifications(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("Failed to listen for worker notifications, reconnecting", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func listenWorkerNotifications(ctx context.Context, f func()) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+workerChannel); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Payload == instanceID {
+			continue
+		}
+		f()
+	}
+}
@@ -0,0 +1,56 @@
+package db
+
+import "time"
+
+// Maintenance holds the state of the maintenance mode. There is always a
+// single row in the table.
+type Maintenance struct {
+	ID        uint `gorm:"primaryKey"`
+	UpdatedAt time.Time
+
+	Enabled bool   `gorm:"not null;default:false"`
+	Message string `gorm:"type:text;not null;default:''"`
+	// True if the maintenance was enabled by the config and not by an admin
+	FromConfig bool `gorm:"not null;default:false"`
+}
+
+func initMaintenance() error {
+	err := db.AutoMigrate(&Maintenance{})
+	if err != nil {
+		logger.Error("Failed to migrate Maintenance table", "error", err)
+		return err
+	}
+
+	err = db.FirstOrCreate(&Maintenance{}, Maintenance{ID: 1}).Error
+	if err != nil {
+		logger.Error("Failed to initialize maintenance state", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetMaintenance() (*Maintenance, error) {
+	var m Maintenance
+	if err := db.First(&m, 1).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance saves the maintenance state set by an admin
+func SetMaintenance(enabled bool, message string) error {
+	return db.Model(&Maintenance{ID: 1}).
+		Updates(map[string]interface{}{"enabled": enabled, "message": message, "from_config": false}).Error
+}
+
+// SetMaintenanceFromConfig applies the maintenance state of the config at
+// boot. When the config disables it, only a maintenance enabled by the config
+// is ended, the one enabled by an admin is kept.
+func SetMaintenanceFromConfig(enabled bool, message string) error {
+	if enabled {
+		return db.Model(&Maintenance{ID: 1}).
+			Updates(map[string]interface{}{"enabled": true, "message": message, "from_config": true}).Error
+	}
+	return db.Model(&Maintenance{}).Where("id = ? AND from_config", 1).
+		Updates(map[string]interface{}{"enabled": false, "message": "", "from_config": false}).Error
+}
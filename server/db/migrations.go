@@ -0,0 +1,155 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	MigrationStatusPending   = "pending"
+	MigrationStatusMigrating = "migrating"
+	MigrationStatusCompleted = "completed"
+	MigrationStatusFailed    = "failed"
+)
+
+// Migration is an admin request to move a VM to another node. The worker
+// executes the pending ones. If TargetNode is empty the worker chooses the
+// node with the placement strategy.
+type Migration struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	VMID       uint64 `gorm:"not null;index"`
+	SourceNode string `gorm:"type:varchar(64);not null"`
+	TargetNode string `gorm:"type:varchar(64);not null;default:''"`
+	Online     bool   `gorm:"not null;default:false"`
+	// Drain is true if the migration was created while draining SourceNode
+	Drain bool `gorm:"not null;default:false"`
+
+	Status string `gorm:"type:varchar(20);not null;default:'pending';check:status IN ('pending','migrating','completed','failed')"`
+	Error  string `gorm:"type:text;not null;default:''"`
+
+	// Proxmox task of the running migration
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+}
+
+func initMigrations() error {
+	err := db.AutoMigrate(&Migration{})
+	if err != nil {
+		logger.Error("Failed to migrate Migrations table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func NewMigration(vmID uint64, sourceNode, targetNode string, drain bool) (*Migration, error) {
+	m := &Migration{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&Migration{}).
+			Where("vm_id = ? AND status IN ?", vmID, []string{MigrationStatusPending, MigrationStatusMigrating}).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyExists
+		}
+
+		m.VMID = vmID
+		m.SourceNode = sourceNode
+		m.TargetNode = targetNode
+		m.Drain = drain
+		m.Status = MigrationStatusPending
+		return tx.Create(m).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func GetMigrationByID(id uint) (*Migration, error) {
+	var m Migration
+	result := db.First(&m, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &m, nil
+}
+
+func GetAllMigrations() ([]Migration, error) {
+	var migrations []Migration
+	result := db.Order("id DESC").Find(&migrations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return migrations, nil
+}
+
+func GetMigrationsWithStatus(status string) ([]Migration, error) {
+	var migrations []Migration
+	result := db.Where(&Migration{Status: status}).Order("id ASC").Find(&migrations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return migrations, nil
+}
+
+// GetVMIDsWithActiveMigration returns the IDs of the VMs with a pending or
+// running migration
+func GetVMIDsWithActiveMigration() ([]uint64, error) {
+	var ids []uint64
+	err := db.Model(&Migration{}).
+		Where("status IN ?", []string{MigrationStatusPending, MigrationStatusMigrating}).
+		Pluck("vm_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func IsVMMigrating(vmID uint64) (bool, error) {
+	var count int64
+	err := db.Model(&Migration{}).
+		Where("vm_id = ? AND status IN ?", vmID, []string{MigrationStatusPending, MigrationStatusMigrating}).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GetDrainingNodes returns the nodes that still have drain migrations to
+// complete
+func GetDrainingNodes() ([]string, error) {
+	var nodes []string
+	err := db.Model(&Migration{}).
+		Distinct("source_node").
+		Where("drain = true AND status IN ?", []string{MigrationStatusPending, MigrationStatusMigrating}).
+		Pluck("source_node", &nodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func UpdateMigrationStatus(id uint, status, errMsg string) error {
+	return db.Model(&Migration{ID: id}).
+		Updates(map[string]interface{}{"status": status, "error": errMsg}).Error
+}
+
+func UpdateMigrationTarget(id uint, targetNode string, online bool) error {
+	return db.Model(&Migration{ID: id}).
+		Updates(map[string]interface{}{"target_node": targetNode, "online": online}).Error
+}
+
+// SetMigrationTask saves the Proxmox task of the running migration
+func SetMigrationTask(id uint, upid string) error {
+	return db.Model(&Migration{ID: id}).Update("task_upid", upid).Error
+}
@@ -1,13 +1,16 @@
 package db
 
+import "time"
+
 type Net struct {
 	ID        uint  `gorm:"primaryKey"`
 	CreatedAt int64 `gorm:"autoCreateTime"`
 	UpdatedAt int64 `gorm:"autoUpdateTime"`
 
 	Name      string `gorm:"uniqueIndex;not null"`
-	Alias     string `gorm:"not null"`             // For users
-	Zone      string `gorm:"not null"`             // Should be "sasso"
+	Alias     string `gorm:"not null"` // For users
+	Zone      string `gorm:"not null"` // SDN zone of the cluster
+	Cluster   string `gorm:"type:varchar(64);not null;default:'';index"`
 	Tag       uint32 `gorm:"not null;uniqueIndex"` // Unique tag for the network
 	VlanAware bool   `gorm:"not null;default:false"`
 
@@ -17,6 +20,12 @@ type Net struct {
 
 	Status string `gorm:"type:varchar(20);not null;default:'unknown';check:status IN ('unknown','pending','ready','reconfiguring','creating','deleting','pre-creating','pre-deleting')"`
 
+	// Last error of the worker on the net, the number of failed attempts and
+	// when the next attempt is made. They are reset when an attempt succeeds
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
 	OwnerID   uint   `gorm:"not null;index"`
 	OwnerType string `gorm:"not null;index"`
 
@@ -151,11 +160,12 @@ func IsAddressAGatewayOrBroadcast(address string) (bool, error) {
 
 // This function only creates a network for a user in the DB. It does
 // not create the network in Proxmox
-func CreateNetForUser(userID uint, name, alias, zone string, tag uint32, vlanAware bool, status string) (*Net, error) {
+func CreateNetForUser(userID uint, name, alias, cluster, zone string, tag uint32, vlanAware bool, status string) (*Net, error) {
 
 	net := &Net{
 		Name:      string(name[:]),
 		Alias:     alias,
+		Cluster:   cluster,
 		Zone:      zone,
 		Tag:       tag,
 		VlanAware: vlanAware,
@@ -176,11 +186,12 @@ func CreateNetForUser(userID uint, name, alias, zone string, tag uint32, vlanAwa
 
 // This function only creates a network for a group in the DB. It does
 // not create the network in Proxmox
-func CreateNetForGroup(groupID uint, name, alias, zone string, tag uint32, vlanAware bool, status string) (*Net, error) {
+func CreateNetForGroup(groupID uint, name, alias, cluster, zone string, tag uint32, vlanAware bool, status string) (*Net, error) {
 
 	net := &Net{
 		Name:      string(name[:]),
 		Alias:     alias,
+		Cluster:   cluster,
 		Zone:      zone,
 		Tag:       tag,
 		VlanAware: vlanAware,
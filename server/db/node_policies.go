@@ -0,0 +1,114 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	NodePolicyAllow = "allow"
+	NodePolicyDeny  = "deny"
+)
+
+// NodePolicy restricts the Proxmox nodes where the VMs of a realm or a group
+// can be placed. If a realm or a group has at least one 'allow' policy, only
+// the allowed nodes are used. 'deny' policies always remove a node.
+type NodePolicy struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Cluster of the node. If empty the policy applies to the nodes with this
+	// name in every cluster
+	Cluster string `gorm:"type:varchar(64);not null;default:''"`
+	Node    string `gorm:"type:varchar(64);not null"`
+	Action  string `gorm:"type:varchar(10);not null;check:action IN ('allow','deny')"`
+
+	OwnerID   uint   `gorm:"not null;index"`
+	OwnerType string `gorm:"not null;index"`
+}
+
+func initNodePolicies() error {
+	err := db.AutoMigrate(&NodePolicy{})
+	if err != nil {
+		logger.Error("Failed to migrate NodePolicies table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetAllNodePolicies() ([]NodePolicy, error) {
+	var policies []NodePolicy
+	result := db.Order("id ASC").Find(&policies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policies, nil
+}
+
+func GetNodePoliciesByRealmID(realmID uint) ([]NodePolicy, error) {
+	return getNodePoliciesByOwner(realmID, "Realm")
+}
+
+func GetNodePoliciesByGroupID(groupID uint) ([]NodePolicy, error) {
+	return getNodePoliciesByOwner(groupID, "Group")
+}
+
+func getNodePoliciesByOwner(ownerID uint, ownerType string) ([]NodePolicy, error) {
+	var policies []NodePolicy
+	result := db.Where(&NodePolicy{OwnerID: ownerID, OwnerType: ownerType}).Find(&policies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policies, nil
+}
+
+func NewNodePolicyForRealm(realmID uint, cluster, node, action string) (*NodePolicy, error) {
+	return newNodePolicy(realmID, "Realm", cluster, node, action)
+}
+
+func NewNodePolicyForGroup(groupID uint, cluster, node, action string) (*NodePolicy, error) {
+	return newNodePolicy(groupID, "Group", cluster, node, action)
+}
+
+func newNodePolicy(ownerID uint, ownerType, cluster, node, action string) (*NodePolicy, error) {
+	var count int64
+	err := db.Model(&NodePolicy{}).
+		Where("owner_id = ? AND owner_type = ? AND cluster = ? AND node = ?", ownerID, ownerType, cluster, node).
+		Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAlreadyExists
+	}
+
+	policy := &NodePolicy{
+		Cluster:   cluster,
+		Node:      node,
+		Action:    action,
+		OwnerID:   ownerID,
+		OwnerType: ownerType,
+	}
+	result := db.Create(policy)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return policy, nil
+}
+
+func DeleteNodePolicy(id uint) error {
+	result := db.Delete(&NodePolicy{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func deleteNodePoliciesByOwnerTransaction(tx *gorm.DB, ownerID uint, ownerType string) error {
+	return tx.Where(&NodePolicy{OwnerID: ownerID, OwnerType: ownerType}).Delete(&NodePolicy{}).Error
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PersonalToken is a long lived token of a user for the endpoints used by
+// scripts, like the inventory. Only the hash of the token is stored.
+type PersonalToken struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	UserID    uint   `gorm:"not null;index"`
+	Name      string `gorm:"type:varchar(64);not null"`
+	TokenHash string `gorm:"type:varchar(64);not null;uniqueIndex"`
+
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+func initPersonalTokens() error {
+	if err := db.AutoMigrate(&PersonalToken{}); err != nil {
+		logger.Error("Failed to migrate personal tokens table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetPersonalTokensByUserID(userID uint) ([]PersonalToken, error) {
+	var tokens []PersonalToken
+	if err := db.Where("user_id = ?", userID).Order("id ASC").Find(&tokens).Error; err != nil {
+		logger.Error("Failed to get personal tokens", "userID", userID, "error", err)
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func GetPersonalTokenByHash(hash string) (*PersonalToken, error) {
+	var token PersonalToken
+	if err := db.Where("token_hash = ?", hash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to get personal token by hash", "error", err)
+		return nil, err
+	}
+	return &token, nil
+}
+
+func NewPersonalToken(token *PersonalToken) error {
+	if err := db.Create(token).Error; err != nil {
+		logger.Error("Failed to create personal token", "userID", token.UserID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func DeletePersonalToken(userID, id uint) error {
+	result := db.Where("user_id = ? AND id = ?", userID, id).Delete(&PersonalToken{})
+	if result.Error != nil {
+		logger.Error("Failed to delete personal token", "userID", userID, "tokenID", id, "error", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdatePersonalTokenLastUsed does not fail the request that uses the token,
+// so the error is only logged
+func UpdatePersonalTokenLastUsed(id uint) error {
+	return db.Model(&PersonalToken{ID: id}).UpdateColumn("last_used_at", time.Now()).Error
+}
@@ -100,6 +100,15 @@ func GetPortForwardsByUserID(userID uint) ([]PortForward, error) {
 	return pfs, nil
 }
 
+func GetPortForwardsByOwner(ownerID uint, ownerType string) ([]PortForward, error) {
+	var pfs []PortForward
+	if err := db.Where(&PortForward{OwnerID: ownerID, OwnerType: ownerType}).Find(&pfs).Error; err != nil {
+		logger.Error("Failed to get port forwards for owner", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	}
+	return pfs, nil
+}
+
 func AddPortForwardForUser(outPort, destPort uint16, destIP, subnet string, userID uint) (*PortForward, error) {
 	return addPortForwardForOwner(outPort, destPort, destIP, subnet, userID, "User")
 }
@@ -132,6 +141,21 @@ func addPortForwardForOwner(outPort, destPort uint16, destIP, subnet string, own
 	return pf, nil
 }
 
+// UpdatePortForwardDest changes the destination of a port forward, keeping
+// its out port
+func UpdatePortForwardDest(pfID uint, destPort uint16, destIP string, vnetID uint) error {
+	err := db.Model(&PortForward{}).Where("id = ?", pfID).Updates(map[string]interface{}{
+		"dest_port": destPort,
+		"dest_ip":   destIP,
+		"v_net_id":  vnetID,
+	}).Error
+	if err != nil {
+		logger.Error("Failed to update port forward destination", "pfID", pfID, "error", err)
+		return err
+	}
+	return nil
+}
+
 func UpdatePortForwardApproval(pfID uint, approve bool) error {
 	if err := db.Model(&PortForward{}).Where("id = ?", pfID).Update("approved", approve).Error; err != nil {
 		logger.Error("Failed to update port forward approval", "pfID", pfID, "error", err)
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	QuotaRequestStatusPending           = "pending"
+	QuotaRequestStatusApproved          = "approved"
+	QuotaRequestStatusPartiallyApproved = "partially_approved"
+	QuotaRequestStatusDenied            = "denied"
+	QuotaRequestStatusReverted          = "reverted"
+)
+
+// QuotaRequest is a request for more resources made by a user for itself or
+// by a group admin for a group. The resources are increments over the current
+// limits. If ExpiresAt is set, the granted resources are removed once it is
+// reached.
+type QuotaRequest struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	RequesterID uint   `gorm:"not null;index"`
+	OwnerID     uint   `gorm:"not null;index"`
+	OwnerType   string `gorm:"type:varchar(20);not null;check:owner_type IN ('User','Group')"`
+
+	Cores     uint   `gorm:"not null;default:0"`
+	RAM       uint   `gorm:"not null;default:0"`
+	Disk      uint   `gorm:"not null;default:0"`
+	Nets      uint   `gorm:"not null;default:0"`
+	Reason    string `gorm:"type:text;not null"`
+	ExpiresAt *time.Time
+
+	Status string `gorm:"type:varchar(20);not null;default:'pending';check:status IN ('pending','approved','partially_approved','denied','reverted')"`
+
+	GrantedCores uint `gorm:"not null;default:0"`
+	GrantedRAM   uint `gorm:"not null;default:0"`
+	GrantedDisk  uint `gorm:"not null;default:0"`
+	GrantedNets  uint `gorm:"not null;default:0"`
+	// GrantedUntil is the expiration chosen by the reviewer. If nil the
+	// increase is permanent
+	GrantedUntil *time.Time `gorm:"index"`
+
+	ReviewerID  *uint
+	ReviewNotes string `gorm:"type:text;not null;default:''"`
+}
+
+func initQuotaRequests() error {
+	err := db.AutoMigrate(&QuotaRequest{})
+	if err != nil {
+		logger.Error("Failed to migrate QuotaRequests table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func NewQuotaRequest(qr *QuotaRequest) error {
+	qr.Status = QuotaRequestStatusPending
+	return db.Create(qr).Error
+}
+
+func GetQuotaRequestByID(id uint) (*QuotaRequest, error) {
+	var qr QuotaRequest
+	result := db.First(&qr, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &qr, nil
+}
+
+// GetQuotaRequests returns all the requests with the given status, or all the
+// requests if status is empty
+func GetQuotaRequests(status string) ([]QuotaRequest, error) {
+	var requests []QuotaRequest
+	result := db.Where(&QuotaRequest{Status: status}).Order("id DESC").Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func GetQuotaRequestsByRequesterID(userID uint) ([]QuotaRequest, error) {
+	var requests []QuotaRequest
+	result := db.Where(&QuotaRequest{RequesterID: userID}).Order("id DESC").Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+// GetExpiredQuotaRequests returns the approved requests with a temporary
+// increase that is expired
+func GetExpiredQuotaRequests() ([]QuotaRequest, error) {
+	var requests []QuotaRequest
+	result := db.Where("status IN ? AND granted_until IS NOT NULL AND granted_until <= ?",
+		[]string{QuotaRequestStatusApproved, QuotaRequestStatusPartiallyApproved}, time.Now()).
+		Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+// ApproveQuotaRequest grants the given resources and applies them to the
+// limits of the owner. If less than what was requested is granted the request
+// is partially approved. ErrNotFound is returned if there is no pending
+// request with the given ID.
+func ApproveQuotaRequest(id, reviewerID uint, cores, ram, disk, nets uint, grantedUntil *time.Time, notes string) (*QuotaRequest, error) {
+	var qr QuotaRequest
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ? AND status = ?", id, QuotaRequestStatusPending).First(&qr).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if cores < qr.Cores || ram < qr.RAM || disk < qr.Disk || nets < qr.Nets {
+			qr.Status = QuotaRequestStatusPartiallyApproved
+		} else {
+			qr.Status = QuotaRequestStatusApproved
+		}
+		qr.GrantedCores = cores
+		qr.GrantedRAM = ram
+		qr.GrantedDisk = disk
+		qr.GrantedNets = nets
+		qr.GrantedUntil = grantedUntil
+		qr.ReviewerID = &reviewerID
+		qr.ReviewNotes = notes
+
+		if err := applyQuotaIncreaseTransaction(tx, &qr, false); err != nil {
+			return err
+		}
+
+		return tx.Model(&qr).
+			Select("status", "granted_cores", "granted_ram", "granted_disk", "granted_nets", "granted_until", "reviewer_id", "review_notes").
+			Updates(&qr).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &qr, nil
+}
+
+// DenyQuotaRequest denies a pending request. ErrNotFound is returned if there
+// is no pending request with the given ID.
+func DenyQuotaRequest(id, reviewerID uint, notes string) (*QuotaRequest, error) {
+	var qr QuotaRequest
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ? AND status = ?", id, QuotaRequestStatusPending).First(&qr).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		qr.Status = QuotaRequestStatusDenied
+		qr.ReviewerID = &reviewerID
+		qr.ReviewNotes = notes
+		return tx.Model(&qr).
+			Select("status", "reviewer_id", "review_notes").
+			Updates(&qr).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &qr, nil
+}
+
+// RevertQuotaRequest removes the granted resources from the limits of the
+// owner. The limits never go below 0.
+func RevertQuotaRequest(id uint) (*QuotaRequest, error) {
+	var qr QuotaRequest
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ? AND status IN ?", id, []string{QuotaRequestStatusApproved, QuotaRequestStatusPartiallyApproved}).
+			First(&qr).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if err := applyQuotaIncreaseTransaction(tx, &qr, true); err != nil {
+			return err
+		}
+
+		return tx.Model(&qr).Update("status", QuotaRequestStatusReverted).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	qr.Status = QuotaRequestStatusReverted
+	return &qr, nil
+}
+
+// applyQuotaIncreaseTransaction adds (or removes, if revert is true) the
+// granted resources to the owner. For users the limits are changed directly,
+// while for groups the resources are assigned by the admin user, as done by
+// UpdateGroupResourceByAdmin.
+func applyQuotaIncreaseTransaction(tx *gorm.DB, qr *QuotaRequest, revert bool) error {
+	if qr.OwnerType == "User" {
+		op := "+"
+		if revert {
+			op = "-"
+		}
+		err := tx.Model(&User{Model: gorm.Model{ID: qr.OwnerID}}).
+			UpdateColumns(map[string]interface{}{
+				"max_cores": gorm.Expr("GREATEST(max_cores "+op+" ?, 0)", qr.GrantedCores),
+				"max_ram":   gorm.Expr("GREATEST(max_ram "+op+" ?, 0)", qr.GrantedRAM),
+				"max_disk":  gorm.Expr("GREATEST(max_disk "+op+" ?, 0)", qr.GrantedDisk),
+				"max_nets":  gorm.Expr("GREATEST(max_nets "+op+" ?, 0)", qr.GrantedNets),
+			}).Error
+		if err != nil {
+			logger.Error("Failed to update user limits", "userID", qr.OwnerID, "error", err)
+			return err
+		}
+		return nil
+	}
+
+	adminID, err := getAdminIDTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	var groupResource GroupResource
+	err = tx.Where(&GroupResource{GroupID: qr.OwnerID, UserID: adminID}).
+		First(&groupResource).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Error("Failed to get group resource by admin", "groupID", qr.OwnerID, "error", err)
+			return err
+		}
+		groupResource = GroupResource{GroupID: qr.OwnerID, UserID: adminID}
+	}
+
+	if revert {
+		groupResource.Cores = subtractOrZero(groupResource.Cores, qr.GrantedCores)
+		groupResource.RAM = subtractOrZero(groupResource.RAM, qr.GrantedRAM)
+		groupResource.Disk = subtractOrZero(groupResource.Disk, qr.GrantedDisk)
+		groupResource.Nets = subtractOrZero(groupResource.Nets, qr.GrantedNets)
+	} else {
+		groupResource.Cores += qr.GrantedCores
+		groupResource.RAM += qr.GrantedRAM
+		groupResource.Disk += qr.GrantedDisk
+		groupResource.Nets += qr.GrantedNets
+	}
+
+	if err := tx.Save(&groupResource).Error; err != nil {
+		logger.Error("Failed to save group resource by admin", "groupID", qr.OwnerID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func subtractOrZero(a, b uint) uint {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+func deleteQuotaRequestsByGroupTransaction(tx *gorm.DB, groupID uint) error {
+	return tx.Where("owner_id = ? AND owner_type = ?", groupID, "Group").Delete(&QuotaRequest{}).Error
+}
@@ -1,6 +1,10 @@
 package db
 
-import "gorm.io/gorm"
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
 
 var (
 	LocalRealmType = "local"
@@ -89,6 +93,9 @@ func AddLDAPRealm(realm LDAPRealm) error {
 func GetRealmByID(id uint) (*Realm, error) {
 	var realm Realm
 	if err := db.First(&realm, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
 		logger.Error("Failed to find realm by ID", "realmID", id, "error", err)
 		return nil, err
 	}
@@ -116,6 +123,21 @@ func DeleteRealmByID(id uint) error {
 			return err
 		}
 
+		if err := deleteNodePoliciesByOwnerTransaction(tx, id, "Realm"); err != nil {
+			logger.Error("Failed to delete realm node policies", "realmID", id, "error", err)
+			return err
+		}
+
+		if err := deleteLifetimePoliciesByRealmTransaction(tx, id); err != nil {
+			logger.Error("Failed to delete realm lifetime policies", "realmID", id, "error", err)
+			return err
+		}
+
+		if err := deleteIdlePoliciesByRealmTransaction(tx, id); err != nil {
+			logger.Error("Failed to delete realm idle policies", "realmID", id, "error", err)
+			return err
+		}
+
 		logger.Debug("Realm deleted successfully", "realmID", id)
 		return nil
 	})
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+)
+
+// failedAttemptUpdates returns the columns updated when an attempt of the
+// worker on an object fails
+func failedAttemptUpdates(status, lastError string, attempts uint, nextRetryAt *time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"status":        status,
+		"last_error":    lastError,
+		"attempts":      attempts,
+		"next_retry_at": nextRetryAt,
+	}
+}
+
+// failedTaskAttemptUpdates is like failedAttemptUpdates, but it also clears
+// the Proxmox task of the object, as it's not running anymore
+func failedTaskAttemptUpdates(status, lastError string, attempts uint, nextRetryAt *time.Time) map[string]interface{} {
+	updates := failedAttemptUpdates(status, lastError, attempts, nextRetryAt)
+	updates["task_upid"] = ""
+	updates["task_node"] = ""
+	return updates
+}
+
+var resetAttemptsUpdates = map[string]interface{}{
+	"last_error":    "",
+	"attempts":      0,
+	"next_retry_at": nil,
+}
+
+// SetVMFailedAttempt saves a failed attempt of the worker on a VM. If
+// nextRetryAt is nil the VM is not retried anymore
+func SetVMFailedAttempt(vmID uint64, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&VM{ID: vmID}).Updates(failedTaskAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetVMAttempts(vmID uint64) error {
+	return db.Model(&VM{ID: vmID}).UpdateColumns(resetAttemptsUpdates).Error
+}
+
+// SetContainerFailedAttempt saves a failed attempt of the worker on a
+// container. If nextRetryAt is nil the container is not retried anymore
+func SetContainerFailedAttempt(id uint64, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&Container{ID: id}).Updates(failedTaskAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetContainerAttempts(id uint64) error {
+	return db.Model(&Container{ID: id}).UpdateColumns(resetAttemptsUpdates).Error
+}
+
+// SetInterfaceFailedAttempt saves a failed attempt of the worker on an
+// interface. If nextRetryAt is nil the interface is not retried anymore
+func SetInterfaceFailedAttempt(id uint, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&Interface{}).Where("id = ?", id).Updates(failedTaskAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetInterfaceAttempts(id uint) error {
+	return db.Model(&Interface{}).Where("id = ?", id).UpdateColumns(resetAttemptsUpdates).Error
+}
+
+// SetNetFailedAttempt saves a failed attempt of the worker on a net. If
+// nextRetryAt is nil the net is not retried anymore
+func SetNetFailedAttempt(id uint, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&Net{ID: id}).Updates(failedAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetNetAttempts(id uint) error {
+	return db.Model(&Net{ID: id}).UpdateColumns(resetAttemptsUpdates).Error
+}
+
+// SetBackupRequestFailedAttempt saves a failed attempt of the worker on a
+// backup request. If nextRetryAt is nil the request is not retried anymore
+func SetBackupRequestFailedAttempt(id uint, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&BackupRequest{ID: id}).Updates(failedTaskAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetBackupRequestAttempts(id uint) error {
+	return db.Model(&BackupRequest{ID: id}).UpdateColumns(resetAttemptsUpdates).Error
+}
+
+// SetStackFailedAttempt saves a failed attempt of the worker to apply a
+// stack. If nextRetryAt is nil the stack is not retried anymore
+func SetStackFailedAttempt(id uint, status, lastError string, attempts uint, nextRetryAt *time.Time) error {
+	return db.Model(&Stack{ID: id}).Updates(failedAttemptUpdates(status, lastError, attempts, nextRetryAt)).Error
+}
+
+func ResetStackAttempts(id uint) error {
+	return db.Model(&Stack{ID: id}).UpdateColumns(resetAttemptsUpdates).Error
+}
@@ -17,6 +17,10 @@ type Setting struct {
 	MailUserInvitationNotification       bool `gorm:"not null;default:true"`
 	MailUserRemovalFromGroupNotification bool `gorm:"not null;default:true"`
 	MailLifetimeOfVMExpiredNotification  bool `gorm:"not null;default:true"`
+	MailRequestReviewedNotification      bool `gorm:"not null;default:true"`
+	MailNewRequestNotification           bool `gorm:"not null;default:true"`
+	MailVMIdleNotification               bool `gorm:"not null;default:true"`
+	MailOperationFailedNotification      bool `gorm:"not null;default:true"`
 
 	TelegramPortForwardNotification          bool `gorm:"not null;default:true"`
 	TelegramVMStatusUpdateNotification       bool `gorm:"not null;default:true"`
@@ -28,6 +32,10 @@ type Setting struct {
 	TelegramUserInvitationNotification       bool `gorm:"not null;default:true"`
 	TelegramUserRemovalFromGroupNotification bool `gorm:"not null;default:true"`
 	TelegramLifetimeOfVMExpiredNotification  bool `gorm:"not null;default:true"`
+	TelegramRequestReviewedNotification      bool `gorm:"not null;default:true"`
+	TelegramNewRequestNotification           bool `gorm:"not null;default:true"`
+	TelegramVMIdleNotification               bool `gorm:"not null;default:true"`
+	TelegramOperationFailedNotification      bool `gorm:"not null;default:true"`
 }
 
 func initSettings() error {
@@ -65,6 +73,10 @@ func createDefaultSettingsForUserTransaction(tx *gorm.DB, userID uint) error {
 		MailUserInvitationNotification:       true,
 		MailUserRemovalFromGroupNotification: true,
 		MailLifetimeOfVMExpiredNotification:  true,
+		MailRequestReviewedNotification:      true,
+		MailNewRequestNotification:           true,
+		MailVMIdleNotification:               true,
+		MailOperationFailedNotification:      true,
 
 		TelegramPortForwardNotification:          true,
 		TelegramVMStatusUpdateNotification:       true,
@@ -76,6 +88,10 @@ func createDefaultSettingsForUserTransaction(tx *gorm.DB, userID uint) error {
 		TelegramUserInvitationNotification:       true,
 		TelegramUserRemovalFromGroupNotification: true,
 		TelegramLifetimeOfVMExpiredNotification:  true,
+		TelegramRequestReviewedNotification:      true,
+		TelegramNewRequestNotification:           true,
+		TelegramVMIdleNotification:               true,
+		TelegramOperationFailedNotification:      true,
 	}
 
 	if err := tx.Create(&setting).Error; err != nil {
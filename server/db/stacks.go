@@ -0,0 +1,214 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Stack is a declarative description of nets, VMs, interfaces and port
+// forwards of a user or a group. The worker applies the document until the
+// resources of the owner match it.
+type Stack struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Name string `gorm:"type:varchar(64);not null;uniqueIndex:idx_stack_owner_name"`
+	// Document as received, in YAML or JSON
+	Document string `gorm:"type:text;not null"`
+
+	Status string `gorm:"type:varchar(20);not null;default:'applying';check:status IN ('applying','applied','failed','pre-deleting')"`
+
+	// User that applied the stack last. The resources are created with the
+	// permissions of this user
+	AppliedBy uint `gorm:"not null"`
+
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
+	OwnerID   uint   `gorm:"not null;uniqueIndex:idx_stack_owner_name"`
+	OwnerType string `gorm:"not null;uniqueIndex:idx_stack_owner_name"`
+
+	Resources []StackResource `gorm:"foreignKey:StackID;constraint:OnDelete:CASCADE"`
+}
+
+// StackResource links a resource created by a stack to its key in the
+// document
+type StackResource struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	StackID uint   `gorm:"not null;uniqueIndex:idx_stack_resource_key"`
+	Kind    string `gorm:"type:varchar(20);not null;uniqueIndex:idx_stack_resource_key;check:kind IN ('net','vm','interface','port_forward')"`
+	Key     string `gorm:"type:varchar(128);not null;uniqueIndex:idx_stack_resource_key"`
+
+	ResourceID uint64 `gorm:"not null"`
+}
+
+func initStacks() error {
+	if err := db.AutoMigrate(&Stack{}, &StackResource{}); err != nil {
+		logger.Error("Failed to migrate stacks tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+// GetStacksByUserID returns the stacks of the user and of the groups of the
+// user
+func GetStacksByUserID(userID uint) ([]Stack, error) {
+	var stacks []Stack
+	err := db.Where("owner_type = ? AND owner_id = ?", "User", userID).
+		Or("owner_type = ? AND owner_id IN (?)", "Group", db.Model(&UserGroup{}).Select("group_id").Where("user_id = ?", userID)).
+		Order("id ASC").
+		Find(&stacks).Error
+	if err != nil {
+		logger.Error("Failed to get stacks by user ID", "userID", userID, "error", err)
+		return nil, err
+	}
+	return stacks, nil
+}
+
+func GetStackByID(id uint) (*Stack, error) {
+	var stack Stack
+	if err := db.First(&stack, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to get stack by ID", "stackID", id, "error", err)
+		return nil, err
+	}
+	return &stack, nil
+}
+
+func GetStackByOwnerAndName(ownerID uint, ownerType, name string) (*Stack, error) {
+	var stack Stack
+	err := db.Where(&Stack{OwnerID: ownerID, OwnerType: ownerType, Name: name}).First(&stack).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to get stack by owner and name", "ownerID", ownerID, "ownerType", ownerType, "name", name, "error", err)
+		return nil, err
+	}
+	return &stack, nil
+}
+
+func GetStacksWithStates(states []string) ([]Stack, error) {
+	var stacks []Stack
+	if err := db.Where("status IN ?", states).Order("id ASC").Find(&stacks).Error; err != nil {
+		logger.Error("Failed to get stacks with states", "states", states, "error", err)
+		return nil, err
+	}
+	return stacks, nil
+}
+
+// SaveStackDocument creates the stack or replaces the document of the
+// existing one with the same owner and name. The stack is applied again by
+// the worker.
+func SaveStackDocument(ownerID uint, ownerType, name, document string, appliedBy uint, status string) (*Stack, error) {
+	stack := &Stack{
+		Name:      name,
+		Document:  document,
+		Status:    status,
+		AppliedBy: appliedBy,
+		OwnerID:   ownerID,
+		OwnerType: ownerType,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing Stack
+		err := tx.Where(&Stack{OwnerID: ownerID, OwnerType: ownerType, Name: name}).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(stack).Error
+		} else if err != nil {
+			return err
+		}
+
+		if existing.Status == "pre-deleting" {
+			return ErrAlreadyExists
+		}
+
+		stack.ID = existing.ID
+		stack.CreatedAt = existing.CreatedAt
+		updates := map[string]interface{}{
+			"document":   document,
+			"status":     status,
+			"applied_by": appliedBy,
+		}
+		for k, v := range resetAttemptsUpdates {
+			updates[k] = v
+		}
+		return tx.Model(&existing).Updates(updates).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrAlreadyExists) {
+			logger.Error("Failed to save stack", "ownerID", ownerID, "ownerType", ownerType, "name", name, "error", err)
+		}
+		return nil, err
+	}
+	return stack, nil
+}
+
+func UpdateStackStatus(id uint, status string) error {
+	if err := db.Model(&Stack{ID: id}).Update("status", status).Error; err != nil {
+		logger.Error("Failed to update stack status", "stackID", id, "status", status, "error", err)
+		return err
+	}
+	return nil
+}
+
+// SetStackDeleting sets the stack to the status of deletion. The resources
+// are deleted with the rights of the user that deletes the stack.
+func SetStackDeleting(id uint, status string, appliedBy uint) error {
+	updates := map[string]interface{}{
+		"status":     status,
+		"applied_by": appliedBy,
+	}
+	for k, v := range resetAttemptsUpdates {
+		updates[k] = v
+	}
+	if err := db.Model(&Stack{ID: id}).Updates(updates).Error; err != nil {
+		logger.Error("Failed to set stack deleting", "stackID", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+func DeleteStackByID(id uint) error {
+	if err := db.Delete(&Stack{}, id).Error; err != nil {
+		logger.Error("Failed to delete stack", "stackID", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetStackResources(stackID uint) ([]StackResource, error) {
+	var resources []StackResource
+	if err := db.Where("stack_id = ?", stackID).Order("id ASC").Find(&resources).Error; err != nil {
+		logger.Error("Failed to get stack resources", "stackID", stackID, "error", err)
+		return nil, err
+	}
+	return resources, nil
+}
+
+// SetStackResource links the resource to the key of the stack, replacing a
+// previous link with the same key
+func SetStackResource(stackID uint, kind, key string, resourceID uint64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("stack_id = ? AND kind = ? AND key = ?", stackID, kind, key).Delete(&StackResource{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&StackResource{StackID: stackID, Kind: kind, Key: key, ResourceID: resourceID}).Error
+	})
+}
+
+func DeleteStackResource(id uint) error {
+	if err := db.Delete(&StackResource{}, id).Error; err != nil {
+		logger.Error("Failed to delete stack resource", "stackResourceID", id, "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Template is a private template made from a VM. It can only be used by its
+// owner as the clone source of new VMs. The template has a VMID in the same
+// range of the VMs of the owner.
+type Template struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	VMID        uint64 `gorm:"not null;uniqueIndex"`
+	Name        string `gorm:"type:varchar(20);not null"`
+	Description string `gorm:"type:text;not null;default:''"`
+	Disk        uint   `gorm:"not null"`
+	Cluster     string `gorm:"type:varchar(64);not null;default:'';index"`
+	Node        string `gorm:"type:varchar(64);not null;default:''"`
+	Status      string `gorm:"type:varchar(20);not null;check:status IN ('pre-creating','copying','creating','ready','pre-deleting','deleting','unknown')"`
+
+	// Proxmox task running on the template and the node where it runs. They
+	// are empty when no task is tracked
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+	TaskNode string `gorm:"type:varchar(64);not null;default:''"`
+
+	// VM the template was made from. If Convert is true the VM itself is
+	// turned into the template, otherwise it's copied
+	SourceVMID uint64 `gorm:"not null"`
+	Convert    bool   `gorm:"not null;default:false"`
+
+	OwnerID   uint   `gorm:"not null;index"`
+	OwnerType string `gorm:"not null;index"`
+}
+
+func initTemplates() error {
+	err := db.AutoMigrate(&Template{})
+	if err != nil {
+		logger.Error("Failed to migrate Templates table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetTemplateByID(id uint) (*Template, error) {
+	var template Template
+	result := db.First(&template, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &template, nil
+}
+
+func GetTemplatesByUserID(userID uint) ([]Template, error) {
+	return getTemplatesByOwner(userID, "User")
+}
+
+func GetTemplatesByGroupID(groupID uint) ([]Template, error) {
+	return getTemplatesByOwner(groupID, "Group")
+}
+
+func getTemplatesByOwner(ownerID uint, ownerType string) ([]Template, error) {
+	var templates []Template
+	result := db.Where(&Template{OwnerID: ownerID, OwnerType: ownerType}).
+		Order("id ASC").
+		Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return templates, nil
+}
+
+func GetTemplatesWithStatus(status string) ([]Template, error) {
+	var templates []Template
+	result := db.Where("status = ?", status).Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return templates, nil
+}
+
+func GetTemplatesWithStates(states []string) ([]Template, error) {
+	var templates []Template
+	result := db.Where("status IN ?", states).Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return templates, nil
+}
+
+func GetTemplatesWithTask() ([]Template, error) {
+	var templates []Template
+	result := db.Where("task_upid <> ''").Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return templates, nil
+}
+
+// SetTemplateTask updates the status of the template together with the
+// tracked Proxmox task. Empty upid and node stop the tracking
+func SetTemplateTask(id uint, status, upid, node string) error {
+	return db.Model(&Template{ID: id}).Updates(map[string]interface{}{
+		"status":    status,
+		"task_upid": upid,
+		"task_node": node,
+	}).Error
+}
+
+func CountTemplatesByGroupID(groupID uint) (int64, error) {
+	var count int64
+	result := db.Model(&Template{}).Where(&Template{OwnerID: groupID, OwnerType: "Group"}).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
+
+func ExistsTemplateWithOwnerAndName(ownerID uint, ownerType, name string) (bool, error) {
+	var count int64
+	result := db.Model(&Template{}).
+		Where(&Template{OwnerID: ownerID, OwnerType: ownerType, Name: name}).
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+// NewTemplate creates the template. If the VM is converted, it's kept in the
+// given status until the template is ready, as its interfaces and its disk
+// still belong to it.
+func NewTemplate(template *Template, convertingStatus string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if template.Convert {
+			result := tx.Model(&VM{ID: template.SourceVMID}).Update("status", convertingStatus)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrNotFound
+			}
+		}
+		return tx.Create(template).Error
+	})
+}
+
+// CompleteTemplate sets the template as ready on the node. If the VM was
+// converted, it's deleted in the same transaction, as its VMID now belongs to
+// the template.
+func CompleteTemplate(template *Template, node, status string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if template.Convert {
+			if err := tx.Delete(&VM{}, template.SourceVMID).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&Template{ID: template.ID}).Updates(map[string]interface{}{
+			"node":      node,
+			"status":    status,
+			"task_upid": "",
+			"task_node": "",
+		}).Error
+	})
+}
+
+// RevertTemplateConversion deletes a template whose conversion failed and
+// gives the VM back the status. If ifaceStatus is not empty, the interfaces of
+// the VM are set to it, as they were removed for the template.
+func RevertTemplateConversion(template *Template, vmStatus, ifaceStatus string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Template{}, template.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&VM{ID: template.SourceVMID}).Update("status", vmStatus).Error; err != nil {
+			return err
+		}
+		if ifaceStatus == "" {
+			return nil
+		}
+		return tx.Model(&Interface{}).Where("vm_id = ?", template.SourceVMID).Update("status", ifaceStatus).Error
+	})
+}
+
+func UpdateTemplateStatus(id uint, status string) error {
+	return db.Model(&Template{ID: id}).Update("status", status).Error
+}
+
+func UpdateTemplateNode(id uint, node string) error {
+	return db.Model(&Template{ID: id}).Update("node", node).Error
+}
+
+func DeleteTemplateByID(id uint) error {
+	return db.Delete(&Template{}, id).Error
+}
+
+// CountVMsUsingTemplate counts the VMs cloned from a template. If onlyCreating
+// is true only the VMs still being created are counted.
+func CountVMsUsingTemplate(templateID uint, onlyCreating bool) (int64, error) {
+	tx := db.Model(&VM{}).Where("template_id = ?", templateID)
+	if onlyCreating {
+		tx = tx.Where("status IN ?", []string{"pre-creating", "creating"})
+	}
+
+	var count int64
+	if err := tx.Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func getTemplatesDiskByOwner(ownerID uint, ownerType string) (uint, error) {
+	var disk uint
+	// The disk of a VM being converted is still counted with the VMs
+	err := db.Model(&Template{}).
+		Select("COALESCE(SUM(disk), 0)").
+		Where(&Template{OwnerID: ownerID, OwnerType: ownerType}).
+		Where(`NOT ("convert" AND status IN ?)`, []string{"pre-creating", "copying", "creating"}).
+		Scan(&disk).Error
+	if err != nil {
+		return 0, err
+	}
+	return disk, nil
+}
+
+func getTemplatesVMIDsByOwner(ownerID uint, ownerType string) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&Template{}).
+		Where(&Template{OwnerID: ownerID, OwnerType: ownerType}).
+		Pluck("vm_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UsageRecord is the resource usage of a VM between two samples of the
+// worker. Records are kept after the VM is deleted, so the name and the owner
+// are copied.
+type UsageRecord struct {
+	ID   uint      `gorm:"primaryKey"`
+	Time time.Time `gorm:"not null;index"`
+
+	VMID      uint64 `gorm:"not null;index"`
+	VMName    string `gorm:"type:varchar(20);not null"`
+	OwnerID   uint   `gorm:"not null;index"`
+	OwnerType string `gorm:"not null;index"`
+
+	// Cores and RAM are counted only while the VM is running, the disk is
+	// always allocated
+	CoreHours  float64 `gorm:"column:core_hours;not null;default:0"`
+	RAMGBHours float64 `gorm:"column:ram_gb_hours;not null;default:0"`
+	DiskGBDays float64 `gorm:"column:disk_gb_days;not null;default:0"`
+}
+
+// UsageSummary is the usage summed over a period. Depending on the report the
+// usage is grouped by VM or by owner.
+type UsageSummary struct {
+	VMID       uint64
+	VMName     string
+	OwnerID    uint
+	OwnerType  string
+	CoreHours  float64 `gorm:"column:core_hours"`
+	RAMGBHours float64 `gorm:"column:ram_gb_hours"`
+	DiskGBDays float64 `gorm:"column:disk_gb_days"`
+}
+
+func initUsageRecords() error {
+	err := db.AutoMigrate(&UsageRecord{})
+	if err != nil {
+		logger.Error("Failed to migrate UsageRecords table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func NewUsageRecords(records []UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return db.Create(&records).Error
+}
+
+// GetLastUsageRecordTime returns the time of the last sample, or the zero
+// time if there are no samples
+func GetLastUsageRecordTime() (time.Time, error) {
+	var record UsageRecord
+	err := db.Order("time DESC").First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return record.Time, nil
+}
+
+func usageInPeriod(from, to time.Time) *gorm.DB {
+	return db.Model(&UsageRecord{}).
+		Where("usage_records.time >= ? AND usage_records.time < ?", from, to)
+}
+
+// GetUsageByUserID returns the usage of the VMs of a user, grouped by VM
+func GetUsageByUserID(userID uint, from, to time.Time) ([]UsageSummary, error) {
+	return getUsageByOwner(userID, "User", from, to)
+}
+
+// GetUsageByGroupID returns the usage of the VMs of a group, grouped by VM
+func GetUsageByGroupID(groupID uint, from, to time.Time) ([]UsageSummary, error) {
+	return getUsageByOwner(groupID, "Group", from, to)
+}
+
+func getUsageByOwner(ownerID uint, ownerType string, from, to time.Time) ([]UsageSummary, error) {
+	var usage []UsageSummary
+	err := usageInPeriod(from, to).
+		Select("vm_id, MAX(vm_name) AS vm_name, owner_id, owner_type, SUM(core_hours) AS core_hours, SUM(ram_gb_hours) AS ram_gb_hours, SUM(disk_gb_days) AS disk_gb_days").
+		Where("owner_id = ? AND owner_type = ?", ownerID, ownerType).
+		Group("vm_id, owner_id, owner_type").
+		Order("vm_id ASC").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// GetUsageByRealmID returns the usage of the VMs of the users of a realm,
+// grouped by user
+func GetUsageByRealmID(realmID uint, from, to time.Time) ([]UsageSummary, error) {
+	var usage []UsageSummary
+	err := usageInPeriod(from, to).
+		Select("owner_id, owner_type, SUM(core_hours) AS core_hours, SUM(ram_gb_hours) AS ram_gb_hours, SUM(disk_gb_days) AS disk_gb_days").
+		Joins("JOIN users ON users.id = usage_records.owner_id").
+		Where("usage_records.owner_type = ? AND users.realm_id = ?", "User", realmID).
+		Group("owner_id, owner_type").
+		Order("owner_id ASC").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
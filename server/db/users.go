@@ -259,6 +259,17 @@ func getAdminIDTransaction(tx *gorm.DB) (uint, error) {
 	return adminID, nil
 }
 
+// GetUserIDsByRole returns the IDs of all the users with the given role
+func GetUserIDsByRole(role UserRole) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&User{}).Where("role = ?", role).Pluck("id", &ids).Error
+	if err != nil {
+		logger.Error("Failed to get user IDs by role", "role", role, "error", err)
+		return nil, err
+	}
+	return ids, nil
+}
+
 func GetLocalAdmin() (*User, error) {
 	var admin User
 	err := db.Joins("JOIN realms ON users.realm_id = realms.id").
@@ -12,7 +12,7 @@ type VM struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	Status string `gorm:"type:varchar(20);not null;default:'unknown';check:status IN ('running','stopped','paused','unknown','deleting','creating','pre-deleting','pre-creating','configuring','pre-configuring')"`
+	Status string `gorm:"type:varchar(20);not null;default:'unknown';check:status IN ('running','stopped','paused','hibernated','unknown','deleting','creating','pre-deleting','pre-creating','configuring','pre-configuring','pre-rebuilding','rebuilding','converting')"`
 
 	Name  string `gorm:"type:varchar(20);not null"`
 	Notes string `gorm:"type:text;not null;default:''"`
@@ -24,11 +24,51 @@ type VM struct {
 
 	IncludeGlobalSSHKeys bool `gorm:"not null"`
 
+	// Proxmox cluster and node where the VM has been placed
+	Cluster string `gorm:"type:varchar(64);not null;default:'';index"`
+	Node    string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Proxmox task running on the VM and the node where it runs. They are
+	// empty when no task is tracked
+	TaskUPID string `gorm:"column:task_upid;type:varchar(128);not null;default:''"`
+	TaskNode string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Last error of the worker on the VM, the number of failed attempts and
+	// when the next attempt is made. They are reset when an attempt succeeds
+	LastError   string `gorm:"type:text;not null;default:''"`
+	Attempts    uint   `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
+	// Private template the VM was cloned from, nil for the default template
+	TemplateID *uint `gorm:"index"`
+
+	// The VM is never stopped by the idle detection
+	IdleStopOptOut bool `gorm:"not null;default:false"`
+	// When the VM was first seen idle, nil if it's not idle
+	IdleSince *time.Time
+	// When the owner was warned that the VM is idle
+	IdleWarnedAt *time.Time
+
+	// Last time the worker failed to stop the VM after its lifetime expired
+	LifetimeStopFailedAt *time.Time
+
+	// Catalog template used for a pending rebuild. Empty for the default
+	// template
+	RebuildTemplate string `gorm:"type:varchar(64);not null;default:''"`
+
+	// Proxmox VM cloned to create the VM when it's imported with a new VMID.
+	// It's deleted from Proxmox when the clone completes, and ImportTaskUPID
+	// tracks the deletion
+	ImportedFromVMID *uint64 `gorm:"column:imported_from_vm_id"`
+	ImportTaskUPID   string  `gorm:"column:import_task_upid;type:varchar(128);not null;default:''"`
+
 	OwnerID   uint   `gorm:"not null;index"`
 	OwnerType string `gorm:"not null;index"`
 
 	Interfaces              []Interface                `gorm:"foreignKey:VMID;constraint:OnDelete:CASCADE"`
 	ExpirationNotifications []VMExpirationNotification `gorm:"foreignKey:VMID;constraint:OnDelete:CASCADE"`
+	LifetimeRequests        []LifetimeRequest          `gorm:"foreignKey:VMID;constraint:OnDelete:CASCADE"`
+	Labels                  []VMLabel                  `gorm:"foreignKey:VMID;constraint:OnDelete:CASCADE"`
 }
 
 func initVMs() error {
@@ -77,17 +117,18 @@ func existsVMWithOwnerIdAndName(ownerID uint, ownerType, name string) (bool, err
 	return count > 0, nil
 }
 
-func NewVMForUser(ID uint64, userID uint, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool) (*VM, error) {
-	return newvm(ID, userID, "User", status, name, notes, cores, ram, disk, lifeTime, includeGlobalSSHKeys)
+func NewVMForUser(ID uint64, userID uint, cluster, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool, templateID *uint) (*VM, error) {
+	return newvm(ID, userID, "User", cluster, status, name, notes, cores, ram, disk, lifeTime, includeGlobalSSHKeys, templateID)
 }
 
-func NewVMForGroup(ID uint64, groupID uint, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool) (*VM, error) {
-	return newvm(ID, groupID, "Group", status, name, notes, cores, ram, disk, lifeTime, includeGlobalSSHKeys)
+func NewVMForGroup(ID uint64, groupID uint, cluster, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool, templateID *uint) (*VM, error) {
+	return newvm(ID, groupID, "Group", cluster, status, name, notes, cores, ram, disk, lifeTime, includeGlobalSSHKeys, templateID)
 }
 
-func newvm(ID uint64, ownerID uint, ownerType string, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool) (*VM, error) {
+func newvm(ID uint64, ownerID uint, ownerType string, cluster, status, name, notes string, cores, ram, disk uint, lifeTime time.Time, includeGlobalSSHKeys bool, templateID *uint) (*VM, error) {
 	vm := &VM{
 		ID:                   ID,
+		Cluster:              cluster,
 		Status:               status,
 		Name:                 name,
 		Notes:                notes,
@@ -98,6 +139,7 @@ func newvm(ID uint64, ownerID uint, ownerType string, status, name, notes string
 		IncludeGlobalSSHKeys: includeGlobalSSHKeys,
 		OwnerID:              ownerID,
 		OwnerType:            ownerType,
+		TemplateID:           templateID,
 	}
 	result := db.Create(vm)
 	if result.Error != nil {
@@ -141,6 +183,130 @@ func UpdateVMStatus(vmID uint64, status string) error {
 	return nil
 }
 
+func UpdateVMNameAndNotes(vmID uint64, name, notes string) error {
+	result := db.Model(&VM{ID: vmID}).Updates(map[string]interface{}{
+		"name":  name,
+		"notes": notes,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func UpdateVMIdleStopOptOut(vmID uint64, optOut bool) error {
+	result := db.Model(&VM{ID: vmID}).Updates(map[string]interface{}{
+		"idle_stop_opt_out": optOut,
+		"idle_since":        nil,
+		"idle_warned_at":    nil,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateVMIdleState does not touch updated_at, as it is used to detect recent
+// status changes
+func UpdateVMIdleState(vmID uint64, idleSince, warnedAt *time.Time) error {
+	return db.Model(&VM{ID: vmID}).UpdateColumns(map[string]interface{}{
+		"idle_since":     idleSince,
+		"idle_warned_at": warnedAt,
+	}).Error
+}
+
+// ResetIdleStateOfNotRunningVMs clears the idle state of the VMs that have
+// been stopped in the meantime
+func ResetIdleStateOfNotRunningVMs() error {
+	return db.Model(&VM{}).
+		Where("status <> ? AND idle_since IS NOT NULL", "running").
+		UpdateColumns(map[string]interface{}{
+			"idle_since":     nil,
+			"idle_warned_at": nil,
+		}).Error
+}
+
+// UpdateVMLifetimeStopFailedAt does not touch updated_at, as it is used to
+// detect recent status changes
+func UpdateVMLifetimeStopFailedAt(vmID uint64, t time.Time) error {
+	return db.Model(&VM{ID: vmID}).UpdateColumn("lifetime_stop_failed_at", t).Error
+}
+
+// RebuildVM sets the VM in the rebuild status. The interfaces that were being
+// deleted are removed, all the others are set to ifaceStatus so that the
+// worker creates them again on the new clone.
+func RebuildVM(vmID uint64, status, template, ifaceStatus string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&VM{ID: vmID}).Updates(map[string]interface{}{
+			"status":           status,
+			"rebuild_template": template,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		if err := tx.Where("vm_id = ? AND status IN ?", vmID, []string{"pre-deleting", "deleting"}).
+			Delete(&Interface{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&Interface{}).Where("vm_id = ?", vmID).Update("status", ifaceStatus).Error
+	})
+}
+
+// CompleteVMRebuild sets the status of a rebuilt VM and clears the chosen
+// template
+func CompleteVMRebuild(vmID uint64, status string) error {
+	return db.Model(&VM{ID: vmID}).Updates(map[string]interface{}{
+		"status":           status,
+		"rebuild_template": "",
+		"task_upid":        "",
+		"task_node":        "",
+	}).Error
+}
+
+// SetVMTask updates the status of the VM together with the tracked Proxmox
+// task. Empty upid and node stop the tracking
+func SetVMTask(vmID uint64, status, upid, node string) error {
+	return db.Model(&VM{ID: vmID}).Updates(map[string]interface{}{
+		"status":    status,
+		"task_upid": upid,
+		"task_node": node,
+	}).Error
+}
+
+func GetVMsWithTask() ([]VM, error) {
+	var vms []VM
+	result := db.Where("task_upid <> ''").Find(&vms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return vms, nil
+}
+
+// UpdateVMNode does not touch updated_at, as it is used to detect recent
+// status changes
+func UpdateVMNode(vmID uint64, node string) error {
+	result := db.Model(&VM{ID: vmID}).UpdateColumn("node", node)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return ErrNotFound
+		}
+		return result.Error
+	}
+
+	return nil
+}
+
 func UpdateVMResources(vmID uint64, cores, ram, disk uint) error {
 	result := db.Model(&VM{ID: vmID}).
 		UpdateColumns(VM{Cores: cores, RAM: ram, Disk: disk})
@@ -175,6 +341,55 @@ func getVMByOwnerIDAndVMID(ownerID uint, ownerType string, vmID uint64) (*VM, er
 	return &vm, nil
 }
 
+func GetVMsByNode(node string) ([]VM, error) {
+	var vms []VM
+	result := db.Where(&VM{Node: node}).Find(&vms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return vms, nil
+}
+
+// VMFilter restricts the VMs returned by GetVMsWithFilter. Zero values are
+// ignored.
+type VMFilter struct {
+	OwnerID        uint
+	OwnerType      string
+	Status         string
+	Node           string
+	MinCores       uint
+	MinRAM         uint
+	MinDisk        uint
+	LifetimeBefore *time.Time
+	LifetimeAfter  *time.Time
+}
+
+func GetVMsWithFilter(f VMFilter) ([]VM, error) {
+	tx := db.Where(&VM{OwnerID: f.OwnerID, OwnerType: f.OwnerType, Status: f.Status, Node: f.Node})
+	if f.MinCores > 0 {
+		tx = tx.Where("cores >= ?", f.MinCores)
+	}
+	if f.MinRAM > 0 {
+		tx = tx.Where("ram >= ?", f.MinRAM)
+	}
+	if f.MinDisk > 0 {
+		tx = tx.Where("disk >= ?", f.MinDisk)
+	}
+	if f.LifetimeBefore != nil {
+		tx = tx.Where("life_time < ?", *f.LifetimeBefore)
+	}
+	if f.LifetimeAfter != nil {
+		tx = tx.Where("life_time > ?", *f.LifetimeAfter)
+	}
+
+	var vms []VM
+	result := tx.Order("id ASC").Find(&vms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return vms, nil
+}
+
 func GetVMsWithStatus(status string) ([]VM, error) {
 	var vms []VM
 	result := db.Where(&VM{Status: status}).Find(&vms)
@@ -209,11 +424,11 @@ func GetTimeOfLastCreatedVMWithStates(states []string) (time.Time, error) {
 }
 
 func GetAllActiveVMs() ([]VM, error) {
-	return GetVMsWithStates([]string{"running", "stopped", "paused"})
+	return GetVMsWithStates([]string{"running", "stopped", "paused", "hibernated"})
 }
 
 func GetAllActiveVMsWithUnknown() ([]VM, error) {
-	return GetVMsWithStates([]string{"running", "stopped", "paused", "unknown"})
+	return GetVMsWithStates([]string{"running", "stopped", "paused", "hibernated", "unknown"})
 }
 
 func GetVMResourcesByUserID(userID uint) (uint, uint, uint, error) {
@@ -239,7 +454,19 @@ func getVMResourcesByOwner(ownerID uint, ownerType string) (uint, uint, uint, er
 		return 0, 0, 0, err
 	}
 
-	return result.Cores, result.RAM, result.Disk, nil
+	// Private templates use disk space too
+	templatesDisk, err := getTemplatesDiskByOwner(ownerID, ownerType)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Containers share the limits of the VMs
+	ctCores, ctRAM, ctDisk, err := getContainersResourcesByOwner(ownerID, ownerType, "")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return result.Cores + ctCores, result.RAM + ctRAM, result.Disk + templatesDisk + ctDisk, nil
 }
 
 func GetResourcesActiveVMsByUserID(userID uint) (uint, uint, uint, error) {
@@ -265,7 +492,19 @@ func getResourcesActiveVMsByOwner(ownerID uint, ownerType string) (uint, uint, u
 		return 0, 0, 0, err
 	}
 
-	return result.Cores, result.RAM, result.Disk, nil
+	// Private templates use disk space too
+	templatesDisk, err := getTemplatesDiskByOwner(ownerID, ownerType)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Containers share the limits of the VMs
+	ctCores, ctRAM, ctDisk, err := getContainersResourcesByOwner(ownerID, ownerType, "running")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return result.Cores + ctCores, result.RAM + ctRAM, result.Disk + templatesDisk + ctDisk, nil
 }
 
 func CountVMs() (int64, error) {
@@ -295,16 +534,20 @@ func GetVMsWithLifetimesLessThanAndStatusIN(t time.Time, states []string) ([]VM,
 	return vms, nil
 }
 
+// UpdateVMLifetime sets the lifetime of the VM. The expiration
+// notifications already sent are deleted, so the owner is notified again
+// before the new expiration.
 func UpdateVMLifetime(vmID uint64, newLifetime time.Time) error {
-	result := db.Model(&VM{ID: vmID}).Update("life_time", newLifetime)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			return ErrNotFound
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&VM{ID: vmID}).Update("life_time", newLifetime)
+		if result.Error != nil {
+			if result.Error == gorm.ErrRecordNotFound {
+				return ErrNotFound
+			}
+			return result.Error
 		}
-		return result.Error
-	}
-
-	return nil
+		return deleteVMExpirationNotifications(tx, vmID)
+	})
 }
 
 func GetAllVMsIDsByUserID(userID uint) ([]uint, error) {
@@ -323,7 +566,90 @@ func getAllVMsIDsByOwner(ownerID uint, ownerType string) ([]uint, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ids, nil
+
+	// Private templates and containers have a VMID in the same range
+	templateIDs, err := getTemplatesVMIDsByOwner(ownerID, ownerType)
+	if err != nil {
+		return nil, err
+	}
+	containerIDs, err := getContainersIDsByOwner(ownerID, ownerType)
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, templateIDs...)
+	return append(ids, containerIDs...), nil
+}
+
+// GetAllVMs returns the VMs of every user and group, in every status
+func GetAllVMs() ([]VM, error) {
+	var vms []VM
+	if err := db.Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// GetAllVMIDs returns the IDs of all the VMs, of all the private templates
+// and of the Proxmox VMs that are being imported
+func GetAllVMIDs() ([]uint64, error) {
+	var ids []uint64
+	if err := db.Model(&VM{}).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	var templateIDs []uint64
+	if err := db.Model(&Template{}).Pluck("vm_id", &templateIDs).Error; err != nil {
+		return nil, err
+	}
+
+	var importedIDs []uint64
+	if err := db.Model(&VM{}).Where("imported_from_vm_id IS NOT NULL").Pluck("imported_from_vm_id", &importedIDs).Error; err != nil {
+		return nil, err
+	}
+
+	ids = append(ids, templateIDs...)
+	return append(ids, importedIDs...), nil
+}
+
+// ImportVM creates an imported VM together with its interfaces
+func ImportVM(vm *VM, interfaces []Interface) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(vm).Error; err != nil {
+			return err
+		}
+		for i := range interfaces {
+			interfaces[i].VMID = uint(vm.ID)
+			if err := tx.Create(&interfaces[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetImportedVMs returns the VMs whose original Proxmox VM is not deleted yet
+func GetImportedVMs() ([]VM, error) {
+	var vms []VM
+	result := db.Where("imported_from_vm_id IS NOT NULL").Find(&vms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return vms, nil
+}
+
+// SetVMImportTask saves the task deleting the original VM of an import. Like
+// UpdateVMNode, it does not touch updated_at
+func SetVMImportTask(vmID uint64, upid string) error {
+	return db.Model(&VM{}).Where("id = ?", vmID).UpdateColumn("import_task_upid", upid).Error
+}
+
+// ClearVMImportedFrom is called when the Proxmox VM the VM was imported from
+// has been deleted
+func ClearVMImportedFrom(vmID uint64) error {
+	return db.Model(&VM{}).Where("id = ?", vmID).UpdateColumns(map[string]interface{}{
+		"imported_from_vm_id": nil,
+		"import_task_upid":    "",
+	}).Error
 }
 
 type VMExpirationNotification struct {
@@ -355,7 +681,7 @@ func NewVMExpirationNotification(vmID uint64, daysBefore uint) (*VMExpirationNot
 
 func GetVMExpirationNotificationsByVMID(vmID uint64) ([]VMExpirationNotification, error) {
 	var notifications []VMExpirationNotification
-	result := db.Model(&VMExpirationNotification{VMID: vmID}).Find(&notifications)
+	result := db.Where("vm_id = ?", vmID).Find(&notifications)
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			return nil, ErrNotFound
@@ -365,6 +691,10 @@ func GetVMExpirationNotificationsByVMID(vmID uint64) ([]VMExpirationNotification
 	return notifications, nil
 }
 
+func deleteVMExpirationNotifications(tx *gorm.DB, vmID uint64) error {
+	return tx.Where("vm_id = ?", vmID).Delete(&VMExpirationNotification{}).Error
+}
+
 func CountGroupVMs(groupID uint) (int64, error) {
 	var count int64
 	result := db.Model(&VM{}).Where(&VM{OwnerID: groupID, OwnerType: "Group"}).Count(&count)
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// VMLabel is a free label of a VM, used to group the VMs in the inventory
+type VMLabel struct {
+	VMID  uint64 `gorm:"primaryKey"`
+	Label string `gorm:"type:varchar(32);primaryKey"`
+}
+
+func initVMLabels() error {
+	if err := db.AutoMigrate(&VMLabel{}); err != nil {
+		logger.Error("Failed to migrate VM labels table", "error", err)
+		return err
+	}
+
+	// The labels are deleted with the VM. The labels of the VMs deleted
+	// before the foreign key existed are removed, or it can't be created
+	if !db.Migrator().HasConstraint(&VM{}, "Labels") {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("vm_id NOT IN (?)", tx.Model(&VM{}).Select("id")).Delete(&VMLabel{}).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().CreateConstraint(&VM{}, "Labels")
+		})
+		if err != nil {
+			logger.Error("Failed to create foreign key of VM labels", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func GetVMLabels(vmID uint64) ([]string, error) {
+	var labels []string
+	err := db.Model(&VMLabel{}).Where("vm_id = ?", vmID).Order("label ASC").Pluck("label", &labels).Error
+	if err != nil {
+		logger.Error("Failed to get VM labels", "vmID", vmID, "error", err)
+		return nil, err
+	}
+	return labels, nil
+}
+
+// SetVMLabels replaces the labels of the VM
+func SetVMLabels(vmID uint64, labels []string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("vm_id = ?", vmID).Delete(&VMLabel{}).Error; err != nil {
+			return err
+		}
+		if len(labels) == 0 {
+			return nil
+		}
+
+		rows := make([]VMLabel, len(labels))
+		for i, l := range labels {
+			rows[i] = VMLabel{VMID: vmID, Label: l}
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		logger.Error("Failed to set VM labels", "vmID", vmID, "error", err)
+		return err
+	}
+	return nil
+}
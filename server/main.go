@@ -119,6 +119,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	if c.Maintenance.Enabled {
+		slog.Info("Starting in maintenance mode")
+	}
+	err = db.SetMaintenanceFromConfig(c.Maintenance.Enabled, c.Maintenance.Message)
+	if err != nil {
+		slog.Error("Failed to apply maintenance mode from config", "error", err)
+		os.Exit(1)
+	}
+
 	// Auth
 	authLogger := slog.With("module", "auth")
 	err = auth.Init(authLogger)
@@ -143,15 +152,33 @@ func main() {
 	go proxmox.TestEndpointVersion()
 	go proxmox.TestEndpointClone()
 	go proxmox.TestEndpointNetZone()
-	proxmox.StartWorker()
 
 	// Notifications
 	if c.Notifications.Enabled {
 		notifyLogger := slog.With("module", "notify")
 		err = notify.Init(notifyLogger, c.Notifications)
-		notify.StartWorker()
 	}
 
+	// The API is served by every instance, while the workers run only on the
+	// leader. If the leadership is lost the workers are stopped, and they are
+	// started again on the instance that is elected next.
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		db.RunAsLeader(ctx, func(leaderCtx context.Context) {
+			slog.Info("Starting workers")
+			proxmox.StartWorker()
+			if c.Notifications.Enabled {
+				notify.StartWorker()
+			}
+
+			<-leaderCtx.Done()
+
+			slog.Info("Stopping workers")
+			stopWorkers()
+		})
+	}()
+
 	// API
 	slog.Debug("Initializing API server")
 	apiLogger := slog.With("module", "api")
@@ -174,7 +201,7 @@ func main() {
 	case <-ctx.Done():
 		slog.Info("Received termination signal, shutting down...")
 		var waitGroup sync.WaitGroup
-		waitGroup.Add(3)
+		waitGroup.Add(2)
 
 		go func() {
 			defer waitGroup.Done()
@@ -184,22 +211,10 @@ func main() {
 			}
 		}()
 
+		// The workers are stopped by the leader election when ctx is done
 		go func() {
 			defer waitGroup.Done()
-
-			err = proxmox.ShutdownWorker()
-			if err != nil {
-				slog.Error("Failed to shut down Proxmox worker", "error", err)
-			}
-		}()
-
-		go func() {
-			defer waitGroup.Done()
-
-			err = notify.ShutdownWorker()
-			if err != nil {
-				slog.Error("Failed to shut down notifications worker", "error", err)
-			}
+			<-leaderDone
 		}()
 
 		waitGroup.Wait()
@@ -207,3 +222,28 @@ func main() {
 	slog.Info("Server shut down gracefully")
 	os.Exit(0)
 }
+
+func stopWorkers() {
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+
+	go func() {
+		defer waitGroup.Done()
+
+		err := proxmox.ShutdownWorker()
+		if err != nil {
+			slog.Error("Failed to shut down Proxmox worker", "error", err)
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+
+		err := notify.ShutdownWorker()
+		if err != nil {
+			slog.Error("Failed to shut down notifications worker", "error", err)
+		}
+	}()
+
+	waitGroup.Wait()
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"samuelemusiani/sasso/server/config"
 	"samuelemusiani/sasso/server/db"
+	"strings"
 	"time"
 
 	"github.com/wneessen/go-mail"
@@ -22,7 +23,7 @@ var (
 
 	workerContext    context.Context
 	workerCancelFunc context.CancelFunc
-	workerReturnChan chan error = make(chan error, 1)
+	workerReturnChan chan error = nil
 
 	bucketLimiter24hInstance *bucketLimiter = nil
 	bucketLimiter1mInstance  *bucketLimiter = nil
@@ -73,8 +74,11 @@ func Init(l *slog.Logger, c config.Notifications) error {
 	return nil
 }
 
+// StartWorker starts the worker. It can be started again after
+// ShutdownWorker, for example when this instance is elected as leader again.
 func StartWorker() {
 	workerContext, workerCancelFunc = context.WithCancel(context.Background())
+	workerReturnChan = make(chan error, 1)
 	go func() {
 		workerReturnChan <- worker(workerContext)
 		close(workerReturnChan)
@@ -715,3 +719,284 @@ func SendUserRemovalFromGroupNotification(userID uint, groupName string) error {
 	}
 	return nil
 }
+
+func SendLifetimeRequestReviewedNotification(userID uint, vmName string, approved bool, notes string) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for lifetime request notification", "userID", userID, "error", err)
+		return err
+	}
+
+	outcome := "rejected"
+	if approved {
+		outcome = "approved"
+	}
+
+	t := `Your request to extend the lifetime of the VM "%s" has been %s.`
+	body := fmt.Sprintf(t, vmName, outcome)
+	if notes != "" {
+		body += fmt.Sprintf("\nNotes from the reviewer: %s", notes)
+	}
+
+	n := &notification{
+		UserID:   userID,
+		Subject:  "Lifetime Extension Request Reviewed",
+		Mail:     s.MailRequestReviewedNotification,
+		Telegram: s.TelegramRequestReviewedNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save lifetime request notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendNewQuotaRequestNotificationToAdmins(requester string, target string, reason string) error {
+	admins, err := db.GetUserIDsByRole(db.RoleAdmin)
+	if err != nil {
+		logger.Error("Failed to get admins for new quota request notification", "error", err)
+		return err
+	}
+	for _, userID := range admins {
+		err := SendNewQuotaRequestNotification(userID, requester, target, reason)
+		if err != nil {
+			logger.Error("Failed to send new quota request notification to admin", "userID", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+func SendNewQuotaRequestNotification(userID uint, requester string, target string, reason string) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for new quota request notification", "userID", userID, "error", err)
+		return err
+	}
+
+	t := `The user "%s" has requested more resources for %s.
+Reason: %s
+To review the request please login and navigate to the quota requests section.
+`
+	body := fmt.Sprintf(t, requester, target, reason)
+	n := &notification{
+		UserID:   userID,
+		Subject:  "New Quota Request",
+		Mail:     s.MailNewRequestNotification,
+		Telegram: s.TelegramNewRequestNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save new quota request notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendQuotaRequestReviewedNotification(userID uint, qr *db.QuotaRequest) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for quota request notification", "userID", userID, "error", err)
+		return err
+	}
+
+	var body string
+	switch qr.Status {
+	case db.QuotaRequestStatusDenied:
+		body = "Your request for more resources has been denied."
+	default:
+		t := `Your request for more resources has been %s.
+Granted: %d cores, %d MB of RAM, %d GB of disk, %d nets.`
+		body = fmt.Sprintf(t, strings.ReplaceAll(qr.Status, "_", " "), qr.GrantedCores, qr.GrantedRAM, qr.GrantedDisk, qr.GrantedNets)
+		if qr.GrantedUntil != nil {
+			body += fmt.Sprintf("\nThe resources will be removed on %s.", qr.GrantedUntil.Format(time.DateTime))
+		}
+	}
+	if qr.ReviewNotes != "" {
+		body += fmt.Sprintf("\nNotes from the reviewer: %s", qr.ReviewNotes)
+	}
+
+	n := &notification{
+		UserID:   userID,
+		Subject:  "Quota Request Reviewed",
+		Mail:     s.MailRequestReviewedNotification,
+		Telegram: s.TelegramRequestReviewedNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save quota request notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendQuotaIncreaseRevertedNotificationToGroup(groupID uint, qr *db.QuotaRequest) error {
+	members, err := db.GetUserIDsByGroupID(groupID)
+	if err != nil {
+		logger.Error("Failed to get group members for quota increase reverted notification", "groupID", groupID, "error", err)
+		return err
+	}
+	for _, userID := range members {
+		err := SendQuotaIncreaseRevertedNotification(userID, qr)
+		if err != nil {
+			logger.Error("Failed to send quota increase reverted notification to group member", "groupID", groupID, "userID", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+func SendQuotaIncreaseRevertedNotification(userID uint, qr *db.QuotaRequest) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for quota increase reverted notification", "userID", userID, "error", err)
+		return err
+	}
+
+	t := `A temporary increase of resources has expired and has been removed:
+%d cores, %d MB of RAM, %d GB of disk, %d nets.
+`
+	body := fmt.Sprintf(t, qr.GrantedCores, qr.GrantedRAM, qr.GrantedDisk, qr.GrantedNets)
+	n := &notification{
+		UserID:   userID,
+		Subject:  "Temporary Resources Expired",
+		Mail:     s.MailRequestReviewedNotification,
+		Telegram: s.TelegramRequestReviewedNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save quota increase reverted notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendVMIdleWarningNotificationToGroup(groupID uint, vmName string, idleHours, stopInHours uint) error {
+	members, err := db.GetUserIDsByGroupID(groupID)
+	if err != nil {
+		logger.Error("Failed to get group members for VM idle warning notification", "groupID", groupID, "error", err)
+		return err
+	}
+	for _, userID := range members {
+		err := SendVMIdleWarningNotification(userID, vmName, idleHours, stopInHours)
+		if err != nil {
+			logger.Error("Failed to send VM idle warning notification to group member", "groupID", groupID, "userID", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+func SendVMIdleWarningNotification(userID uint, vmName string, idleHours, stopInHours uint) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for VM idle warning notification", "userID", userID, "error", err)
+		return err
+	}
+
+	t := `Your VM "%s" has been idle for the last %d hours.
+If it stays idle it will be stopped in %d hours.
+If the VM is a server that must keep running, please login and disable the idle stop for it.
+`
+	body := fmt.Sprintf(t, vmName, idleHours, stopInHours)
+	n := &notification{
+		UserID:   userID,
+		Subject:  "VM Idle Warning",
+		Mail:     s.MailVMIdleNotification,
+		Telegram: s.TelegramVMIdleNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save VM idle warning notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendVMIdleStoppedNotificationToGroup(groupID uint, vmName string) error {
+	members, err := db.GetUserIDsByGroupID(groupID)
+	if err != nil {
+		logger.Error("Failed to get group members for VM idle stopped notification", "groupID", groupID, "error", err)
+		return err
+	}
+	for _, userID := range members {
+		err := SendVMIdleStoppedNotification(userID, vmName)
+		if err != nil {
+			logger.Error("Failed to send VM idle stopped notification to group member", "groupID", groupID, "userID", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+func SendVMIdleStoppedNotification(userID uint, vmName string) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for VM idle stopped notification", "userID", userID, "error", err)
+		return err
+	}
+
+	t := `Your VM "%s" has been stopped because it was idle.
+You can start it again at any time.
+`
+	body := fmt.Sprintf(t, vmName)
+	n := &notification{
+		UserID:   userID,
+		Subject:  "Idle VM Stopped",
+		Mail:     s.MailVMIdleNotification,
+		Telegram: s.TelegramVMIdleNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save VM idle stopped notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func SendOperationFailedNotificationToGroup(groupID uint, object, name, operation, lastError string) error {
+	members, err := db.GetUserIDsByGroupID(groupID)
+	if err != nil {
+		logger.Error("Failed to get group members for operation failed notification", "groupID", groupID, "error", err)
+		return err
+	}
+	for _, userID := range members {
+		err := SendOperationFailedNotification(userID, object, name, operation, lastError)
+		if err != nil {
+			logger.Error("Failed to send operation failed notification to group member", "groupID", groupID, "userID", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// SendOperationFailedNotification notifies that sasso gave up on an operation
+// after retrying it, for example the creation of a VM or of a backup
+func SendOperationFailedNotification(userID uint, object, name, operation, lastError string) error {
+	s, err := db.GetSettingsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get user settings for operation failed notification", "userID", userID, "error", err)
+		return err
+	}
+
+	t := `The %s of your %s "%s" failed after several attempts.
+The last error was: %s
+Please contact an administrator if the problem persists.
+`
+	body := fmt.Sprintf(t, operation, object, name, lastError)
+	n := &notification{
+		UserID:   userID,
+		Subject:  "Operation Failed",
+		Mail:     s.MailOperationFailedNotification,
+		Telegram: s.TelegramOperationFailedNotification,
+		Body:     body,
+	}
+	err = n.save()
+	if err != nil {
+		logger.Error("Failed to save operation failed notification", "userID", userID, "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package proxmox
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+// GetAllVMs returns the VMs of every user and group that match the filter.
+// It is meant for admins, so no ownership is checked.
+func GetAllVMs(filter db.VMFilter) ([]VM, error) {
+	dbVMs, err := db.GetVMsWithFilter(filter)
+	if err != nil {
+		logger.Error("Failed to get VMs with filter", "error", err)
+		return nil, err
+	}
+
+	vms := make([]VM, len(dbVMs))
+	for i := range dbVMs {
+		vms[i] = *convertDBVMToVM(&dbVMs[i], nil, nil, nil)
+	}
+	return vms, nil
+}
+
+func getVMForAdmin(vmID uint64) (*db.VM, error) {
+	vm, err := db.GetVMByID(vmID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrVMNotFound
+		}
+		logger.Error("Failed to get VM from database", "vmID", vmID, "error", err)
+		return nil, err
+	}
+	return vm, nil
+}
+
+// AdminChangeVMStatus changes the status of any VM, without checking the
+// owner. VMs in the unknown status can be force stopped.
+func AdminChangeVMStatus(vmID uint64, action string) error {
+	vm, err := getVMForAdmin(vmID)
+	if err != nil {
+		return err
+	}
+
+	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusHibernated)}
+	if action == "stop" {
+		vmStates = append(vmStates, string(VMStatusUnknown))
+	}
+	if !slices.Contains(vmStates, vm.Status) {
+		logger.Warn("VM is not in a valid state for changing status", "vmID", vmID, "status", vm.Status)
+		return ErrInvalidVMState
+	}
+
+	return changeVMStatus(vmID, action, true)
+}
+
+// AdminDeleteVM deletes any VM, without checking the owner. Unlike DeleteVM
+// it can be used on VMs in every state that is not already a deletion.
+func AdminDeleteVM(vmID uint64) error {
+	vm, err := getVMForAdmin(vmID)
+	if err != nil {
+		return err
+	}
+
+	vmStates := []string{string(VMStatusPreDeleting), string(VMStatusDeleting)}
+	if slices.Contains(vmStates, vm.Status) {
+		logger.Warn("VM is already being deleted", "vmID", vmID, "status", vm.Status)
+		return ErrInvalidVMState
+	}
+
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return err
+	} else if migrating {
+		return ErrVMMigrating
+	}
+
+	logger.Info("Admin is force deleting VM", "vmID", vmID, "status", vm.Status)
+	return deleteVMBypass(vmID)
+}
+
+// AdminSetVMLifetime sets the lifetime of a VM, ignoring the lifetime policy
+// of the owner
+func AdminSetVMLifetime(vmID uint64, lifetime time.Time) error {
+	if _, err := getVMForAdmin(vmID); err != nil {
+		return err
+	}
+
+	if err := db.UpdateVMLifetime(vmID, lifetime); err != nil {
+		logger.Error("Failed to update VM lifetime in database", "vmID", vmID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// AdminResetVMStatus forces the status of a VM in the database, for example
+// to recover a VM stuck in the unknown status. The worker keeps reconciling
+// the status with Proxmox afterwards.
+func AdminResetVMStatus(vmID uint64, status VMStatus) error {
+	validStates := []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused}
+	if !slices.Contains(validStates, status) {
+		return errors.Join(ErrInvalidVMParam, errors.New("status must be running, stopped or paused"))
+	}
+
+	vm, err := getVMForAdmin(vmID)
+	if err != nil {
+		return err
+	}
+
+	vmStates := []string{string(VMStatusPreDeleting), string(VMStatusDeleting)}
+	if slices.Contains(vmStates, vm.Status) {
+		logger.Warn("Can't reset the status of a VM being deleted", "vmID", vmID, "status", vm.Status)
+		return ErrInvalidVMState
+	}
+
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return err
+	} else if migrating {
+		return ErrVMMigrating
+	}
+
+	logger.Info("Admin is resetting VM status", "vmID", vmID, "old_status", vm.Status, "new_status", status)
+	if err := db.UpdateVMStatus(vmID, string(status)); err != nil {
+		logger.Error("Failed to update VM status in database", "vmID", vmID, "error", err)
+		return err
+	}
+	return nil
+}
@@ -51,7 +51,7 @@ var (
 	ErrBackupNotesTooLong         = errors.New("backup_notes_too_long")
 )
 
-var goodVMStatesForBackupManipulation = []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused}
+var goodVMStatesForBackupManipulation = []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused, VMStatusHibernated}
 
 func ListBackups(vmID uint64, since time.Time) ([]Backup, error) {
 	vm, err := db.GetVMByID(vmID)
@@ -248,7 +248,12 @@ func RestoreBackup(userID uint, groupID *uint, vmID uint64, backupid string, sin
 }
 
 func listBackups(vmID uint64, since time.Time) (cluster *proxmox.Cluster, node *proxmox.Node, vm *proxmox.VirtualMachine, scontent []*proxmox.StorageContent, err error) {
-	cluster, err = getProxmoxCluster(client)
+	pc, err := getVMClusterByID(vmID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	cluster, err = getProxmoxCluster(pc.client)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -263,12 +268,12 @@ func listBackups(vmID uint64, since time.Time) (cluster *proxmox.Cluster, node *
 		return nil, nil, nil, nil, ErrVMNotFound
 	}
 
-	node, err = getProxmoxNode(client, nodeName)
+	node, err = getProxmoxNode(pc.client, nodeName)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	s, err := getProxmoxStorage(node, cBackup.Storage)
+	s, err := getProxmoxStorage(node, pc.backup.Storage)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -404,7 +409,12 @@ func ProtectBackup(userID, vmID uint64, backupid string, since time.Time, protec
 		return false, ErrPendingBackupRequest
 	}
 
-	s, err := getProxmoxStorage(node, cBackup.Storage)
+	pc, err := getVMCluster(vm)
+	if err != nil {
+		return false, err
+	}
+
+	s, err := getProxmoxStorage(node, pc.backup.Storage)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,254 @@
+package proxmox
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"samuelemusiani/sasso/server/config"
+	"samuelemusiani/sasso/server/db"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+const defaultClusterName = "default"
+
+var (
+	// clusters holds the Proxmox clusters in the order of the config. The
+	// first one is the main cluster
+	clusters []*pveCluster = nil
+
+	ErrClusterNotFound = errors.New("cluster not found")
+)
+
+// pveCluster is a Proxmox cluster managed by sasso. Every cluster has its own
+// templates, SDN zone, backup storage and placement, and it's reconciled by
+// its own worker.
+type pveCluster struct {
+	name   string
+	client *proxmox.Client
+
+	template   *config.ProxmoxTemplate
+	catalog    []config.ProxmoxCatalog
+	targetNode string
+	network    *config.ProxmoxNetwork
+	backup     *config.ProxmoxBackup
+	placement  *config.ProxmoxPlacement
+	container  *config.ProxmoxContainer
+
+	// Minimum disk size in GB of the VMs, read from the template
+	cloneDiskSizeGB atomic.Uint64
+	reachable       atomic.Bool
+
+	pool *taskPool
+	// wakeUp starts a new cycle of the worker of the cluster without waiting
+	// for the periodic one. The buffer coalesces the wake ups received during
+	// a cycle.
+	wakeUp chan struct{}
+
+	// State of the worker, reset when the worker starts
+	vmStatusTimeMap          map[uint64]stringTime
+	vmLastTimePrelaunchMap   map[uint64]time.Time
+	workerStartTime          time.Time
+	lastConfigureSSHKeysTime time.Time
+	untrackedTasksResumed    bool
+	taskStatusErrors         map[string]int
+	lastIdleSampleTime       time.Time
+	lastDriftCheckTime       time.Time
+}
+
+// Cluster is a Proxmox cluster where users can place their VMs and nets
+type Cluster struct {
+	Name      string `json:"name"`
+	Default   bool   `json:"default"`
+	Reachable bool   `json:"reachable"`
+}
+
+func newPVECluster(name, url, tokenID, secret string, insecureSkipVerify bool, maxTasks, maxTasksPerNode int) *pveCluster {
+	if !strings.Contains(url, "api2/json") {
+		if !strings.HasSuffix(url, "/") {
+			url += "/"
+		}
+		url += "api2/json"
+	}
+
+	http_client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: insecureSkipVerify,
+			},
+		},
+	}
+
+	pc := &pveCluster{
+		name: name,
+		client: proxmox.NewClient(url,
+			proxmox.WithHTTPClient(&http_client),
+			proxmox.WithAPIToken(tokenID, secret)),
+		pool:   newTaskPool(maxTasks, maxTasksPerNode),
+		wakeUp: make(chan struct{}, 1),
+	}
+	pc.cloneDiskSizeGB.Store(uint64(defaultCloneDiskSizeGB))
+	pc.reachable.Store(true)
+	pc.resetWorkerState()
+	return pc
+}
+
+func (pc *pveCluster) resetWorkerState() {
+	pc.vmStatusTimeMap = make(map[uint64]stringTime)
+	pc.vmLastTimePrelaunchMap = make(map[uint64]time.Time)
+	pc.workerStartTime = time.Now()
+	pc.lastConfigureSSHKeysTime = time.Time{}
+	pc.untrackedTasksResumed = false
+	pc.taskStatusErrors = make(map[string]int)
+	pc.lastIdleSampleTime = time.Time{}
+	pc.lastDriftCheckTime = time.Time{}
+}
+
+// isMain returns true for the main cluster, whose worker also runs the stages
+// that don't depend on Proxmox
+func (pc *pveCluster) isMain() bool {
+	return pc == clusters[0]
+}
+
+// getCluster returns the cluster with the given name. An empty name is the
+// main cluster.
+func getCluster(name string) (*pveCluster, error) {
+	if name == "" {
+		return clusters[0], nil
+	}
+	for _, pc := range clusters {
+		if pc.name == name {
+			return pc, nil
+		}
+	}
+	return nil, ErrClusterNotFound
+}
+
+// getVMCluster returns the cluster where a VM is placed
+func getVMCluster(v *db.VM) (*pveCluster, error) {
+	pc, err := getCluster(v.Cluster)
+	if err != nil {
+		logger.Error("Cluster of VM is not configured", "vmid", v.ID, "cluster", v.Cluster)
+		return nil, err
+	}
+	return pc, nil
+}
+
+// getVMClusterByID is like getVMCluster, but it loads the VM from the DB
+func getVMClusterByID(vmID uint64) (*pveCluster, error) {
+	v, err := db.GetVMByID(vmID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrVMNotFound
+		}
+		logger.Error("Failed to get VM from database", "vmID", vmID, "error", err)
+		return nil, err
+	}
+	return getVMCluster(v)
+}
+
+// ListClusters returns the clusters where the VMs and the nets can be placed
+func ListClusters() []Cluster {
+	resp := make([]Cluster, len(clusters))
+	for i, pc := range clusters {
+		resp[i] = Cluster{
+			Name:      pc.name,
+			Default:   i == 0,
+			Reachable: pc.reachable.Load(),
+		}
+	}
+	return resp
+}
+
+// ClusterExists reports whether a cluster with the given name is configured
+func ClusterExists(name string) bool {
+	_, err := getCluster(name)
+	return err == nil
+}
+
+// ownerNodePolicies returns the node policies of the realm of the user or of
+// the group
+func ownerNodePolicies(ownerID uint, ownerType string) ([]db.NodePolicy, error) {
+	if ownerType == "Group" {
+		p, err := db.GetNodePoliciesByGroupID(ownerID)
+		if err != nil {
+			logger.Error("Failed to get node policies for group", "groupID", ownerID, "error", err)
+			return nil, err
+		}
+		return p, nil
+	}
+
+	user, err := db.GetUserByID(ownerID)
+	if err != nil {
+		logger.Error("Failed to get VM owner", "userID", ownerID, "error", err)
+		return nil, err
+	}
+	p, err := db.GetNodePoliciesByRealmID(user.RealmID)
+	if err != nil {
+		logger.Error("Failed to get node policies for realm", "realmID", user.RealmID, "error", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// selectClusterForOwner returns the cluster for a new VM or net of a user or
+// a group. If the owner has allow policies only on nodes of some clusters, it
+// can use only those clusters. Without a requested cluster the first one that
+// can be used is chosen.
+func selectClusterForOwner(ownerID uint, ownerType string, requested string) (*pveCluster, error) {
+	policies, err := ownerNodePolicies(ownerID, ownerType)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []string
+	for _, p := range policies {
+		if p.Action != db.NodePolicyAllow {
+			continue
+		}
+		if p.Cluster == "" {
+			// The node can be on any cluster
+			allowed = nil
+			break
+		}
+		allowed = append(allowed, p.Cluster)
+	}
+
+	if requested != "" {
+		pc, err := getCluster(requested)
+		if err != nil {
+			return nil, err
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, pc.name) {
+			return nil, ErrPermissionDenied
+		}
+		return pc, nil
+	}
+
+	for _, pc := range clusters {
+		if len(allowed) == 0 || slices.Contains(allowed, pc.name) {
+			return pc, nil
+		}
+	}
+	return nil, ErrClusterNotFound
+}
+
+// vmIDs returns the IDs of the VMs placed on the cluster
+func (pc *pveCluster) vmIDs() (map[uint64]bool, error) {
+	ids, err := db.GetVMIDsByCluster(pc.name)
+	if err != nil {
+		logger.Error("Failed to get VMs of cluster", "cluster", pc.name, "error", err)
+		return nil, err
+	}
+
+	set := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,992 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+	"github.com/seancfoley/ipaddress-go/ipaddr"
+)
+
+type ContainerStatus string
+
+var (
+	ContainerStatusRunning ContainerStatus = "running"
+	ContainerStatusStopped ContainerStatus = "stopped"
+	ContainerStatusUnknown ContainerStatus = "unknown"
+
+	// The container is created from the CT template of the cluster and then
+	// configured with the resources and the NICs
+	ContainerStatusPreCreating    ContainerStatus = "pre-creating"
+	ContainerStatusCreating       ContainerStatus = "creating"
+	ContainerStatusPreConfiguring ContainerStatus = "pre-configuring"
+
+	ContainerStatusPreDeleting ContainerStatus = "pre-deleting"
+	ContainerStatusDeleting    ContainerStatus = "deleting"
+
+	ErrContainerNotFound    = errors.New("container not found")
+	ErrContainersNotEnabled = errors.New("containers are not enabled on the cluster")
+
+	ctMinRAM  uint = 256 // in MB
+	ctMinDisk uint = 2   // in GB
+
+	// Maximum number of NICs of a container. The unused netX options up to
+	// this index are removed when the container is configured
+	ctMaxInterfaces uint = 8
+
+	// The states where the container can be changed
+	goodContainerStates = []ContainerStatus{ContainerStatusRunning, ContainerStatusStopped}
+)
+
+type Container struct {
+	ID                   uint64     `json:"id"`
+	Status               string     `json:"status"`
+	Name                 string     `json:"name"`
+	Notes                string     `json:"notes"`
+	Cores                uint       `json:"cores"`
+	RAM                  uint       `json:"ram"`
+	Disk                 uint       `json:"disk"`
+	IncludeGlobalSSHKeys bool       `json:"include_global_ssh_keys"`
+	Cluster              string     `json:"cluster"`
+	Node                 string     `json:"node,omitempty"`
+	LastError            string     `json:"last_error,omitempty"`
+	Attempts             uint       `json:"attempts"`
+	NextRetryAt          *time.Time `json:"next_retry_at,omitempty"`
+	OwnerID              uint       `json:"-"`
+	OwnerType            string     `json:"-"`
+
+	GroupID   uint   `json:"group_id,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	// Role in the group of the user requesting the container
+	GroupRole string `json:"group_role,omitempty"`
+}
+
+type ContainerInterface struct {
+	ID      uint   `json:"id"`
+	VNetID  uint   `json:"vnet_id"`
+	VlanTag uint16 `json:"vlan_tag"`
+	IPAdd   string `json:"ip_add"`
+	Gateway string `json:"gateway"`
+}
+
+func convertDBContainer(c *db.Container, group *db.Group, groupRole string) *Container {
+	ct := &Container{
+		ID:                   c.ID,
+		Status:               c.Status,
+		Name:                 c.Name,
+		Notes:                c.Notes,
+		Cores:                c.Cores,
+		RAM:                  c.RAM,
+		Disk:                 c.Disk,
+		IncludeGlobalSSHKeys: c.IncludeGlobalSSHKeys,
+		Cluster:              c.Cluster,
+		Node:                 c.Node,
+		LastError:            c.LastError,
+		Attempts:             c.Attempts,
+		NextRetryAt:          c.NextRetryAt,
+		OwnerID:              c.OwnerID,
+		OwnerType:            c.OwnerType,
+	}
+	if group != nil {
+		ct.GroupID = group.ID
+		ct.GroupName = group.Name
+		ct.GroupRole = groupRole
+	}
+	return ct
+}
+
+func convertDBContainerInterface(iface *db.ContainerInterface) ContainerInterface {
+	return ContainerInterface{
+		ID:      iface.ID,
+		VNetID:  iface.VNetID,
+		VlanTag: iface.VlanTag,
+		IPAdd:   iface.IPAdd,
+		Gateway: iface.Gateway,
+	}
+}
+
+// GetContainersByUserID returns the containers of the user and of the groups
+// of the user
+func GetContainersByUserID(userID uint) ([]Container, error) {
+	dbContainers, err := db.GetContainersByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get containers by user ID", "userID", userID, "error", err)
+		return nil, err
+	}
+
+	containers := make([]Container, len(dbContainers))
+	for i := range dbContainers {
+		containers[i] = *convertDBContainer(&dbContainers[i], nil, "")
+	}
+
+	groups, err := db.GetGroupsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get groups by user ID", "userID", userID, "error", err)
+		return nil, err
+	}
+	for _, g := range groups {
+		gContainers, err := db.GetContainersByGroupID(g.ID)
+		if err != nil {
+			logger.Error("Failed to get containers by group ID", "groupID", g.ID, "error", err)
+			return nil, err
+		}
+		group := &db.Group{ID: g.ID, Name: g.Name}
+		for i := range gContainers {
+			containers = append(containers, *convertDBContainer(&gContainers[i], group, g.Role))
+		}
+	}
+
+	return containers, nil
+}
+
+// GetContainerByID returns the container if it belongs to the user or to a
+// group of the user
+func GetContainerByID(id uint64, userID uint) (*Container, error) {
+	c, err := db.GetContainerByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrContainerNotFound
+		}
+		logger.Error("Failed to get container by ID", "ctID", id, "error", err)
+		return nil, err
+	}
+
+	if c.OwnerType == "User" {
+		if c.OwnerID != userID {
+			return nil, ErrContainerNotFound
+		}
+		return convertDBContainer(c, nil, ""), nil
+	}
+
+	group, err := db.GetGroupByID(c.OwnerID)
+	if err != nil {
+		logger.Error("Failed to get group of container", "groupID", c.OwnerID, "ctID", id, "error", err)
+		return nil, err
+	}
+	role, err := db.GetUserRoleInGroup(userID, group.ID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrContainerNotFound
+		}
+		logger.Error("Failed to get user role in group for container", "userID", userID, "groupID", group.ID, "ctID", id, "error", err)
+		return nil, err
+	}
+	return convertDBContainer(c, group, role), nil
+}
+
+// selectContainerCluster returns the cluster for a new container. Without a
+// requested cluster the first one that the owner can use and that has a CT
+// template is chosen.
+func selectContainerCluster(ownerID uint, ownerType string, requested string) (*pveCluster, error) {
+	if requested != "" {
+		pc, err := selectClusterForOwner(ownerID, ownerType, requested)
+		if err != nil {
+			return nil, err
+		}
+		if pc.container.Template == "" {
+			return nil, ErrContainersNotEnabled
+		}
+		return pc, nil
+	}
+
+	for _, pc := range clusters {
+		if pc.container.Template == "" {
+			continue
+		}
+		_, err := selectClusterForOwner(ownerID, ownerType, pc.name)
+		if errors.Is(err, ErrPermissionDenied) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return pc, nil
+	}
+	return nil, ErrContainersNotEnabled
+}
+
+// NewContainer creates a container in the database. The container is created
+// on Proxmox by the worker and it uses the same limits of the VMs of the
+// owner.
+func NewContainer(userID uint, groupID *uint, name, notes string, cores, ram, disk uint, includeGlobalSSHKeys bool, cluster string) (*Container, error) {
+	if !isValidVMName(name) {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
+	}
+	if cores < vmMinCores {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("cores must be at least 1"))
+	}
+	if ram < ctMinRAM {
+		return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("ram must be at least %d MB", ctMinRAM))
+	}
+	if disk < ctMinDisk {
+		return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("disk must be at least %d GB", ctMinDisk))
+	}
+
+	ownerID, ownerType := userID, "User"
+	var group *db.Group
+	var role string
+	if groupID != nil {
+		var err error
+		group, err = db.GetGroupByID(*groupID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrNotFound
+			}
+			logger.Error("Failed to get group from database", "groupID", *groupID, "error", err)
+			return nil, err
+		}
+		role, err = db.GetUserRoleInGroup(userID, group.ID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrPermissionDenied
+			}
+			logger.Error("Failed to get user role in group", "userID", userID, "groupID", group.ID, "error", err)
+			return nil, err
+		}
+		if role != "admin" && role != "owner" {
+			return nil, ErrPermissionDenied
+		}
+		ownerID, ownerType = group.ID, "Group"
+	}
+
+	// Containers share the name checks and the quota with the VMs
+	m := getOwnerMutex(ownerID, ownerType)
+	m.Lock()
+	defer m.Unlock()
+
+	exists, err := db.ExistsContainerWithOwnerAndName(ownerID, ownerType, name)
+	if err != nil {
+		logger.Error("Failed to check if container name exists", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	} else if exists {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("container name already exists"))
+	}
+
+	pc, err := selectContainerCluster(ownerID, ownerType, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVMQuota(group != nil, ownerID, cores, ram, disk); err != nil {
+		return nil, err
+	}
+
+	// Containers take the next VMID of the owner, like VMs and templates
+	ctID, err := nextVMIDForOwner(group != nil, ownerID)
+	if err != nil {
+		logger.Error("Failed to generate container ID", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	}
+
+	c := &db.Container{
+		ID:                   ctID,
+		Status:               string(ContainerStatusPreCreating),
+		Name:                 name,
+		Notes:                notes,
+		Cores:                cores,
+		RAM:                  ram,
+		Disk:                 disk,
+		IncludeGlobalSSHKeys: includeGlobalSSHKeys,
+		Cluster:              pc.name,
+		OwnerID:              ownerID,
+		OwnerType:            ownerType,
+	}
+	if err := db.NewContainer(c); err != nil {
+		logger.Error("Failed to create container in database", "ctID", ctID, "error", err)
+		return nil, err
+	}
+	return convertDBContainer(c, group, role), nil
+}
+
+// getContainerInGoodState returns the container if it can be changed
+func getContainerInGoodState(id uint64) (*db.Container, error) {
+	c, err := db.GetContainerByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrContainerNotFound
+		}
+		logger.Error("Failed to get container by ID", "ctID", id, "error", err)
+		return nil, err
+	}
+	if !slices.Contains(goodContainerStates, ContainerStatus(c.Status)) {
+		return nil, ErrInvalidVMState
+	}
+	return c, nil
+}
+
+// DeleteContainer sets the container to be deleted by the worker
+func DeleteContainer(id uint64) error {
+	c, err := db.GetContainerByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrContainerNotFound
+		}
+		logger.Error("Failed to get container by ID", "ctID", id, "error", err)
+		return err
+	}
+
+	// A container that can't be reached is deleted too
+	states := append(slices.Clone(goodContainerStates), ContainerStatusUnknown)
+	if !slices.Contains(states, ContainerStatus(c.Status)) {
+		return ErrInvalidVMState
+	}
+
+	if err := db.UpdateContainerStatus(id, string(ContainerStatusPreDeleting)); err != nil {
+		logger.Error("Failed to update container status", "ctID", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateContainerResources changes the resources of the container. The disk
+// can only grow.
+func UpdateContainerResources(id uint64, cores, ram, disk uint) error {
+	c, err := getContainerInGoodState(id)
+	if err != nil {
+		return err
+	}
+
+	if cores < vmMinCores {
+		return errors.Join(ErrInvalidVMParam, errors.New("cores must be at least 1"))
+	}
+	if ram < ctMinRAM {
+		return errors.Join(ErrInvalidVMParam, fmt.Errorf("ram must be at least %d MB", ctMinRAM))
+	}
+	if disk < c.Disk {
+		return errors.Join(ErrInvalidVMParam, errors.New("disk size can only be increased"))
+	}
+
+	m := getOwnerMutex(c.OwnerID, c.OwnerType)
+	m.Lock()
+	defer m.Unlock()
+
+	// The current resources of the container are already counted in the
+	// quota, so only the difference is checked
+	var addCores, addRAM uint
+	if cores > c.Cores {
+		addCores = cores - c.Cores
+	}
+	if ram > c.RAM {
+		addRAM = ram - c.RAM
+	}
+	if err := checkVMQuota(c.OwnerType == "Group", c.OwnerID, addCores, addRAM, disk-c.Disk); err != nil {
+		return err
+	}
+
+	if err := db.UpdateContainerResources(id, cores, ram, disk, string(ContainerStatusPreConfiguring)); err != nil {
+		logger.Error("Failed to update container resources", "ctID", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+// ChangeContainerStatus starts, stops, shuts down or restarts a container
+func ChangeContainerStatus(id uint64, action string) error {
+	c, err := getContainerInGoodState(id)
+	if err != nil {
+		return err
+	}
+
+	var validStates []ContainerStatus
+	switch action {
+	case "start":
+		validStates = []ContainerStatus{ContainerStatusStopped}
+	case "stop", "shutdown", "restart":
+		validStates = []ContainerStatus{ContainerStatusRunning}
+	default:
+		return ErrInvalidVMState
+	}
+	if !slices.Contains(validStates, ContainerStatus(c.Status)) {
+		logger.Warn("Container is not in a valid state for this action", "ctID", id, "action", action, "status", c.Status)
+		return nil
+	}
+
+	pc, err := getCluster(c.Cluster)
+	if err != nil {
+		logger.Error("Cluster of container is not configured", "ctID", id, "cluster", c.Cluster)
+		return err
+	}
+
+	node, err := getProxmoxNode(pc.client, c.Node)
+	if err != nil {
+		return err
+	}
+	ct, err := getProxmoxContainer(node, int(id))
+	if err != nil {
+		return ErrContainerNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	var task *gprox.Task
+	switch action {
+	case "start":
+		task, err = ct.Start(ctx)
+	case "stop":
+		task, err = ct.Stop(ctx)
+	case "shutdown":
+		task, err = ct.Shutdown(ctx, false, 0)
+	case "restart":
+		task, err = ct.Reboot(ctx)
+	}
+	cancel()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to %s container in Proxmox", action), "ctID", id, "node", c.Node, "error", err)
+		return err
+	}
+
+	isSuccessful, err := waitForProxmoxTaskCompletion(context.Background(), task)
+	if err != nil {
+		return err
+	}
+	if !isSuccessful {
+		return ErrTaskFailed
+	}
+
+	status := ContainerStatusRunning
+	if action == "stop" || action == "shutdown" {
+		status = ContainerStatusStopped
+	}
+	if err := db.UpdateContainerStatus(id, string(status)); err != nil {
+		logger.Error("Failed to update container status", "ctID", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+func GetContainerInterfaces(id uint64) ([]ContainerInterface, error) {
+	dbIfaces, err := db.GetContainerInterfaces(id)
+	if err != nil {
+		logger.Error("Failed to get interfaces of container", "ctID", id, "error", err)
+		return nil, err
+	}
+
+	ifaces := make([]ContainerInterface, len(dbIfaces))
+	for i := range dbIfaces {
+		ifaces[i] = convertDBContainerInterface(&dbIfaces[i])
+	}
+	return ifaces, nil
+}
+
+// AddContainerInterface adds a NIC on a VNet to the container. The NICs are
+// applied by the worker when the container is configured.
+func AddContainerInterface(id uint64, net *db.Net, vlanTag uint16, ipAdd, gateway string) (*ContainerInterface, error) {
+	c, err := getContainerInGoodState(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.Cluster != c.Cluster {
+		return nil, errors.Join(ErrInvalidInterfaceConfig, errors.New("vnet is on another cluster than the container"))
+	}
+	if err := InterfacesChecks(net, &Interface{VlanTag: vlanTag, IPAdd: ipAdd, Gateway: gateway}); err != nil {
+		return nil, errors.Join(ErrInvalidInterfaceConfig, err)
+	}
+
+	if gateway != "" {
+		ifaces, err := db.GetContainerInterfaces(id)
+		if err != nil {
+			logger.Error("Failed to get interfaces of container", "ctID", id, "error", err)
+			return nil, err
+		}
+		if slices.ContainsFunc(ifaces, func(i db.ContainerInterface) bool { return i.Gateway != "" }) {
+			return nil, errors.Join(ErrInvalidInterfaceConfig, errors.New("the container already has an interface with a gateway"))
+		}
+	}
+
+	used, err := db.ExistsIPInVNetWithVlanTag(net.ID, vlanTag, ipAdd)
+	if err != nil {
+		return nil, err
+	} else if used {
+		return nil, errors.Join(ErrInvalidInterfaceConfig, errors.New("ip_add is already used in the vnet"))
+	}
+
+	iface := &db.ContainerInterface{
+		ContainerID: id,
+		VNetID:      net.ID,
+		VlanTag:     vlanTag,
+		IPAdd:       ipAdd,
+		Gateway:     gateway,
+	}
+	err = db.NewContainerInterface(iface, ctMaxInterfaces, string(ContainerStatusPreConfiguring))
+	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return nil, ErrMaxNumberOfInterfaces
+		}
+		logger.Error("Failed to add interface to container", "ctID", id, "error", err)
+		return nil, err
+	}
+
+	ci := convertDBContainerInterface(iface)
+	return &ci, nil
+}
+
+func DeleteContainerInterface(id uint64, ifaceID uint) error {
+	if _, err := getContainerInGoodState(id); err != nil {
+		return err
+	}
+
+	err := db.DeleteContainerInterface(id, ifaceID, string(ContainerStatusPreConfiguring))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrInterfaceNotFound
+		}
+		logger.Error("Failed to delete interface of container", "ctID", id, "interfaceID", ifaceID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// containerNetValue returns the netX option of a NIC of a container
+func containerNetValue(iface *db.ContainerInterface, vnet string) string {
+	v := fmt.Sprintf("name=eth%d,bridge=%s,ip=%s", iface.LocalID, vnet, iface.IPAdd)
+	if iface.Gateway != "" {
+		gw := ipaddr.NewIPAddressString(iface.Gateway).GetAddress().WithoutPrefixLen().String()
+		v = fmt.Sprintf("%s,gw=%s", v, gw)
+	}
+	if cClone.EnableFirewall {
+		v += ",firewall=1"
+	}
+	if cClone.MTU.Set && !cClone.MTU.SameAsBridge {
+		v = fmt.Sprintf("%s,mtu=%d", v, cClone.MTU.MTU)
+	}
+	if iface.VlanTag != 0 {
+		v = fmt.Sprintf("%s,tag=%d", v, iface.VlanTag)
+	}
+	return v
+}
+
+// createContainers creates on Proxmox the containers in the 'pre-creating'
+// status from the CT template of the cluster. The SSH keys can be injected in
+// a container only when it's created.
+func createContainers(pc *pveCluster, cluster *gprox.Cluster) {
+	logger.Debug("Creating containers in worker")
+
+	containers, err := db.GetContainersWithStatus(string(ContainerStatusPreCreating))
+	if err != nil {
+		logger.Error("Failed to get containers with 'pre-creating' status", "error", err)
+		return
+	}
+	containers = slices.DeleteFunc(containers, func(c db.Container) bool { return c.Cluster != pc.name })
+
+	if len(containers) == 0 {
+		return
+	}
+	if pc.container.Template == "" {
+		logger.Error("Can't create containers. The CT template of the cluster is not configured", "cluster", pc.name)
+		return
+	}
+
+	candidates, err := getNodeCandidates(pc, cluster)
+	if err != nil {
+		logger.Error("Failed to get placement candidates", "error", err)
+		return
+	}
+
+	run := pc.newStageRun("create_containers")
+	for _, c := range containers {
+		if waitingForRetry(c.NextRetryAt) {
+			continue
+		}
+
+		// The placement only needs the resources and the owner
+		targetNode, err := selectNodeForVM(pc, candidates, &db.VM{
+			ID:        c.ID,
+			Cores:     c.Cores,
+			RAM:       c.RAM,
+			Disk:      c.Disk,
+			OwnerID:   c.OwnerID,
+			OwnerType: c.OwnerType,
+		})
+		if err != nil {
+			if errors.Is(err, ErrNoSuitableNode) {
+				logger.Warn("No suitable node for container, retrying later", "ctid", c.ID, "strategy", pc.placement.Strategy)
+			} else {
+				logger.Error("Failed to select node for container", "ctid", c.ID, "error", err)
+			}
+			continue
+		}
+
+		sshKeys, err := ownerSSHKeys(c.OwnerID, c.OwnerType, c.IncludeGlobalSSHKeys)
+		if err != nil {
+			continue
+		}
+
+		unprivileged := 0
+		if pc.container.Unprivileged {
+			unprivileged = 1
+		}
+		options := []gprox.ContainerOption{
+			{Name: "ostemplate", Value: pc.container.Template},
+			{Name: "hostname", Value: c.Name},
+			{Name: "cores", Value: c.Cores},
+			{Name: "memory", Value: c.RAM},
+			{Name: "rootfs", Value: fmt.Sprintf("%s:%d", pc.container.Storage, c.Disk)},
+			{Name: "unprivileged", Value: unprivileged},
+			{Name: "ssh-public-keys", Value: sshKeys},
+		}
+		if pc.container.Unprivileged {
+			// Needed by systemd in the recent distributions
+			options = append(options, gprox.ContainerOption{Name: "features", Value: "nesting=1"})
+		}
+
+		run.Go(targetNode, c.ID, func() {
+			node, err := getProxmoxNode(pc.client, targetNode)
+			if err != nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := node.NewContainer(ctx, int(c.ID), options...)
+			cancel()
+			if err != nil {
+				containerAttemptFailed(&c, ContainerStatusPreCreating, "creation", err)
+				return
+			}
+			// The task is tracked by pollTasks
+			err = db.SetContainerTask(c.ID, string(ContainerStatusCreating), string(task.UPID), targetNode)
+			if err != nil {
+				logger.Error("Failed to update status of container", "ctid", c.ID, "new_status", ContainerStatusCreating, "err", err)
+			}
+			err = db.UpdateContainerNode(c.ID, targetNode)
+			if err != nil {
+				logger.Error("Failed to update node of container", "ctid", c.ID, "node", targetNode, "err", err)
+			}
+		})
+	}
+	run.Wait()
+}
+
+// configureContainers applies the resources and the NICs of the containers
+// in the 'pre-configuring' status
+func configureContainers(pc *pveCluster, ctNodes map[uint64]string) {
+	logger.Debug("Configuring containers in worker")
+
+	containers, err := db.GetContainersWithStatus(string(ContainerStatusPreConfiguring))
+	if err != nil {
+		logger.Error("Failed to get containers with 'pre-configuring' status", "error", err)
+		return
+	}
+	containers = slices.DeleteFunc(containers, func(c db.Container) bool { return c.Cluster != pc.name })
+
+	run := pc.newStageRun("configure_containers")
+	for _, c := range containers {
+		if waitingForRetry(c.NextRetryAt) {
+			continue
+		}
+		nodeName, ok := ctNodes[c.ID]
+		if !ok {
+			logger.Error("Can't configure container. Not found on cluster resources", "ctid", c.ID)
+			continue
+		}
+		run.Go(nodeName, c.ID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
+			ct, err := getProxmoxContainer(node, int(c.ID))
+			if err != nil {
+				return
+			}
+			logger.Debug("Configuring container", "ctid", c.ID)
+
+			ifaces, err := db.GetContainerInterfaces(c.ID)
+			if err != nil {
+				logger.Error("Failed to get interfaces of container", "ctid", c.ID, "err", err)
+				return
+			}
+
+			options := []gprox.ContainerOption{
+				{Name: "cores", Value: c.Cores},
+				{Name: "memory", Value: c.RAM},
+			}
+			var unused []string
+			for i := range ctMaxInterfaces {
+				idx := slices.IndexFunc(ifaces, func(iface db.ContainerInterface) bool { return iface.LocalID == i })
+				if idx == -1 {
+					unused = append(unused, "net"+strconv.Itoa(int(i)))
+					continue
+				}
+				vnet, err := db.GetNetByID(ifaces[idx].VNetID)
+				if err != nil {
+					logger.Error("Failed to get net of container interface", "ctid", c.ID, "net_id", ifaces[idx].VNetID, "err", err)
+					return
+				}
+				options = append(options, gprox.ContainerOption{
+					Name:  "net" + strconv.Itoa(int(i)),
+					Value: containerNetValue(&ifaces[idx], vnet.Name),
+				})
+			}
+			// Proxmox ignores the options to delete that are not set
+			options = append(options, gprox.ContainerOption{Name: "delete", Value: strings.Join(unused, ",")})
+
+			// The configuration of a container is applied synchronously, so
+			// there is no task to wait for
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			_, err = ct.Config(ctx, options...)
+			cancel()
+			if err != nil {
+				containerAttemptFailed(&c, ContainerStatusPreConfiguring, "configuration", err)
+				return
+			}
+
+			size, err := getSizeFromStorageString(ct.ContainerConfig.RootFS)
+			if err != nil {
+				logger.Error("Failed to parse storage of rootfs", "ctid", c.ID, "rootfs", ct.ContainerConfig.RootFS, "error", err)
+				return
+			}
+			if size < c.Disk {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				t, err := ct.Resize(ctx, "rootfs", fmt.Sprintf("+%dG", c.Disk-size))
+				cancel()
+				if err != nil {
+					containerAttemptFailed(&c, ContainerStatusPreConfiguring, "configuration", err)
+					return
+				}
+				if _, err := waitForProxmoxTaskCompletion(workerContext, t); err != nil {
+					if workerContext.Err() == nil {
+						containerAttemptFailed(&c, ContainerStatusPreConfiguring, "configuration", fmt.Errorf("failed to resize the root filesystem: %w", err))
+					}
+					return
+				}
+			}
+
+			// Like for the VMs, the status before the configuration is not
+			// saved, so the one on Proxmox is used
+			status := ContainerStatusStopped
+			if ct.Status == string(ContainerStatusRunning) {
+				status = ContainerStatusRunning
+			}
+			if err := db.UpdateContainerStatus(c.ID, string(status)); err != nil {
+				logger.Error("Failed to update status of container", "ctid", c.ID, "new_status", status, "err", err)
+			}
+			containerAttemptSucceeded(&c)
+		})
+	}
+	run.Wait()
+}
+
+// deleteContainers deletes from Proxmox the containers in the 'pre-deleting'
+// status
+func deleteContainers(pc *pveCluster, ctNodes map[uint64]string) {
+	logger.Debug("Deleting containers in worker")
+
+	containers, err := db.GetContainersWithStatus(string(ContainerStatusPreDeleting))
+	if err != nil {
+		logger.Error("Failed to get containers with 'pre-deleting' status", "error", err)
+		return
+	}
+	containers = slices.DeleteFunc(containers, func(c db.Container) bool { return c.Cluster != pc.name })
+
+	run := pc.newStageRun("delete_containers")
+	for _, c := range containers {
+		if waitingForRetry(c.NextRetryAt) {
+			continue
+		}
+
+		nodeName, ok := ctNodes[c.ID]
+		if !ok {
+			// If the container is not on Proxmox, it's only deleted from the DB
+			logger.Warn("Container to delete not found on cluster resources", "ctid", c.ID)
+			if err := db.DeleteContainerByID(c.ID); err != nil {
+				logger.Error("Failed to delete container", "ctid", c.ID, "err", err)
+			}
+			continue
+		}
+
+		run.Go(nodeName, c.ID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
+			ct, err := getProxmoxContainer(node, int(c.ID))
+			if err != nil {
+				return
+			}
+
+			if ct.Status == string(ContainerStatusRunning) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				task, err := ct.Stop(ctx)
+				cancel()
+				if err != nil {
+					containerAttemptFailed(&c, ContainerStatusPreDeleting, "deletion", fmt.Errorf("can't stop container: %w", err))
+					return
+				}
+				if _, err := waitForProxmoxTaskCompletion(workerContext, task); err != nil {
+					if workerContext.Err() == nil {
+						containerAttemptFailed(&c, ContainerStatusPreDeleting, "deletion", fmt.Errorf("the stop task failed: %w", err))
+					}
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := ct.Delete(ctx)
+			cancel()
+			if err != nil {
+				containerAttemptFailed(&c, ContainerStatusPreDeleting, "deletion", err)
+				return
+			}
+			// The task is tracked by pollTasks
+			err = db.SetContainerTask(c.ID, string(ContainerStatusDeleting), string(task.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to update status of container", "ctid", c.ID, "new_status", ContainerStatusDeleting, "err", err)
+			}
+		})
+	}
+	run.Wait()
+}
+
+// updateContainers updates the status and the node of the containers in the
+// database from Proxmox
+func updateContainers(pc *pveCluster, cluster *gprox.Cluster) {
+	logger.Debug("Updating containers in worker")
+
+	resources, err := getProxmoxResources(cluster, "vm")
+	if err != nil {
+		return
+	}
+
+	states := []string{string(ContainerStatusRunning), string(ContainerStatusStopped), string(ContainerStatusUnknown)}
+	containers, err := db.GetContainersWithStates(states)
+	if err != nil {
+		logger.Error("Failed to get active containers", "error", err)
+		return
+	}
+
+	found := make(map[uint64]bool)
+	for _, c := range containers {
+		if c.Cluster != pc.name {
+			continue
+		}
+
+		idx := slices.IndexFunc(resources, func(r *gprox.ClusterResource) bool { return r.Type == "lxc" && r.VMID == c.ID })
+		if idx == -1 {
+			continue
+		}
+		r := resources[idx]
+		found[c.ID] = true
+
+		if c.Node != r.Node {
+			if err := db.UpdateContainerNode(c.ID, r.Node); err != nil {
+				logger.Error("Failed to update node of container", "ctid", c.ID, "node", r.Node, "err", err)
+			}
+		}
+
+		status := ContainerStatus(r.Status)
+		if status != ContainerStatusRunning && status != ContainerStatusStopped {
+			status = ContainerStatusUnknown
+		}
+		// Avoid status flapping right after a status change from the APIs
+		if string(status) == c.Status || c.UpdatedAt.After(time.Now().Add(-1*time.Minute)) {
+			continue
+		}
+
+		logger.Warn("Container changed status on Proxmox", "ctid", c.ID, "new_status", status, "old_status", c.Status)
+		if err := db.UpdateContainerStatus(c.ID, string(status)); err != nil {
+			logger.Error("Failed to update status of container", "ctid", c.ID, "new_status", status, "err", err)
+		}
+	}
+
+	for _, c := range containers {
+		if c.Cluster != pc.name || found[c.ID] || c.Status == string(ContainerStatusUnknown) {
+			continue
+		}
+
+		logger.Error("Container not found on Proxmox but is on sasso. Setting status to unknown", "ctid", c.ID, "status", c.Status)
+		if err := db.UpdateContainerStatus(c.ID, string(ContainerStatusUnknown)); err != nil {
+			logger.Error("Failed to update status of container", "ctid", c.ID, "new_status", ContainerStatusUnknown, "err", err)
+		}
+	}
+}
+
+func pollContainerTasks(pc *pveCluster) {
+	containers, err := db.GetContainersWithTask()
+	if err != nil {
+		logger.Error("Failed to get containers with a task", "error", err)
+		return
+	}
+
+	for _, c := range containers {
+		if c.Cluster != pc.name {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, c.TaskUPID)
+		if lost {
+			setContainerTaskResult(c.ID, ContainerStatus(c.Status))
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		logger.Debug("Proxmox task of container completed", "ctid", c.ID, "upid", c.TaskUPID, "successful", successful)
+
+		switch ContainerStatus(c.Status) {
+		case ContainerStatusCreating:
+			if successful {
+				// Cores, RAM and NICs are set by configureContainers
+				setContainerTaskResult(c.ID, ContainerStatusPreConfiguring)
+				containerAttemptSucceeded(&c)
+			} else {
+				containerAttemptFailed(&c, ContainerStatusPreCreating, "creation", errProxmoxTaskFailed(c.TaskUPID, exitStatus))
+			}
+		case ContainerStatusDeleting:
+			if successful {
+				if err := db.DeleteContainerByID(c.ID); err != nil {
+					logger.Error("Failed to delete container", "ctid", c.ID, "err", err)
+				}
+			} else {
+				containerAttemptFailed(&c, ContainerStatusPreDeleting, "deletion", errProxmoxTaskFailed(c.TaskUPID, exitStatus))
+			}
+		default:
+			setContainerTaskResult(c.ID, ContainerStatus(c.Status))
+		}
+	}
+}
+
+// resumeUntrackedContainerTasks is like resumeUntrackedTasks for the
+// containers
+func resumeUntrackedContainerTasks(pc *pveCluster, ctNodes map[uint64]string) {
+	states := []string{string(ContainerStatusCreating), string(ContainerStatusDeleting)}
+	containers, err := db.GetContainersWithStates(states)
+	if err != nil {
+		logger.Error("Failed to get containers in a transient status", "error", err)
+		return
+	}
+
+	for _, c := range containers {
+		if c.TaskUPID != "" || c.Cluster != pc.name {
+			continue
+		}
+
+		_, exists := ctNodes[c.ID]
+		logger.Warn("Container in a transient status without a task", "ctid", c.ID, "status", c.Status, "exists_on_proxmox", exists)
+
+		switch ContainerStatus(c.Status) {
+		case ContainerStatusCreating:
+			if exists {
+				setContainerTaskResult(c.ID, ContainerStatusPreConfiguring)
+			} else {
+				setContainerTaskResult(c.ID, ContainerStatusPreCreating)
+			}
+		case ContainerStatusDeleting:
+			if exists {
+				setContainerTaskResult(c.ID, ContainerStatusPreDeleting)
+			} else if err := db.DeleteContainerByID(c.ID); err != nil {
+				logger.Error("Failed to delete container", "ctid", c.ID, "err", err)
+			}
+		}
+	}
+}
+
+func setContainerTaskResult(id uint64, status ContainerStatus) {
+	if err := db.SetContainerTask(id, string(status), "", ""); err != nil {
+		logger.Error("Failed to update status of container", "ctid", id, "new_status", status, "err", err)
+	}
+}
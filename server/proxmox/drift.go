@@ -0,0 +1,349 @@
+package proxmox
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+const (
+	DriftObjectVM        = "vm"
+	DriftObjectInterface = "interface"
+	DriftObjectSSHKeys   = "ssh_keys"
+)
+
+var (
+	driftObjectTypes = []string{DriftObjectVM, DriftObjectInterface, DriftObjectSSHKeys}
+
+	// Interval between two drift checks and the object types whose drift is
+	// corrected automatically. They are set from the config in Init
+	driftCheckInterval = time.Hour
+	driftAutoCorrect   []string
+
+	vmStatesForDriftCheck = []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused)}
+)
+
+type Drift struct {
+	ID         uint      `json:"id"`
+	Cluster    string    `json:"cluster"`
+	DetectedAt time.Time `json:"detected_at"`
+	ObjectType string    `json:"object_type"`
+	ObjectID   uint64    `json:"object_id"`
+	VMID       uint64    `json:"vm_id"`
+	Field      string    `json:"field"`
+	Expected   string    `json:"expected"`
+	Actual     string    `json:"actual"`
+	Corrected  bool      `json:"corrected"`
+}
+
+// GetDrifts returns the drifts found by the last check
+func GetDrifts() ([]Drift, error) {
+	drifts, err := db.GetDrifts()
+	if err != nil {
+		logger.Error("Failed to get drifts", "error", err)
+		return nil, err
+	}
+
+	resp := make([]Drift, len(drifts))
+	for i, d := range drifts {
+		resp[i] = Drift{
+			ID:         d.ID,
+			Cluster:    d.Cluster,
+			DetectedAt: d.CreatedAt,
+			ObjectType: d.ObjectType,
+			ObjectID:   d.ObjectID,
+			VMID:       d.VMID,
+			Field:      d.Field,
+			Expected:   d.Expected,
+			Actual:     d.Actual,
+			Corrected:  d.Corrected,
+		}
+	}
+	return resp, nil
+}
+
+// checkDrift compares the configuration of the VMs on Proxmox with the DB.
+// configureVMs, configureInterfaces and configureSSHKeys only act when the
+// DB changes, so changes made directly on Proxmox are found only here. The
+// drifts of the enabled object types are corrected by putting the objects
+// back in the status handled by those stages.
+func checkDrift(pc *pveCluster, vmNodes map[uint64]string) {
+	if pc.lastDriftCheckTime.After(time.Now().Add(-driftCheckInterval)) {
+		return
+	}
+
+	logger.Debug("Checking configuration drift in worker")
+
+	vms, err := db.GetVMsWithStates(vmStatesForDriftCheck)
+	if err != nil {
+		logger.Error("Failed to get VMs for drift check", "error", err)
+		return
+	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
+
+	migratingVMs, err := db.GetVMIDsWithActiveMigration()
+	if err != nil {
+		logger.Error("Failed to get VMs with active migration", "error", err)
+		return
+	}
+
+	nets, err := db.GetAllNets()
+	if err != nil {
+		logger.Error("Failed to get nets for drift check", "error", err)
+		return
+	}
+	netsByID := make(map[uint]db.Net, len(nets))
+	for _, n := range nets {
+		netsByID[n.ID] = n
+	}
+
+	var mu sync.Mutex
+	drifts := []db.Drift{}
+
+	run := pc.newStageRun("check_drift")
+	for _, v := range vms {
+		nodeName, ok := vmNodes[v.ID]
+		if !ok || v.TaskUPID != "" || slices.Contains(migratingVMs, v.ID) {
+			continue
+		}
+
+		run.Go(nodeName, v.ID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
+
+			vm, err := getProxmoxVM(node, int(v.ID))
+			if err != nil {
+				return
+			}
+
+			vmDrifts := checkVMDrift(&v, vm)
+			vmDrifts = append(vmDrifts, checkInterfacesDrift(&v, vm, netsByID)...)
+			vmDrifts = append(vmDrifts, checkSSHKeysDrift(&v, vm)...)
+
+			mu.Lock()
+			drifts = append(drifts, vmDrifts...)
+			mu.Unlock()
+		})
+	}
+	run.Wait()
+
+	for i := range drifts {
+		if slices.Contains(driftAutoCorrect, drifts[i].ObjectType) {
+			drifts[i].Corrected = correctDrift(pc, &drifts[i])
+		}
+	}
+
+	if len(drifts) > 0 {
+		logger.Warn("Configuration drift found on Proxmox", "cluster", pc.name, "drifts", len(drifts))
+	}
+
+	if err := db.ReplaceDrifts(pc.name, drifts); err != nil {
+		logger.Error("Failed to save drifts", "error", err)
+		return
+	}
+	if all, err := db.GetDrifts(); err == nil {
+		objectCountSet("drifts", int64(len(all)))
+	}
+
+	pc.lastDriftCheckTime = time.Now()
+}
+
+func checkVMDrift(v *db.VM, vm *gprox.VirtualMachine) []db.Drift {
+	var drifts []db.Drift
+	add := func(field string, expected, actual uint) {
+		drifts = append(drifts, db.Drift{
+			ObjectType: DriftObjectVM,
+			ObjectID:   v.ID,
+			VMID:       v.ID,
+			Field:      field,
+			Expected:   strconv.FormatUint(uint64(expected), 10),
+			Actual:     strconv.FormatUint(uint64(actual), 10),
+		})
+	}
+
+	if vm.VirtualMachineConfig.Cores != int(v.Cores) {
+		add("cores", v.Cores, uint(vm.VirtualMachineConfig.Cores))
+	}
+
+	if uint(vm.VirtualMachineConfig.Memory) != v.RAM {
+		add("ram", v.RAM, uint(vm.VirtualMachineConfig.Memory))
+	}
+
+	scsi0, ok := vm.VirtualMachineConfig.SCSIs["scsi0"]
+	if !ok {
+		logger.Error("Failed to find SCSI0 on VM", "vmid", v.ID)
+		return drifts
+	}
+	size, err := getSizeFromStorageString(scsi0)
+	if err != nil {
+		logger.Error("Failed to parse storage on SCSI0", "vmid", v.ID, "scsi0", scsi0, "error", err)
+		return drifts
+	}
+	if size != v.Disk {
+		add("disk", v.Disk, size)
+	}
+
+	return drifts
+}
+
+func checkInterfacesDrift(v *db.VM, vm *gprox.VirtualMachine, nets map[uint]db.Net) []db.Drift {
+	interfaces, err := db.GetInterfacesByVMID(v.ID)
+	if err != nil {
+		logger.Error("Failed to get interfaces of VM", "vmid", v.ID, "error", err)
+		return nil
+	}
+
+	var drifts []db.Drift
+	add := func(objectID uint64, field, expected, actual string) {
+		drifts = append(drifts, db.Drift{
+			ObjectType: DriftObjectInterface,
+			ObjectID:   objectID,
+			VMID:       v.ID,
+			Field:      field,
+			Expected:   expected,
+			Actual:     actual,
+		})
+	}
+
+	managed := make(map[string]bool)
+	for _, iface := range interfaces {
+		if iface.Status != string(InterfaceStatusReady) {
+			continue
+		}
+
+		name := fmt.Sprintf("net%d", iface.LocalID)
+		managed[name] = true
+
+		vnet, ok := nets[iface.VNetID]
+		if !ok {
+			continue
+		}
+
+		pnet, ok := vm.VirtualMachineConfig.Nets[name]
+		if !ok {
+			add(uint64(iface.ID), "nic", name, "")
+			continue
+		}
+
+		options := parseProxmoxOptions(pnet)
+		if options["bridge"] != vnet.Name {
+			add(uint64(iface.ID), "bridge", vnet.Name, options["bridge"])
+		}
+
+		if vnet.VlanAware {
+			expected := ""
+			if iface.VlanTag != 0 {
+				expected = strconv.Itoa(int(iface.VlanTag))
+			}
+			if options["tag"] != expected {
+				add(uint64(iface.ID), "vlan_tag", expected, options["tag"])
+			}
+		}
+
+		ipconfig := parseProxmoxOptions(vm.VirtualMachineConfig.IPConfigs[fmt.Sprintf("ipconfig%d", iface.LocalID)])
+		if ipconfig["ip"] != iface.IPAdd {
+			add(uint64(iface.ID), "ip", iface.IPAdd, ipconfig["ip"])
+		}
+	}
+
+	// Interfaces added on Proxmox to a sasso net are not in the DB
+	bridges := make(map[string]bool, len(nets))
+	for _, n := range nets {
+		bridges[n.Name] = true
+	}
+	for name, pnet := range vm.VirtualMachineConfig.Nets {
+		if managed[name] {
+			continue
+		}
+		bridge := parseProxmoxOptions(pnet)["bridge"]
+		if bridges[bridge] {
+			add(0, "nic", "", name+" on "+bridge)
+		}
+	}
+
+	return drifts
+}
+
+func checkSSHKeysDrift(v *db.VM, vm *gprox.VirtualMachine) []db.Drift {
+	cloudInitKeys, err := getVMCloudInitSSHKeys(v)
+	if err != nil {
+		return nil
+	}
+	if vm.VirtualMachineConfig.SSHKeys == cloudInitKeys {
+		return nil
+	}
+
+	return []db.Drift{{
+		ObjectType: DriftObjectSSHKeys,
+		ObjectID:   v.ID,
+		VMID:       v.ID,
+		Field:      "sshkeys",
+		Expected:   cloudInitKeys,
+		Actual:     vm.VirtualMachineConfig.SSHKeys,
+	}}
+}
+
+// correctDrift schedules the correction of a drift. It returns false if the
+// drift can't be corrected by the worker.
+func correctDrift(pc *pveCluster, d *db.Drift) bool {
+	var err error
+	switch d.ObjectType {
+	case DriftObjectVM:
+		if d.Field == "disk" {
+			// A disk can only grow
+			expected, _ := strconv.ParseUint(d.Expected, 10, 64)
+			actual, _ := strconv.ParseUint(d.Actual, 10, 64)
+			if actual > expected {
+				return false
+			}
+		}
+		err = db.UpdateVMStatus(d.VMID, string(VMStatusPreConfiguring))
+	case DriftObjectInterface:
+		switch d.Field {
+		case "nic":
+			if d.ObjectID == 0 {
+				// Interfaces unknown to sasso are never removed
+				return false
+			}
+			err = db.UpdateInterfaceStatus(uint(d.ObjectID), string(InterfaceStatusPreCreating))
+		case "vlan_tag", "ip":
+			err = db.UpdateInterfaceStatus(uint(d.ObjectID), string(InterfaceStatusPreConfiguring))
+		default:
+			return false
+		}
+	case DriftObjectSSHKeys:
+		// All the SSH keys are configured again in the next cycle
+		pc.lastConfigureSSHKeysTime = time.Time{}
+	default:
+		return false
+	}
+
+	if err != nil {
+		logger.Error("Failed to correct drift", "vmid", d.VMID, "object_type", d.ObjectType, "object_id", d.ObjectID, "field", d.Field, "error", err)
+		return false
+	}
+	return true
+}
+
+// parseProxmoxOptions parses an option string like
+// "virtio=BC:24:11:64:07:FE,bridge=sasso,tag=7"
+func parseProxmoxOptions(s string) map[string]string {
+	options := make(map[string]string)
+	for opt := range strings.SplitSeq(s, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		options[kv[0]] = kv[1]
+	}
+	return options
+}
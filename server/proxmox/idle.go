@@ -0,0 +1,248 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/notify"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+var (
+	// Interval between two samples of the idle detection
+	idleSampleInterval = 5 * time.Minute
+)
+
+func SetVMIdleStopOptOut(vmID uint64, optOut bool) error {
+	err := db.UpdateVMIdleStopOptOut(vmID, optOut)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrVMNotFound
+		}
+		logger.Error("Failed to update idle stop opt-out of VM", "vmID", vmID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// getIdlePolicy returns the idle policy for the VMs of a user or a group.
+// Group VMs use the default policy.
+func getIdlePolicy(ownerID uint, ownerType string) (*db.IdlePolicy, error) {
+	var realmID *uint
+	if ownerType == "User" {
+		user, err := db.GetUserByID(ownerID)
+		if err != nil {
+			logger.Error("Failed to get user for idle policy", "userID", ownerID, "error", err)
+			return nil, err
+		}
+		realmID = &user.RealmID
+	}
+
+	policy, err := db.GetIdlePolicyForRealm(realmID)
+	if err != nil {
+		logger.Error("Failed to get idle policy", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	}
+	return policy, nil
+}
+
+// idleAverages returns the average CPU usage, in percent, and the average
+// network traffic, in KB/s, of a VM since the given time. The averages are
+// computed from the RRD data of Proxmox, with the smallest timeframe that
+// covers the period.
+func idleAverages(vm *gprox.VirtualMachine, since time.Time) (float64, float64, error) {
+	period := time.Since(since)
+	timeframe := gprox.TimeframeYear
+	switch {
+	case period <= time.Hour:
+		timeframe = gprox.TimeframeHour
+	case period <= 24*time.Hour:
+		timeframe = gprox.TimeframeDay
+	case period <= 7*24*time.Hour:
+		timeframe = gprox.TimeframeWeek
+	case period <= 30*24*time.Hour:
+		timeframe = gprox.TimeframeMonth
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, err := vm.RRDData(ctx, timeframe, gprox.AVERAGE)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) == 0 {
+		return 0, 0, errors.New("no RRD data")
+	}
+
+	var cpu, traffic float64
+	var count int
+	for _, d := range data {
+		if int64(d.Time) < since.Unix() {
+			continue
+		}
+		cpu += d.CPU
+		traffic += d.NetIn + d.NetOut
+		count++
+	}
+	if count == 0 {
+		// The period is shorter than the resolution of the timeframe, so the
+		// last point is used
+		last := data[len(data)-1]
+		cpu, traffic, count = last.CPU, last.NetIn+last.NetOut, 1
+	}
+
+	return cpu / float64(count) * 100, traffic / float64(count) / 1024, nil
+}
+
+// detectIdleVMs checks the running VMs every idleSampleInterval. A VM is idle
+// if its average CPU usage and network traffic over the window of its policy
+// are under the thresholds. The owner of an idle VM is warned, and if the VM
+// is still idle after the grace period it's shut down.
+func detectIdleVMs(pc *pveCluster, cluster *gprox.Cluster) {
+	if time.Since(pc.lastIdleSampleTime) < idleSampleInterval {
+		return
+	}
+	pc.lastIdleSampleTime = time.Now()
+
+	logger.Debug("Detecting idle VMs in worker")
+
+	if err := db.ResetIdleStateOfNotRunningVMs(); err != nil {
+		logger.Error("Failed to reset idle state of not running VMs", "error", err)
+		return
+	}
+
+	resources, err := getProxmoxResources(cluster, "vm")
+	if err != nil {
+		return
+	}
+
+	vms, err := db.GetVMsWithStatus(string(VMStatusRunning))
+	if err != nil {
+		logger.Error("Failed to get VMs with 'running' status", "error", err)
+		return
+	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
+
+	vmMap := make(map[uint64]*db.VM)
+	for i := range vms {
+		vmMap[vms[i].ID] = &vms[i]
+	}
+
+	// The idle policy depends only on the realm of the owner, so it's looked
+	// up once per owner
+	policies := make(map[string]*db.IdlePolicy)
+
+	for _, r := range resources {
+		if r.Type != "qemu" || r.Status != "running" {
+			continue
+		}
+
+		v, ok := vmMap[r.VMID]
+		if !ok {
+			continue
+		}
+
+		key := fmt.Sprintf("%s-%d", v.OwnerType, v.OwnerID)
+		policy, ok := policies[key]
+		if !ok {
+			policy, err = getIdlePolicy(v.OwnerID, v.OwnerType)
+			if err != nil {
+				continue
+			}
+			policies[key] = policy
+		}
+
+		if !policy.Enabled || v.IdleStopOptOut {
+			resetVMIdleState(v)
+			continue
+		}
+
+		// Before the warning the VM must be idle for the whole window, after
+		// it for the whole time since the warning
+		now := time.Now()
+		since := now.Add(-time.Duration(policy.IdleHours) * time.Hour)
+		if v.IdleWarnedAt != nil {
+			since = *v.IdleWarnedAt
+		}
+
+		// A VM restarted during the period has not been idle for all of it
+		if now.Sub(since) > time.Duration(r.Uptime)*time.Second {
+			resetVMIdleState(v)
+			continue
+		}
+
+		node, err := getProxmoxNode(pc.client, r.Node)
+		if err != nil {
+			continue
+		}
+		vmr, err := getProxmoxVM(node, int(v.ID))
+		if err != nil {
+			continue
+		}
+		cpu, traffic, err := idleAverages(vmr, since)
+		if err != nil {
+			logger.Error("Failed to get RRD data of VM", "vmid", v.ID, "error", err)
+			continue
+		}
+
+		if cpu >= policy.CPUThreshold || traffic >= float64(policy.NetThreshold) {
+			resetVMIdleState(v)
+			continue
+		}
+
+		if v.IdleWarnedAt == nil {
+			err = db.UpdateVMIdleState(v.ID, &since, &now)
+			if err != nil {
+				logger.Error("Failed to update idle state of VM", "vmid", v.ID, "error", err)
+				continue
+			}
+
+			if v.OwnerType == "Group" {
+				err = notify.SendVMIdleWarningNotificationToGroup(v.OwnerID, v.Name, policy.IdleHours, policy.GracePeriod)
+			} else {
+				err = notify.SendVMIdleWarningNotification(v.OwnerID, v.Name, policy.IdleHours, policy.GracePeriod)
+			}
+			if err != nil {
+				logger.Error("Failed to send VM idle warning notification", "vmid", v.ID, "error", err)
+			}
+			continue
+		}
+
+		if now.Sub(*v.IdleWarnedAt) < time.Duration(policy.GracePeriod)*time.Hour {
+			continue
+		}
+
+		logger.Info("Shutting down idle VM", "vmid", v.ID, "idle_since", v.IdleSince)
+		err = changeVMStatusBypass(v.ID, "shutdown")
+		if err != nil {
+			logger.Error("Failed to shut down idle VM", "vmid", v.ID, "error", err)
+			continue
+		}
+		resetVMIdleState(v)
+
+		if v.OwnerType == "Group" {
+			err = notify.SendVMIdleStoppedNotificationToGroup(v.OwnerID, v.Name)
+		} else {
+			err = notify.SendVMIdleStoppedNotification(v.OwnerID, v.Name)
+		}
+		if err != nil {
+			logger.Error("Failed to send VM idle stopped notification", "vmid", v.ID, "error", err)
+		}
+	}
+}
+
+func resetVMIdleState(v *db.VM) {
+	if v.IdleSince == nil && v.IdleWarnedAt == nil {
+		return
+	}
+
+	err := db.UpdateVMIdleState(v.ID, nil, nil)
+	if err != nil {
+		logger.Error("Failed to reset idle state of VM", "vmid", v.ID, "error", err)
+	}
+}
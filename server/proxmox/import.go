@@ -0,0 +1,411 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+	"github.com/seancfoley/ipaddress-go/ipaddr"
+)
+
+// ImportVM adds a VM that already exists on Proxmox, but was not created by
+// sasso, to the user or the group. The resources are read from Proxmox and
+// must fit in the quota of the owner. The NICs on the nets of the owner
+// become interfaces, while the ones on other bridges are left untouched.
+//
+// The VMID must match the owner, as generated by generateFullVMID. If it
+// doesn't, the VM can be renumbered: the worker clones the stopped VM to a
+// new VMID and then deletes the original one. Proxmox generates new MAC
+// addresses for the NICs of a clone, so the guest of a renumbered VM sees
+// new NICs: configurations bound to the old MAC addresses, like static DHCP
+// leases or udev rules, must be updated.
+func ImportVM(clusterName string, vmID uint64, userID uint, groupID *uint, name string, lifeTime uint, includeGlobalSSHKeys, renumber bool) (*VM, error) {
+	if lifeTime == 0 {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("lifetime must be at least 1 month"))
+	}
+
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	group := groupID != nil
+	ownerID := userID
+	if group {
+		ownerID = *groupID
+		_, err = db.GetGroupByID(ownerID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrInvalidOwner
+			}
+			logger.Error("Failed to get group from database", "groupID", ownerID, "error", err)
+			return nil, err
+		}
+	} else {
+		_, err = db.GetUserByID(ownerID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrInvalidOwner
+			}
+			logger.Error("Failed to get user from database", "userID", ownerID, "error", err)
+			return nil, err
+		}
+	}
+	l := logger.With("cluster", pc.name, "vmID", vmID, "ownerID", ownerID, "ownerType", ownerTypeFromGroupBit(group))
+
+	cluster, err := getProxmoxCluster(pc.client)
+	if err != nil {
+		return nil, err
+	}
+
+	vmNodes, err := mapVMIDToProxmoxNodes(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeName, ok := vmNodes[vmID]
+	if !ok {
+		return nil, ErrVMNotFound
+	}
+
+	ids, err := db.GetAllVMIDs()
+	if err != nil {
+		l.Error("Failed to get VM IDs", "error", err)
+		return nil, err
+	}
+	if slices.Contains(ids, vmID) || isSassoTemplateVMID(pc, vmID) {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("the VM is already managed by sasso"))
+	}
+
+	node, err := getProxmoxNode(pc.client, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = vm.Name
+	}
+	if !isValidVMName(name) {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
+	}
+
+	// The name, the quota and the VMID are checked like in NewVM, so the
+	// import can't race with the VMs created by the owner
+	m := getOwnerMutex(ownerID, ownerTypeFromGroupBit(group))
+	m.Lock()
+	defer m.Unlock()
+
+	var exists bool
+	if group {
+		exists, err = db.ExistsVMWithGroupIDAndName(ownerID, name)
+	} else {
+		exists, err = db.ExistsVMWithUserIDAndName(ownerID, name)
+	}
+	if err != nil {
+		l.Error("Failed to check if VM name exists", "error", err)
+		return nil, err
+	} else if exists {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("vm name already exists"))
+	}
+
+	cores, ram, disk, err := getProxmoxVMResources(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVMQuota(group, ownerID, cores, ram, disk); err != nil {
+		return nil, err
+	}
+
+	interfaces, err := importInterfaces(pc, vm, group, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	dbVM := &db.VM{
+		ID:                   vmID,
+		Name:                 name,
+		Cores:                cores,
+		RAM:                  ram,
+		Disk:                 disk,
+		Cluster:              pc.name,
+		LifeTime:             time.Now().AddDate(0, int(lifeTime), 0),
+		IncludeGlobalSSHKeys: includeGlobalSSHKeys,
+		Node:                 nodeName,
+		OwnerID:              ownerID,
+		OwnerType:            ownerTypeFromGroupBit(group),
+	}
+
+	g, o, ok := parseSassoVMID(vmID)
+	if ok && g == group && o == ownerID && !renumber {
+		dbVM.Status = string(vmStatusFromProxmox(vm))
+	} else {
+		if !renumber {
+			return nil, errors.Join(ErrInvalidVMParam, errors.New("the VMID doesn't match the owner, the VM must be renumbered"))
+		}
+		if vm.Status != string(VMStatusStopped) {
+			l.Warn("VM must be stopped to be renumbered", "status", vm.Status)
+			return nil, ErrInvalidVMState
+		}
+
+		newID, err := nextVMIDForOwner(group, ownerID)
+		if err != nil {
+			l.Error("Failed to generate full VM ID", "error", err)
+			return nil, err
+		}
+		if _, used := vmNodes[newID]; used {
+			l.Error("New VMID is already used on Proxmox", "newVMID", newID)
+			return nil, fmt.Errorf("VMID %d is already used on Proxmox", newID)
+		}
+
+		// The VM is created by createVMs, cloning the original one
+		dbVM.ID = newID
+		dbVM.Status = string(VMStatusPreCreating)
+		dbVM.ImportedFromVMID = &vmID
+	}
+
+	if err := db.ImportVM(dbVM, interfaces); err != nil {
+		l.Error("Failed to import VM in database", "error", err)
+		return nil, err
+	}
+
+	l.Info("Admin imported VM", "newVMID", dbVM.ID, "interfaces", len(interfaces))
+	return convertDBVMToVM(dbVM, nil, nil, nil), nil
+}
+
+// getProxmoxVMResources returns the cores, the RAM and the disk of a VM on
+// Proxmox. The disk must be on scsi0, as the worker resizes and checks only
+// that one.
+func getProxmoxVMResources(vm *gprox.VirtualMachine) (cores, ram, disk uint, err error) {
+	scsi0, ok := vm.VirtualMachineConfig.SCSIs["scsi0"]
+	if !ok {
+		return 0, 0, 0, errors.Join(ErrInvalidVMParam, errors.New("the vm has no disk on scsi0"))
+	}
+	disk, err = getSizeFromStorageString(scsi0)
+	if err != nil {
+		logger.Error("Failed to parse storage on SCSI0", "vmid", vm.VMID, "scsi0", scsi0, "error", err)
+		return 0, 0, 0, err
+	}
+
+	return uint(vm.VirtualMachineConfig.Cores), uint(vm.VirtualMachineConfig.Memory), disk, nil
+}
+
+// importInterfaces returns the interfaces for the NICs of the VM that are on
+// a net of the owner in the cluster
+func importInterfaces(pc *pveCluster, vm *gprox.VirtualMachine, group bool, ownerID uint) ([]db.Interface, error) {
+	nets, err := db.GetAllNets()
+	if err != nil {
+		logger.Error("Failed to get nets", "error", err)
+		return nil, err
+	}
+	netsByName := make(map[string]db.Net, len(nets))
+	for _, n := range nets {
+		if n.Cluster == pc.name {
+			netsByName[n.Name] = n
+		}
+	}
+
+	interfaces := []db.Interface{}
+	for name, pnet := range vm.VirtualMachineConfig.Nets {
+		options := parseProxmoxOptions(pnet)
+		n, ok := netsByName[options["bridge"]]
+		if !ok {
+			continue
+		}
+		if n.OwnerID != ownerID || n.OwnerType != ownerTypeFromGroupBit(group) {
+			return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("%s is on a net of another owner", name))
+		}
+
+		localID, err := strconv.ParseUint(strings.TrimPrefix(name, "net"), 10, 32)
+		if err != nil {
+			logger.Error("Invalid NIC name on VM", "vmid", vm.VMID, "nic", name)
+			continue
+		}
+
+		var vlanTag uint16
+		if n.VlanAware && options["tag"] != "" {
+			tag, err := strconv.ParseUint(options["tag"], 10, 16)
+			if err != nil {
+				return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("invalid vlan tag on %s", name))
+			}
+			vlanTag = uint16(tag)
+		}
+
+		ipconfig := parseProxmoxOptions(vm.VirtualMachineConfig.IPConfigs[fmt.Sprintf("ipconfig%d", localID)])
+		ip := ipconfig["ip"]
+		if ip == "dhcp" {
+			ip = ""
+		}
+
+		iface := db.Interface{
+			LocalID: uint(localID),
+			VNetID:  n.ID,
+			VlanTag: vlanTag,
+			IPAdd:   ip,
+			Gateway: ipconfig["gw"],
+			Status:  string(InterfaceStatusReady),
+		}
+		if ip != "" {
+			if err := checkImportedInterfaceIP(&n, &iface, interfaces); err != nil {
+				return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// checkImportedInterfaceIP checks the IP of an imported NIC like the one of a
+// new interface. The IP must be in the subnet of the net and not used by
+// another interface on the same VLAN, including the other imported NICs.
+func checkImportedInterfaceIP(n *db.Net, iface *db.Interface, imported []db.Interface) error {
+	err := InterfacesChecks(n, &Interface{VNetID: iface.VNetID, VlanTag: iface.VlanTag, IPAdd: iface.IPAdd, Gateway: iface.Gateway})
+	if err != nil {
+		return err
+	}
+
+	host, err := ipaddr.NewIPAddressString(iface.IPAdd).ToHostAddress()
+	if err != nil {
+		return errors.New("failed to get host address from ip_add")
+	}
+	subnet := ipaddr.NewIPAddressString(n.Subnet).GetAddress()
+	if subnet == nil || !subnet.PrefixContains(host) {
+		return fmt.Errorf("ip %s is not in the subnet %s of the net", iface.IPAdd, n.Subnet)
+	}
+
+	exists, err := db.ExistsIPInVNetWithVlanTag(iface.VNetID, iface.VlanTag, iface.IPAdd)
+	if err != nil {
+		return err
+	}
+	for _, other := range imported {
+		if other.VNetID == iface.VNetID && other.VlanTag == iface.VlanTag && other.IPAdd != "" {
+			otherHost, err := ipaddr.NewIPAddressString(other.IPAdd).ToHostAddress()
+			if err == nil && otherHost.Equal(host) {
+				exists = true
+			}
+		}
+	}
+	if exists {
+		return fmt.Errorf("ip %s is already used on the net", iface.IPAdd)
+	}
+	return nil
+}
+
+// deleteImportedVMs deletes the original VMs of the renumbered imports. The
+// clone is completed when it's on Proxmox and no longer in a transient
+// status, as a failed clone is removed by Proxmox. The deletion is tracked by
+// pollTasks.
+func deleteImportedVMs(pc *pveCluster, vmNodes map[uint64]string) {
+	logger.Debug("Deleting original VMs of imports in worker")
+
+	vms, err := db.GetImportedVMs()
+	if err != nil {
+		logger.Error("Failed to get imported VMs", "error", err)
+		return
+	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
+
+	run := pc.newStageRun("delete_imported_vms")
+	for _, v := range vms {
+		if v.ImportTaskUPID != "" || v.Status == string(VMStatusPreCreating) || v.Status == string(VMStatusCreating) {
+			continue
+		}
+		if _, cloned := vmNodes[v.ID]; !cloned {
+			continue
+		}
+
+		sourceID := *v.ImportedFromVMID
+		nodeName, ok := vmNodes[sourceID]
+		if !ok {
+			logger.Info("Original VM of import already deleted", "vmid", v.ID, "source_vmid", sourceID)
+			if err := db.ClearVMImportedFrom(v.ID); err != nil {
+				logger.Error("Failed to clear imported VM", "vmid", v.ID, "err", err)
+			}
+			continue
+		}
+
+		run.Go(nodeName, sourceID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
+
+			vm, err := getProxmoxVM(node, int(sourceID))
+			if err != nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := vm.Delete(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("Failed to delete original VM of import", "vmid", v.ID, "source_vmid", sourceID, "err", err)
+				return
+			}
+
+			// The task is tracked by pollTasks
+			if err := db.SetVMImportTask(v.ID, string(task.UPID)); err != nil {
+				logger.Error("Failed to save import task of VM", "vmid", v.ID, "upid", task.UPID, "err", err)
+			}
+		})
+	}
+	run.Wait()
+}
+
+// pollImportTasks completes the imports whose original VM has been deleted.
+// If the deletion fails it's started again in the next cycle, unless the
+// failure is permanent: then the original VM is left on Proxmox and shows up
+// as an orphan.
+func pollImportTasks(pc *pveCluster, vmIDs map[uint64]bool) {
+	vms, err := db.GetImportedVMs()
+	if err != nil {
+		logger.Error("Failed to get imported VMs", "error", err)
+		return
+	}
+
+	for _, v := range vms {
+		if v.ImportTaskUPID == "" || !vmIDs[v.ID] {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, v.ImportTaskUPID)
+		if lost {
+			if err := db.SetVMImportTask(v.ID, ""); err != nil {
+				logger.Error("Failed to save import task of VM", "vmid", v.ID, "err", err)
+			}
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		if !successful {
+			taskErr := errProxmoxTaskFailed(v.ImportTaskUPID, exitStatus)
+			if !errors.Is(taskErr, errPermanentFailure) {
+				logger.Warn("Failed to delete original VM of import, retrying", "vmid", v.ID, "source_vmid", *v.ImportedFromVMID, "err", taskErr)
+				if err := db.SetVMImportTask(v.ID, ""); err != nil {
+					logger.Error("Failed to save import task of VM", "vmid", v.ID, "err", err)
+				}
+				continue
+			}
+			logger.Error("Failed to delete original VM of import, giving up", "vmid", v.ID, "source_vmid", *v.ImportedFromVMID, "err", taskErr)
+		} else {
+			logger.Info("Deleted original VM of import", "vmid", v.ID, "source_vmid", *v.ImportedFromVMID)
+		}
+
+		if err := db.ClearVMImportedFrom(v.ID); err != nil {
+			logger.Error("Failed to clear imported VM", "vmid", v.ID, "err", err)
+		}
+	}
+}
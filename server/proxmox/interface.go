@@ -4,6 +4,7 @@ import (
 	"errors"
 	"slices"
 	"sync"
+	"time"
 
 	"samuelemusiani/sasso/server/db"
 
@@ -37,9 +38,13 @@ type Interface struct {
 	IPAdd   string          `json:"ip_add"`
 	Gateway string          `json:"gateway"`
 	Status  InterfaceStatus `json:"status"`
+
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    uint       `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
 }
 
-var goodVMStatesForInterfacesManipulation = []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused, VMStatusPreConfiguring, VMStatusConfiguring}
+var goodVMStatesForInterfacesManipulation = []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused, VMStatusHibernated, VMStatusPreConfiguring, VMStatusConfiguring}
 
 func NewInterface(VMID uint, vnetID uint, vlanTag uint16, ipAdd string, gateway string) (*Interface, error) {
 	vm, err := db.GetVMByID(uint64(VMID))
@@ -77,6 +82,10 @@ func InterfaceFromDB(dbIface *db.Interface) *Interface {
 		IPAdd:   dbIface.IPAdd,
 		Gateway: dbIface.Gateway,
 		Status:  InterfaceStatus(dbIface.Status),
+
+		LastError:   dbIface.LastError,
+		Attempts:    dbIface.Attempts,
+		NextRetryAt: dbIface.NextRetryAt,
 	}
 }
 
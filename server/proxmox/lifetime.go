@@ -0,0 +1,241 @@
+package proxmox
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/notify"
+)
+
+var (
+	ErrApprovalRequired       = errors.New("approval_required")
+	ErrLifetimeRequestPending = errors.New("lifetime_request_pending")
+)
+
+type LifetimeRequest struct {
+	ID            uint      `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	VMID          uint64    `json:"vm_id"`
+	UserID        uint      `json:"user_id"`
+	ExtendBy      uint      `json:"extend_by"`
+	Justification string    `json:"justification"`
+	Status        string    `json:"status"`
+	ReviewerID    *uint     `json:"reviewer_id,omitempty"`
+	ReviewNotes   string    `json:"review_notes,omitempty"`
+}
+
+func convertDBLifetimeRequest(lr *db.LifetimeRequest) LifetimeRequest {
+	return LifetimeRequest{
+		ID:            lr.ID,
+		CreatedAt:     lr.CreatedAt,
+		UpdatedAt:     lr.UpdatedAt,
+		VMID:          lr.VMID,
+		UserID:        lr.UserID,
+		ExtendBy:      lr.ExtendBy,
+		Justification: lr.Justification,
+		Status:        lr.Status,
+		ReviewerID:    lr.ReviewerID,
+		ReviewNotes:   lr.ReviewNotes,
+	}
+}
+
+// getLifetimePolicy returns the lifetime policy that applies to the VMs of
+// an owner
+func getLifetimePolicy(ownerID uint, ownerType string) (*db.LifetimePolicy, error) {
+	var policy *db.LifetimePolicy
+	var err error
+	if ownerType == "Group" {
+		policy, err = db.GetLifetimePolicyForGroup(ownerID)
+	} else {
+		policy, err = db.GetLifetimePolicyForUser(ownerID)
+	}
+	if err != nil {
+		logger.Error("Failed to get lifetime policy", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	}
+	return policy, nil
+}
+
+// GetLifetimePolicy returns the lifetime policy that applies to new VMs of
+// the user, or of the group if groupID is not nil
+func GetLifetimePolicy(userID uint, groupID *uint) (*db.LifetimePolicy, error) {
+	if groupID != nil {
+		return getLifetimePolicy(*groupID, "Group")
+	}
+	return getLifetimePolicy(userID, "User")
+}
+
+// checkVMLifetimeExtension validates an extension of extendBy months of the
+// lifetime of the VM and returns the new lifetime together with the policy
+// of the owner
+func checkVMLifetimeExtension(vm *db.VM, extendBy uint) (time.Time, *db.LifetimePolicy, error) {
+	policy, err := getLifetimePolicy(vm.OwnerID, vm.OwnerType)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	// The extensions follow the durations allowed for new VMs
+	if !slices.Contains(policy.AllowedDurations, extendBy) {
+		err := fmt.Errorf("extend_by must be one of the following values: %v", policy.AllowedDurations)
+		return time.Time{}, nil, errors.Join(ErrInvalidVMParam, err)
+	}
+
+	months := int(extendBy / 2)
+	days := int((extendBy % 2) * 15)
+	if vm.LifeTime.After(time.Now().AddDate(0, months, days)) {
+		return time.Time{}, nil, errors.Join(ErrInvalidVMParam, errors.New("cannot update lifetime. Too soon"))
+	}
+
+	newLifetime := vm.LifeTime.AddDate(0, int(extendBy), 0)
+	if err := checkMaxTotalLifetime(vm, policy, newLifetime); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return newLifetime, policy, nil
+}
+
+func checkMaxTotalLifetime(vm *db.VM, policy *db.LifetimePolicy, newLifetime time.Time) error {
+	if policy.MaxTotalLifetime > 0 && newLifetime.After(vm.CreatedAt.AddDate(0, int(policy.MaxTotalLifetime), 0)) {
+		err := fmt.Errorf("the lifetime of a VM can't exceed %d months", policy.MaxTotalLifetime)
+		return errors.Join(ErrInvalidVMParam, err)
+	}
+	return nil
+}
+
+func lifetimeNeedsApproval(vm *db.VM, policy *db.LifetimePolicy, newLifetime time.Time) bool {
+	return policy.ApprovalThreshold > 0 &&
+		newLifetime.After(vm.CreatedAt.AddDate(0, int(policy.ApprovalThreshold), 0))
+}
+
+// RequestVMLifetimeExtension creates a request to extend the lifetime of a
+// VM, that must be approved by a maintainer or an admin
+func RequestVMLifetimeExtension(VMID uint64, userID uint, extendBy uint, justification string) (*LifetimeRequest, error) {
+	vm, err := db.GetVMByID(VMID)
+	if err != nil {
+		logger.Error("Failed to get VM from database for lifetime request", "vmID", VMID, "error", err)
+		return nil, err
+	}
+
+	if _, _, err := checkVMLifetimeExtension(vm, extendBy); err != nil {
+		return nil, err
+	}
+
+	lr, err := db.NewLifetimeRequest(VMID, userID, extendBy, justification)
+	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return nil, ErrLifetimeRequestPending
+		}
+		logger.Error("Failed to create lifetime request", "vmID", VMID, "error", err)
+		return nil, err
+	}
+
+	request := convertDBLifetimeRequest(lr)
+	return &request, nil
+}
+
+// ListLifetimeRequests returns the requests with the given status, or all of
+// them if status is empty
+func ListLifetimeRequests(status string) ([]LifetimeRequest, error) {
+	dbRequests, err := db.GetLifetimeRequests(status)
+	if err != nil {
+		logger.Error("Failed to get lifetime requests", "error", err)
+		return nil, err
+	}
+
+	requests := make([]LifetimeRequest, len(dbRequests))
+	for i := range dbRequests {
+		requests[i] = convertDBLifetimeRequest(&dbRequests[i])
+	}
+	return requests, nil
+}
+
+func ListLifetimeRequestsByVMID(VMID uint64) ([]LifetimeRequest, error) {
+	dbRequests, err := db.GetLifetimeRequestsByVMID(VMID)
+	if err != nil {
+		logger.Error("Failed to get lifetime requests for VM", "vmID", VMID, "error", err)
+		return nil, err
+	}
+
+	requests := make([]LifetimeRequest, len(dbRequests))
+	for i := range dbRequests {
+		requests[i] = convertDBLifetimeRequest(&dbRequests[i])
+	}
+	return requests, nil
+}
+
+// ApproveLifetimeRequest extends the lifetime of the VM and notifies the user
+// that made the request. The max total lifetime of the policy is checked
+// again, as the lifetime could have changed since the request was made.
+func ApproveLifetimeRequest(id uint, reviewerID uint, notes string) (*LifetimeRequest, error) {
+	lr, err := db.GetLifetimeRequestByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to get lifetime request", "id", id, "error", err)
+		return nil, err
+	}
+
+	vm, err := db.GetVMByID(lr.VMID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrVMNotFound
+		}
+		logger.Error("Failed to get VM for lifetime request", "vmID", lr.VMID, "error", err)
+		return nil, err
+	}
+
+	policy, err := getLifetimePolicy(vm.OwnerID, vm.OwnerType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMaxTotalLifetime(vm, policy, vm.LifeTime.AddDate(0, int(lr.ExtendBy), 0)); err != nil {
+		return nil, err
+	}
+
+	lr, err = db.ApproveLifetimeRequest(id, reviewerID, notes)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to approve lifetime request", "id", id, "error", err)
+		return nil, err
+	}
+
+	if err := notify.SendLifetimeRequestReviewedNotification(lr.UserID, vm.Name, true, notes); err != nil {
+		logger.Error("Failed to send lifetime request notification", "userID", lr.UserID, "error", err)
+	}
+
+	request := convertDBLifetimeRequest(lr)
+	return &request, nil
+}
+
+// RejectLifetimeRequest rejects the request and notifies the user that made
+// it
+func RejectLifetimeRequest(id uint, reviewerID uint, notes string) (*LifetimeRequest, error) {
+	lr, err := db.RejectLifetimeRequest(id, reviewerID, notes)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to reject lifetime request", "id", id, "error", err)
+		return nil, err
+	}
+
+	vmName := fmt.Sprintf("%d", lr.VMID)
+	if vm, err := db.GetVMByID(lr.VMID); err == nil {
+		vmName = vm.Name
+	}
+
+	if err := notify.SendLifetimeRequestReviewedNotification(lr.UserID, vmName, false, notes); err != nil {
+		logger.Error("Failed to send lifetime request notification", "userID", lr.UserID, "error", err)
+	}
+
+	request := convertDBLifetimeRequest(lr)
+	return &request, nil
+}
@@ -0,0 +1,32 @@
+package proxmox
+
+import (
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+// After the maintenance ends the worker finds VMs that changed status during
+// the maintenance. The notifications for those changes are suppressed for
+// this time.
+const maintenanceNotificationGrace = 10 * time.Minute
+
+// isInMaintenance reports if the maintenance mode is enabled. If the state
+// can't be read, the maintenance is assumed to be disabled.
+func isInMaintenance() bool {
+	m, err := db.GetMaintenance()
+	if err != nil {
+		logger.Error("Failed to get maintenance state", "error", err)
+		return false
+	}
+	return m.Enabled
+}
+
+func statusNotificationsSuppressed() bool {
+	m, err := db.GetMaintenance()
+	if err != nil {
+		logger.Error("Failed to get maintenance state", "error", err)
+		return false
+	}
+	return m.Enabled || time.Since(m.UpdatedAt) < maintenanceNotificationGrace
+}
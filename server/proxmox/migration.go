@@ -0,0 +1,390 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+var (
+	ErrVMMigrating       = errors.New("vm_migrating")
+	ErrSameNode          = errors.New("same_node")
+	ErrInvalidTargetNode = errors.New("invalid_target_node")
+)
+
+type Migration struct {
+	ID         uint      `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	VMID       uint64    `json:"vm_id"`
+	SourceNode string    `json:"source_node"`
+	TargetNode string    `json:"target_node"`
+	Online     bool      `json:"online"`
+	Drain      bool      `json:"drain"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func convertDBMigration(m *db.Migration) Migration {
+	return Migration{
+		ID:         m.ID,
+		CreatedAt:  m.CreatedAt,
+		UpdatedAt:  m.UpdatedAt,
+		VMID:       m.VMID,
+		SourceNode: m.SourceNode,
+		TargetNode: m.TargetNode,
+		Online:     m.Online,
+		Drain:      m.Drain,
+		Status:     m.Status,
+		Error:      m.Error,
+	}
+}
+
+func ListMigrations() ([]Migration, error) {
+	dbMigrations, err := db.GetAllMigrations()
+	if err != nil {
+		logger.Error("Failed to get migrations", "error", err)
+		return nil, err
+	}
+
+	migrations := make([]Migration, len(dbMigrations))
+	for i := range dbMigrations {
+		migrations[i] = convertDBMigration(&dbMigrations[i])
+	}
+	return migrations, nil
+}
+
+func GetMigration(id uint) (*Migration, error) {
+	m, err := db.GetMigrationByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		logger.Error("Failed to get migration", "id", id, "error", err)
+		return nil, err
+	}
+	migration := convertDBMigration(m)
+	return &migration, nil
+}
+
+// MigrateVM schedules the migration of a VM to targetNode. If targetNode is
+// empty, the worker chooses the node with the placement strategy. Running VMs
+// are migrated online.
+func MigrateVM(vmID uint64, targetNode string) (*Migration, error) {
+	vm, err := db.GetVMByID(vmID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrVMNotFound
+		}
+		logger.Error("Failed to get VM for migration", "vmID", vmID, "error", err)
+		return nil, err
+	}
+
+	if targetNode != "" {
+		if err := checkMigrationTarget(vm, targetNode); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := newMigration(vm, targetNode, false)
+	if err != nil {
+		return nil, err
+	}
+
+	migration := convertDBMigration(m)
+	return &migration, nil
+}
+
+// DrainNode schedules the migration of all the VMs on a node of a cluster.
+// While the node is draining it is not used for new VMs.
+func DrainNode(clusterName, node string) ([]Migration, error) {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := db.GetVMsByNode(node)
+	if err != nil {
+		logger.Error("Failed to get VMs by node", "node", node, "error", err)
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for i := range vms {
+		if vms[i].Cluster != pc.name {
+			continue
+		}
+		m, err := newMigration(&vms[i], "", true)
+		if err != nil {
+			if errors.Is(err, ErrVMMigrating) || errors.Is(err, ErrInvalidVMState) {
+				logger.Warn("Skipping VM while draining node", "vmID", vms[i].ID, "node", node, "error", err)
+				continue
+			}
+			return nil, err
+		}
+		migrations = append(migrations, convertDBMigration(m))
+	}
+
+	return migrations, nil
+}
+
+// checkMigrationTarget returns ErrInvalidTargetNode if the node is not an
+// online node of the cluster of the VM
+func checkMigrationTarget(vm *db.VM, targetNode string) error {
+	pc, err := getVMCluster(vm)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := getProxmoxCluster(pc.client)
+	if err != nil {
+		return err
+	}
+	resources, err := getProxmoxResources(cluster, "node")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		if r.Type == "node" && r.Node == targetNode {
+			if r.Status != "online" {
+				logger.Warn("Target node of migration is not online", "vmID", vm.ID, "node", targetNode, "status", r.Status)
+				return ErrInvalidTargetNode
+			}
+			return nil
+		}
+	}
+	logger.Warn("Target node of migration not found", "vmID", vm.ID, "node", targetNode)
+	return ErrInvalidTargetNode
+}
+
+func newMigration(vm *db.VM, targetNode string, drain bool) (*db.Migration, error) {
+	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusHibernated)}
+	if !slices.Contains(vmStates, vm.Status) || vm.Node == "" {
+		logger.Warn("VM is not in a valid state for migration", "vmID", vm.ID, "status", vm.Status, "node", vm.Node)
+		return nil, ErrInvalidVMState
+	}
+
+	if vm.Node == targetNode {
+		return nil, ErrSameNode
+	}
+
+	m, err := db.NewMigration(vm.ID, vm.Node, targetNode, drain)
+	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return nil, ErrVMMigrating
+		}
+		logger.Error("Failed to create migration", "vmID", vm.ID, "error", err)
+		return nil, err
+	}
+	return m, nil
+}
+
+// migrateVMs executes the pending migrations
+func migrateVMs(pc *pveCluster, cluster *gprox.Cluster, vmNodes map[uint64]string) {
+	logger.Debug("Migrating VMs in worker")
+
+	migrations, err := db.GetMigrationsWithStatus(db.MigrationStatusPending)
+	if err != nil {
+		logger.Error("Failed to get pending migrations", "error", err)
+		return
+	}
+
+	// VMs are migrated only between the nodes of their cluster
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	migrations = slices.DeleteFunc(migrations, func(m db.Migration) bool { return !vmIDs[m.VMID] })
+
+	if len(migrations) == 0 {
+		return
+	}
+
+	var candidates map[string]*nodeCandidate
+
+	// Targets are selected one migration at a time, while the migrations run
+	// in the pool
+	run := pc.newStageRun("migrate_vms")
+	defer run.Wait()
+
+	for _, m := range migrations {
+		vm, err := db.GetVMByID(m.VMID)
+		if err != nil {
+			logger.Error("Failed to get VM for migration", "vmid", m.VMID, "error", err)
+			failMigration(m.ID, "VM not found")
+			continue
+		}
+
+		nodeName, ok := vmNodes[m.VMID]
+		if !ok {
+			logger.Error("VM to migrate not found on proxmox", "vmid", m.VMID)
+			failMigration(m.ID, "VM not found on proxmox")
+			continue
+		}
+
+		target := m.TargetNode
+		if target == "" {
+			if candidates == nil {
+				candidates, err = getNodeCandidates(pc, cluster)
+				if err != nil {
+					logger.Error("Failed to get placement candidates", "error", err)
+					return
+				}
+			}
+
+			// The current node is never a valid target
+			filtered := make(map[string]*nodeCandidate, len(candidates))
+			for name, c := range candidates {
+				if name != nodeName {
+					filtered[name] = c
+				}
+			}
+
+			target, err = selectNodeForVM(pc, filtered, vm)
+			if err != nil {
+				logger.Error("Failed to select target node for migration", "vmid", m.VMID, "error", err)
+				failMigration(m.ID, "no suitable node found")
+				continue
+			}
+		}
+
+		if target == nodeName {
+			logger.Info("VM is already on the target node", "vmid", m.VMID, "node", nodeName)
+			if err := db.UpdateMigrationStatus(m.ID, db.MigrationStatusCompleted, ""); err != nil {
+				logger.Error("Failed to update migration status", "id", m.ID, "err", err)
+			}
+			continue
+		}
+
+		online := vm.Status == string(VMStatusRunning)
+		if err := db.UpdateMigrationTarget(m.ID, target, online); err != nil {
+			logger.Error("Failed to update migration target", "id", m.ID, "err", err)
+			continue
+		}
+		if err := db.UpdateMigrationStatus(m.ID, db.MigrationStatusMigrating, ""); err != nil {
+			logger.Error("Failed to update migration status", "id", m.ID, "err", err)
+			continue
+		}
+
+		run.Go(nodeName, m.VMID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				failMigration(m.ID, "can't get proxmox node")
+				return
+			}
+
+			vmr, err := getProxmoxVM(node, int(m.VMID))
+			if err != nil {
+				failMigration(m.ID, "can't get proxmox VM")
+				return
+			}
+
+			logger.Info("Migrating VM", "vmid", m.VMID, "source", nodeName, "target", target, "online", online)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := vmr.Migrate(ctx, &gprox.VirtualMachineMigrateOptions{
+				Target:         target,
+				Online:         gprox.IntOrBool(online),
+				WithLocalDisks: gprox.IntOrBool(true),
+			})
+			cancel()
+			if err != nil {
+				logger.Error("Failed to migrate VM", "vmid", m.VMID, "target", target, "error", err)
+				failMigration(m.ID, err.Error())
+				return
+			}
+
+			// Live migrations of big VMs can take a long time, so the task is
+			// tracked by pollTasks
+			if err := db.SetMigrationTask(m.ID, string(task.UPID)); err != nil {
+				logger.Error("Failed to save migration task", "id", m.ID, "upid", task.UPID, "err", err)
+			}
+		})
+	}
+}
+
+// pollMigrationTasks completes the migrations whose task is completed
+func pollMigrationTasks(pc *pveCluster, vmIDs map[uint64]bool) {
+	migrations, err := db.GetMigrationsWithStatus(db.MigrationStatusMigrating)
+	if err != nil {
+		logger.Error("Failed to get running migrations", "error", err)
+		return
+	}
+
+	for _, m := range migrations {
+		if m.TaskUPID == "" || !vmIDs[m.VMID] {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, m.TaskUPID)
+		if lost {
+			if err := db.SetMigrationTask(m.ID, ""); err != nil {
+				logger.Error("Failed to save migration task", "id", m.ID, "err", err)
+			}
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		if !successful {
+			logger.Error("Migration task failed", "id", m.ID, "vmid", m.VMID, "upid", m.TaskUPID)
+			failMigration(m.ID, errProxmoxTaskFailed(m.TaskUPID, exitStatus).Error())
+			continue
+		}
+		completeMigration(&m)
+	}
+}
+
+// resumeUntrackedMigrations handles the migrations started without saving
+// the task. They are completed if the VM is already on the target node,
+// otherwise they are executed again. It returns false if some migration is
+// still running on Proxmox and must be resumed later.
+func resumeUntrackedMigrations(pc *pveCluster, vmNodes map[uint64]string) bool {
+	migrations, err := db.GetMigrationsWithStatus(db.MigrationStatusMigrating)
+	if err != nil {
+		logger.Error("Failed to get running migrations", "error", err)
+		return false
+	}
+
+	resumed := true
+	for _, m := range migrations {
+		node, exists := vmNodes[m.VMID]
+		if m.TaskUPID != "" || !exists {
+			continue
+		}
+		if isVMLockedOnProxmox(pc, node, m.VMID) {
+			resumed = false
+			continue
+		}
+
+		logger.Warn("Migration without a task", "id", m.ID, "vmid", m.VMID, "node", node, "target", m.TargetNode)
+		if node == m.TargetNode {
+			completeMigration(&m)
+		} else if err := db.UpdateMigrationStatus(m.ID, db.MigrationStatusPending, ""); err != nil {
+			logger.Error("Failed to update migration status", "id", m.ID, "err", err)
+		}
+	}
+	return resumed
+}
+
+func completeMigration(m *db.Migration) {
+	if err := db.UpdateVMNode(m.VMID, m.TargetNode); err != nil {
+		logger.Error("Failed to update node of VM", "vmid", m.VMID, "node", m.TargetNode, "err", err)
+	}
+	if err := db.UpdateMigrationStatus(m.ID, db.MigrationStatusCompleted, ""); err != nil {
+		logger.Error("Failed to update migration status", "id", m.ID, "err", err)
+	}
+	logger.Info("VM migrated", "vmid", m.VMID, "source", m.SourceNode, "target", m.TargetNode)
+}
+
+func failMigration(id uint, errMsg string) {
+	if err := db.UpdateMigrationStatus(id, db.MigrationStatusFailed, errMsg); err != nil {
+		logger.Error("Failed to update migration status", "id", id, "new_status", db.MigrationStatusFailed, "err", err)
+	}
+}
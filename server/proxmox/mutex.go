@@ -0,0 +1,17 @@
+package proxmox
+
+import "sync"
+
+type ownerKey struct {
+	ownerType string
+	ownerID   uint
+}
+
+// Used to serialize the checks on the VMs of an owner, like the unique names
+// and the quota, with the changes that depend on them. The APIs and the
+// stacks share it
+var ownerMutexes = sync.Map{} // map[ownerKey]*sync.Mutex
+func getOwnerMutex(ownerID uint, ownerType string) *sync.Mutex {
+	mu, _ := ownerMutexes.LoadOrStore(ownerKey{ownerType: ownerType, ownerID: ownerID}, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
@@ -31,55 +31,64 @@ var (
 	ErrVNetHasTaggedInterfaces error = errors.New("VNet has tagged interfaces")
 )
 
+// TestEndpointNetZone checks that the SDN zones of the clusters are valid
 func TestEndpointNetZone() {
+	for _, pc := range clusters[1:] {
+		go testEndpointNetZone(pc)
+	}
+	testEndpointNetZone(clusters[0])
+}
+
+func testEndpointNetZone(pc *pveCluster) {
 	time.Sleep(5 * time.Second)
 	wasError := false
 	first := true
+	l := logger.With("cluster", pc.name)
 
 	for {
-		if !isProxmoxReachable {
+		if !pc.reachable.Load() {
 			time.Sleep(20 * time.Second)
 			continue
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		cluster, err := client.Cluster(ctx)
+		cluster, err := pc.client.Cluster(ctx)
 		cancel()
 		if err != nil {
-			logger.Error("Failed to get Proxmox cluster", "error", err)
+			l.Error("Failed to get Proxmox cluster", "error", err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
 		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		zone, err := cluster.SDNZone(ctx, cNetwork.SDNZone)
+		zone, err := cluster.SDNZone(ctx, pc.network.SDNZone)
 		cancel()
 		if err != nil {
-			logger.Error("Failed to get Proxmox SDN cluster zone", "error", err)
+			l.Error("Failed to get Proxmox SDN cluster zone", "error", err)
 			wasError = true
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
-		if zone.Name != cNetwork.SDNZone {
-			logger.Error("Proxmox SDN cluster zone name mismatch", "expected", cNetwork.SDNZone, "got", zone.Name)
+		if zone.Name != pc.network.SDNZone {
+			l.Error("Proxmox SDN cluster zone name mismatch", "expected", pc.network.SDNZone, "got", zone.Name)
 			wasError = true
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
 		if zone.Type != "vxlan" {
-			logger.Error("Proxmox SDN cluster zone type mismatch", "expected", "vxlan", "got", zone.Type)
+			l.Error("Proxmox SDN cluster zone type mismatch", "expected", "vxlan", "got", zone.Type)
 			wasError = true
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
 		if first {
-			logger.Info("Proxmox SDN cluster zone is valid", "name", zone.Name, "type", zone.Type)
+			l.Info("Proxmox SDN cluster zone is valid", "name", zone.Name, "type", zone.Type)
 			first = false
 		} else if wasError {
-			logger.Info("Proxmox SDN cluster zone is valid again after error", "name", zone.Name, "type", zone.Type)
+			l.Info("Proxmox SDN cluster zone is valid again after error", "name", zone.Name, "type", zone.Type)
 			wasError = false
 		}
 
@@ -89,8 +98,10 @@ func TestEndpointNetZone() {
 	}
 }
 
-// This Function only creates a network in the database.
-func CreateNewNet(userID uint, name string, vlanaware bool, groupID *uint) (*db.Net, error) {
+// This Function only creates a network in the database. The network is
+// placed on the requested cluster, or on the first one the owner can use if
+// cluster is empty.
+func CreateNewNet(userID uint, name string, vlanaware bool, groupID *uint, cluster string) (*db.Net, error) {
 	user, err := db.GetUserByID(userID)
 	if err != nil {
 		logger.Error("Failed to get user by ID", "userID", userID, "error", err)
@@ -112,6 +123,15 @@ func CreateNewNet(userID uint, name string, vlanaware bool, groupID *uint) (*db.
 		}
 	}
 
+	ownerID, ownerType := userID, "User"
+	if groupID != nil {
+		ownerID, ownerType = *groupID, "Group"
+	}
+	pc, err := selectClusterForOwner(ownerID, ownerType, cluster)
+	if err != nil {
+		return nil, err
+	}
+
 	var nets []db.Net
 
 	if groupID != nil {
@@ -151,28 +171,28 @@ func CreateNewNet(userID uint, name string, vlanaware bool, groupID *uint) (*db.
 		return nil, ErrVNetNameExists
 	}
 
-	tag, err := db.GetRandomAvailableTagByZone(cNetwork.SDNZone, cNetwork.VXLANIDStart, cNetwork.VXLANIDEnd)
+	tag, err := db.GetRandomAvailableTagByZone(pc.network.SDNZone, pc.network.VXLANIDStart, pc.network.VXLANIDEnd)
 	if err != nil {
 		logger.Error("Failed to get available tag for creating network", "userID", userID, "error", err)
 		return nil, err
 	}
 
-	if tag < cNetwork.VXLANIDStart || tag > cNetwork.VXLANIDEnd {
+	if tag < pc.network.VXLANIDStart || tag > pc.network.VXLANIDEnd {
 		logger.Error("Tag is out of range", "userID", userID, "tag", tag)
 		return nil, errors.New("Tag is out of range")
 	}
 
-	netName := cNetwork.SDNZone[0:3] + EncodeBase62(uint32(tag))
+	netName := pc.network.SDNZone[0:3] + EncodeBase62(uint32(tag))
 
 	var net *db.Net
 	if groupID != nil {
-		net, err = db.CreateNetForGroup(*groupID, netName, name, cNetwork.SDNZone, tag, vlanaware, string(VNetStatusPreCreating))
+		net, err = db.CreateNetForGroup(*groupID, netName, name, pc.name, pc.network.SDNZone, tag, vlanaware, string(VNetStatusPreCreating))
 		if err != nil {
 			logger.Error("Failed to create network for group", "groupID", *groupID, "error", err)
 			return nil, err
 		}
 	} else {
-		net, err = db.CreateNetForUser(userID, netName, name, cNetwork.SDNZone, tag, vlanaware, string(VNetStatusPreCreating))
+		net, err = db.CreateNetForUser(userID, netName, name, pc.name, pc.network.SDNZone, tag, vlanaware, string(VNetStatusPreCreating))
 		if err != nil {
 			logger.Error("Failed to create network for user", "userID", userID, "error", err)
 			return nil, err
@@ -199,6 +219,16 @@ func DeleteNet(userID uint, netID uint) error {
 		return ErrVNetHasActiveInterfaces
 	}
 
+	ctInterfaces, err := db.CountContainerInterfacesByVNetID(netID)
+	if err != nil {
+		logger.Error("Failed to count container interfaces by net ID", "userID", userID, "netID", netID, "error", err)
+		return err
+	}
+	if ctInterfaces > 0 {
+		logger.Error("Cannot delete net with container interfaces", "ownerID", userID, "netID", netID)
+		return ErrVNetHasActiveInterfaces
+	}
+
 	switch net.OwnerType {
 	case "User":
 		if net.OwnerID != userID {
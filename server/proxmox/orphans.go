@@ -0,0 +1,624 @@
+package proxmox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/config"
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+var (
+	ErrOrphanNotFound = errors.New("orphan not found")
+	ErrInvalidOwner   = errors.New("invalid owner")
+)
+
+// OrphanVM is a VM on Proxmox with a VMID in the sasso range that is not in
+// the DB. The owner is decoded from the VMID.
+type OrphanVM struct {
+	Cluster   string `json:"cluster"`
+	VMID      uint64 `json:"vmid"`
+	Node      string `json:"node"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	OwnerID   uint   `json:"owner_id"`
+	OwnerType string `json:"owner_type"`
+}
+
+// OrphanVNet is a VNet in the sasso SDN zone that is not in the DB
+type OrphanVNet struct {
+	Cluster   string `json:"cluster"`
+	Name      string `json:"name"`
+	Zone      string `json:"zone"`
+	Tag       uint32 `json:"tag"`
+	VlanAware bool   `json:"vlan_aware"`
+}
+
+// OrphanBackup is a backup made by sasso whose VM is not in the DB anymore.
+// A backup older than the VM with the same VMID belongs to a deleted VM too.
+type OrphanBackup struct {
+	// ID is the Volid hashed, like in Backup
+	ID        string    `json:"id"`
+	Cluster   string    `json:"cluster"`
+	VMID      uint64    `json:"vmid"`
+	Ctime     time.Time `json:"ctime"`
+	Name      string    `json:"name"`
+	Protected bool      `json:"protected"`
+	OwnerID   uint      `json:"owner_id"`
+	OwnerType string    `json:"owner_type"`
+
+	node  string
+	volid string
+}
+
+type Orphans struct {
+	VMs     []OrphanVM     `json:"vms"`
+	VNets   []OrphanVNet   `json:"vnets"`
+	Backups []OrphanBackup `json:"backups"`
+}
+
+// ListOrphans returns the resources on the Proxmox clusters that look like
+// they were created by sasso, but that have no counterpart in the DB
+func ListOrphans() (*Orphans, error) {
+	orphans := &Orphans{VMs: []OrphanVM{}, VNets: []OrphanVNet{}, Backups: []OrphanBackup{}}
+	for _, pc := range clusters {
+		cluster, err := getProxmoxCluster(pc.client)
+		if err != nil {
+			return nil, err
+		}
+
+		vms, err := listOrphanVMs(pc, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		vnets, err := listOrphanVNets(pc, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		backups, err := listOrphanBackups(pc, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		orphans.VMs = append(orphans.VMs, vms...)
+		orphans.VNets = append(orphans.VNets, vnets...)
+		orphans.Backups = append(orphans.Backups, backups...)
+	}
+	return orphans, nil
+}
+
+// parseSassoVMID decodes a VMID generated by generateFullVMID. It returns
+// false if the VMID is not in the range used by sasso.
+func parseSassoVMID(vmid uint64) (group bool, ownerID uint, ok bool) {
+	prefix, suffix, found := strings.Cut(cClone.IDTemplate, "{{vmid}}")
+	if !found {
+		return false, 0, false
+	}
+
+	sid := strconv.FormatUint(vmid, 10)
+	if len(sid) != len(prefix)+len(suffix)+1+cClone.VMIDUserDigits+cClone.VMIDVMDigits {
+		return false, 0, false
+	}
+	if !strings.HasPrefix(sid, prefix) || !strings.HasSuffix(sid, suffix) {
+		return false, 0, false
+	}
+
+	s := sid[len(prefix) : len(sid)-len(suffix)]
+	if s[0] != '0' && s[0] != '1' {
+		return false, 0, false
+	}
+
+	id, err := strconv.ParseUint(s[1:1+cClone.VMIDUserDigits], 10, 32)
+	if err != nil {
+		return false, 0, false
+	}
+	return s[0] == '1', uint(id), true
+}
+
+func ownerTypeFromGroupBit(group bool) string {
+	if group {
+		return "Group"
+	}
+	return "User"
+}
+
+// isSassoTemplateVMID returns true for the VMIDs of the templates in the
+// config of the cluster, as they can be in the sasso range too
+func isSassoTemplateVMID(pc *pveCluster, vmid uint64) bool {
+	if vmid == uint64(pc.template.VMID) {
+		return true
+	}
+	return slices.ContainsFunc(pc.catalog, func(c config.ProxmoxCatalog) bool { return uint64(c.VMID) == vmid })
+}
+
+func listOrphanVMs(pc *pveCluster, cluster *gprox.Cluster) ([]OrphanVM, error) {
+	resources, err := getProxmoxResources(cluster, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := db.GetAllVMIDs()
+	if err != nil {
+		logger.Error("Failed to get VM IDs", "error", err)
+		return nil, err
+	}
+
+	orphans := []OrphanVM{}
+	for _, r := range resources {
+		if r.Type != "qemu" || slices.Contains(ids, r.VMID) || isSassoTemplateVMID(pc, r.VMID) {
+			continue
+		}
+
+		group, ownerID, ok := parseSassoVMID(r.VMID)
+		if !ok {
+			continue
+		}
+
+		orphans = append(orphans, OrphanVM{
+			Cluster:   pc.name,
+			VMID:      r.VMID,
+			Node:      r.Node,
+			Name:      r.Name,
+			Status:    r.Status,
+			OwnerID:   ownerID,
+			OwnerType: ownerTypeFromGroupBit(group),
+		})
+	}
+	return orphans, nil
+}
+
+func listOrphanVNets(pc *pveCluster, cluster *gprox.Cluster) ([]OrphanVNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	pVNets, err := cluster.SDNVNets(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to get VNets from Proxmox", "error", err)
+		return nil, err
+	}
+
+	nets, err := db.GetAllNets()
+	if err != nil {
+		logger.Error("Failed to get nets", "error", err)
+		return nil, err
+	}
+
+	orphans := []OrphanVNet{}
+	for _, pn := range pVNets {
+		if pn.Zone != pc.network.SDNZone {
+			continue
+		}
+		if slices.ContainsFunc(nets, func(n db.Net) bool { return n.Name == pn.Name }) {
+			continue
+		}
+
+		orphans = append(orphans, OrphanVNet{
+			Cluster:   pc.name,
+			Name:      pn.Name,
+			Zone:      pn.Zone,
+			Tag:       pn.Tag,
+			VlanAware: pn.VlanAware == 1,
+		})
+	}
+	return orphans, nil
+}
+
+func listOrphanBackups(pc *pveCluster, cluster *gprox.Cluster) ([]OrphanBackup, error) {
+	resources, err := getProxmoxResources(cluster, "node")
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := db.GetAllVMs()
+	if err != nil {
+		logger.Error("Failed to get VMs", "error", err)
+		return nil, err
+	}
+	vmsCreatedAt := make(map[uint64]time.Time, len(vms))
+	for _, v := range vms {
+		vmsCreatedAt[v.ID] = v.CreatedAt
+	}
+
+	// The backup storage can be shared between the nodes, so the same backup
+	// can be listed more than once
+	seen := make(map[string]bool)
+	orphans := []OrphanBackup{}
+	for _, r := range resources {
+		if r.Type != "node" || r.Status != "online" {
+			continue
+		}
+
+		node, err := getProxmoxNode(pc.client, r.Node)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := getProxmoxStorage(node, pc.backup.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := getProxmoxStorageContent(s)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range content {
+			if seen[item.Volid] || !strings.Contains(item.Volid, ":backup/") {
+				continue
+			}
+			seen[item.Volid] = true
+
+			bkn, err := parseBackupNotes(item.Notes)
+			if err != nil || bkn.SassoVerifier != BackupSassoString {
+				continue
+			}
+
+			ctime := time.Unix(int64(item.Ctime), 0)
+			if createdAt, ok := vmsCreatedAt[item.VMID]; ok && ctime.After(createdAt) {
+				continue
+			}
+
+			h := hmac.New(sha256.New, nonce)
+			h.Write([]byte(item.Volid))
+
+			orphans = append(orphans, OrphanBackup{
+				ID:        hex.EncodeToString(h.Sum(nil)),
+				Cluster:   pc.name,
+				VMID:      item.VMID,
+				Ctime:     ctime,
+				Name:      bkn.Name,
+				Protected: bool(item.Protected),
+				OwnerID:   bkn.OwnerID,
+				OwnerType: bkn.OwnerType,
+				node:      r.Node,
+				volid:     item.Volid,
+			})
+		}
+	}
+	return orphans, nil
+}
+
+func findOrphanVM(pc *pveCluster, vmID uint64) (*OrphanVM, error) {
+	cluster, err := getProxmoxCluster(pc.client)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := listOrphanVMs(pc, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(vms, func(v OrphanVM) bool { return v.VMID == vmID })
+	if i == -1 {
+		return nil, ErrOrphanNotFound
+	}
+	return &vms[i], nil
+}
+
+// AdoptOrphanVM adds an orphan VM to the DB, owned by the user or the group
+// encoded in its VMID. The resources are read from Proxmox and the quota is
+// not checked. The interfaces of the VM are not adopted.
+func AdoptOrphanVM(clusterName string, vmID uint64, name string, lifeTime uint, includeGlobalSSHKeys bool) (*VM, error) {
+	if lifeTime == 0 {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("lifetime must be at least 1 month"))
+	}
+
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	orphan, err := findOrphanVM(pc, vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = orphan.Name
+	}
+	if !isValidVMName(name) {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
+	}
+
+	group := orphan.OwnerType == "Group"
+	if group {
+		_, err = db.GetGroupByID(orphan.OwnerID)
+	} else {
+		_, err = db.GetUserByID(orphan.OwnerID)
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrInvalidOwner
+		}
+		logger.Error("Failed to get owner of orphan VM", "vmID", vmID, "ownerID", orphan.OwnerID, "ownerType", orphan.OwnerType, "error", err)
+		return nil, err
+	}
+
+	var exists bool
+	if group {
+		exists, err = db.ExistsVMWithGroupIDAndName(orphan.OwnerID, name)
+	} else {
+		exists, err = db.ExistsVMWithUserIDAndName(orphan.OwnerID, name)
+	}
+	if err != nil {
+		logger.Error("Failed to check if VM name exists", "vmID", vmID, "error", err)
+		return nil, err
+	} else if exists {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("vm name already exists"))
+	}
+
+	node, err := getProxmoxNode(pc.client, orphan.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return nil, err
+	}
+
+	cores, ram, disk, err := getProxmoxVMResources(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	status := vmStatusFromProxmox(vm)
+
+	lifetime := time.Now().AddDate(0, int(lifeTime), 0)
+
+	var dbVM *db.VM
+	if group {
+		dbVM, err = db.NewVMForGroup(vmID, orphan.OwnerID, pc.name, string(status), name, "", cores, ram, disk, lifetime, includeGlobalSSHKeys, nil)
+	} else {
+		dbVM, err = db.NewVMForUser(vmID, orphan.OwnerID, pc.name, string(status), name, "", cores, ram, disk, lifetime, includeGlobalSSHKeys, nil)
+	}
+	if err != nil {
+		logger.Error("Failed to create adopted VM in database", "vmID", vmID, "error", err)
+		return nil, err
+	}
+
+	if err := db.UpdateVMNode(vmID, orphan.Node); err != nil {
+		logger.Error("Failed to update node of adopted VM", "vmID", vmID, "node", orphan.Node, "error", err)
+	}
+	dbVM.Node = orphan.Node
+
+	logger.Info("Admin adopted orphan VM", "vmID", vmID, "ownerID", orphan.OwnerID, "ownerType", orphan.OwnerType)
+	return convertDBVMToVM(dbVM, nil, nil, nil), nil
+}
+
+// DeleteOrphanVM stops and deletes an orphan VM from Proxmox. The deletion
+// task is not waited for.
+func DeleteOrphanVM(clusterName string, vmID uint64) error {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	orphan, err := findOrphanVM(pc, vmID)
+	if err != nil {
+		return err
+	}
+
+	node, err := getProxmoxNode(pc.client, orphan.Node)
+	if err != nil {
+		return err
+	}
+
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return err
+	}
+
+	if vm.Status == "running" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		task, err := vm.Stop(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("Failed to stop orphan VM", "vmID", vmID, "error", err)
+			return err
+		}
+		isSuccessful, err := waitForProxmoxTaskCompletion(context.Background(), task)
+		if err != nil {
+			return err
+		}
+		if !isSuccessful {
+			return errors.New("the stop task failed")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err = vm.Delete(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to delete orphan VM", "vmID", vmID, "error", err)
+		return err
+	}
+
+	logger.Info("Admin deleted orphan VM", "vmID", vmID, "node", orphan.Node)
+	return nil
+}
+
+func findOrphanVNet(pc *pveCluster, name string) (*gprox.Cluster, *OrphanVNet, error) {
+	cluster, err := getProxmoxCluster(pc.client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vnets, err := listOrphanVNets(pc, cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i := slices.IndexFunc(vnets, func(v OrphanVNet) bool { return v.Name == name })
+	if i == -1 {
+		return nil, nil, ErrOrphanNotFound
+	}
+	return cluster, &vnets[i], nil
+}
+
+// AdoptOrphanVNet adds an orphan VNet to the DB, owned by the given user or
+// group. The VNet is already on Proxmox, so it's ready right away.
+func AdoptOrphanVNet(clusterName, name string, userID uint, groupID *uint, alias string) (*db.Net, error) {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, orphan, err := findOrphanVNet(pc, name)
+	if err != nil {
+		return nil, err
+	}
+
+	nets, err := db.GetAllNets()
+	if err != nil {
+		logger.Error("Failed to get nets", "error", err)
+		return nil, err
+	}
+	// Tags are unique across the zones of all the clusters
+	if slices.ContainsFunc(nets, func(n db.Net) bool { return n.Tag == orphan.Tag }) {
+		logger.Warn("Tag of orphan VNet is already used", "vnet", name, "tag", orphan.Tag)
+		return nil, ErrVNetNameExists
+	}
+
+	if alias == "" {
+		alias = orphan.Name
+	}
+
+	var net *db.Net
+	if groupID != nil {
+		if _, err := db.GetGroupByID(*groupID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrInvalidOwner
+			}
+			logger.Error("Failed to get group", "groupID", *groupID, "error", err)
+			return nil, err
+		}
+		net, err = db.CreateNetForGroup(*groupID, orphan.Name, alias, pc.name, orphan.Zone, orphan.Tag, orphan.VlanAware, string(VNetStatusReady))
+	} else {
+		if _, err := db.GetUserByID(userID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil, ErrInvalidOwner
+			}
+			logger.Error("Failed to get user", "userID", userID, "error", err)
+			return nil, err
+		}
+		net, err = db.CreateNetForUser(userID, orphan.Name, alias, pc.name, orphan.Zone, orphan.Tag, orphan.VlanAware, string(VNetStatusReady))
+	}
+	if err != nil {
+		logger.Error("Failed to create adopted net in database", "vnet", name, "error", err)
+		return nil, err
+	}
+
+	logger.Info("Admin adopted orphan VNet", "vnet", name, "userID", userID, "groupID", groupID)
+	return net, nil
+}
+
+// DeleteOrphanVNet deletes an orphan VNet from Proxmox and applies the SDN
+// changes
+func DeleteOrphanVNet(clusterName, name string) error {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	cluster, _, err := findOrphanVNet(pc, name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = cluster.DeleteSDNVNet(ctx, name)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to delete orphan VNet", "vnet", name, "error", err)
+		return err
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	task, err := cluster.SDNApply(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to apply SDN changes", "error", err)
+		return err
+	}
+
+	isSuccessful, err := waitForProxmoxTaskCompletion(context.Background(), task)
+	if err != nil {
+		return err
+	}
+	if !isSuccessful {
+		return errors.New("the SDN apply task failed")
+	}
+
+	logger.Info("Admin deleted orphan VNet", "vnet", name)
+	return nil
+}
+
+// DeleteOrphanBackup deletes an orphan backup from the backup storage.
+// Orphan backups can't be adopted, as they have no VM to be restored on.
+func DeleteOrphanBackup(clusterName, backupID string) error {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := getProxmoxCluster(pc.client)
+	if err != nil {
+		return err
+	}
+
+	backups, err := listOrphanBackups(pc, cluster)
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(backups, func(b OrphanBackup) bool { return b.ID == backupID })
+	if i == -1 {
+		return ErrOrphanNotFound
+	}
+	b := backups[i]
+	if b.Protected {
+		return ErrCantDeleteBackup
+	}
+
+	node, err := getProxmoxNode(pc.client, b.node)
+	if err != nil {
+		return err
+	}
+
+	s, err := getProxmoxStorage(node, pc.backup.Storage)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	task, err := s.DeleteContent(ctx, b.volid)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to delete orphan backup", "volid", b.volid, "error", err)
+		return err
+	}
+
+	isSuccessful, err := waitForProxmoxTaskCompletion(context.Background(), task)
+	if err != nil {
+		return err
+	}
+	if !isSuccessful {
+		return errors.New("the backup deletion task failed")
+	}
+
+	logger.Info("Admin deleted orphan backup", "vmID", b.VMID, "volid", b.volid)
+	return nil
+}
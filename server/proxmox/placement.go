@@ -0,0 +1,250 @@
+package proxmox
+
+import (
+	"errors"
+	"slices"
+	"sort"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+var (
+	PlacementStrategySpread = "spread"
+	PlacementStrategyPack   = "pack"
+	PlacementStrategyPinned = "pinned"
+
+	ErrInvalidPlacementStrategy = errors.New("invalid_placement_strategy")
+	ErrNoSuitableNode           = errors.New("no_suitable_node")
+)
+
+// nodeCandidate holds the free resources of a Proxmox node. The values are
+// updated while placing VMs, so that multiple VMs placed in the same worker
+// cycle do not all end up on the same node.
+type nodeCandidate struct {
+	Name     string
+	FreeRAM  uint64 // in bytes
+	MaxRAM   uint64 // in bytes
+	CPULoad  float64
+	MaxCPU   uint64
+	FreeDisk uint64 // in bytes, on the placement storage
+}
+
+func placementConfigChecks(strategy string, targetNode string) error {
+	switch strategy {
+	case PlacementStrategySpread, PlacementStrategyPack:
+		return nil
+	case PlacementStrategyPinned:
+		if targetNode == "" {
+			logger.Error("Proxmox clone target node must be set with the pinned placement strategy")
+			return ErrInvalidPlacementStrategy
+		}
+		return nil
+	default:
+		logger.Error("Invalid Proxmox placement strategy", "strategy", strategy)
+		return ErrInvalidPlacementStrategy
+	}
+}
+
+// getNodeCandidates returns the online nodes that can host VMs, together
+// with their free resources. Nodes that are being drained are excluded.
+func getNodeCandidates(pc *pveCluster, cluster *gprox.Cluster) (map[string]*nodeCandidate, error) {
+	resources, err := getProxmoxResources(cluster, "node")
+	if err != nil {
+		return nil, err
+	}
+
+	drainingNodes, err := db.GetDrainingNodes()
+	if err != nil {
+		logger.Error("Failed to get draining nodes", "error", err)
+		return nil, err
+	}
+
+	candidates := make(map[string]*nodeCandidate)
+	for _, r := range resources {
+		if r.Type != "node" || r.Status != "online" {
+			continue
+		}
+		if len(pc.placement.Nodes) > 0 && !slices.Contains(pc.placement.Nodes, r.Node) {
+			continue
+		}
+		if slices.Contains(drainingNodes, r.Node) {
+			continue
+		}
+
+		var freeRAM uint64
+		if r.MaxMem > r.Mem {
+			freeRAM = r.MaxMem - r.Mem
+		}
+		candidates[r.Node] = &nodeCandidate{
+			Name:    r.Node,
+			FreeRAM: freeRAM,
+			MaxRAM:  r.MaxMem,
+			CPULoad: r.CPU,
+			MaxCPU:  r.MaxCPU,
+		}
+	}
+
+	if pc.placement.Storage == "" {
+		return candidates, nil
+	}
+
+	resources, err = getProxmoxResources(cluster, "storage")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range resources {
+		if r.Type != "storage" || r.Storage != pc.placement.Storage || r.Status != "available" {
+			continue
+		}
+		c, ok := candidates[r.Node]
+		if !ok {
+			continue
+		}
+		if r.MaxDisk > r.Disk {
+			c.FreeDisk = r.MaxDisk - r.Disk
+		}
+	}
+
+	return candidates, nil
+}
+
+// allowedNodesForVM filters the candidates with the node policies of the
+// realm of the owner (for user VMs) or of the group (for group VMs). Only the
+// policies of the cluster, or of any cluster, are applied.
+func allowedNodesForVM(pc *pveCluster, candidates map[string]*nodeCandidate, vm *db.VM) ([]*nodeCandidate, error) {
+	policies, err := ownerNodePolicies(vm.OwnerID, vm.OwnerType)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := []string{}
+	denied := []string{}
+	for _, p := range policies {
+		if p.Cluster != "" && p.Cluster != pc.name {
+			continue
+		}
+		if p.Action == db.NodePolicyAllow {
+			allowed = append(allowed, p.Node)
+		} else {
+			denied = append(denied, p.Node)
+		}
+	}
+
+	nodes := make([]*nodeCandidate, 0, len(candidates))
+	for name, c := range candidates {
+		if len(allowed) > 0 && !slices.Contains(allowed, name) {
+			continue
+		}
+		if slices.Contains(denied, name) {
+			continue
+		}
+		nodes = append(nodes, c)
+	}
+
+	// Sort by name to have a deterministic choice between equal nodes
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	return nodes, nil
+}
+
+// selectNodeForVM chooses the node where the VM will be cloned, following the
+// configured strategy. The resources of the chosen node are reserved in the
+// candidate.
+func selectNodeForVM(pc *pveCluster, candidates map[string]*nodeCandidate, vm *db.VM) (string, error) {
+	nodes, err := allowedNodesForVM(pc, candidates, vm)
+	if err != nil {
+		return "", err
+	}
+
+	ram := uint64(vm.RAM) * 1024 * 1024
+	disk := uint64(vm.Disk) * 1024 * 1024 * 1024
+
+	fits := func(n *nodeCandidate) bool {
+		if n.FreeRAM < ram {
+			return false
+		}
+		return pc.placement.Storage == "" || n.FreeDisk >= disk
+	}
+
+	var best *nodeCandidate
+	if pc.placement.Strategy == PlacementStrategyPinned {
+		// The target node is preferred, the other allowed nodes are used if
+		// it's denied or full
+		for _, n := range nodes {
+			if !fits(n) {
+				continue
+			}
+			if n.Name == pc.targetNode {
+				best = n
+				break
+			}
+			if best == nil {
+				best = n
+			}
+		}
+	} else {
+		var bestScore float64
+		for _, n := range nodes {
+			if !fits(n) {
+				continue
+			}
+
+			// The score is higher for nodes with more free resources
+			score := 1 - n.CPULoad
+			if n.MaxRAM > 0 {
+				score += float64(n.FreeRAM) / float64(n.MaxRAM)
+			}
+
+			if best == nil ||
+				(pc.placement.Strategy == PlacementStrategySpread && score > bestScore) ||
+				(pc.placement.Strategy == PlacementStrategyPack && score < bestScore) {
+				best = n
+				bestScore = score
+			}
+		}
+	}
+
+	if best == nil {
+		return "", ErrNoSuitableNode
+	}
+
+	best.FreeRAM -= ram
+	if pc.placement.Storage != "" {
+		best.FreeDisk -= disk
+	}
+	if best.MaxCPU > 0 {
+		best.CPULoad += float64(vm.Cores) / float64(best.MaxCPU)
+	}
+
+	return best.Name, nil
+}
+
+// NodeExists returns true if the node is a node of the cluster. If
+// clusterName is empty, the node is looked for on every cluster.
+func NodeExists(clusterName, node string) (bool, error) {
+	for _, pc := range clusters {
+		if clusterName != "" && pc.name != clusterName {
+			continue
+		}
+
+		cluster, err := getProxmoxCluster(pc.client)
+		if err != nil {
+			return false, err
+		}
+		resources, err := getProxmoxResources(cluster, "node")
+		if err != nil {
+			return false, err
+		}
+		for _, r := range resources {
+			if r.Type == "node" && r.Node == node {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,151 @@
+package proxmox
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// Default limits of the tasks that the worker runs at the same time
+	defaultWorkerMaxTasks        = 8
+	defaultWorkerMaxTasksPerNode = 2
+)
+
+// taskPool bounds the number of Proxmox tasks that the worker runs at the
+// same time, both globally and on every node. Tasks on the same VM are
+// serialized, so two tasks never lock the same VM config on Proxmox.
+type taskPool struct {
+	global      chan struct{}
+	maxPerNode  int
+	mu          sync.Mutex
+	nodes       map[string]chan struct{}
+	vms         map[uint64]*sync.Mutex
+	vmsRefCount map[uint64]int
+}
+
+func newTaskPool(maxTasks, maxTasksPerNode int) *taskPool {
+	return &taskPool{
+		global:      make(chan struct{}, maxTasks),
+		maxPerNode:  maxTasksPerNode,
+		nodes:       make(map[string]chan struct{}),
+		vms:         make(map[uint64]*sync.Mutex),
+		vmsRefCount: make(map[uint64]int),
+	}
+}
+
+func (p *taskPool) nodeSemaphore(node string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.nodes[node]
+	if !ok {
+		s = make(chan struct{}, p.maxPerNode)
+		p.nodes[node] = s
+	}
+	return s
+}
+
+// lockVM locks the mutex of a VM. The mutex is removed when no task is using
+// it anymore
+func (p *taskPool) lockVM(vmID uint64) {
+	p.mu.Lock()
+	m, ok := p.vms[vmID]
+	if !ok {
+		m = &sync.Mutex{}
+		p.vms[vmID] = m
+	}
+	p.vmsRefCount[vmID]++
+	p.mu.Unlock()
+
+	m.Lock()
+}
+
+func (p *taskPool) unlockVM(vmID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.vms[vmID].Unlock()
+	p.vmsRefCount[vmID]--
+	if p.vmsRefCount[vmID] == 0 {
+		delete(p.vms, vmID)
+		delete(p.vmsRefCount, vmID)
+	}
+}
+
+// stageRun runs the tasks of a worker stage in the pool of the cluster. The
+// stage is completed when Wait returns. When the worker context is done, the
+// tasks that are not started yet are dropped.
+type stageRun struct {
+	stage string
+	ctx   context.Context
+	pool  *taskPool
+	wg    sync.WaitGroup
+}
+
+func (pc *pveCluster) newStageRun(stage string) *stageRun {
+	return &stageRun{stage: stage, ctx: workerContext, pool: pc.pool}
+}
+
+// Go runs f in the pool. If node is empty only the global limit is applied,
+// if vmID is 0 the task is not serialized with the other tasks on the VM.
+func (s *stageRun) Go(node string, vmID uint64, f func()) {
+	workerQueueDepth.WithLabelValues(s.stage).Inc()
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		// The VM is locked first, so a task waiting for another task on the
+		// same VM doesn't hold a slot of the pool
+		if vmID != 0 {
+			s.pool.lockVM(vmID)
+			defer s.pool.unlockVM(vmID)
+		}
+
+		// The node slot is taken before the global one, so the tasks waiting
+		// for a busy node don't block the tasks on the other nodes
+		if node != "" {
+			ns := s.pool.nodeSemaphore(node)
+			if !s.acquire(ns) {
+				return
+			}
+			defer func() { <-ns }()
+		}
+
+		if !s.acquire(s.pool.global) {
+			return
+		}
+		defer func() { <-s.pool.global }()
+
+		workerQueueDepth.WithLabelValues(s.stage).Dec()
+
+		// Another instance could have become the leader while the task was
+		// waiting, and two instances must never change the same object. The
+		// lock is checked on Postgres once per stage by runStage, and the
+		// worker context is canceled as soon as the leadership is lost
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		workerRunningTasks.WithLabelValues(s.stage).Inc()
+		defer workerRunningTasks.WithLabelValues(s.stage).Dec()
+
+		f()
+	}()
+}
+
+// acquire takes a slot of the semaphore. It returns false if the worker
+// context is done before a slot is free.
+func (s *stageRun) acquire(sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-s.ctx.Done():
+		workerQueueDepth.WithLabelValues(s.stage).Dec()
+		return false
+	}
+}
+
+func (s *stageRun) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,35 @@
+package proxmox
+
+import (
+	"sync"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+// Out ports of the port forwards
+const (
+	portForwardMinOutPort uint16 = 20000
+	portForwardMaxOutPort uint16 = 40000
+)
+
+// Used to serialize the choice of a free out port with the creation of the
+// port forward, both for the APIs and the stacks
+var randomPortMutex = sync.Mutex{}
+
+// NewPortForward creates a port forward of the owner on a random free out
+// port
+func NewPortForward(ownerID uint, ownerType string, destPort uint16, destIP, subnet string) (*db.PortForward, error) {
+	randomPortMutex.Lock()
+	defer randomPortMutex.Unlock()
+
+	// TODO: Make this values configurable
+	outPort, err := db.GetRandomAvailableOutPort(portForwardMinOutPort, portForwardMaxOutPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if ownerType == "Group" {
+		return db.AddPortForwardForGroup(outPort, destPort, destIP, subnet, ownerID)
+	}
+	return db.AddPortForwardForUser(outPort, destPort, destIP, subnet, ownerID)
+}
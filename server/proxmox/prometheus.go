@@ -27,6 +27,18 @@ var (
 			Name: "sasso_object_count",
 			Help: "Number of objects in the system.",
 		}, []string{"object"})
+
+	workerQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sasso_worker_queue_depth",
+			Help: "Number of worker tasks waiting for a slot in the pool.",
+		}, []string{"stage"})
+
+	workerRunningTasks = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sasso_worker_running_tasks",
+			Help: "Number of worker tasks running in the pool.",
+		}, []string{"stage"})
 )
 
 func workerCycleDurationObserve(function string, f func()) {
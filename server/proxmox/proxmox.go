@@ -3,26 +3,20 @@ package proxmox
 import (
 	"context"
 	"crypto/rand"
-	"crypto/tls"
 	"errors"
 	"log/slog"
-	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"samuelemusiani/sasso/server/config"
-
-	"github.com/luthermonson/go-proxmox"
+	"samuelemusiani/sasso/server/db"
 )
 
 var (
-	client *proxmox.Client = nil
-	logger *slog.Logger    = nil
+	logger *slog.Logger = nil
 
-	cTemplate *config.ProxmoxTemplate = nil
-	cClone    *config.ProxmoxClone    = nil
-	cNetwork  *config.ProxmoxNetwork  = nil
-	cBackup   *config.ProxmoxBackup   = nil
+	cClone *config.ProxmoxClone = nil
 
 	// nonce is used to generate backup names
 	nonce []byte = nil
@@ -34,10 +28,13 @@ var (
 	ErrTaskFailed             = errors.New("task_failed")
 	ErrInvalidStorage         = errors.New("invalid_storage")
 	ErrCantGenerateNonce      = errors.New("cant_generate_nonce")
+	ErrInvalidCatalog         = errors.New("invalid_catalog")
+	ErrInvalidWorkerLimits    = errors.New("invalid_worker_limits")
+	ErrInvalidDriftConfig     = errors.New("invalid_drift_config")
+	ErrInvalidClusters        = errors.New("invalid_clusters")
 	ErrPermissionDenied       = errors.New("permission_denied")
 	ErrNotFound               = errors.New("a resouces can't be found")
 
-	isProxmoxReachable = true
 	isGatewayReachable = true
 	isVPNReachable     = true
 )
@@ -45,6 +42,20 @@ var (
 func Init(proxmoxLogger *slog.Logger, config config.Proxmox) error {
 	logger = proxmoxLogger
 
+	// Before the placement strategies were introduced every VM was cloned on
+	// the clone target node
+	if config.Placement.Strategy == "" {
+		config.Placement.Strategy = PlacementStrategyPinned
+	}
+	if config.Name == "" {
+		config.Name = defaultClusterName
+	}
+	for i := range config.Clusters {
+		if config.Clusters[i].Placement.Strategy == "" {
+			config.Clusters[i].Placement.Strategy = PlacementStrategyPinned
+		}
+	}
+
 	err := configChecks(config)
 	if err != nil {
 		return err
@@ -58,30 +69,51 @@ func Init(proxmoxLogger *slog.Logger, config config.Proxmox) error {
 		return ErrCantGenerateNonce
 	}
 
-	url := config.Url
-	if !strings.Contains(config.Url, "api2/json") {
-		if !strings.HasSuffix(config.Url, "/") {
-			url += "/"
-		}
-		url += "api2/json"
+	maxTasks := config.Worker.MaxTasks
+	if maxTasks == 0 {
+		maxTasks = defaultWorkerMaxTasks
 	}
-
-	http_client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.InsecureSkipVerify,
-			},
-		},
+	maxTasksPerNode := config.Worker.MaxTasksPerNode
+	if maxTasksPerNode == 0 {
+		maxTasksPerNode = defaultWorkerMaxTasksPerNode
 	}
 
-	client = proxmox.NewClient(url,
-		proxmox.WithHTTPClient(&http_client),
-		proxmox.WithAPIToken(config.TokenID, config.Secret))
+	mainCluster := newPVECluster(config.Name, config.Url, config.TokenID, config.Secret, config.InsecureSkipVerify, maxTasks, maxTasksPerNode)
+	mainCluster.template = &config.Template
+	mainCluster.catalog = config.Catalog
+	mainCluster.targetNode = config.Clone.TargetNode
+	mainCluster.network = &config.Network
+	mainCluster.backup = &config.Backup
+	mainCluster.placement = &config.Placement
+	mainCluster.container = &config.Container
+	clusters = []*pveCluster{mainCluster}
+
+	for i := range config.Clusters {
+		c := &config.Clusters[i]
+		pc := newPVECluster(c.Name, c.Url, c.TokenID, c.Secret, c.InsecureSkipVerify, maxTasks, maxTasksPerNode)
+		pc.template = &c.Template
+		pc.catalog = c.Catalog
+		pc.targetNode = c.TargetNode
+		pc.network = &c.Network
+		pc.backup = &c.Backup
+		pc.placement = &c.Placement
+		pc.container = &c.Container
+		clusters = append(clusters, pc)
+	}
 
-	cTemplate = &config.Template
 	cClone = &config.Clone
-	cNetwork = &config.Network
-	cBackup = &config.Backup
+
+	// The objects created before the clusters were introduced are on the main
+	// cluster
+	if err := db.AssignDefaultCluster(mainCluster.name); err != nil {
+		logger.Error("Failed to assign objects to the main cluster", "error", err)
+		return err
+	}
+
+	if config.Drift.IntervalMinutes > 0 {
+		driftCheckInterval = time.Duration(config.Drift.IntervalMinutes) * time.Minute
+	}
+	driftAutoCorrect = config.Drift.AutoCorrect
 
 	return nil
 }
@@ -104,55 +136,130 @@ func configChecks(config config.Proxmox) error {
 		return ErrInvalidCloneIDTemplate
 	}
 
-	if config.Network.SDNZone == "" {
-		logger.Error("Proxmox SDN zone is not configured", "zone", config.Network.SDNZone)
+	if err := clusterConfigChecks(config.Name, config.Network, config.Backup, config.Catalog, config.Placement.Strategy, config.Clone.TargetNode); err != nil {
+		return err
+	}
+
+	names := map[string]bool{config.Name: true}
+	vxlanRanges := [][2]uint32{{config.Network.VXLANIDStart, config.Network.VXLANIDEnd}}
+	for _, c := range config.Clusters {
+		if c.Name == "" || c.Url == "" {
+			logger.Error("Proxmox clusters must have a name and a URL", "cluster", c.Name)
+			return ErrInvalidClusters
+		}
+		if names[c.Name] {
+			logger.Error("Proxmox cluster names must be unique", "cluster", c.Name)
+			return ErrInvalidClusters
+		}
+		names[c.Name] = true
+
+		if err := clusterConfigChecks(c.Name, c.Network, c.Backup, c.Catalog, c.Placement.Strategy, c.TargetNode); err != nil {
+			return err
+		}
+
+		// The VXLAN IDs are unique in the DB
+		for _, r := range vxlanRanges {
+			if c.Network.VXLANIDStart <= r[1] && r[0] <= c.Network.VXLANIDEnd {
+				logger.Error("Proxmox VXLAN ranges of the clusters must not overlap", "cluster", c.Name)
+				return ErrInvalidVXLANRange
+			}
+		}
+		vxlanRanges = append(vxlanRanges, [2]uint32{c.Network.VXLANIDStart, c.Network.VXLANIDEnd})
+	}
+
+	if config.Worker.MaxTasks < 0 || config.Worker.MaxTasksPerNode < 0 {
+		logger.Error("Proxmox worker task limits can't be negative", "max_tasks", config.Worker.MaxTasks, "max_tasks_per_node", config.Worker.MaxTasksPerNode)
+		return ErrInvalidWorkerLimits
+	}
+
+	if config.Drift.IntervalMinutes < 0 {
+		logger.Error("Proxmox drift check interval can't be negative", "interval_minutes", config.Drift.IntervalMinutes)
+		return ErrInvalidDriftConfig
+	}
+	for _, t := range config.Drift.AutoCorrect {
+		if !slices.Contains(driftObjectTypes, t) {
+			logger.Error("Invalid object type for drift auto correction", "type", t, "valid_types", driftObjectTypes)
+			return ErrInvalidDriftConfig
+		}
+	}
+
+	return nil
+}
+
+// clusterConfigChecks checks the settings that every cluster has
+func clusterConfigChecks(name string, network config.ProxmoxNetwork, backup config.ProxmoxBackup, catalog []config.ProxmoxCatalog, placementStrategy, targetNode string) error {
+	if network.SDNZone == "" {
+		logger.Error("Proxmox SDN zone is not configured", "cluster", name, "zone", network.SDNZone)
 		return ErrInvalidSDNZone
 	}
 
-	if config.Network.VXLANIDStart <= 0 {
-		logger.Error("Proxmox VXLAN ID start must be greater than 0", "vxlan_id_start", config.Network.VXLANIDStart)
+	if network.VXLANIDStart <= 0 {
+		logger.Error("Proxmox VXLAN ID start must be greater than 0", "cluster", name, "vxlan_id_start", network.VXLANIDStart)
 		return ErrInvalidVXLANRange
 	}
 
-	if config.Network.VXLANIDEnd <= config.Network.VXLANIDStart {
-		logger.Error("Proxmox VXLAN ID end must be greater than VXLAN ID start", "vxlan_id_start", config.Network.VXLANIDStart, "vxlan_id_end", config.Network.VXLANIDEnd)
+	if network.VXLANIDEnd <= network.VXLANIDStart {
+		logger.Error("Proxmox VXLAN ID end must be greater than VXLAN ID start", "cluster", name, "vxlan_id_start", network.VXLANIDStart, "cluster", name, "vxlan_id_end", network.VXLANIDEnd)
 		return ErrInvalidVXLANRange
 	}
 
-	if config.Network.VXLANIDEnd >= 1<<24 {
-		logger.Error("Proxmox VXLAN ID end must be less than 16777216 (2^24)", "vxlan_id_end", config.Network.VXLANIDEnd)
+	if network.VXLANIDEnd >= 1<<24 {
+		logger.Error("Proxmox VXLAN ID end must be less than 16777216 (2^24)", "cluster", name, "vxlan_id_end", network.VXLANIDEnd)
 		return ErrInvalidVXLANRange
 	}
 
-	if config.Backup.Storage == "" {
-		logger.Error("Proxmox backup storage is not configured")
+	if backup.Storage == "" {
+		logger.Error("Proxmox backup storage is not configured", "cluster", name)
 		return ErrInvalidStorage
 	}
-	return nil
+
+	names := make(map[string]bool)
+	for _, t := range catalog {
+		if t.Name == "" || t.Node == "" || t.VMID <= 0 {
+			logger.Error("Proxmox catalog templates must have a name, a node and a VMID", "cluster", name, "template", t)
+			return ErrInvalidCatalog
+		}
+		if names[t.Name] {
+			logger.Error("Proxmox catalog template names must be unique", "cluster", name, "name", t.Name)
+			return ErrInvalidCatalog
+		}
+		names[t.Name] = true
+	}
+
+	return placementConfigChecks(placementStrategy, targetNode)
 }
 
+// TestEndpointVersion checks that the clusters are reachable
 func TestEndpointVersion() {
+	for _, pc := range clusters[1:] {
+		go testEndpointVersion(pc)
+	}
+	testEndpointVersion(clusters[0])
+}
+
+func testEndpointVersion(pc *pveCluster) {
 	first := true
 	wasError := false
+	l := logger.With("cluster", pc.name)
 
 	for {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 
-		version, err := client.Version(ctx)
+		version, err := pc.client.Version(ctx)
 		cancel() // Cancel immediately after the call
 
 		if err != nil {
-			logger.Error("Failed to get Proxmox version", "error", err)
+			l.Error("Failed to get Proxmox version", "error", err)
 			wasError = true
-			isProxmoxReachable = false
+			pc.reachable.Store(false)
 		} else if first {
-			logger.Info("Proxmox version", "version", version.Version)
+			l.Info("Proxmox version", "version", version.Version)
 			first = false
-			isProxmoxReachable = true
+			pc.reachable.Store(true)
 		} else if wasError {
-			logger.Info("Proxmox version endpoint is back online", "version", version.Version)
+			l.Info("Proxmox version endpoint is back online", "version", version.Version)
 			wasError = false
-			isProxmoxReachable = true
+			pc.reachable.Store(true)
 		}
 
 		time.Sleep(10 * time.Second)
@@ -0,0 +1,37 @@
+package proxmox
+
+import (
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/notify"
+)
+
+// revertExpiredQuotaIncreases removes the resources granted by temporary quota
+// requests that are expired and notifies the owners
+func revertExpiredQuotaIncreases() {
+	logger.Debug("Reverting expired quota increases in worker")
+
+	requests, err := db.GetExpiredQuotaRequests()
+	if err != nil {
+		logger.Error("Failed to get expired quota requests", "error", err)
+		return
+	}
+
+	for _, r := range requests {
+		qr, err := db.RevertQuotaRequest(r.ID)
+		if err != nil {
+			logger.Error("Failed to revert quota request", "id", r.ID, "error", err)
+			continue
+		}
+
+		logger.Info("Reverted expired quota increase", "id", qr.ID, "ownerID", qr.OwnerID, "ownerType", qr.OwnerType)
+
+		if qr.OwnerType == "Group" {
+			err = notify.SendQuotaIncreaseRevertedNotificationToGroup(qr.OwnerID, qr)
+		} else {
+			err = notify.SendQuotaIncreaseRevertedNotification(qr.OwnerID, qr)
+		}
+		if err != nil {
+			logger.Error("Failed to send quota increase reverted notification", "id", qr.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("template_not_found")
+
+	vmStatesForRebuild = []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused, VMStatusHibernated, VMStatusUnknown}
+)
+
+type CatalogTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ListCatalogTemplates returns the templates that can be chosen when
+// rebuilding a VM on a cluster. An empty name is the main cluster.
+func ListCatalogTemplates(clusterName string) ([]CatalogTemplate, error) {
+	pc, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]CatalogTemplate, len(pc.catalog))
+	for i, t := range pc.catalog {
+		templates[i] = CatalogTemplate{
+			Name:        t.Name,
+			Description: t.Description,
+		}
+	}
+	return templates, nil
+}
+
+// getTemplateLocation returns the node and the VMID of a catalog template of
+// the cluster. If name is empty the default template is returned.
+func getTemplateLocation(pc *pveCluster, name string) (string, int, error) {
+	if name == "" {
+		return pc.template.Node, pc.template.VMID, nil
+	}
+
+	for _, t := range pc.catalog {
+		if t.Name == name {
+			return t.Node, t.VMID, nil
+		}
+	}
+	return "", 0, ErrTemplateNotFound
+}
+
+// getRebuildTemplateLocation returns the node and the VMID of the template
+// used to rebuild a VM. Without a catalog template, a VM created from a
+// private template is rebuilt from it. If the private template was deleted
+// after the request, the default template is used.
+func getRebuildTemplateLocation(pc *pveCluster, v *db.VM) (string, int, error) {
+	if v.RebuildTemplate != "" || v.TemplateID == nil {
+		return getTemplateLocation(pc, v.RebuildTemplate)
+	}
+
+	t, err := getReadyPrivateTemplate(*v.TemplateID)
+	if err != nil {
+		if errors.Is(err, ErrTemplateNotFound) {
+			logger.Warn("Private template of VM not available, rebuilding from the default template", "vmid", v.ID, "template_id", *v.TemplateID)
+			return getTemplateLocation(pc, "")
+		}
+		return "", 0, err
+	}
+	return t.Node, int(t.VMID), nil
+}
+
+// RebuildVM schedules the rebuild of a VM from the default template or from
+// a catalog template. The VM keeps its VMID, interfaces, port forwards and
+// SSH keys, but the disk is recreated from the template.
+func RebuildVM(vmID uint64, template string) error {
+	vm, err := db.GetVMByID(vmID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrVMNotFound
+		}
+		logger.Error("Failed to get VM from database for rebuild", "vmID", vmID, "error", err)
+		return err
+	}
+
+	if !slices.Contains(vmStatesForRebuild, VMStatus(vm.Status)) {
+		logger.Warn("VM is not in a valid state for rebuild", "vmID", vmID, "status", vm.Status)
+		return ErrInvalidVMState
+	}
+
+	if vm.LifeTime.Before(time.Now()) {
+		return errors.Join(ErrInvalidVMState, errors.New("vm lifetime has expired"))
+	}
+
+	pc, err := getVMCluster(vm)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := getTemplateLocation(pc, template); err != nil {
+		return err
+	}
+
+	// Without a catalog template the VM is rebuilt from its private template,
+	// which must still be available
+	if template == "" && vm.TemplateID != nil {
+		if _, err := getReadyPrivateTemplate(*vm.TemplateID); err != nil {
+			if errors.Is(err, ErrTemplateNotFound) {
+				return errors.Join(err, errors.New("the private template of the vm is not available, choose a template"))
+			}
+			return err
+		}
+	}
+
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return err
+	} else if migrating {
+		return ErrVMMigrating
+	}
+
+	err = db.RebuildVM(vmID, string(VMStatusPreRebuilding), template, string(InterfaceStatusPreCreating))
+	if err != nil {
+		logger.Error("Failed to set VM for rebuild", "vmID", vmID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// rebuildVMs rebuilds VMs that are in the 'pre-rebuilding' status. The VM is
+// deleted from Proxmox and the template is cloned again with the same VMID on
+// the same node. When the clone is completed the VM goes through the
+// 'pre-configuring' status, and the interfaces are created again by
+// createInterfaces.
+func rebuildVMs(pc *pveCluster, vmNodes map[uint64]string) {
+	logger.Debug("Rebuilding VMs in worker")
+
+	vms, err := db.GetVMsWithStatus(string(VMStatusPreRebuilding))
+	if err != nil {
+		logger.Error("Failed to get VMs with 'pre-rebuilding' status", "error", err)
+		return
+	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
+
+	// https://github.com/luthermonson/go-proxmox/issues/102
+	var optionFull uint8
+	if cClone.Full {
+		optionFull = 1
+	} else {
+		optionFull = 0
+	}
+
+	run := pc.newStageRun("rebuild_vms")
+	for _, v := range vms {
+		if waitingForRetry(v.NextRetryAt) {
+			continue
+		}
+
+		run.Go(vmNodes[v.ID], v.ID, func() {
+			templateNodeName, templateVMID, err := getRebuildTemplateLocation(pc, &v)
+			if err != nil {
+				// The catalog changed after the request, or the private template
+				// was deleted
+				vmFailed(&v, "rebuild", err)
+				completeFailedVMRebuild(v.ID)
+				return
+			}
+
+			// The VM is retried while it's still in pre-rebuilding, and the
+			// rebuild is ended after the last attempt
+			attemptFailed := func(err error) {
+				if !vmAttemptFailed(&v, VMStatusPreRebuilding, "rebuild", err) {
+					completeFailedVMRebuild(v.ID)
+				}
+			}
+
+			templateNode, err := getProxmoxNode(pc.client, templateNodeName)
+			if err != nil {
+				attemptFailed(err)
+				return
+			}
+
+			templateVm, err := getProxmoxVM(templateNode, templateVMID)
+			if err != nil {
+				attemptFailed(err)
+				return
+			}
+
+			vmName, err := proxmoxVMName(&v)
+			if err != nil {
+				logger.Error("Failed to get unique owner ID for VM naming", "vmid", v.ID, "err", err)
+				return
+			}
+
+			logger.Debug("Rebuilding VM", "vmid", v.ID, "template", templateVMID)
+
+			targetNode, ok := vmNodes[v.ID]
+			if ok {
+				if err := destroyVMForRebuild(pc, targetNode, v.ID); err != nil {
+					attemptFailed(err)
+					return
+				}
+			} else {
+				// The VM is already gone from Proxmox, it's cloned again where it
+				// was placed
+				targetNode = v.Node
+				if targetNode == "" {
+					targetNode = pc.targetNode
+				}
+			}
+
+			err = db.UpdateVMStatus(v.ID, string(VMStatusRebuilding))
+			if err != nil {
+				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusRebuilding, "err", err)
+			}
+
+			cloningOptions := gprox.VirtualMachineCloneOptions{
+				Full:   optionFull,
+				Target: targetNode,
+				Name:   vmName,
+				NewID:  int(v.ID),
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, task, err := templateVm.Clone(ctx, &cloningOptions)
+			cancel()
+			if err != nil {
+				// The VM is already destroyed, so the next attempt only clones it
+				attemptFailed(err)
+				return
+			}
+
+			// The rebuild is completed by pollTasks
+			err = db.SetVMTask(v.ID, string(VMStatusRebuilding), string(task.UPID), targetNode)
+			if err != nil {
+				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusRebuilding, "err", err)
+			}
+		})
+	}
+	run.Wait()
+}
+
+// completeFailedVMRebuild ends a rebuild that won't be retried anymore
+func completeFailedVMRebuild(vmID uint64) {
+	err := db.CompleteVMRebuild(vmID, string(VMStatusUnknown))
+	if err != nil {
+		logger.Error("Failed to update status of VM", "vmid", vmID, "new_status", VMStatusUnknown, "err", err)
+	}
+}
+
+// destroyVMForRebuild stops and deletes the VM from Proxmox. It returns nil
+// if the VM has been deleted.
+func destroyVMForRebuild(pc *pveCluster, nodeName string, vmID uint64) error {
+	node, err := getProxmoxNode(pc.client, nodeName)
+	if err != nil {
+		return err
+	}
+
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return err
+	}
+
+	if vm.Status != "stopped" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		task, err := vm.Stop(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("Can't stop VM before rebuild", "err", err, "vmid", vmID)
+			return err
+		}
+		if _, err := waitForProxmoxTaskCompletion(workerContext, task); err != nil {
+			logger.Error("Can't stop VM before rebuild", "err", err, "vmid", vmID)
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	task, err := vm.Delete(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Can't delete VM for rebuild", "err", err, "vmid", vmID)
+		return err
+	}
+
+	if _, err := waitForProxmoxTaskCompletion(workerContext, task); err != nil {
+		logger.Error("Can't delete VM for rebuild", "err", err, "vmid", vmID)
+		return err
+	}
+	return nil
+}
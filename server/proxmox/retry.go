@@ -0,0 +1,259 @@
+package proxmox
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+	"samuelemusiani/sasso/server/notify"
+)
+
+var (
+	// Failed operations of the worker are retried with an exponential backoff.
+	// After the last attempt the object is left in an error status and the
+	// owner is notified
+	retryMaxAttempts uint = 5
+	retryBaseDelay        = 30 * time.Second
+	retryMaxDelay         = 30 * time.Minute
+
+	// Failures that are not retried, as they depend on the request or on the
+	// config of the cluster. They are matched in the exit status of the
+	// Proxmox tasks
+	errPermanentFailure   = errors.New("permanent failure")
+	permanentTaskFailures = []string{
+		"quota",
+		"no space left",
+		"not enough space",
+		"does not exist",
+		"unable to find",
+		"unable to parse",
+		"invalid",
+		"parameter verification failed",
+		"not a template",
+	}
+
+	backupRequestOperations = map[string]string{
+		BackupRequestTypeCreate:  "backup",
+		BackupRequestTypeRestore: "backup restore",
+		BackupRequestTypeDelete:  "backup deletion",
+	}
+)
+
+// waitingForRetry returns true if the next attempt on an object must wait
+func waitingForRetry(nextRetryAt *time.Time) bool {
+	return nextRetryAt != nil && time.Now().Before(*nextRetryAt)
+}
+
+// nextAttempt returns the number of attempts after a failure and when the
+// operation is retried. The time is nil after the last attempt or if the
+// failure is permanent.
+func nextAttempt(attempts uint, cause error) (uint, *time.Time) {
+	attempts++
+	if attempts >= retryMaxAttempts || errors.Is(cause, errPermanentFailure) {
+		return attempts, nil
+	}
+
+	delay := retryBaseDelay << (attempts - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	t := time.Now().Add(delay)
+	return attempts, &t
+}
+
+func notifyOperationFailed(ownerID uint, ownerType, object, name, operation, lastError string) {
+	var err error
+	if ownerType == "Group" {
+		err = notify.SendOperationFailedNotificationToGroup(ownerID, object, name, operation, lastError)
+	} else {
+		err = notify.SendOperationFailedNotification(ownerID, object, name, operation, lastError)
+	}
+	if err != nil {
+		logger.Error("Failed to send operation failed notification", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+	}
+}
+
+// vmAttemptFailed records a failed attempt of an operation on a VM. Until the
+// last attempt the VM is set to retryStatus, then to unknown. It returns true
+// if the operation will be retried.
+func vmAttemptFailed(v *db.VM, retryStatus VMStatus, operation string, cause error) bool {
+	attempts, nextRetryAt := nextAttempt(v.Attempts, cause)
+	recordVMFailure(v, retryStatus, operation, cause, attempts, nextRetryAt)
+	return nextRetryAt != nil
+}
+
+// vmFailed records a failure of an operation on a VM that can't be retried
+func vmFailed(v *db.VM, operation string, cause error) {
+	recordVMFailure(v, VMStatusUnknown, operation, cause, v.Attempts+1, nil)
+}
+
+func recordVMFailure(v *db.VM, status VMStatus, operation string, cause error, attempts uint, nextRetryAt *time.Time) {
+	if nextRetryAt == nil {
+		status = VMStatusUnknown
+		logger.Error("VM operation failed, giving up", "vmid", v.ID, "operation", operation, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("VM operation failed, retrying later", "vmid", v.ID, "operation", operation, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	err := db.SetVMFailedAttempt(v.ID, string(status), cause.Error(), attempts, nextRetryAt)
+	if err != nil {
+		logger.Error("Failed to save failed attempt of VM", "vmid", v.ID, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		notifyOperationFailed(v.OwnerID, v.OwnerType, "VM", v.Name, operation, cause.Error())
+	}
+}
+
+func vmAttemptSucceeded(v *db.VM) {
+	if v.Attempts == 0 && v.LastError == "" {
+		return
+	}
+	if err := db.ResetVMAttempts(v.ID); err != nil {
+		logger.Error("Failed to reset attempts of VM", "vmid", v.ID, "err", err)
+	}
+}
+
+// containerAttemptFailed is like vmAttemptFailed for the containers
+func containerAttemptFailed(c *db.Container, retryStatus ContainerStatus, operation string, cause error) bool {
+	attempts, nextRetryAt := nextAttempt(c.Attempts, cause)
+	status := retryStatus
+	if nextRetryAt == nil {
+		status = ContainerStatusUnknown
+		logger.Error("Container operation failed, giving up", "ctid", c.ID, "operation", operation, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("Container operation failed, retrying later", "ctid", c.ID, "operation", operation, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	err := db.SetContainerFailedAttempt(c.ID, string(status), cause.Error(), attempts, nextRetryAt)
+	if err != nil {
+		logger.Error("Failed to save failed attempt of container", "ctid", c.ID, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		notifyOperationFailed(c.OwnerID, c.OwnerType, "container", c.Name, operation, cause.Error())
+	}
+	return nextRetryAt != nil
+}
+
+func containerAttemptSucceeded(c *db.Container) {
+	if c.Attempts == 0 && c.LastError == "" {
+		return
+	}
+	if err := db.ResetContainerAttempts(c.ID); err != nil {
+		logger.Error("Failed to reset attempts of container", "ctid", c.ID, "err", err)
+	}
+}
+
+// interfaceAttemptFailed records a failed attempt of an operation on an
+// interface. Until the last attempt the interface is set to retryStatus,
+// then to unknown.
+func interfaceAttemptFailed(iface *db.Interface, retryStatus InterfaceStatus, operation string, cause error) {
+	attempts, nextRetryAt := nextAttempt(iface.Attempts, cause)
+	status := retryStatus
+	if nextRetryAt == nil {
+		status = InterfaceStatusUnknown
+		logger.Error("Interface operation failed, giving up", "interface_id", iface.ID, "operation", operation, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("Interface operation failed, retrying later", "interface_id", iface.ID, "operation", operation, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	err := db.SetInterfaceFailedAttempt(iface.ID, string(status), cause.Error(), attempts, nextRetryAt)
+	if err != nil {
+		logger.Error("Failed to save failed attempt of interface", "interface_id", iface.ID, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		vm, err := db.GetVMByID(uint64(iface.VMID))
+		if err != nil {
+			logger.Error("Failed to get VM of interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
+			return
+		}
+		notifyOperationFailed(vm.OwnerID, vm.OwnerType, "VM", vm.Name, operation, cause.Error())
+	}
+}
+
+func interfaceAttemptSucceeded(iface *db.Interface) {
+	if iface.Attempts == 0 && iface.LastError == "" {
+		return
+	}
+	if err := db.ResetInterfaceAttempts(iface.ID); err != nil {
+		logger.Error("Failed to reset attempts of interface", "interface_id", iface.ID, "err", err)
+	}
+}
+
+// netAttemptFailed records a failed attempt of an operation on a net. Until
+// the last attempt the net is set to retryStatus, then to unknown.
+func netAttemptFailed(n *db.Net, retryStatus VMStatus, operation string, cause error) {
+	attempts, nextRetryAt := nextAttempt(n.Attempts, cause)
+	recordNetFailure(n, retryStatus, operation, cause, attempts, nextRetryAt)
+}
+
+// netFailed records a failure of an operation on a net that can't be retried
+func netFailed(n *db.Net, operation string, cause error) {
+	recordNetFailure(n, VNetStatusUnknown, operation, cause, n.Attempts+1, nil)
+}
+
+func recordNetFailure(n *db.Net, status VMStatus, operation string, cause error, attempts uint, nextRetryAt *time.Time) {
+	if nextRetryAt == nil {
+		status = VNetStatusUnknown
+		logger.Error("Net operation failed, giving up", "vnet", n.Name, "operation", operation, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("Net operation failed, retrying later", "vnet", n.Name, "operation", operation, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	err := db.SetNetFailedAttempt(n.ID, string(status), cause.Error(), attempts, nextRetryAt)
+	if err != nil {
+		logger.Error("Failed to save failed attempt of net", "vnet", n.Name, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		notifyOperationFailed(n.OwnerID, n.OwnerType, "net", n.Alias, operation, cause.Error())
+	}
+}
+
+func netAttemptSucceeded(n *db.Net) {
+	if n.Attempts == 0 && n.LastError == "" {
+		return
+	}
+	if err := db.ResetNetAttempts(n.ID); err != nil {
+		logger.Error("Failed to reset attempts of net", "vnet", n.Name, "err", err)
+	}
+}
+
+// backupRequestAttemptFailed records a failed attempt of a backup request.
+// Until the last attempt the request stays pending, then it's failed.
+func backupRequestAttemptFailed(r *db.BackupRequest, cause error) {
+	attempts, nextRetryAt := nextAttempt(r.Attempts, cause)
+	status := BackupRequestStatusPending
+	if nextRetryAt == nil {
+		status = BackupRequestStatusFailed
+		logger.Error("Backup request failed, giving up", "id", r.ID, "type", r.Type, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("Backup request failed, retrying later", "id", r.ID, "type", r.Type, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	err := db.SetBackupRequestFailedAttempt(r.ID, status, cause.Error(), attempts, nextRetryAt)
+	if err != nil {
+		logger.Error("Failed to save failed attempt of backup request", "id", r.ID, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		vm, err := db.GetVMByID(uint64(r.VMID))
+		name := strconv.FormatUint(uint64(r.VMID), 10)
+		if err == nil {
+			name = vm.Name
+		}
+		notifyOperationFailed(r.OwnerID, r.OwnerType, "VM", name, backupRequestOperations[r.Type], cause.Error())
+	}
+}
+
+func backupRequestAttemptSucceeded(r *db.BackupRequest) {
+	if r.Attempts == 0 && r.LastError == "" {
+		return
+	}
+	if err := db.ResetBackupRequestAttempts(r.ID); err != nil {
+		logger.Error("Failed to reset attempts of backup request", "id", r.ID, "err", err)
+	}
+}
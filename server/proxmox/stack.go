@@ -0,0 +1,1024 @@
+package proxmox
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	"github.com/seancfoley/ipaddress-go/ipaddr"
+	yaml "go.yaml.in/yaml/v2"
+)
+
+type StackStatus string
+
+var (
+	// The worker is creating, updating or deleting the resources of the stack
+	StackStatusApplying StackStatus = "applying"
+	StackStatusApplied  StackStatus = "applied"
+	// The stack couldn't be applied after the maximum number of attempts
+	StackStatusFailed StackStatus = "failed"
+	// The resources of the stack are deleted and then the stack itself
+	StackStatusPreDeleting StackStatus = "pre-deleting"
+
+	ErrStackNotFound = errors.New("stack not found")
+	ErrInvalidStack  = errors.New("invalid stack document")
+	ErrStackDeleting = errors.New("stack is being deleted")
+
+	// errStackNotReady is returned when a resource of a stack depends on
+	// another one that is not ready yet. It's applied in a later cycle.
+	errStackNotReady = errors.New("dependency not ready")
+)
+
+const (
+	stackKindNet         = "net"
+	stackKindVM          = "vm"
+	stackKindInterface   = "interface"
+	stackKindPortForward = "port_forward"
+)
+
+// StackSpec is the document of a stack. JSON documents are valid YAML, so
+// both are parsed in the same way.
+type StackSpec struct {
+	Name    string `yaml:"name" json:"name"`
+	GroupID *uint  `yaml:"group_id" json:"group_id,omitempty"`
+	// Cluster of the nets and the VMs. If empty the cluster is chosen like for
+	// the single resources
+	Cluster string `yaml:"cluster" json:"cluster,omitempty"`
+
+	Nets         []StackNetSpec         `yaml:"nets" json:"nets"`
+	VMs          []StackVMSpec          `yaml:"vms" json:"vms"`
+	PortForwards []StackPortForwardSpec `yaml:"port_forwards" json:"port_forwards"`
+}
+
+type StackNetSpec struct {
+	Name      string `yaml:"name" json:"name"`
+	VlanAware bool   `yaml:"vlanaware" json:"vlanaware"`
+}
+
+type StackVMSpec struct {
+	Name  string `yaml:"name" json:"name"`
+	Notes string `yaml:"notes" json:"notes"`
+	Cores uint   `yaml:"cores" json:"cores"`
+	RAM   uint   `yaml:"ram" json:"ram"`
+	Disk  uint   `yaml:"disk" json:"disk"`
+	// Number of months the VM should live. It's used only when the VM is
+	// created
+	LifeTime             uint  `yaml:"lifetime" json:"lifetime"`
+	IncludeGlobalSSHKeys bool  `yaml:"include_global_ssh_keys" json:"include_global_ssh_keys"`
+	TemplateID           *uint `yaml:"template_id" json:"template_id,omitempty"`
+
+	Interfaces []StackInterfaceSpec `yaml:"interfaces" json:"interfaces"`
+}
+
+// StackInterfaceSpec is an interface of a VM on a net of the stack. The
+// subnets of the nets are assigned when they are created, so the address can
+// be given as an offset in the subnet of the net.
+type StackInterfaceSpec struct {
+	Net     string `yaml:"net" json:"net"`
+	VlanTag uint16 `yaml:"vlan_tag" json:"vlan_tag"`
+	// Offset of the address in the subnet of the net. Ignored if IPAdd is set
+	Host  uint   `yaml:"host" json:"host"`
+	IPAdd string `yaml:"ip_add" json:"ip_add,omitempty"`
+	// Use the gateway of the net
+	Gateway bool `yaml:"gateway" json:"gateway"`
+}
+
+// StackPortForwardSpec forwards a port to the interface of a VM on a net of
+// the stack
+type StackPortForwardSpec struct {
+	VM       string `yaml:"vm" json:"vm"`
+	Net      string `yaml:"net" json:"net"`
+	DestPort uint16 `yaml:"dest_port" json:"dest_port"`
+}
+
+// StackChange is a change needed to make the resources of the owner match
+// the stack
+type StackChange struct {
+	Action string `json:"action"` // create, update or delete
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type StackResource struct {
+	Kind       string `json:"kind"`
+	Key        string `json:"key"`
+	ResourceID uint64 `json:"resource_id"`
+}
+
+type Stack struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Document    string     `json:"document"`
+	LastError   string     `json:"last_error,omitempty"`
+	Attempts    uint       `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+	GroupID     uint       `json:"group_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	Resources []StackResource `json:"resources,omitempty"`
+	// Changes still to apply
+	Pending []StackChange `json:"pending,omitempty"`
+}
+
+func convertDBStack(s *db.Stack) *Stack {
+	stack := &Stack{
+		ID:          s.ID,
+		Name:        s.Name,
+		Status:      s.Status,
+		Document:    s.Document,
+		LastError:   s.LastError,
+		Attempts:    s.Attempts,
+		NextRetryAt: s.NextRetryAt,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+	if s.OwnerType == "Group" {
+		stack.GroupID = s.OwnerID
+	}
+	return stack
+}
+
+func interfaceStackKey(vm, net string) string {
+	return vm + "/" + net
+}
+
+func portForwardStackKey(pf *StackPortForwardSpec) string {
+	return fmt.Sprintf("%s/%s:%d", pf.VM, pf.Net, pf.DestPort)
+}
+
+// ParseStackDocument parses and validates a stack document in YAML or JSON
+func ParseStackDocument(document string) (*StackSpec, error) {
+	var spec StackSpec
+	if err := yaml.UnmarshalStrict([]byte(document), &spec); err != nil {
+		return nil, errors.Join(ErrInvalidStack, err)
+	}
+	if err := validateStackSpec(&spec); err != nil {
+		return nil, errors.Join(ErrInvalidStack, err)
+	}
+	return &spec, nil
+}
+
+func validateStackSpec(spec *StackSpec) error {
+	if spec.Name == "" || len(spec.Name) > 64 {
+		return errors.New("name must be between 1 and 64 characters")
+	}
+
+	nets := make(map[string]bool)
+	for _, n := range spec.Nets {
+		if n.Name == "" || strings.ContainsAny(n.Name, "/:") {
+			return fmt.Errorf("invalid net name %q", n.Name)
+		}
+		if nets[n.Name] {
+			return fmt.Errorf("net %q is defined more than once", n.Name)
+		}
+		nets[n.Name] = true
+	}
+
+	interfaces := make(map[string]bool)
+	vms := make(map[string]bool)
+	for _, v := range spec.VMs {
+		if !isValidVMName(v.Name) {
+			return fmt.Errorf("invalid vm name %q", v.Name)
+		}
+		if vms[v.Name] {
+			return fmt.Errorf("vm %q is defined more than once", v.Name)
+		}
+		vms[v.Name] = true
+
+		hasGateway := false
+		for _, iface := range v.Interfaces {
+			if !nets[iface.Net] {
+				return fmt.Errorf("vm %q has an interface on the unknown net %q", v.Name, iface.Net)
+			}
+			key := interfaceStackKey(v.Name, iface.Net)
+			if interfaces[key] {
+				return fmt.Errorf("vm %q has more than one interface on net %q", v.Name, iface.Net)
+			}
+			interfaces[key] = true
+
+			if iface.IPAdd == "" && iface.Host == 0 {
+				return fmt.Errorf("interface of vm %q on net %q needs ip_add or host", v.Name, iface.Net)
+			}
+			if iface.Gateway {
+				if hasGateway {
+					return fmt.Errorf("vm %q has more than one interface with a gateway", v.Name)
+				}
+				hasGateway = true
+			}
+		}
+	}
+
+	pfs := make(map[string]bool)
+	for _, pf := range spec.PortForwards {
+		if !interfaces[interfaceStackKey(pf.VM, pf.Net)] {
+			return fmt.Errorf("port forward to vm %q on net %q has no matching interface", pf.VM, pf.Net)
+		}
+		if pf.DestPort == 0 {
+			return fmt.Errorf("port forward to vm %q has an invalid dest_port", pf.VM)
+		}
+		key := portForwardStackKey(&pf)
+		if pfs[key] {
+			return fmt.Errorf("port forward %q is defined more than once", key)
+		}
+		pfs[key] = true
+	}
+	return nil
+}
+
+// stackState holds the resources of the owner of a stack
+type stackState struct {
+	nets   map[uint]*db.Net
+	vms    map[uint64]*db.VM
+	ifaces map[uint]*db.Interface
+	pfs    map[uint]*db.PortForward
+}
+
+func loadStackState(ownerID uint, ownerType string) (*stackState, error) {
+	st := &stackState{
+		nets:   make(map[uint]*db.Net),
+		vms:    make(map[uint64]*db.VM),
+		ifaces: make(map[uint]*db.Interface),
+		pfs:    make(map[uint]*db.PortForward),
+	}
+
+	var nets []db.Net
+	var vms []db.VM
+	var err error
+	if ownerType == "Group" {
+		nets, err = db.GetNetsByGroupID(ownerID)
+		if err == nil {
+			vms, err = db.GetVMsByGroupID(ownerID)
+		}
+	} else {
+		nets, err = db.GetNetsByUserID(ownerID)
+		if err == nil {
+			vms, err = db.GetVMsByUserID(ownerID)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to get resources of stack owner", "ownerID", ownerID, "ownerType", ownerType, "error", err)
+		return nil, err
+	}
+
+	for i := range nets {
+		st.nets[nets[i].ID] = &nets[i]
+	}
+	for i := range vms {
+		st.vms[vms[i].ID] = &vms[i]
+
+		ifaces, err := db.GetInterfacesByVMID(vms[i].ID)
+		if err != nil {
+			logger.Error("Failed to get interfaces of VM", "vmID", vms[i].ID, "error", err)
+			return nil, err
+		}
+		for j := range ifaces {
+			st.ifaces[ifaces[j].ID] = &ifaces[j]
+		}
+	}
+
+	pfs, err := db.GetPortForwardsByOwner(ownerID, ownerType)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pfs {
+		st.pfs[pfs[i].ID] = &pfs[i]
+	}
+	return st, nil
+}
+
+// exists reports whether the resource linked to the stack still exists
+func (st *stackState) exists(r *db.StackResource) bool {
+	switch r.Kind {
+	case stackKindNet:
+		return st.nets[uint(r.ResourceID)] != nil
+	case stackKindVM:
+		return st.vms[r.ResourceID] != nil
+	case stackKindInterface:
+		return st.ifaces[uint(r.ResourceID)] != nil
+	case stackKindPortForward:
+		return st.pfs[uint(r.ResourceID)] != nil
+	}
+	return false
+}
+
+type stackKey struct {
+	kind string
+	key  string
+}
+
+// stackPlan is the plan of a stack against the resources of the owner
+type stackPlan struct {
+	spec   *StackSpec
+	st     *stackState
+	linked map[stackKey]*db.StackResource
+	steps  []stackStep
+}
+
+type stackStep struct {
+	StackChange
+	resource *db.StackResource
+
+	net   *StackNetSpec
+	vm    *StackVMSpec
+	iface *StackInterfaceSpec
+	pf    *StackPortForwardSpec
+}
+
+func (p *stackPlan) changes() []StackChange {
+	changes := make([]StackChange, len(p.steps))
+	for i := range p.steps {
+		changes[i] = p.steps[i].StackChange
+	}
+	return changes
+}
+
+func (p *stackPlan) linkedNet(name string) *db.Net {
+	if r := p.linked[stackKey{stackKindNet, name}]; r != nil {
+		return p.st.nets[uint(r.ResourceID)]
+	}
+	return nil
+}
+
+func (p *stackPlan) linkedVM(name string) *db.VM {
+	if r := p.linked[stackKey{stackKindVM, name}]; r != nil {
+		return p.st.vms[r.ResourceID]
+	}
+	return nil
+}
+
+func (p *stackPlan) linkedInterface(vm, net string) *db.Interface {
+	if r := p.linked[stackKey{stackKindInterface, interfaceStackKey(vm, net)}]; r != nil {
+		return p.st.ifaces[uint(r.ResourceID)]
+	}
+	return nil
+}
+
+// stackInterfaceAddress returns the address and the gateway of an interface
+// on the net. It returns errStackNotReady if the net has no subnet yet.
+func stackInterfaceAddress(n *db.Net, iface *StackInterfaceSpec) (string, string, error) {
+	if n == nil || n.Status != string(VNetStatusReady) || n.Subnet == "" {
+		return "", "", errStackNotReady
+	}
+
+	ipAdd := iface.IPAdd
+	if ipAdd == "" {
+		subnet := ipaddr.NewIPAddressString(n.Subnet).GetAddress()
+		if subnet == nil || subnet.GetNetworkPrefixLen() == nil {
+			return "", "", fmt.Errorf("invalid subnet %q of net %q", n.Subnet, n.Alias)
+		}
+		host := subnet.GetLower().WithoutPrefixLen().Increment(int64(iface.Host))
+		if host == nil || !subnet.Contains(host) {
+			return "", "", fmt.Errorf("host %d is outside of the subnet %s of net %q", iface.Host, n.Subnet, n.Alias)
+		}
+		ipAdd = fmt.Sprintf("%s/%d", host, subnet.GetNetworkPrefixLen().Len())
+	}
+
+	gateway := ""
+	if iface.Gateway {
+		gw := ipaddr.NewIPAddressString(n.Gateway).GetAddress()
+		if gw == nil {
+			return "", "", errStackNotReady
+		}
+		gateway = gw.WithoutPrefixLen().String()
+	}
+	return ipAdd, gateway, nil
+}
+
+// planStack computes the changes needed to apply the spec. The links to the
+// resources that don't exist anymore must be already removed. The deletions
+// come first, from the port forwards to the nets, then the creations and the
+// updates, from the nets to the port forwards.
+func planStack(spec *StackSpec, resources []db.StackResource, st *stackState) *stackPlan {
+	p := &stackPlan{spec: spec, st: st, linked: make(map[stackKey]*db.StackResource)}
+	for i := range resources {
+		r := &resources[i]
+		p.linked[stackKey{r.Kind, r.Key}] = r
+	}
+
+	wanted := make(map[stackKey]bool)
+	var changes []stackStep
+
+	for i := range spec.Nets {
+		n := &spec.Nets[i]
+		k := stackKey{stackKindNet, n.Name}
+		wanted[k] = true
+
+		cur := p.linkedNet(n.Name)
+		if cur == nil {
+			changes = append(changes, stackStep{StackChange: StackChange{Action: "create", Kind: k.kind, Key: k.key}, net: n})
+		} else if cur.VlanAware != n.VlanAware {
+			changes = append(changes, stackStep{
+				StackChange: StackChange{Action: "update", Kind: k.kind, Key: k.key, Detail: fmt.Sprintf("vlanaware: %t -> %t", cur.VlanAware, n.VlanAware)},
+				resource:    p.linked[k],
+				net:         n,
+			})
+		}
+	}
+
+	for i := range spec.VMs {
+		v := &spec.VMs[i]
+		k := stackKey{stackKindVM, v.Name}
+		wanted[k] = true
+
+		cur := p.linkedVM(v.Name)
+		if cur == nil {
+			changes = append(changes, stackStep{StackChange: StackChange{Action: "create", Kind: k.kind, Key: k.key}, vm: v})
+			continue
+		}
+
+		var diffs []string
+		if cur.Cores != v.Cores {
+			diffs = append(diffs, fmt.Sprintf("cores: %d -> %d", cur.Cores, v.Cores))
+		}
+		if cur.RAM != v.RAM {
+			diffs = append(diffs, fmt.Sprintf("ram: %d -> %d", cur.RAM, v.RAM))
+		}
+		if cur.Disk != v.Disk {
+			diffs = append(diffs, fmt.Sprintf("disk: %d -> %d", cur.Disk, v.Disk))
+		}
+		if cur.Notes != v.Notes {
+			diffs = append(diffs, "notes")
+		}
+		if len(diffs) > 0 {
+			changes = append(changes, stackStep{
+				StackChange: StackChange{Action: "update", Kind: k.kind, Key: k.key, Detail: strings.Join(diffs, ", ")},
+				resource:    p.linked[k],
+				vm:          v,
+			})
+		}
+	}
+
+	for i := range spec.VMs {
+		v := &spec.VMs[i]
+		for j := range v.Interfaces {
+			iface := &v.Interfaces[j]
+			k := stackKey{stackKindInterface, interfaceStackKey(v.Name, iface.Net)}
+			wanted[k] = true
+
+			cur := p.linkedInterface(v.Name, iface.Net)
+			if cur == nil {
+				changes = append(changes, stackStep{StackChange: StackChange{Action: "create", Kind: k.kind, Key: k.key}, vm: v, iface: iface})
+				continue
+			}
+
+			n := p.linkedNet(iface.Net)
+			ipAdd, gateway, err := stackInterfaceAddress(n, iface)
+			if err != nil {
+				// Compared again when the net is ready
+				continue
+			}
+			var diffs []string
+			if cur.VNetID != n.ID {
+				diffs = append(diffs, "net")
+			}
+			if cur.VlanTag != iface.VlanTag {
+				diffs = append(diffs, fmt.Sprintf("vlan_tag: %d -> %d", cur.VlanTag, iface.VlanTag))
+			}
+			if cur.IPAdd != ipAdd {
+				diffs = append(diffs, fmt.Sprintf("ip_add: %s -> %s", cur.IPAdd, ipAdd))
+			}
+			if cur.Gateway != gateway {
+				diffs = append(diffs, fmt.Sprintf("gateway: %q -> %q", cur.Gateway, gateway))
+			}
+			if len(diffs) > 0 {
+				changes = append(changes, stackStep{
+					StackChange: StackChange{Action: "update", Kind: k.kind, Key: k.key, Detail: strings.Join(diffs, ", ")},
+					resource:    p.linked[k],
+					vm:          v,
+					iface:       iface,
+				})
+			}
+		}
+	}
+
+	for i := range spec.PortForwards {
+		pf := &spec.PortForwards[i]
+		k := stackKey{stackKindPortForward, portForwardStackKey(pf)}
+		wanted[k] = true
+
+		r := p.linked[k]
+		if r == nil {
+			changes = append(changes, stackStep{StackChange: StackChange{Action: "create", Kind: k.kind, Key: k.key}, pf: pf})
+			continue
+		}
+		// The port forward follows the address of the interface
+		iface := p.linkedInterface(pf.VM, pf.Net)
+		if iface != nil && st.pfs[uint(r.ResourceID)].DestIP != interfaceHostAddress(iface.IPAdd) {
+			changes = append(changes, stackStep{
+				StackChange: StackChange{Action: "update", Kind: k.kind, Key: k.key, Detail: "dest_ip"},
+				resource:    r,
+				pf:          pf,
+			})
+		}
+	}
+
+	var deletes []stackStep
+	for _, kind := range []string{stackKindPortForward, stackKindInterface, stackKindVM, stackKindNet} {
+		for i := range resources {
+			r := &resources[i]
+			if r.Kind != kind || wanted[stackKey{r.Kind, r.Key}] {
+				continue
+			}
+			deletes = append(deletes, stackStep{StackChange: StackChange{Action: "delete", Kind: r.Kind, Key: r.Key}, resource: r})
+		}
+	}
+
+	p.steps = append(deletes, changes...)
+	return p
+}
+
+func interfaceHostAddress(ipAdd string) string {
+	if i := strings.Index(ipAdd, "/"); i != -1 {
+		return ipAdd[:i]
+	}
+	return ipAdd
+}
+
+// stackOwner returns the owner of a stack applied by the user. Only admins
+// and owners of a group can apply stacks for the group.
+func stackOwner(userID uint, groupID *uint) (uint, string, error) {
+	if groupID == nil {
+		return userID, "User", nil
+	}
+
+	role, err := db.GetUserRoleInGroup(userID, *groupID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return 0, "", ErrNotFound
+		}
+		logger.Error("Failed to get user role in group", "userID", userID, "groupID", *groupID, "error", err)
+		return 0, "", err
+	}
+	if role != "admin" && role != "owner" {
+		return 0, "", ErrPermissionDenied
+	}
+	return *groupID, "Group", nil
+}
+
+// planStackForOwner computes the plan of the spec against the resources of
+// the owner and the existing stack with the same name, if any
+func planStackForOwner(spec *StackSpec, ownerID uint, ownerType string, stackID uint) (*stackPlan, error) {
+	var resources []db.StackResource
+	if stackID != 0 {
+		var err error
+		resources, err = db.GetStackResources(stackID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	st, err := loadStackState(ownerID, ownerType)
+	if err != nil {
+		return nil, err
+	}
+	resources = slices.DeleteFunc(resources, func(r db.StackResource) bool { return !st.exists(&r) })
+
+	return planStack(spec, resources, st), nil
+}
+
+// ApplyStack saves the stack and returns the changes that the worker will
+// apply. With dryRun the stack is not saved.
+func ApplyStack(userID uint, document string, dryRun bool) (*Stack, []StackChange, error) {
+	spec, err := ParseStackDocument(document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ownerID, ownerType, err := stackOwner(userID, spec.GroupID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stackID uint
+	existing, err := db.GetStackByOwnerAndName(ownerID, ownerType, spec.Name)
+	if err == nil {
+		if existing.Status == string(StackStatusPreDeleting) {
+			return nil, nil, ErrStackDeleting
+		}
+		stackID = existing.ID
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return nil, nil, err
+	}
+
+	plan, err := planStackForOwner(spec, ownerID, ownerType, stackID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dryRun {
+		return nil, plan.changes(), nil
+	}
+
+	s, err := db.SaveStackDocument(ownerID, ownerType, spec.Name, document, userID, string(StackStatusApplying))
+	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return nil, nil, ErrStackDeleting
+		}
+		return nil, nil, err
+	}
+	return convertDBStack(s), plan.changes(), nil
+}
+
+// getStackForUser returns the stack if it belongs to the user or to a group
+// of the user, together with the role of the user in the group
+func getStackForUser(id, userID uint) (*db.Stack, string, error) {
+	s, err := db.GetStackByID(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, "", ErrStackNotFound
+		}
+		return nil, "", err
+	}
+
+	if s.OwnerType == "User" {
+		if s.OwnerID != userID {
+			return nil, "", ErrStackNotFound
+		}
+		return s, "", nil
+	}
+
+	role, err := db.GetUserRoleInGroup(userID, s.OwnerID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, "", ErrStackNotFound
+		}
+		logger.Error("Failed to get user role in group for stack", "userID", userID, "groupID", s.OwnerID, "stackID", id, "error", err)
+		return nil, "", err
+	}
+	return s, role, nil
+}
+
+func GetStacksByUserID(userID uint) ([]Stack, error) {
+	dbStacks, err := db.GetStacksByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stacks := make([]Stack, len(dbStacks))
+	for i := range dbStacks {
+		stacks[i] = *convertDBStack(&dbStacks[i])
+	}
+	return stacks, nil
+}
+
+// GetStackByID returns the stack with its resources and the changes still to
+// apply
+func GetStackByID(id, userID uint) (*Stack, error) {
+	s, _, err := getStackForUser(id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := db.GetStackResources(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stack := convertDBStack(s)
+	stack.Resources = make([]StackResource, len(resources))
+	for i, r := range resources {
+		stack.Resources[i] = StackResource{Kind: r.Kind, Key: r.Key, ResourceID: r.ResourceID}
+	}
+
+	spec := &StackSpec{}
+	if s.Status != string(StackStatusPreDeleting) {
+		spec, err = ParseStackDocument(s.Document)
+		if err != nil {
+			// The document was valid when it was saved
+			logger.Error("Failed to parse saved stack document", "stackID", s.ID, "error", err)
+			return stack, nil
+		}
+	}
+	plan, err := planStackForOwner(spec, s.OwnerID, s.OwnerType, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	stack.Pending = plan.changes()
+	return stack, nil
+}
+
+// DeleteStack sets the stack to be deleted by the worker, together with all
+// the resources it created
+func DeleteStack(id, userID uint) error {
+	s, role, err := getStackForUser(id, userID)
+	if err != nil {
+		return err
+	}
+	if s.OwnerType == "Group" && role != "admin" && role != "owner" {
+		return ErrPermissionDenied
+	}
+	if s.Status == string(StackStatusPreDeleting) {
+		return nil
+	}
+
+	return db.SetStackDeleting(s.ID, string(StackStatusPreDeleting), userID)
+}
+
+// applyStacks applies the stacks that are not applied yet. The stacks only
+// change the database, so they are applied by the main worker for all the
+// clusters.
+func applyStacks() {
+	logger.Debug("Applying stacks in worker")
+
+	stacks, err := db.GetStacksWithStates([]string{string(StackStatusApplying), string(StackStatusPreDeleting)})
+	if err != nil {
+		return
+	}
+
+	for i := range stacks {
+		s := &stacks[i]
+		if waitingForRetry(s.NextRetryAt) {
+			continue
+		}
+		applyStack(s)
+	}
+}
+
+func applyStack(s *db.Stack) {
+	deleting := s.Status == string(StackStatusPreDeleting)
+
+	// The user that applied a stack of a group could have lost the rights on
+	// the group after the apply
+	if s.OwnerType == "Group" {
+		if _, _, err := stackOwner(s.AppliedBy, &s.OwnerID); errors.Is(err, ErrNotFound) || errors.Is(err, ErrPermissionDenied) {
+			stackFailed(s, errors.New("the user that applied the stack is not an admin or owner of the group anymore"))
+			return
+		} else if err != nil {
+			return
+		}
+	}
+
+	// A stack that is deleted is applied as an empty one
+	spec := &StackSpec{}
+	if !deleting {
+		var err error
+		spec, err = ParseStackDocument(s.Document)
+		if err != nil {
+			stackFailed(s, err)
+			return
+		}
+	}
+
+	resources, err := db.GetStackResources(s.ID)
+	if err != nil {
+		return
+	}
+	st, err := loadStackState(s.OwnerID, s.OwnerType)
+	if err != nil {
+		return
+	}
+
+	// The resources deleted outside of the stack are created again
+	resources = slices.DeleteFunc(resources, func(r db.StackResource) bool {
+		if st.exists(&r) {
+			return false
+		}
+		if err := db.DeleteStackResource(r.ID); err != nil {
+			logger.Error("Failed to delete link of missing stack resource", "stackID", s.ID, "kind", r.Kind, "key", r.Key, "error", err)
+		}
+		return true
+	})
+
+	plan := planStack(spec, resources, st)
+	if len(plan.steps) == 0 {
+		if deleting {
+			logger.Info("All the resources of the stack are deleted", "stackID", s.ID, "name", s.Name)
+			if err := db.DeleteStackByID(s.ID); err != nil {
+				logger.Error("Failed to delete stack", "stackID", s.ID, "error", err)
+			}
+			return
+		}
+		if err := db.UpdateStackStatus(s.ID, string(StackStatusApplied)); err != nil {
+			logger.Error("Failed to update status of stack", "stackID", s.ID, "status", StackStatusApplied, "error", err)
+		}
+		stackAttemptSucceeded(s)
+		return
+	}
+
+	var errs []error
+	for i := range plan.steps {
+		step := &plan.steps[i]
+		err := applyStackStep(s, plan, step)
+		if errors.Is(err, errStackNotReady) {
+			logger.Debug("Stack change postponed", "stackID", s.ID, "action", step.Action, "kind", step.Kind, "key", step.Key)
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s %q: %w", step.Action, step.Kind, step.Key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		stackAttemptFailed(s, errors.Join(errs...))
+		return
+	}
+	stackAttemptSucceeded(s)
+}
+
+// applyStackStep applies a change of the plan. The changes that depend on
+// resources that are still being created or deleted return errStackNotReady.
+func applyStackStep(s *db.Stack, p *stackPlan, step *stackStep) error {
+	var groupID *uint
+	if s.OwnerType == "Group" {
+		groupID = &s.OwnerID
+	}
+	isGroup := groupID != nil
+
+	switch step.Action {
+	case "delete":
+		return deleteStackResource(s, step.resource, isGroup)
+
+	case "create":
+		switch step.Kind {
+		case stackKindNet:
+			n, err := CreateNewNet(s.AppliedBy, step.net.Name, step.net.VlanAware, groupID, p.spec.Cluster)
+			if err != nil {
+				return err
+			}
+			return db.SetStackResource(s.ID, step.Kind, step.Key, uint64(n.ID))
+
+		case stackKindVM:
+			v := step.vm
+			vm, err := NewVM(s.AppliedBy, groupID, v.Name, v.Notes, v.Cores, v.RAM, v.Disk, v.LifeTime, v.IncludeGlobalSSHKeys, v.TemplateID, p.spec.Cluster)
+			if err != nil {
+				return err
+			}
+			return db.SetStackResource(s.ID, step.Kind, step.Key, vm.ID)
+
+		case stackKindInterface:
+			vm := p.linkedVM(step.vm.Name)
+			n := p.linkedNet(step.iface.Net)
+			if vm == nil || n == nil || !slices.Contains(goodVMStatesForInterfacesManipulation, VMStatus(vm.Status)) {
+				return errStackNotReady
+			}
+			ipAdd, gateway, err := stackInterfaceAddress(n, step.iface)
+			if err != nil {
+				return err
+			}
+			if n.Cluster != vm.Cluster {
+				return errors.New("vnet is on another cluster than the VM")
+			}
+			tmpFace := &Interface{VNetID: n.ID, VlanTag: step.iface.VlanTag, IPAdd: ipAdd, Gateway: gateway}
+			if err := InterfacesChecks(n, tmpFace); err != nil {
+				return err
+			}
+			iface, err := NewInterface(uint(vm.ID), n.ID, step.iface.VlanTag, ipAdd, gateway)
+			if err != nil {
+				return err
+			}
+			return db.SetStackResource(s.ID, step.Kind, step.Key, uint64(iface.ID))
+
+		case stackKindPortForward:
+			return createStackPortForward(s, p, step)
+		}
+
+	case "update":
+		switch step.Kind {
+		case stackKindNet:
+			return UpdateNet(s.AppliedBy, uint(step.resource.ResourceID), step.net.Name, step.net.VlanAware)
+
+		case stackKindVM:
+			v := step.vm
+			cur := p.st.vms[step.resource.ResourceID]
+			if cur.Notes != v.Notes {
+				if err := UpdateVMNameAndNotes(cur.ID, nil, &v.Notes); err != nil {
+					return err
+				}
+			}
+			if cur.Cores != v.Cores || cur.RAM != v.RAM || cur.Disk != v.Disk {
+				err := UpdateVMResources(cur.ID, v.Cores, v.RAM, v.Disk)
+				if errors.Is(err, ErrInvalidVMState) {
+					return errStackNotReady
+				}
+				return err
+			}
+			return nil
+
+		case stackKindInterface:
+			n := p.linkedNet(step.iface.Net)
+			ipAdd, gateway, err := stackInterfaceAddress(n, step.iface)
+			if err != nil {
+				return err
+			}
+			iface := &Interface{ID: uint(step.resource.ResourceID), VNetID: n.ID, VlanTag: step.iface.VlanTag, IPAdd: ipAdd, Gateway: gateway}
+			if err := InterfacesChecks(n, iface); err != nil {
+				return err
+			}
+			return UpdateInterface(iface)
+
+		case stackKindPortForward:
+			// The forward is updated in place, so the out port published to
+			// the users is kept
+			destIP, n, err := stackPortForwardDest(p, step)
+			if err != nil {
+				return err
+			}
+			return db.UpdatePortForwardDest(uint(step.resource.ResourceID), step.pf.DestPort, destIP, n.ID)
+		}
+	}
+	return fmt.Errorf("unknown change %s of %s", step.Action, step.Kind)
+}
+
+func deleteStackResource(s *db.Stack, r *db.StackResource, isGroup bool) error {
+	var err error
+	switch r.Kind {
+	case stackKindNet:
+		err = DeleteNet(s.AppliedBy, uint(r.ResourceID))
+		if errors.Is(err, ErrVNetHasActiveInterfaces) {
+			// The interfaces are deleted together with the VMs
+			return errStackNotReady
+		}
+	case stackKindVM:
+		err = DeleteVM(isGroup, s.OwnerID, s.AppliedBy, r.ResourceID)
+		if errors.Is(err, ErrInvalidVMState) || errors.Is(err, ErrVMMigrating) {
+			return errStackNotReady
+		}
+	case stackKindInterface:
+		err = DeleteInterface(uint(r.ResourceID))
+		if errors.Is(err, ErrInvalidVMState) {
+			return errStackNotReady
+		}
+	case stackKindPortForward:
+		err = db.DeletePortForward(uint(r.ResourceID))
+	}
+	if err != nil {
+		return err
+	}
+	return db.DeleteStackResource(r.ID)
+}
+
+// stackPortForwardDest returns the address and the net of the interface the
+// port forward points to
+func stackPortForwardDest(p *stackPlan, step *stackStep) (string, *db.Net, error) {
+	iface := p.linkedInterface(step.pf.VM, step.pf.Net)
+	n := p.linkedNet(step.pf.Net)
+	if iface == nil || n == nil || n.Status != string(VNetStatusReady) || n.Subnet == "" {
+		return "", nil, errStackNotReady
+	}
+
+	destIP := interfaceHostAddress(iface.IPAdd)
+	isGatewayOrBroadcast, err := db.IsAddressAGatewayOrBroadcast(destIP)
+	if err != nil {
+		return "", nil, err
+	} else if isGatewayOrBroadcast {
+		return "", nil, errors.New("the address of the interface is a gateway or a broadcast address")
+	}
+	return destIP, n, nil
+}
+
+func createStackPortForward(s *db.Stack, p *stackPlan, step *stackStep) error {
+	destIP, n, err := stackPortForwardDest(p, step)
+	if err != nil {
+		return err
+	}
+
+	pf, err := NewPortForward(s.OwnerID, s.OwnerType, step.pf.DestPort, destIP, n.Subnet)
+	if err != nil {
+		return err
+	}
+	return db.SetStackResource(s.ID, step.Kind, step.Key, uint64(pf.ID))
+}
+
+// stackAttemptFailed records a failed attempt to apply a stack. After the
+// last attempt the stack is set to failed and the owner is notified.
+func stackAttemptFailed(s *db.Stack, cause error) {
+	attempts, nextRetryAt := nextAttempt(s.Attempts, cause)
+	status := StackStatus(s.Status)
+	if nextRetryAt == nil {
+		status = StackStatusFailed
+		logger.Error("Stack apply failed, giving up", "stackID", s.ID, "attempts", attempts, "error", cause)
+	} else {
+		logger.Warn("Stack apply failed, retrying later", "stackID", s.ID, "attempts", attempts, "next_retry_at", *nextRetryAt, "error", cause)
+	}
+
+	if err := db.SetStackFailedAttempt(s.ID, string(status), cause.Error(), attempts, nextRetryAt); err != nil {
+		logger.Error("Failed to save failed attempt of stack", "stackID", s.ID, "err", err)
+	}
+
+	if nextRetryAt == nil {
+		notifyOperationFailed(s.OwnerID, s.OwnerType, "stack", s.Name, "apply", cause.Error())
+	}
+}
+
+// stackFailed records a failure to apply a stack that can't be retried
+func stackFailed(s *db.Stack, cause error) {
+	logger.Error("Stack apply failed", "stackID", s.ID, "error", cause)
+	if err := db.SetStackFailedAttempt(s.ID, string(StackStatusFailed), cause.Error(), s.Attempts+1, nil); err != nil {
+		logger.Error("Failed to save failed attempt of stack", "stackID", s.ID, "err", err)
+	}
+	notifyOperationFailed(s.OwnerID, s.OwnerType, "stack", s.Name, "apply", cause.Error())
+}
+
+func stackAttemptSucceeded(s *db.Stack) {
+	if s.Attempts == 0 && s.LastError == "" {
+		return
+	}
+	if err := db.ResetStackAttempts(s.ID); err != nil {
+		logger.Error("Failed to reset attempts of stack", "stackID", s.ID, "err", err)
+	}
+}
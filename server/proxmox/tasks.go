@@ -0,0 +1,337 @@
+package proxmox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+// Long Proxmox tasks (clones, deletions, backups and migrations) are not
+// awaited by the worker. The UPID of the task is saved on the row of the
+// object and the task is polled in every cycle, so the tracking survives a
+// restart.
+
+// Number of polls in a row that can fail to read the status of a task before
+// it's considered lost
+const maxTaskStatusErrors = 10
+
+// getTrackedTaskStatus returns the status of a tracked task. If the status
+// can't be read for maxTaskStatusErrors polls in a row, for example because
+// the task log was removed from Proxmox, lost is true. The caller then stops
+// tracking the task and the final state of the object is guessed by
+// resumeUntrackedTasks from what's on Proxmox.
+func getTrackedTaskStatus(pc *pveCluster, upid string) (completed, successful bool, exitStatus string, lost bool) {
+	completed, successful, exitStatus, err := getProxmoxTaskStatus(pc.client, upid)
+	if err == nil {
+		delete(pc.taskStatusErrors, upid)
+		return completed, successful, exitStatus, false
+	}
+
+	pc.taskStatusErrors[upid]++
+	if pc.taskStatusErrors[upid] < maxTaskStatusErrors {
+		return false, false, "", false
+	}
+
+	logger.Error("Proxmox task lost, its status can't be read", "upid", upid, "errors", pc.taskStatusErrors[upid])
+	delete(pc.taskStatusErrors, upid)
+	pc.untrackedTasksResumed = false
+	return false, false, "", true
+}
+
+// pollTasks resolves the final state of the objects whose task is completed
+func pollTasks(pc *pveCluster) {
+	logger.Debug("Polling Proxmox tasks in worker")
+
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+
+	pollVMTasks(pc, vmIDs)
+	pollImportTasks(pc, vmIDs)
+	pollInterfaceTasks(pc, vmIDs)
+	pollBackupRequestTasks(pc, vmIDs)
+	pollMigrationTasks(pc, vmIDs)
+	pollContainerTasks(pc)
+	pollTemplateTasks(pc)
+}
+
+func pollVMTasks(pc *pveCluster, vmIDs map[uint64]bool) {
+	vms, err := db.GetVMsWithTask()
+	if err != nil {
+		logger.Error("Failed to get VMs with a task", "error", err)
+		return
+	}
+
+	for _, v := range vms {
+		if !vmIDs[v.ID] {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, v.TaskUPID)
+		if lost {
+			setVMTaskResult(v.ID, VMStatus(v.Status))
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		logger.Debug("Proxmox task of VM completed", "vmid", v.ID, "upid", v.TaskUPID, "successful", successful)
+
+		switch VMStatus(v.Status) {
+		case VMStatusCreating:
+			if successful {
+				setVMTaskResult(v.ID, VMStatusPreConfiguring)
+				vmAttemptSucceeded(&v)
+			} else {
+				// A failed clone doesn't leave the VM on Proxmox, so it's cloned
+				// again
+				vmAttemptFailed(&v, VMStatusPreCreating, "creation", errProxmoxTaskFailed(v.TaskUPID, exitStatus))
+			}
+		case VMStatusDeleting:
+			if successful {
+				if err := db.DeleteVMByID(v.ID); err != nil {
+					logger.Error("Failed to delete VM", "vmid", v.ID, "err", err)
+				}
+			} else {
+				vmAttemptFailed(&v, VMStatusPreDeleting, "deletion", errProxmoxTaskFailed(v.TaskUPID, exitStatus))
+			}
+		case VMStatusRebuilding:
+			if !successful {
+				if !vmAttemptFailed(&v, VMStatusPreRebuilding, "rebuild", errProxmoxTaskFailed(v.TaskUPID, exitStatus)) {
+					completeFailedVMRebuild(v.ID)
+				}
+				continue
+			}
+
+			if err := db.UpdateVMNode(v.ID, v.TaskNode); err != nil {
+				logger.Error("Failed to update node of VM", "vmid", v.ID, "node", v.TaskNode, "err", err)
+			}
+			// Cores, RAM and disk are set by configureVMs
+			pc.lastConfigureSSHKeysTime = time.Time{}
+			if err := db.CompleteVMRebuild(v.ID, string(VMStatusPreConfiguring)); err != nil {
+				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusPreConfiguring, "err", err)
+			}
+			vmAttemptSucceeded(&v)
+		default:
+			// The status was changed while the task was running
+			setVMTaskResult(v.ID, VMStatus(v.Status))
+		}
+	}
+}
+
+// errProxmoxTaskFailed returns the error of a failed task with the exit status
+// of Proxmox as the reason. A failure that won't go away by retrying wraps
+// errPermanentFailure.
+func errProxmoxTaskFailed(upid, exitStatus string) error {
+	if isPermanentTaskFailure(exitStatus) {
+		return fmt.Errorf("%w: proxmox task %s failed: %s", errPermanentFailure, upid, exitStatus)
+	}
+	return fmt.Errorf("proxmox task %s failed: %s", upid, exitStatus)
+}
+
+// isPermanentTaskFailure returns true if the exit status of a task is a
+// failure that depends on the request or on the cluster config, like an
+// exceeded quota or a missing template
+func isPermanentTaskFailure(exitStatus string) bool {
+	exitStatus = strings.ToLower(exitStatus)
+	for _, f := range permanentTaskFailures {
+		if strings.Contains(exitStatus, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func setVMTaskResult(vmID uint64, status VMStatus) {
+	if err := db.SetVMTask(vmID, string(status), "", ""); err != nil {
+		logger.Error("Failed to update status of VM", "vmid", vmID, "new_status", status, "err", err)
+	}
+}
+
+func pollInterfaceTasks(pc *pveCluster, vmIDs map[uint64]bool) {
+	interfaces, err := db.GetInterfacesWithTask()
+	if err != nil {
+		logger.Error("Failed to get interfaces with a task", "error", err)
+		return
+	}
+
+	for _, iface := range interfaces {
+		if !vmIDs[uint64(iface.VMID)] {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, iface.TaskUPID)
+		if lost {
+			if err := db.SetInterfaceTask(iface.ID, iface.Status, "", ""); err != nil {
+				logger.Error("Failed to update interface status", "interface_id", iface.ID, "status", iface.Status, "err", err)
+			}
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		logger.Debug("Proxmox task of interface completed", "interface_id", iface.ID, "upid", iface.TaskUPID, "successful", successful)
+
+		status := InterfaceStatus(iface.Status)
+		if status == InterfaceStatusDeleting {
+			if successful {
+				if err := db.DeleteInterfaceByID(iface.ID); err != nil {
+					logger.Error("Failed to delete interface from DB", "interface_id", iface.ID, "err", err)
+				}
+			} else {
+				interfaceAttemptFailed(&iface, InterfaceStatusPreDeleting, "interface deletion", errProxmoxTaskFailed(iface.TaskUPID, exitStatus))
+			}
+			continue
+		}
+
+		if err := db.SetInterfaceTask(iface.ID, string(status), "", ""); err != nil {
+			logger.Error("Failed to update interface status", "interface_id", iface.ID, "status", status, "err", err)
+		}
+	}
+}
+
+func pollBackupRequestTasks(pc *pveCluster, vmIDs map[uint64]bool) {
+	bkr, err := db.GetBackupRequestsWithTask()
+	if err != nil {
+		logger.Error("Failed to get backup requests with a task", "error", err)
+		return
+	}
+
+	for _, r := range bkr {
+		if !vmIDs[uint64(r.VMID)] {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, r.TaskUPID)
+		if lost {
+			// Whether the backup was made can't be known, so the request fails
+			backupRequestAttemptFailed(&r, fmt.Errorf("status of proxmox task %s can't be read", r.TaskUPID))
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		logger.Debug("Proxmox task of backup request completed", "id", r.ID, "upid", r.TaskUPID, "successful", successful)
+
+		if !successful {
+			backupRequestAttemptFailed(&r, errProxmoxTaskFailed(r.TaskUPID, exitStatus))
+			continue
+		}
+		if err := db.SetBackupRequestTask(r.ID, BackupRequestStatusCompleted, "", ""); err != nil {
+			logger.Error("Failed to update backup request status", "status", BackupRequestStatusCompleted, "id", r.ID, "error", err)
+		}
+		backupRequestAttemptSucceeded(&r)
+	}
+}
+
+// resumeUntrackedTasks handles the objects left in a transient status without
+// a tracked task, for example if sasso was stopped before saving the UPID.
+// The final state is guessed from the VMs and the containers on Proxmox.
+func resumeUntrackedTasks(pc *pveCluster, vmNodes, ctNodes map[uint64]string) {
+	if pc.untrackedTasksResumed {
+		return
+	}
+
+	logger.Debug("Resuming untracked tasks in worker")
+
+	states := []string{string(VMStatusCreating), string(VMStatusDeleting), string(VMStatusRebuilding)}
+	vms, err := db.GetVMsWithStates(states)
+	if err != nil {
+		logger.Error("Failed to get VMs in a transient status", "error", err)
+		return
+	}
+
+	// Objects with a task still running on Proxmox are resumed in a later
+	// cycle
+	pending := false
+
+	for _, v := range vms {
+		if v.TaskUPID != "" || v.Cluster != pc.name {
+			continue
+		}
+
+		nodeName, exists := vmNodes[v.ID]
+		if exists && isVMLockedOnProxmox(pc, nodeName, v.ID) {
+			// A clone creates the VM before copying the disks, so the VM
+			// exists long before the task is completed
+			logger.Debug("VM in a transient status is locked, waiting for its task", "vmid", v.ID, "status", v.Status)
+			pending = true
+			continue
+		}
+		logger.Warn("VM in a transient status without a task", "vmid", v.ID, "status", v.Status, "exists_on_proxmox", exists)
+
+		switch VMStatus(v.Status) {
+		case VMStatusCreating:
+			if exists {
+				setVMTaskResult(v.ID, VMStatusPreConfiguring)
+			} else {
+				setVMTaskResult(v.ID, VMStatusPreCreating)
+			}
+		case VMStatusDeleting:
+			if exists {
+				setVMTaskResult(v.ID, VMStatusPreDeleting)
+			} else if err := db.DeleteVMByID(v.ID); err != nil {
+				logger.Error("Failed to delete VM", "vmid", v.ID, "err", err)
+			}
+		case VMStatusRebuilding:
+			if exists {
+				if err := db.CompleteVMRebuild(v.ID, string(VMStatusPreConfiguring)); err != nil {
+					logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusPreConfiguring, "err", err)
+				}
+				pc.lastConfigureSSHKeysTime = time.Time{}
+			} else {
+				// The VM was already destroyed, so it's only cloned again
+				setVMTaskResult(v.ID, VMStatusPreRebuilding)
+			}
+		}
+	}
+
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+
+	interfaces, err := db.GetInterfacesWithStatus(string(InterfaceStatusDeleting))
+	if err != nil {
+		logger.Error("Failed to get interfaces with 'deleting' status", "error", err)
+		return
+	}
+	for _, iface := range interfaces {
+		if iface.TaskUPID != "" || !vmIDs[uint64(iface.VMID)] {
+			continue
+		}
+		// Removing the interface from Proxmox again is harmless
+		if err := db.SetInterfaceTask(iface.ID, string(InterfaceStatusPreDeleting), "", ""); err != nil {
+			logger.Error("Failed to update interface status", "interface_id", iface.ID, "status", InterfaceStatusPreDeleting, "err", err)
+		}
+	}
+
+	if !resumeUntrackedMigrations(pc, vmNodes) {
+		pending = true
+	}
+	resumeUntrackedContainerTasks(pc, ctNodes)
+	if !resumeUntrackedTemplateTasks(pc, vmNodes) {
+		pending = true
+	}
+
+	pc.untrackedTasksResumed = !pending
+}
+
+// isVMLockedOnProxmox returns true if the config of the VM is locked by a
+// task, like a clone or a deletion. If the config can't be read the VM is
+// considered locked, so nothing is guessed from it.
+func isVMLockedOnProxmox(pc *pveCluster, nodeName string, vmID uint64) bool {
+	node, err := getProxmoxNode(pc.client, nodeName)
+	if err != nil {
+		return true
+	}
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return true
+	}
+	lock := vm.VirtualMachineConfig.Lock
+	return lock != "" && lock != "suspended"
+}
@@ -0,0 +1,630 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+
+	gprox "github.com/luthermonson/go-proxmox"
+)
+
+type TemplateStatus string
+
+var (
+	TemplateStatusPreCreating TemplateStatus = "pre-creating"
+	// The source VM is being copied, then the template goes back to
+	// 'pre-creating' to be converted
+	TemplateStatusCopying     TemplateStatus = "copying"
+	TemplateStatusCreating    TemplateStatus = "creating"
+	TemplateStatusReady       TemplateStatus = "ready"
+	TemplateStatusPreDeleting TemplateStatus = "pre-deleting"
+	TemplateStatusDeleting    TemplateStatus = "deleting"
+	TemplateStatusUnknown     TemplateStatus = "unknown"
+
+	ErrTemplateInUse = errors.New("template_in_use")
+)
+
+type Template struct {
+	ID          uint      `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Disk        uint      `json:"disk"`
+	Status      string    `json:"status"`
+	Cluster     string    `json:"cluster"`
+
+	GroupID   uint   `json:"group_id,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+}
+
+func convertDBTemplate(t *db.Template, group *db.Group) Template {
+	template := Template{
+		ID:          t.ID,
+		CreatedAt:   t.CreatedAt,
+		Name:        t.Name,
+		Description: t.Description,
+		Disk:        t.Disk,
+		Status:      t.Status,
+		Cluster:     t.Cluster,
+	}
+	if group != nil {
+		template.GroupID = group.ID
+		template.GroupName = group.Name
+	}
+	return template
+}
+
+// ListPrivateTemplates returns the private templates of the user and of the
+// groups of the user
+func ListPrivateTemplates(userID uint) ([]Template, error) {
+	dbTemplates, err := db.GetTemplatesByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get templates of user", "userID", userID, "error", err)
+		return nil, err
+	}
+
+	templates := make([]Template, 0, len(dbTemplates))
+	for i := range dbTemplates {
+		templates = append(templates, convertDBTemplate(&dbTemplates[i], nil))
+	}
+
+	groups, err := db.GetGroupsByUserID(userID)
+	if err != nil {
+		logger.Error("Failed to get groups of user", "userID", userID, "error", err)
+		return nil, err
+	}
+
+	for _, g := range groups {
+		dbTemplates, err := db.GetTemplatesByGroupID(g.ID)
+		if err != nil {
+			logger.Error("Failed to get templates of group", "groupID", g.ID, "error", err)
+			return nil, err
+		}
+		for i := range dbTemplates {
+			templates = append(templates, convertDBTemplate(&dbTemplates[i], &g))
+		}
+	}
+	return templates, nil
+}
+
+// getOwnerTemplate returns a private template only if it belongs to the owner
+func getOwnerTemplate(templateID uint, ownerID uint, ownerType string) (*db.Template, error) {
+	t, err := db.GetTemplateByID(templateID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrTemplateNotFound
+		}
+		logger.Error("Failed to get template", "templateID", templateID, "error", err)
+		return nil, err
+	}
+	if t.OwnerID != ownerID || t.OwnerType != ownerType {
+		return nil, ErrTemplateNotFound
+	}
+	return t, nil
+}
+
+// CreateTemplate turns a stopped VM, or a copy of it, into a private template
+// of the owner of the VM. A copy is counted against the disk quota of the
+// owner, while a converted VM keeps its disk.
+func CreateTemplate(vmID uint64, name, description string, convert bool) (*Template, error) {
+	vm, err := db.GetVMByID(vmID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrVMNotFound
+		}
+		logger.Error("Failed to get VM for template", "vmID", vmID, "error", err)
+		return nil, err
+	}
+
+	if vm.Status != string(VMStatusStopped) {
+		return nil, errors.Join(ErrInvalidVMState, errors.New("the vm must be stopped"))
+	}
+
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return nil, err
+	} else if migrating {
+		return nil, ErrVMMigrating
+	}
+
+	if !isValidVMName(name) {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
+	}
+
+	// The copy takes disk quota and a VMID of the owner
+	m := getOwnerMutex(vm.OwnerID, vm.OwnerType)
+	m.Lock()
+	defer m.Unlock()
+
+	exists, err := db.ExistsTemplateWithOwnerAndName(vm.OwnerID, vm.OwnerType, name)
+	if err != nil {
+		logger.Error("Failed to check if template name exists", "vmID", vmID, "error", err)
+		return nil, err
+	} else if exists {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("template name already exists"))
+	}
+
+	group := vm.OwnerType == "Group"
+	template := db.Template{
+		VMID:        vm.ID,
+		Name:        name,
+		Description: description,
+		Disk:        vm.Disk,
+		Cluster:     vm.Cluster,
+		Node:        vm.Node,
+		Status:      string(TemplateStatusPreCreating),
+		SourceVMID:  vm.ID,
+		Convert:     convert,
+		OwnerID:     vm.OwnerID,
+		OwnerType:   vm.OwnerType,
+	}
+
+	if !convert {
+		var currentDisk, maxDisk uint
+		if group {
+			_, _, currentDisk, err = db.GetVMResourcesByGroupID(vm.OwnerID)
+			if err == nil {
+				_, _, maxDisk, _, err = db.GetGroupResourceLimits(vm.OwnerID)
+			}
+		} else {
+			_, _, currentDisk, err = db.GetVMResourcesByUserID(vm.OwnerID)
+			if err == nil {
+				var user db.User
+				user, err = db.GetUserByID(vm.OwnerID)
+				if err == nil {
+					maxDisk = user.MaxDisk
+				}
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to get resources for template", "vmID", vmID, "error", err)
+			return nil, err
+		}
+		if currentDisk+vm.Disk > maxDisk {
+			return nil, ErrInsufficientResources
+		}
+
+		template.VMID, err = nextVMIDForOwner(group, vm.OwnerID)
+		if err != nil {
+			logger.Error("Failed to generate VMID for template", "vmID", vmID, "error", err)
+			return nil, err
+		}
+	}
+
+	if err := db.NewTemplate(&template, string(VMStatusConverting)); err != nil {
+		logger.Error("Failed to create template", "vmID", vmID, "error", err)
+		return nil, err
+	}
+
+	t := convertDBTemplate(&template, nil)
+	return &t, nil
+}
+
+// DeleteTemplate deletes a private template. The user must own the template
+// or be an admin or the owner of the group that owns it. Linked clones need
+// the template, so it can't be deleted while they exist.
+func DeleteTemplate(userID uint, templateID uint) error {
+	t, err := db.GetTemplateByID(templateID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrTemplateNotFound
+		}
+		logger.Error("Failed to get template", "templateID", templateID, "error", err)
+		return err
+	}
+
+	if t.OwnerType == "Group" {
+		role, err := db.GetUserRoleInGroup(userID, t.OwnerID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return ErrTemplateNotFound
+			}
+			logger.Error("Failed to get user role in group", "userID", userID, "groupID", t.OwnerID, "error", err)
+			return err
+		}
+		if role != "admin" && role != "owner" {
+			return ErrPermissionDenied
+		}
+	} else if t.OwnerID != userID {
+		return ErrTemplateNotFound
+	}
+
+	if t.Status != string(TemplateStatusReady) && t.Status != string(TemplateStatusUnknown) {
+		return ErrInvalidVMState
+	}
+
+	count, err := db.CountVMsUsingTemplate(t.ID, cClone.Full)
+	if err != nil {
+		logger.Error("Failed to count VMs using template", "templateID", templateID, "error", err)
+		return err
+	}
+	if count > 0 {
+		return ErrTemplateInUse
+	}
+
+	if err := db.UpdateTemplateStatus(t.ID, string(TemplateStatusPreDeleting)); err != nil {
+		logger.Error("Failed to update status of template", "templateID", templateID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// getReadyPrivateTemplate returns a private template that can be cloned.
+// ErrTemplateNotFound is returned if the template was deleted or is not
+// ready.
+func getReadyPrivateTemplate(templateID uint) (*db.Template, error) {
+	t, err := db.GetTemplateByID(templateID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrTemplateNotFound
+		}
+		logger.Error("Failed to get private template", "templateID", templateID, "error", err)
+		return nil, err
+	}
+	if t.Status != string(TemplateStatusReady) {
+		return nil, errors.Join(ErrTemplateNotFound, errors.New("template is not ready"))
+	}
+	return t, nil
+}
+
+// getPrivateTemplateVM returns the Proxmox VM of a ready private template on
+// the cluster
+func getPrivateTemplateVM(pc *pveCluster, templateID uint) (*gprox.VirtualMachine, error) {
+	t, err := getReadyPrivateTemplate(templateID)
+	if err != nil {
+		return nil, err
+	}
+	if t.Cluster != pc.name {
+		return nil, errors.Join(ErrTemplateNotFound, errors.New("template is on another cluster"))
+	}
+
+	node, err := getProxmoxNode(pc.client, t.Node)
+	if err != nil {
+		return nil, err
+	}
+	return getProxmoxVM(node, int(t.VMID))
+}
+
+// removeSassoInterfaces removes from a VM the interfaces attached to the
+// sasso VNets, together with their cloud-init configuration. VMs cloned from
+// the template get their own interfaces.
+func removeSassoInterfaces(vm *gprox.VirtualMachine) error {
+	nets, err := db.GetAllNets()
+	if err != nil {
+		logger.Error("Failed to get nets", "error", err)
+		return err
+	}
+	names := make(map[string]bool)
+	for _, n := range nets {
+		names[n.Name] = true
+	}
+
+	var toDelete []string
+	for k, v := range vm.VirtualMachineConfig.Nets {
+		for _, option := range strings.Split(v, ",") {
+			bridge, ok := strings.CutPrefix(option, "bridge=")
+			if ok && names[bridge] {
+				toDelete = append(toDelete, k, strings.Replace(k, "net", "ipconfig", 1))
+				break
+			}
+		}
+	}
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	isSuccessful, err := configureVM(workerContext, vm, gprox.VirtualMachineOption{
+		Name:  "delete",
+		Value: strings.Join(toDelete, ","),
+	})
+	if err != nil {
+		return err
+	}
+	if !isSuccessful {
+		return ErrTaskFailed
+	}
+	return nil
+}
+
+// createTemplates creates the templates in the 'pre-creating' status. If the
+// VM is not converted it's copied first, then the interfaces are removed and
+// the VM is converted to a template. The Proxmox tasks are tracked by
+// pollTasks, so a template goes through this stage once for the copy and once
+// for the conversion.
+func createTemplates(pc *pveCluster, vmNodes map[uint64]string) {
+	logger.Debug("Creating templates in worker")
+
+	templates, err := db.GetTemplatesWithStatus(string(TemplateStatusPreCreating))
+	if err != nil {
+		logger.Error("Failed to get templates with 'pre-creating' status", "error", err)
+		return
+	}
+	templates = slices.DeleteFunc(templates, func(t db.Template) bool { return t.Cluster != pc.name })
+
+	run := pc.newStageRun("create_templates")
+	for _, t := range templates {
+		nodeName, copied := vmNodes[t.VMID]
+		if !copied && !t.Convert {
+			sourceNode, ok := vmNodes[t.SourceVMID]
+			if !ok {
+				logger.Error("Can't create template. Source VM not found on cluster resources", "template_id", t.ID, "vmid", t.SourceVMID)
+				failTemplateCreation(&t, false)
+				continue
+			}
+			run.Go(sourceNode, t.SourceVMID, func() { copyVMForTemplate(pc, &t, sourceNode) })
+			continue
+		}
+
+		if !copied {
+			logger.Error("Can't create template. Source VM not found on cluster resources", "template_id", t.ID, "vmid", t.SourceVMID)
+			failTemplateCreation(&t, false)
+			continue
+		}
+		run.Go(nodeName, t.VMID, func() { convertVMToTemplate(pc, &t, nodeName) })
+	}
+	run.Wait()
+}
+
+// copyVMForTemplate starts the full clone of the source VM with the VMID of
+// the template. Only templates can be cloned with a linked clone.
+func copyVMForTemplate(pc *pveCluster, t *db.Template, nodeName string) {
+	node, err := getProxmoxNode(pc.client, nodeName)
+	if err != nil {
+		return
+	}
+
+	vm, err := getProxmoxVM(node, int(t.SourceVMID))
+	if err != nil {
+		return
+	}
+
+	cloningOptions := gprox.VirtualMachineCloneOptions{
+		Full:   1,
+		Target: nodeName,
+		Name:   t.Name,
+		NewID:  int(t.VMID),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, task, err := vm.Clone(ctx, &cloningOptions)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to copy VM for template", "template_id", t.ID, "vmid", t.SourceVMID, "err", err)
+		setTemplateUnknown(t.ID)
+		return
+	}
+
+	// The copy is tracked by pollTasks
+	err = db.SetTemplateTask(t.ID, string(TemplateStatusCopying), string(task.UPID), nodeName)
+	if err != nil {
+		logger.Error("Failed to update status of template", "template_id", t.ID, "new_status", TemplateStatusCopying, "err", err)
+	}
+}
+
+// convertVMToTemplate removes the interfaces of the VM with the VMID of the
+// template and starts its conversion to a template
+func convertVMToTemplate(pc *pveCluster, t *db.Template, nodeName string) {
+	node, err := getProxmoxNode(pc.client, nodeName)
+	if err != nil {
+		return
+	}
+
+	vm, err := getProxmoxVM(node, int(t.VMID))
+	if err != nil {
+		return
+	}
+
+	// The conversion completed, but the task was not tracked
+	if bool(vm.Template) {
+		err = db.CompleteTemplate(t, nodeName, string(TemplateStatusReady))
+		if err != nil {
+			logger.Error("Failed to complete template", "template_id", t.ID, "node", nodeName, "err", err)
+		}
+		return
+	}
+
+	if err := removeSassoInterfaces(vm); err != nil {
+		logger.Error("Failed to remove interfaces from template", "template_id", t.ID, "err", err)
+		failTemplateCreation(t, true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	task, err := vm.ConvertToTemplate(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to convert VM to template", "template_id", t.ID, "err", err)
+		failTemplateCreation(t, true)
+		return
+	}
+
+	// The conversion is tracked by pollTasks
+	err = db.SetTemplateTask(t.ID, string(TemplateStatusCreating), string(task.UPID), nodeName)
+	if err != nil {
+		logger.Error("Failed to update status of template", "template_id", t.ID, "new_status", TemplateStatusCreating, "err", err)
+	}
+}
+
+// failTemplateCreation handles a template that can't be created. A converted
+// VM is given back to its owner, with its interfaces created again if they
+// were removed, while a copy is left in the 'unknown' status to be deleted.
+func failTemplateCreation(t *db.Template, interfacesRemoved bool) {
+	if !t.Convert {
+		setTemplateUnknown(t.ID)
+		return
+	}
+
+	ifaceStatus := ""
+	if interfacesRemoved {
+		ifaceStatus = string(InterfaceStatusPreCreating)
+	}
+	err := db.RevertTemplateConversion(t, string(VMStatusStopped), ifaceStatus)
+	if err != nil {
+		logger.Error("Failed to revert the conversion of VM to template", "template_id", t.ID, "vmid", t.SourceVMID, "err", err)
+	}
+}
+
+// deleteTemplates deletes from Proxmox the templates in the 'pre-deleting'
+// status
+func deleteTemplates(pc *pveCluster, vmNodes map[uint64]string) {
+	logger.Debug("Deleting templates in worker")
+
+	templates, err := db.GetTemplatesWithStatus(string(TemplateStatusPreDeleting))
+	if err != nil {
+		logger.Error("Failed to get templates with 'pre-deleting' status", "error", err)
+		return
+	}
+	templates = slices.DeleteFunc(templates, func(t db.Template) bool { return t.Cluster != pc.name })
+
+	run := pc.newStageRun("delete_templates")
+	for _, t := range templates {
+		nodeName, ok := vmNodes[t.VMID]
+		if !ok {
+			// If the template is not found on Proxmox, we just delete it from
+			// the DB
+			logger.Warn("Template not found on cluster resources", "template_id", t.ID, "vmid", t.VMID)
+			if err := db.DeleteTemplateByID(t.ID); err != nil {
+				logger.Error("Failed to delete template", "template_id", t.ID, "err", err)
+			}
+			continue
+		}
+
+		run.Go(nodeName, t.VMID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
+
+			vm, err := getProxmoxVM(node, int(t.VMID))
+			if err != nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := vm.Delete(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("Can't delete template", "template_id", t.ID, "err", err)
+				return
+			}
+
+			// The deletion is tracked by pollTasks
+			err = db.SetTemplateTask(t.ID, string(TemplateStatusDeleting), string(task.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to update status of template", "template_id", t.ID, "new_status", TemplateStatusDeleting, "err", err)
+			}
+		})
+	}
+	run.Wait()
+}
+
+// pollTemplateTasks resolves the final state of the templates whose task is
+// completed
+func pollTemplateTasks(pc *pveCluster) {
+	templates, err := db.GetTemplatesWithTask()
+	if err != nil {
+		logger.Error("Failed to get templates with a task", "error", err)
+		return
+	}
+
+	for _, t := range templates {
+		if t.Cluster != pc.name {
+			continue
+		}
+		completed, successful, exitStatus, lost := getTrackedTaskStatus(pc, t.TaskUPID)
+		if lost {
+			setTemplateTaskResult(t.ID, TemplateStatus(t.Status))
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		logger.Debug("Proxmox task of template completed", "template_id", t.ID, "upid", t.TaskUPID, "successful", successful)
+
+		switch TemplateStatus(t.Status) {
+		case TemplateStatusCopying:
+			if successful {
+				setTemplateTaskResult(t.ID, TemplateStatusPreCreating)
+			} else {
+				logger.Error("Failed to copy VM for template", "template_id", t.ID, "vmid", t.SourceVMID, "err", errProxmoxTaskFailed(t.TaskUPID, exitStatus))
+				setTemplateUnknown(t.ID)
+			}
+		case TemplateStatusCreating:
+			if successful {
+				err := db.CompleteTemplate(&t, t.TaskNode, string(TemplateStatusReady))
+				if err != nil {
+					logger.Error("Failed to complete template", "template_id", t.ID, "node", t.TaskNode, "err", err)
+				}
+			} else {
+				logger.Error("Failed to convert VM to template", "template_id", t.ID, "err", errProxmoxTaskFailed(t.TaskUPID, exitStatus))
+				failTemplateCreation(&t, true)
+			}
+		case TemplateStatusDeleting:
+			if successful {
+				if err := db.DeleteTemplateByID(t.ID); err != nil {
+					logger.Error("Failed to delete template", "template_id", t.ID, "err", err)
+				}
+			} else {
+				logger.Error("Failed to delete template", "template_id", t.ID, "err", errProxmoxTaskFailed(t.TaskUPID, exitStatus))
+				setTemplateUnknown(t.ID)
+			}
+		default:
+			setTemplateTaskResult(t.ID, TemplateStatus(t.Status))
+		}
+	}
+}
+
+// resumeUntrackedTemplateTasks is like resumeUntrackedTasks for the
+// templates. The copy and the conversion are resumed by createTemplates from
+// what's on Proxmox. It returns false if some template is still locked by a
+// task and must be resumed later.
+func resumeUntrackedTemplateTasks(pc *pveCluster, vmNodes map[uint64]string) bool {
+	states := []string{string(TemplateStatusCopying), string(TemplateStatusCreating), string(TemplateStatusDeleting)}
+	templates, err := db.GetTemplatesWithStates(states)
+	if err != nil {
+		logger.Error("Failed to get templates in a transient status", "error", err)
+		return false
+	}
+
+	resumed := true
+	for _, t := range templates {
+		if t.TaskUPID != "" || t.Cluster != pc.name {
+			continue
+		}
+
+		nodeName, exists := vmNodes[t.VMID]
+		if exists && isVMLockedOnProxmox(pc, nodeName, t.VMID) {
+			resumed = false
+			continue
+		}
+		logger.Warn("Template in a transient status without a task", "template_id", t.ID, "status", t.Status, "exists_on_proxmox", exists)
+
+		switch TemplateStatus(t.Status) {
+		case TemplateStatusCopying, TemplateStatusCreating:
+			setTemplateTaskResult(t.ID, TemplateStatusPreCreating)
+		case TemplateStatusDeleting:
+			if exists {
+				setTemplateTaskResult(t.ID, TemplateStatusPreDeleting)
+			} else if err := db.DeleteTemplateByID(t.ID); err != nil {
+				logger.Error("Failed to delete template", "template_id", t.ID, "err", err)
+			}
+		}
+	}
+	return resumed
+}
+
+func setTemplateTaskResult(id uint, status TemplateStatus) {
+	if err := db.SetTemplateTask(id, string(status), "", ""); err != nil {
+		logger.Error("Failed to update status of template", "template_id", id, "new_status", status, "err", err)
+	}
+}
+
+func setTemplateUnknown(id uint) {
+	setTemplateTaskResult(id, TemplateStatusUnknown)
+}
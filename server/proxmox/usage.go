@@ -0,0 +1,75 @@
+package proxmox
+
+import (
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+var (
+	// Interval between two usage samples
+	usageSampleInterval = time.Hour
+
+	lastUsageSampleTime time.Time = time.Time{}
+)
+
+// recordUsage saves the resources used by every VM since the last sample.
+// The usage is computed from the status in the DB, so it does not need
+// Proxmox.
+func recordUsage() {
+	if lastUsageSampleTime.IsZero() {
+		t, err := db.GetLastUsageRecordTime()
+		if err != nil {
+			logger.Error("Failed to get time of last usage record", "error", err)
+			return
+		}
+		lastUsageSampleTime = t
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(lastUsageSampleTime)
+	if elapsed < usageSampleInterval {
+		return
+	}
+	// If sasso was not running we don't know what happened, so we only count
+	// one interval
+	if elapsed > 2*usageSampleInterval {
+		elapsed = usageSampleInterval
+	}
+
+	logger.Debug("Recording usage in worker")
+
+	vms, err := db.GetAllActiveVMs()
+	if err != nil {
+		logger.Error("Failed to get active VMs for usage", "error", err)
+		return
+	}
+
+	hours := elapsed.Hours()
+	records := make([]db.UsageRecord, len(vms))
+	for i, v := range vms {
+		records[i] = db.UsageRecord{
+			Time:       now,
+			VMID:       v.ID,
+			VMName:     v.Name,
+			OwnerID:    v.OwnerID,
+			OwnerType:  v.OwnerType,
+			DiskGBDays: float64(v.Disk) * hours / 24,
+		}
+
+		// A paused VM keeps its memory, but doesn't use the CPU
+		switch VMStatus(v.Status) {
+		case VMStatusRunning:
+			records[i].CoreHours = float64(v.Cores) * hours
+			records[i].RAMGBHours = float64(v.RAM) / 1024 * hours
+		case VMStatusPaused:
+			records[i].RAMGBHours = float64(v.RAM) / 1024 * hours
+		}
+	}
+
+	if err := db.NewUsageRecords(records); err != nil {
+		logger.Error("Failed to save usage records", "error", err)
+		return
+	}
+	lastUsageSampleTime = now
+}
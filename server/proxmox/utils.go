@@ -112,27 +112,68 @@ func mapVMIDToProxmoxNodes(cluster *proxmox.Cluster) (map[uint64]string, error)
 	return vmNodes, nil
 }
 
-func waitForProxmoxTaskCompletion(t *proxmox.Task) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 240*time.Second)
-	isSuccessful, completed, err := t.WaitForCompleteStatus(ctx, 240, 1)
+// mapContainerIDToProxmoxNodes is like mapVMIDToProxmoxNodes for the LXC
+// containers
+func mapContainerIDToProxmoxNodes(cluster *proxmox.Cluster) (map[uint64]string, error) {
+	resources, err := getProxmoxResources(cluster, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	ctNodes := make(map[uint64]string)
+	for _, r := range resources {
+		if r.Type != "lxc" {
+			continue
+		}
+		ctNodes[r.VMID] = r.Node
+	}
+
+	return ctNodes, nil
+}
+
+// waitForProxmoxTaskCompletion waits until the task is completed or ctx is
+// done. The worker passes its context, so the wait ends when the leadership
+// is lost. The error of a failed task wraps ErrTaskFailed and holds the exit
+// status of Proxmox.
+func waitForProxmoxTaskCompletion(ctx context.Context, t *proxmox.Task) (bool, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, 240*time.Second)
+	isSuccessful, completed, err := t.WaitForCompleteStatus(waitCtx, 240, 1)
 	cancel()
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		logger.Error("Failed to wait for Proxmox task completion", "error", err)
 		return false, err
 	}
 
 	if !completed {
-		return waitForProxmoxTaskCompletion(t)
+		return waitForProxmoxTaskCompletion(ctx, t)
 	}
 
 	if !isSuccessful {
-		logger.Error("Proxmox task failed")
-		return false, errors.New("task_failed")
+		logger.Error("Proxmox task failed", "upid", t.UPID, "exit_status", t.ExitStatus)
+		return false, fmt.Errorf("%w: %w", ErrTaskFailed, errProxmoxTaskFailed(string(t.UPID), t.ExitStatus))
 	}
 
 	return true, nil
 }
 
+// getProxmoxTaskStatus returns the status of a task from its UPID, so that a
+// task can be tracked after a restart. The exit status holds the reason of a
+// failure.
+func getProxmoxTaskStatus(client *proxmox.Client, upid string) (completed bool, successful bool, exitStatus string, err error) {
+	t := proxmox.NewTask(proxmox.UPID(upid), client)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = t.Ping(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to get Proxmox task status", "error", err, "upid", upid)
+		return false, false, "", err
+	}
+	return t.IsCompleted, t.IsSuccessful, t.ExitStatus, nil
+}
+
 func getProxmoxCluster(client *proxmox.Client) (*proxmox.Cluster, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	cluster, err := client.Cluster(ctx)
@@ -166,6 +207,17 @@ func getProxmoxVM(node *proxmox.Node, vmid int) (*proxmox.VirtualMachine, error)
 	return vm, nil
 }
 
+func getProxmoxContainer(node *proxmox.Node, vmid int) (*proxmox.Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ct, err := node.Container(ctx, vmid)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to get Proxmox container", "error", err, "node", node.Name, "vmid", vmid)
+		return nil, err
+	}
+	return ct, nil
+}
+
 func getProxmoxResources(cluster *proxmox.Cluster, filters ...string) (proxmox.ClusterResources, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	resources, err := cluster.Resources(ctx, filters...)
@@ -177,16 +229,16 @@ func getProxmoxResources(cluster *proxmox.Cluster, filters ...string) (proxmox.C
 	return resources, nil
 }
 
-func configureVM(vm *proxmox.VirtualMachine, config proxmox.VirtualMachineOption) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	task, err := vm.Config(ctx, config)
+func configureVM(ctx context.Context, vm *proxmox.VirtualMachine, config proxmox.VirtualMachineOption) (bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	task, err := vm.Config(reqCtx, config)
 	cancel()
 	if err != nil {
 		logger.Error("Failed to set VM config", "error", err, "vmid", vm.VMID)
 		return false, err
 	}
 
-	return waitForProxmoxTaskCompletion(task)
+	return waitForProxmoxTaskCompletion(ctx, task)
 }
 
 func getProxmoxStorage(node *proxmox.Node, storage string) (*proxmox.Storage, error) {
@@ -211,3 +263,15 @@ func getProxmoxStorageBackups(s *proxmox.Storage, VMID uint) ([]*proxmox.Storage
 	}
 	return content, nil
 }
+
+func getProxmoxStorageContent(s *proxmox.Storage) ([]*proxmox.StorageContent, error) {
+	// Listing the whole storage can take a while, so use a longer timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	content, err := s.GetContent(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to get Proxmox Storage content", "error", err, "storage", s.Name)
+		return nil, err
+	}
+	return content, nil
+}
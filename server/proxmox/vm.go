@@ -23,6 +23,9 @@ var (
 	VMStatusPaused  VMStatus = "paused"
 	VMStatusUnknown VMStatus = "unknown"
 
+	// The VM is suspended to disk. On Proxmox it's stopped
+	VMStatusHibernated VMStatus = "hibernated"
+
 	// The pre-status is before the main worker has acknowledged the creation or
 	// deletion
 	VMStatusPreCreating VMStatus = "pre-creating"
@@ -36,7 +39,18 @@ var (
 	VMStatusPreConfiguring VMStatus = "pre-configuring"
 	VMStatusConfiguring    VMStatus = "configuring"
 
-	VMCloneDiskSizeGB uint = 4 // Minimum disk size in GB for a VM clone
+	// The VM is deleted from Proxmox and the template is cloned again with
+	// the same VMID
+	VMStatusPreRebuilding VMStatus = "pre-rebuilding"
+	VMStatusRebuilding    VMStatus = "rebuilding"
+
+	// The VM is being converted to a private template. It's deleted when the
+	// template is ready
+	VMStatusConverting VMStatus = "converting"
+
+	// Minimum disk size in GB for a VM clone, until it's read from the
+	// template of the cluster
+	defaultCloneDiskSizeGB uint = 4
 
 	ErrVMNotFound     error = errors.New("VM not found")
 	ErrInvalidVMState error = errors.New("invalid VM state for this action")
@@ -44,25 +58,30 @@ var (
 
 	vmNameRegex = regexp.MustCompile(`^[a-zA-Z0-9]+(\.[a-zA-Z0-9]+|-[a-zA-Z0-9]+)*$`)
 
-	vmLifeTimes = []uint{1, 3, 6, 12}
-
 	vmMinCores uint = 1
 	vmMinRAM   uint = 512 // in MB
 )
 
 type VM struct {
-	ID                   uint64    `json:"id"`
-	CreatedAt            time.Time `json:"-"`
-	Status               string    `json:"status"`
-	Name                 string    `json:"name"`
-	Notes                string    `json:"notes"`
-	Cores                uint      `json:"cores"`
-	RAM                  uint      `json:"ram"`
-	Disk                 uint      `json:"disk"`
-	LifeTime             time.Time `json:"lifetime"`
-	IncludeGlobalSSHKeys bool      `json:"include_global_ssh_keys"`
-	OwnerID              uint      `json:"-"`
-	OwnerType            string    `json:"-"`
+	ID                   uint64     `json:"id"`
+	CreatedAt            time.Time  `json:"-"`
+	Status               string     `json:"status"`
+	Name                 string     `json:"name"`
+	Notes                string     `json:"notes"`
+	Cores                uint       `json:"cores"`
+	RAM                  uint       `json:"ram"`
+	Disk                 uint       `json:"disk"`
+	LifeTime             time.Time  `json:"lifetime"`
+	IncludeGlobalSSHKeys bool       `json:"include_global_ssh_keys"`
+	Cluster              string     `json:"cluster"`
+	Node                 string     `json:"node,omitempty"`
+	IdleStopOptOut       bool       `json:"idle_stop_opt_out"`
+	TemplateID           *uint      `json:"template_id,omitempty"`
+	LastError            string     `json:"last_error,omitempty"`
+	Attempts             uint       `json:"attempts"`
+	NextRetryAt          *time.Time `json:"next_retry_at,omitempty"`
+	OwnerID              uint       `json:"-"`
+	OwnerType            string     `json:"-"`
 
 	GroupID   uint   `json:"group_id,omitempty"`
 	GroupName string `json:"group_name,omitempty"`
@@ -83,6 +102,13 @@ func convertDBVMToVM(db_vm *db.VM, groupID *uint, groupName, groupRole *string)
 		Disk:                 db_vm.Disk,
 		LifeTime:             db_vm.LifeTime,
 		IncludeGlobalSSHKeys: db_vm.IncludeGlobalSSHKeys,
+		Cluster:              db_vm.Cluster,
+		Node:                 db_vm.Node,
+		IdleStopOptOut:       db_vm.IdleStopOptOut,
+		TemplateID:           db_vm.TemplateID,
+		LastError:            db_vm.LastError,
+		Attempts:             db_vm.Attempts,
+		NextRetryAt:          db_vm.NextRetryAt,
 		OwnerID:              db_vm.OwnerID,
 		OwnerType:            db_vm.OwnerType,
 	}
@@ -186,13 +212,81 @@ func generateFullVMID(group bool, ownerID uint, vmOwnerID uint) (uint64, error)
 	return vmid, nil
 }
 
-func NewVM(userID uint, groupID *uint, name string, notes string, cores uint, ram uint, disk uint, lifeTime uint, includeGlobalSSHKeys bool) (*VM, error) {
+// nextVMIDForOwner returns the VMID for a new VM, or a new private template,
+// of a user or a group
+func nextVMIDForOwner(group bool, ownerID uint) (uint64, error) {
+	var ids []uint
+	var err error
+	if group {
+		ids, err = db.GetAllVMsIDsByGroupID(ownerID)
+	} else {
+		ids, err = db.GetAllVMsIDsByUserID(ownerID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	uniqueOwnerID, err := getLastUsedUniqueOwnerIDInVMs(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	uniqueOwnerID++ // Increment the VM user ID for the new VM
+	return generateFullVMID(group, ownerID, uniqueOwnerID)
+}
+
+// checkVMQuota returns ErrInsufficientResources if a new VM with the given
+// resources doesn't fit in the limits of the user or group
+func checkVMQuota(group bool, ownerID uint, cores, ram, disk uint) error {
+	var currentCores, currentRAM, currentDisk uint
+	var maxCores, maxRAM, maxDisk uint
+	var err error
+
+	if group {
+		currentCores, currentRAM, currentDisk, err = db.GetVMResourcesByGroupID(ownerID)
+		if err != nil {
+			logger.Error("Failed to get current VM resources from database", "groupID", ownerID, "error", err)
+			return err
+		}
+		maxCores, maxRAM, maxDisk, _, err = db.GetGroupResourceLimits(ownerID)
+		if err != nil {
+			logger.Error("Failed to get group resource limits from database", "groupID", ownerID, "error", err)
+			return err
+		}
+	} else {
+		currentCores, currentRAM, currentDisk, err = db.GetVMResourcesByUserID(ownerID)
+		if err != nil {
+			logger.Error("Failed to get current VM resources from database", "userID", ownerID, "error", err)
+			return err
+		}
+		user, err := db.GetUserByID(ownerID)
+		if err != nil {
+			logger.Error("Failed to get user from database", "userID", ownerID, "error", err)
+			return err
+		}
+		maxCores, maxRAM, maxDisk = user.MaxCores, user.MaxRAM, user.MaxDisk
+	}
+
+	if currentCores+cores > maxCores || currentRAM+ram > maxRAM || currentDisk+disk > maxDisk {
+		return ErrInsufficientResources
+	}
+	return nil
+}
+
+func isValidVMName(name string) bool {
+	return vmNameRegex.MatchString(name) && len(name) <= 16
+}
+
+// NewVM creates a VM in the database. The VM is placed on the requested
+// cluster, or on the first one the owner can use if cluster is empty. A VM
+// created from a private template is placed on the cluster of the template.
+func NewVM(userID uint, groupID *uint, name string, notes string, cores uint, ram uint, disk uint, lifeTime uint, includeGlobalSSHKeys bool, templateID *uint, cluster string) (*VM, error) {
 	l := logger.With("userID", userID, "vmName", name)
 	if groupID != nil {
 		l = logger.With("groupID", *groupID)
 	}
 
-	if !vmNameRegex.MatchString(name) || len(name) > 16 {
+	if !isValidVMName(name) {
 		return nil, errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
 	}
 
@@ -202,16 +296,8 @@ func NewVM(userID uint, groupID *uint, name string, notes string, cores uint, ra
 	if ram < vmMinRAM {
 		return nil, errors.Join(ErrInvalidVMParam, errors.New("ram must be at least 512 MB"))
 	}
-	if disk < VMCloneDiskSizeGB {
-		return nil, errors.Join(ErrInvalidVMParam, errors.New("disk must be at least 4 GB"))
-	}
-
-	if !slices.Contains(vmLifeTimes, lifeTime) {
-		err := fmt.Errorf("lifetime must be one of the following values: %v", vmLifeTimes)
-		return nil, errors.Join(ErrInvalidVMParam, err)
-	}
 
-	user, err := db.GetUserByID(userID)
+	_, err := db.GetUserByID(userID)
 	if err != nil {
 		logger.Error("Failed to get user from database", "userID", userID, "error", err)
 		return nil, err
@@ -226,78 +312,82 @@ func NewVM(userID uint, groupID *uint, name string, notes string, cores uint, ra
 		}
 	}
 
-	var exists bool
-	if group != nil {
-		exists, err = db.ExistsVMWithGroupIDAndName(*groupID, name)
-	} else {
-		exists, err = db.ExistsVMWithUserIDAndName(userID, name)
-	}
-	if err != nil {
-		l.Error("Failed to check if VM name exists", "error", err)
-		return nil, err
-	} else if exists {
-		return nil, errors.Join(ErrInvalidVMParam, errors.New("vm name already exists"))
+	// A private template can be used only by its owner and the disk can't be
+	// smaller than the one of the template
+	if templateID != nil {
+		var t *db.Template
+		if group != nil {
+			t, err = getOwnerTemplate(*templateID, group.ID, "Group")
+		} else {
+			t, err = getOwnerTemplate(*templateID, userID, "User")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t.Status != string(TemplateStatusReady) {
+			return nil, errors.Join(ErrInvalidVMParam, errors.New("template is not ready"))
+		}
+		if disk < t.Disk {
+			return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("disk must be at least %d GB", t.Disk))
+		}
+		if cluster != "" && cluster != t.Cluster {
+			return nil, errors.Join(ErrInvalidVMParam, errors.New("the template is on another cluster"))
+		}
+		cluster = t.Cluster
 	}
 
-	var currentCores, currentRAM, currentDisk uint
-
+	var policy *db.LifetimePolicy
 	if group != nil {
-		currentCores, currentRAM, currentDisk, err = db.GetVMResourcesByGroupID(*groupID)
+		policy, err = getLifetimePolicy(group.ID, "Group")
 	} else {
-		currentCores, currentRAM, currentDisk, err = db.GetVMResourcesByUserID(userID)
+		policy, err = getLifetimePolicy(userID, "User")
 	}
-
 	if err != nil {
-		l.Error("Failed to get current VM resources from database", "error", err)
 		return nil, err
 	}
 
-	var maxCores, maxRAM, maxDisk uint
-	if group != nil {
-		maxCores, maxRAM, maxDisk, _, err = db.GetGroupResourceLimits(*groupID)
-		if err != nil {
-			l.Error("Failed to get group resource limits from database", "groupID", *groupID, "error", err)
-			return nil, err
-		}
-	} else {
-		maxCores, maxRAM, maxDisk = user.MaxCores, user.MaxRAM, user.MaxDisk
-	}
-
-	if currentCores+cores > maxCores {
-		return nil, ErrInsufficientResources
+	if !slices.Contains(policy.AllowedDurations, lifeTime) {
+		err := fmt.Errorf("lifetime must be one of the following values: %v", policy.AllowedDurations)
+		return nil, errors.Join(ErrInvalidVMParam, err)
 	}
 
-	if currentRAM+ram > maxRAM {
-		return nil, ErrInsufficientResources
+	ownerID, ownerType := userID, "User"
+	if group != nil {
+		ownerID, ownerType = *groupID, "Group"
 	}
 
-	if currentDisk+disk > maxDisk {
-		return nil, ErrInsufficientResources
-	}
+	// The name must stay unique until the VM is created
+	m := getOwnerMutex(ownerID, ownerType)
+	m.Lock()
+	defer m.Unlock()
 
-	var ids []uint
+	var exists bool
 	if group != nil {
-		ids, err = db.GetAllVMsIDsByGroupID(*groupID)
+		exists, err = db.ExistsVMWithGroupIDAndName(*groupID, name)
 	} else {
-		ids, err = db.GetAllVMsIDsByUserID(userID)
+		exists, err = db.ExistsVMWithUserIDAndName(userID, name)
 	}
 	if err != nil {
-		l.Error("Failed to get existing VM IDs from database", "error", err)
+		l.Error("Failed to check if VM name exists", "error", err)
 		return nil, err
+	} else if exists {
+		return nil, errors.Join(ErrInvalidVMParam, errors.New("vm name already exists"))
 	}
 
-	uniqueOwnerID, err := getLastUsedUniqueOwnerIDInVMs(ids)
+	pc, err := selectClusterForOwner(ownerID, ownerType, cluster)
 	if err != nil {
-		l.Error("Failed to get last used unique owner ID in VMs", "error", err)
 		return nil, err
 	}
 
-	uniqueOwnerID++ // Increment the VM user ID for the new VM
-	ownerID := userID
-	if group != nil {
-		ownerID = *groupID
+	if minDisk := uint(pc.cloneDiskSizeGB.Load()); disk < minDisk {
+		return nil, errors.Join(ErrInvalidVMParam, fmt.Errorf("disk must be at least %d GB", minDisk))
 	}
-	VMID, err := generateFullVMID(group != nil, ownerID, uniqueOwnerID)
+
+	if err := checkVMQuota(group != nil, ownerID, cores, ram, disk); err != nil {
+		return nil, err
+	}
+
+	VMID, err := nextVMIDForOwner(group != nil, ownerID)
 	if err != nil {
 		l.Error("Failed to generate full VM ID", "error", err)
 		return nil, err
@@ -305,9 +395,9 @@ func NewVM(userID uint, groupID *uint, name string, notes string, cores uint, ra
 
 	var db_vm *db.VM
 	if group != nil {
-		db_vm, err = db.NewVMForGroup(VMID, *groupID, string(VMStatusPreCreating), name, notes, cores, ram, disk, time.Now().AddDate(0, int(lifeTime), 0), includeGlobalSSHKeys)
+		db_vm, err = db.NewVMForGroup(VMID, *groupID, pc.name, string(VMStatusPreCreating), name, notes, cores, ram, disk, time.Now().AddDate(0, int(lifeTime), 0), includeGlobalSSHKeys, templateID)
 	} else {
-		db_vm, err = db.NewVMForUser(VMID, userID, string(VMStatusPreCreating), name, notes, cores, ram, disk, time.Now().AddDate(0, int(lifeTime), 0), includeGlobalSSHKeys)
+		db_vm, err = db.NewVMForUser(VMID, userID, pc.name, string(VMStatusPreCreating), name, notes, cores, ram, disk, time.Now().AddDate(0, int(lifeTime), 0), includeGlobalSSHKeys, templateID)
 	}
 
 	if err != nil {
@@ -362,13 +452,20 @@ func DeleteVM(group bool, ownerID, userID uint, vmID uint64) error {
 		}
 	}
 
-	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusUnknown)}
+	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusHibernated), string(VMStatusUnknown)}
 
 	if !slices.Contains(vmStates, vm.Status) {
 		logger.Warn("VM is not in a deletable state", "vmID", vmID, "status", vm.Status)
 		return ErrInvalidVMState
 	}
 
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return err
+	} else if migrating {
+		return ErrVMMigrating
+	}
+
 	return deleteVMBypass(vmID)
 }
 
@@ -385,6 +482,12 @@ func deleteVMBypass(vmID uint64) error {
 }
 
 func changeVMStatusBypass(vmID uint64, action string) error {
+	return changeVMStatus(vmID, action, false)
+}
+
+// changeVMStatus executes the action on the VM. With force, a VM in the
+// unknown status can be stopped, as it's often the only way to recover it.
+func changeVMStatus(vmID uint64, action string, force bool) error {
 	vm, err := db.GetVMByID(vmID)
 	if err != nil {
 		if err == db.ErrNotFound {
@@ -396,27 +499,51 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		}
 	}
 
+	// The states where each action can be performed
+	var validStates []VMStatus
 	switch action {
 	case "start":
-		if vm.Status != string(VMStatusStopped) {
-			logger.Warn("VM is not in 'stopped' state, cannot start", "vmID", vmID, "status", vm.Status)
-			return nil
-		}
-	case "stop", "restart":
-		if vm.Status != string(VMStatusRunning) {
-			logger.Warn("VM is not in 'running' state, cannot stop or restart", "vmID", vmID, "status", vm.Status)
-			return nil
+		validStates = []VMStatus{VMStatusStopped, VMStatusHibernated}
+	case "stop":
+		// Stopping an hibernated VM discards the saved state
+		validStates = []VMStatus{VMStatusRunning, VMStatusPaused, VMStatusHibernated}
+		if force {
+			validStates = append(validStates, VMStatusUnknown)
 		}
+	case "hibernate":
+		validStates = []VMStatus{VMStatusRunning, VMStatusPaused}
+	case "restart", "shutdown", "suspend":
+		validStates = []VMStatus{VMStatusRunning}
+	case "resume":
+		validStates = []VMStatus{VMStatusPaused}
 	default:
 		return ErrInvalidVMState
 	}
 
-	if (action == "start" || action == "restart") && vm.LifeTime.Before(time.Now()) {
-		logger.Warn("VM lifetime has expired, cannot start or restart", "vmID", vmID, "lifetime", vm.LifeTime)
-		return errors.Join(ErrInvalidVMState, errors.New("vm lifetime has expired; cannot start or restart"))
+	if !slices.Contains(validStates, VMStatus(vm.Status)) {
+		logger.Warn("VM is not in a valid state for this action", "vmID", vmID, "action", action, "status", vm.Status)
+		return nil
+	}
+
+	if migrating, err := db.IsVMMigrating(vmID); err != nil {
+		logger.Error("Failed to check if VM is migrating", "vmID", vmID, "error", err)
+		return err
+	} else if migrating {
+		logger.Warn("VM is migrating, cannot change status", "vmID", vmID)
+		return ErrVMMigrating
+	}
+
+	if (action == "start" || action == "restart" || action == "resume") && vm.LifeTime.Before(time.Now()) {
+		logger.Warn("VM lifetime has expired, cannot start, restart or resume", "vmID", vmID, "lifetime", vm.LifeTime)
+		return errors.Join(ErrInvalidVMState, errors.New("vm lifetime has expired; cannot start, restart or resume"))
+	}
+
+	pc, err := getVMCluster(vm)
+	if err != nil {
+		return err
 	}
 
-	cluster, err := getProxmoxCluster(client)
+	cluster, err := getProxmoxCluster(pc.client)
 	if err != nil {
 		logger.Error("Failed to get Proxmox cluster for changing VM status", "vmID", vmID, "error", err)
 		return err
@@ -434,7 +561,7 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		return ErrVMNotFound
 	}
 
-	node, err := getProxmoxNode(client, nodeName)
+	node, err := getProxmoxNode(pc.client, nodeName)
 	if err != nil {
 		logger.Error("Failed to get Proxmox node for changing VM status", "vmID", vmID, "node", nodeName, "error", err)
 		return err
@@ -446,18 +573,21 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		return ErrVMNotFound
 	}
 
-	switch action {
-	case "start":
-		if vmr.Status != "stopped" {
-			logger.Warn("VM is not in 'stopped' state in Proxmox, cannot start", "vmID", vmID, "node", nodeName, "status", vmr.Status)
-			return ErrInvalidVMState
-		}
-	case "stop", "restart":
-		if vmr.Status != "running" {
-			logger.Warn("VM is not in 'running' state in Proxmox, cannot stop or restart", "vmID", vmID, "node", nodeName, "status", vmr.Status)
-			return ErrInvalidVMState
+	// A paused VM is still running on Proxmox, while an hibernated VM is
+	// stopped
+	if action == "start" && vmr.Status != "stopped" {
+		logger.Warn("VM is not in 'stopped' state in Proxmox, cannot start", "vmID", vmID, "node", nodeName, "status", vmr.Status)
+		return ErrInvalidVMState
+	} else if force && action == "stop" && vmr.Status == "stopped" {
+		// The VM is already stopped, only the status in the database is wrong
+		logger.Info("VM is already stopped in Proxmox, updating its status", "vmID", vmID, "node", nodeName, "status", vm.Status)
+		if err := db.UpdateVMStatus(vmID, string(VMStatusStopped)); err != nil {
+			logger.Error("Failed to update VM status from database", "vmID", vmID, "error", err)
+			return err
 		}
-	default:
+		return nil
+	} else if action != "start" && vmr.Status == "stopped" && vm.Status != string(VMStatusHibernated) {
+		logger.Warn("VM is in 'stopped' state in Proxmox, cannot "+action, "vmID", vmID, "node", nodeName, "status", vmr.Status)
 		return ErrInvalidVMState
 	}
 
@@ -470,6 +600,14 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		task, err = vmr.Stop(ctx)
 	case "restart":
 		task, err = vmr.Reset(ctx)
+	case "shutdown":
+		task, err = vmr.Shutdown(ctx)
+	case "suspend":
+		task, err = vmr.Pause(ctx)
+	case "resume":
+		task, err = vmr.Resume(ctx)
+	case "hibernate":
+		task, err = vmr.Hibernate(ctx)
 	}
 	cancel()
 	if err != nil {
@@ -477,25 +615,33 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		return err
 	}
 
-	isSuccessful, err := waitForProxmoxTaskCompletion(task)
+	isSuccessful, err := waitForProxmoxTaskCompletion(context.Background(), task)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to wait for Proxmox task completion when trying to %s VM", action), "vmID", vmID, "node", nodeName, "error", err)
 		return err
 	}
 
 	if !isSuccessful {
-		logger.Error("Proxmox task to start VM was not successful", "vmID", vmID, "node", nodeName)
+		logger.Error(fmt.Sprintf("Proxmox task to %s VM was not successful", action), "vmID", vmID, "node", nodeName)
 		return ErrTaskFailed
 	}
 
 	var vmStatus VMStatus
 	switch action {
-	case "start":
+	case "start", "restart", "resume":
 		vmStatus = VMStatusRunning
-	case "stop":
+	case "stop", "shutdown":
 		vmStatus = VMStatusStopped
-	case "restart":
-		vmStatus = VMStatusRunning
+	case "suspend":
+		vmStatus = VMStatusPaused
+	case "hibernate":
+		vmStatus = VMStatusHibernated
+	}
+
+	// The changes made while the VM was hibernated are configured now. The
+	// status is set by configureVMs afterwards
+	if vm.Status == string(VMStatusHibernated) {
+		vmStatus = VMStatusPreConfiguring
 	}
 
 	if err := db.UpdateVMStatus(vmID, string(vmStatus)); err != nil {
@@ -503,7 +649,7 @@ func changeVMStatusBypass(vmID uint64, action string) error {
 		return err
 	}
 
-	logger.Debug(fmt.Sprintf("VM %sed successfully", action), "vmID", vmID)
+	logger.Debug("VM status changed successfully", "vmID", vmID, "action", action, "status", vmStatus)
 	return nil
 }
 
@@ -541,7 +687,7 @@ func ChangeVMStatus(group bool, ownerID, userID uint, vmID uint64, action string
 		}
 	}
 
-	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused)}
+	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusHibernated)}
 	if !slices.Contains(vmStates, vm.Status) {
 		logger.Warn("VM is not in a valid state for changing status", "vmID", vmID, "status", vm.Status)
 		return ErrInvalidVMState
@@ -550,44 +696,54 @@ func ChangeVMStatus(group bool, ownerID, userID uint, vmID uint64, action string
 	return changeVMStatusBypass(vmID, action)
 }
 
+// TestEndpointClone checks that the templates of the clusters can be cloned
+// and reads the minimum disk size of the VMs from them
 func TestEndpointClone() {
+	for _, pc := range clusters[1:] {
+		go testEndpointClone(pc)
+	}
+	testEndpointClone(clusters[0])
+}
+
+func testEndpointClone(pc *pveCluster) {
 	time.Sleep(5 * time.Second)
 	first := true
 	wasError := false
+	l := logger.With("cluster", pc.name)
 
 	for {
-		if !isProxmoxReachable {
+		if !pc.reachable.Load() {
 			time.Sleep(20 * time.Second)
 			continue
 		}
 
-		node, err := getProxmoxNode(client, cTemplate.Node)
+		node, err := getProxmoxNode(pc.client, pc.template.Node)
 		if err != nil {
-			logger.Error("Failed to get Proxmox node", "node", cTemplate.Node, "error", err)
+			l.Error("Failed to get Proxmox node", "node", pc.template.Node, "error", err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
-		vm, err := getProxmoxVM(node, cTemplate.VMID)
+		vm, err := getProxmoxVM(node, pc.template.VMID)
 		if err != nil {
-			logger.Error("Failed to get Proxmox VM", "vmid", cTemplate.VMID, "error", err)
+			l.Error("Failed to get Proxmox VM", "vmid", pc.template.VMID, "error", err)
 			wasError = true
 		} else if first {
-			logger.Info("Proxmox VM is ready for cloning", "vmid", cTemplate.VMID, "status", vm.Status)
+			l.Info("Proxmox VM is ready for cloning", "vmid", pc.template.VMID, "status", vm.Status)
 			first = false
 
 			s, ok := vm.VirtualMachineConfig.SCSIs["scsi0"]
 			if ok {
 				size, err := getSizeFromStorageString(s)
 				if err != nil {
-					logger.Error("Failed to parse storage from VM config", "vmid", cTemplate.VMID, "storage", s, "error", err)
+					l.Error("Failed to parse storage from VM config", "vmid", pc.template.VMID, "storage", s, "error", err)
 				} else {
-					VMCloneDiskSizeGB = size
+					pc.cloneDiskSizeGB.Store(uint64(size))
 				}
 			}
 
 		} else if wasError {
-			logger.Info("Proxmox VM is back online for cloning", "vmid", cTemplate.VMID, "status", vm.Status)
+			l.Info("Proxmox VM is back online for cloning", "vmid", pc.template.VMID, "status", vm.Status)
 			wasError = false
 		}
 
@@ -602,17 +758,16 @@ func UpdateVMLifetime(VMID uint64, extendBy uint) error {
 		return err
 	}
 
-	if extendBy == 0 || extendBy > 3 {
-		return errors.Join(ErrInvalidVMParam, errors.New("extend_by must be 1, 2 or 3"))
+	newLifetime, policy, err := checkVMLifetimeExtension(vm, extendBy)
+	if err != nil {
+		return err
 	}
 
-	months := int(extendBy / 2)
-	days := int((extendBy % 2) * 15)
-	if vm.LifeTime.After(time.Now().AddDate(0, months, days)) {
-		return errors.Join(ErrInvalidVMParam, errors.New("cannot update lifetime. Too soon"))
+	if lifetimeNeedsApproval(vm, policy, newLifetime) {
+		return ErrApprovalRequired
 	}
 
-	err = db.UpdateVMLifetime(VMID, vm.LifeTime.AddDate(0, int(extendBy), 0))
+	err = db.UpdateVMLifetime(VMID, newLifetime)
 	if err != nil {
 		logger.Error("Failed to update VM lifetime in database", "vmID", VMID, "error", err)
 		return err
@@ -674,6 +829,58 @@ func getUniqueOwnerIDInVM(id uint) (uint, error) {
 	return uint(uniqueOwnerID), nil
 }
 
+// UpdateVMNameAndNotes changes the name and the notes of a VM. A nil value
+// keeps the current one. With user VM names the worker renames the VM on
+// Proxmox too.
+func UpdateVMNameAndNotes(VMID uint64, name, notes *string) error {
+	vm, err := db.GetVMByID(VMID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrVMNotFound
+		}
+		logger.Error("Failed to get VM from database for updating name and notes", "vmID", VMID, "error", err)
+		return err
+	}
+
+	newName := vm.Name
+	newNotes := vm.Notes
+	if notes != nil {
+		newNotes = *notes
+	}
+
+	if name != nil && *name != vm.Name {
+		if !isValidVMName(*name) {
+			return errors.Join(ErrInvalidVMParam, errors.New("invalid name"))
+		}
+
+		// Other VMs of the owner can be created or renamed at the same time
+		m := getOwnerMutex(vm.OwnerID, vm.OwnerType)
+		m.Lock()
+		defer m.Unlock()
+
+		var exists bool
+		if vm.OwnerType == "Group" {
+			exists, err = db.ExistsVMWithGroupIDAndName(vm.OwnerID, *name)
+		} else {
+			exists, err = db.ExistsVMWithUserIDAndName(vm.OwnerID, *name)
+		}
+		if err != nil {
+			logger.Error("Failed to check if VM name exists", "vmID", VMID, "error", err)
+			return err
+		} else if exists {
+			return errors.Join(ErrInvalidVMParam, errors.New("vm name already exists"))
+		}
+		newName = *name
+	}
+
+	err = db.UpdateVMNameAndNotes(VMID, newName, newNotes)
+	if err != nil {
+		logger.Error("Failed to update VM name and notes", "vmID", VMID, "error", err)
+		return err
+	}
+	return nil
+}
+
 func UpdateVMResources(VMID uint64, cores, ram, disk uint) error {
 	vm, err := db.GetVMByID(VMID)
 	if err != nil {
@@ -693,13 +900,18 @@ func UpdateVMResources(VMID uint64, cores, ram, disk uint) error {
 		return errors.Join(ErrInvalidVMParam, errors.New("disk size can only be increased"))
 	}
 
-	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusUnknown)}
+	vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused), string(VMStatusHibernated), string(VMStatusUnknown)}
 
 	if !slices.Contains(vmStates, vm.Status) {
 		logger.Warn("VM is not in a state for resource updates", "vmID", VMID, "status", vm.Status)
 		return ErrInvalidVMState
 	}
 
+	// The quota is shared with the other VMs of the owner
+	m := getOwnerMutex(vm.OwnerID, vm.OwnerType)
+	m.Lock()
+	defer m.Unlock()
+
 	var group *db.Group = nil
 	if vm.OwnerType == "Group" {
 		group, err = db.GetGroupByID(vm.OwnerID)
@@ -745,6 +957,12 @@ func UpdateVMResources(VMID uint64, cores, ram, disk uint) error {
 		return err
 	}
 
+	// Proxmox locks the config of hibernated VMs. The resources are configured
+	// when the VM is started or stopped
+	if vm.Status == string(VMStatusHibernated) {
+		return nil
+	}
+
 	err = db.UpdateVMStatus(VMID, string(VMStatusPreConfiguring))
 	if err != nil {
 		logger.Error("Failed to update VM status to pre-configuring in database", "vmID", VMID, "error", err)
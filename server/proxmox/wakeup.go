@@ -0,0 +1,32 @@
+package proxmox
+
+import (
+	"time"
+
+	"samuelemusiani/sasso/server/db"
+)
+
+var (
+	// Wake ups received within this delay are handled by the same cycle
+	workerWakeUpDelay = 500 * time.Millisecond
+)
+
+// WakeUpWorker makes the workers of all the instances start a new cycle, so
+// a change written to the DB is handled immediately. The periodic cycle still
+// reconciles everything else.
+func WakeUpWorker() {
+	wakeUpLocalWorker()
+
+	if err := db.NotifyWorker(); err != nil {
+		logger.Error("Failed to notify the workers of the other instances", "error", err)
+	}
+}
+
+func wakeUpLocalWorker() {
+	for _, pc := range clusters {
+		select {
+		case pc.wakeUp <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -6,12 +6,14 @@ package proxmox
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"samuelemusiani/sasso/server/db"
@@ -28,24 +30,35 @@ type stringTime struct {
 }
 
 var (
-	vmStatusTimeMap        map[uint64]stringTime = make(map[uint64]stringTime)
-	vmLastTimePrelaunchMap map[uint64]time.Time  = make(map[uint64]time.Time)
-
-	// Last time a VM failed to change status. This is used in the
-	// enforceVMLifetimes function
-	vmFailedChangeStatus map[uint64]time.Time = make(map[uint64]time.Time)
-
-	lastConfigureSSHKeysTime time.Time = time.Time{}
-
 	workerContext    context.Context    = nil
 	workerCancelFunc context.CancelFunc = nil
-	workerReturnChan chan error         = make(chan error, 1)
+	workerReturnChan chan error         = nil
 )
 
+// StartWorker starts a worker for every cluster. It can be started again
+// after ShutdownWorker, for example when this instance is elected as leader
+// again.
 func StartWorker() {
+	// The state of the workers is kept in memory only when it can be rebuilt
+	// from Proxmox or from the DB, as the workers could be restarted on another
+	// instance
+	lastUsageSampleTime = time.Time{}
+
 	workerContext, workerCancelFunc = context.WithCancel(context.Background())
+	workerReturnChan = make(chan error, len(clusters))
+	go db.ListenWorkerNotifications(workerContext, wakeUpLocalWorker)
+
+	var wg sync.WaitGroup
+	for _, pc := range clusters {
+		pc.resetWorkerState()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workerReturnChan <- worker(workerContext, pc)
+		}()
+	}
 	go func() {
-		workerReturnChan <- worker(workerContext)
+		wg.Wait()
 		close(workerReturnChan)
 	}()
 }
@@ -56,16 +69,18 @@ func ShutdownWorker() error {
 	}
 	var err error = nil
 	if workerReturnChan != nil {
-		err = <-workerReturnChan
-	}
-	if err != nil && err != context.Canceled {
-		return err
-	} else {
-		return nil
+		for e := range workerReturnChan {
+			if e != nil && e != context.Canceled {
+				err = e
+			}
+		}
 	}
+	return err
 }
 
-func worker(ctx context.Context) error {
+// worker reconciles a cluster. The worker of the main cluster also runs the
+// stages that don't depend on Proxmox.
+func worker(ctx context.Context, pc *pveCluster) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -73,64 +88,133 @@ func worker(ctx context.Context) error {
 		// Just a small delay to let other components start
 	}
 
-	logger.Info("Proxmox worker started")
+	l := logger.With("cluster", pc.name)
+	l.Info("Proxmox worker started")
 
 	timeToWait := 10 * time.Second
 
 	for {
-		// Handle graceful shutdown at the start of each cycle
+		// Handle graceful shutdown at the start of each cycle. A cycle starts
+		// after timeToWait or as soon as the worker is woken up by a change
 		select {
 		case <-ctx.Done():
-			logger.Info("Proxmox worker shutting down")
+			l.Info("Proxmox worker shutting down")
 			return ctx.Err()
 		case <-time.After(timeToWait):
+		case <-pc.wakeUp:
+			l.Debug("Proxmox worker woken up")
+			select {
+			case <-ctx.Done():
+				l.Info("Proxmox worker shutting down")
+				return ctx.Err()
+			case <-time.After(workerWakeUpDelay):
+			}
 		}
 
 		now := time.Now()
 
 		// For all VMs we must check the status and take the necessary actions
-		if !isProxmoxReachable {
-			time.Sleep(20 * time.Second)
+		if !pc.reachable.Load() {
+			if err := sleepContext(ctx, 20*time.Second); err != nil {
+				l.Info("Proxmox worker shutting down")
+				return err
+			}
 			continue
 		}
 
-		objectCountHelper()
+		if pc.isMain() {
+			objectCountHelper()
+
+			runStage(ctx, "revert_quotas", func() { revertExpiredQuotaIncreases() })
+			runStage(ctx, "record_usage", func() { recordUsage() })
+		}
+
+		// During maintenance Proxmox must not be touched
+		if isInMaintenance() {
+			l.Debug("Maintenance mode enabled, skipping Proxmox stages")
+			timeToWait = 10 * time.Second
+			continue
+		}
 
-		cluster, err := getProxmoxCluster(client)
+		cluster, err := getProxmoxCluster(pc.client)
 		if err != nil {
-			logger.Error("Failed to get Proxmox cluster", "error", err)
-			time.Sleep(5 * time.Second)
+			l.Error("Failed to get Proxmox cluster", "error", err)
+			if err := sleepContext(ctx, 5*time.Second); err != nil {
+				l.Info("Proxmox worker shutting down")
+				return err
+			}
 			continue
 		}
 
-		workerCycleDurationObserve("create_vnets", func() { createVNets(cluster) })
-		workerCycleDurationObserve("delete_vnets", func() { deleteVNets(cluster) })
-		workerCycleDurationObserve("configure_vnets", func() { configureVNets(cluster) })
-		workerCycleDurationObserve("update_vnets", func() { updateVNets(cluster) })
+		// Stages are executed in order. The Proxmox tasks of a stage run
+		// concurrently in the pool and the stage ends when all of them are done
+		runStage(ctx, "create_vnets", func() { createVNets(pc, cluster) })
+		runStage(ctx, "delete_vnets", func() { deleteVNets(pc, cluster) })
+		runStage(ctx, "configure_vnets", func() { configureVNets(pc, cluster) })
+		runStage(ctx, "update_vnets", func() { updateVNets(pc, cluster) })
 
-		workerCycleDurationObserve("create_vms", func() { createVMs() })
-		workerCycleDurationObserve("update_vms", func() { updateVMs(cluster) })
+		runStage(ctx, "poll_tasks", func() { pollTasks(pc) })
 
-		workerCycleDurationObserve("lifetime_vms", func() { enforceVMLifetimes() })
+		runStage(ctx, "create_vms", func() { createVMs(pc, cluster) })
+		runStage(ctx, "update_vms", func() { updateVMs(pc, cluster) })
+		runStage(ctx, "rename_vms", func() { renameVMs(pc, cluster) })
+
+		if pc.isMain() {
+			// Expired VMs are stopped and deleted on the cluster where they are
+			runStage(ctx, "lifetime_vms", func() { enforceVMLifetimes() })
+			// Stacks only change the database, so they are applied for all the
+			// clusters by the main worker
+			runStage(ctx, "apply_stacks", func() { applyStacks() })
+		}
+		runStage(ctx, "idle_vms", func() { detectIdleVMs(pc, cluster) })
 
 		vmNodes, err := mapVMIDToProxmoxNodes(cluster)
 		if err != nil {
-			logger.Error("Failed to map VMID to Proxmox nodes", "error", err)
-			time.Sleep(5 * time.Second)
+			l.Error("Failed to map VMID to Proxmox nodes", "error", err)
+			if err := sleepContext(ctx, 5*time.Second); err != nil {
+				l.Info("Proxmox worker shutting down")
+				return err
+			}
+			continue
+		}
+
+		ctNodes, err := mapContainerIDToProxmoxNodes(cluster)
+		if err != nil {
+			l.Error("Failed to map container IDs to Proxmox nodes", "error", err)
+			if err := sleepContext(ctx, 5*time.Second); err != nil {
+				l.Info("Proxmox worker shutting down")
+				return err
+			}
 			continue
 		}
 
-		workerCycleDurationObserve("delete_vms", func() { deleteVMs(vmNodes) })
-		workerCycleDurationObserve("configure_ssh_keys", func() { configureSSHKeys(vmNodes) })
-		workerCycleDurationObserve("configure_vms", func() { configureVMs(vmNodes) })
+		runStage(ctx, "resume_tasks", func() { resumeUntrackedTasks(pc, vmNodes, ctNodes) })
+		runStage(ctx, "delete_vms", func() { deleteVMs(pc, vmNodes) })
+		runStage(ctx, "delete_imported_vms", func() { deleteImportedVMs(pc, vmNodes) })
+		runStage(ctx, "create_templates", func() { createTemplates(pc, vmNodes) })
+		runStage(ctx, "delete_templates", func() { deleteTemplates(pc, vmNodes) })
+		runStage(ctx, "configure_ssh_keys", func() { configureSSHKeys(pc, vmNodes) })
+		// Rebuilt VMs force a reconfiguration of the SSH keys in the next cycle,
+		// when they are configured and no longer in a transient status
+		runStage(ctx, "rebuild_vms", func() { rebuildVMs(pc, vmNodes) })
+		runStage(ctx, "configure_vms", func() { configureVMs(pc, vmNodes) })
+
+		runStage(ctx, "create_interfaces", func() { createInterfaces(pc, vmNodes) })
+		runStage(ctx, "delete_interfaces", func() { deleteInterfaces(pc, vmNodes) })
+		runStage(ctx, "configure_interfaces", func() { configureInterfaces(pc, vmNodes) })
+		runStage(ctx, "check_drift", func() { checkDrift(pc, vmNodes) })
+
+		runStage(ctx, "create_containers", func() { createContainers(pc, cluster) })
+		runStage(ctx, "update_containers", func() { updateContainers(pc, cluster) })
+		runStage(ctx, "delete_containers", func() { deleteContainers(pc, ctNodes) })
+		runStage(ctx, "configure_containers", func() { configureContainers(pc, ctNodes) })
 
-		workerCycleDurationObserve("create_interfaces", func() { createInterfaces(vmNodes) })
-		workerCycleDurationObserve("delete_interfaces", func() { deleteInterfaces(vmNodes) })
-		workerCycleDurationObserve("configure_interfaces", func() { configureInterfaces(vmNodes) })
+		runStage(ctx, "delete_backups", func() { deleteBackups(pc, vmNodes) })
+		runStage(ctx, "restore_backups", func() { restoreBackups(pc, vmNodes) })
+		runStage(ctx, "create_backups", func() { createBackups(pc, vmNodes) })
 
-		workerCycleDurationObserve("delete_backups", func() { deleteBackups(vmNodes) })
-		workerCycleDurationObserve("restore_backups", func() { restoreBackups(vmNodes) })
-		workerCycleDurationObserve("create_backups", func() { createBackups(vmNodes) })
+		// Migrations are executed last, as they change the node of the VMs
+		runStage(ctx, "migrate_vms", func() { migrateVMs(pc, cluster, vmNodes) })
 
 		elapsed := time.Since(now)
 		workerCycleDuration.Observe(elapsed.Seconds())
@@ -142,6 +226,27 @@ func worker(ctx context.Context) error {
 	}
 }
 
+// sleepContext waits for d, or until ctx is done. It returns the error of ctx
+// if the wait was interrupted.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// runStage runs a stage of the worker only if this instance is still the
+// leader. When the leadership is lost the rest of the cycle is skipped, as
+// another instance could already run its own.
+func runStage(ctx context.Context, stage string, f func()) {
+	if ctx.Err() != nil || !db.IsLeader() {
+		return
+	}
+	workerCycleDurationObserve(stage, f)
+}
+
 func objectCountHelper() {
 	vmsCount, err := db.CountVMs()
 	if err != nil {
@@ -157,6 +262,13 @@ func objectCountHelper() {
 		objectCountSet("interfaces", interfacesCount)
 	}
 
+	containersCount, err := db.CountContainers()
+	if err != nil {
+		logger.Error("Failed to count containers in DB", "error", err)
+	} else {
+		objectCountSet("containers", containersCount)
+	}
+
 	netsCount, err := db.CountVNets()
 	if err != nil {
 		logger.Error("Failed to count VNets in DB", "error", err)
@@ -172,7 +284,7 @@ func objectCountHelper() {
 	}
 }
 
-func createVNets(cluster *gprox.Cluster) {
+func createVNets(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Creating VNets in worker")
 
 	vnets, err := db.GetVNetsWithStatus(string(VMStatusPreCreating))
@@ -180,15 +292,22 @@ func createVNets(cluster *gprox.Cluster) {
 		logger.Error("Failed to get VNets with 'pre-creating' status", "error", err)
 		return
 	}
+	vnets = slices.DeleteFunc(vnets, func(n db.Net) bool { return n.Cluster != pc.name })
 
 	if len(vnets) == 0 {
 		return
 	}
 
+	// Only the VNets created in this cycle are waiting for the SDN apply
+	created := make([]db.Net, 0, len(vnets))
 	for _, v := range vnets {
+		if waitingForRetry(v.NextRetryAt) {
+			continue
+		}
+
 		options := &gprox.VNetOptions{
 			Name:      v.Name,
-			Zone:      cNetwork.SDNZone,
+			Zone:      pc.network.SDNZone,
 			Tag:       v.Tag,
 			VlanAware: v.VlanAware,
 		}
@@ -197,7 +316,7 @@ func createVNets(cluster *gprox.Cluster) {
 		err := cluster.NewSDNVNet(ctx, options)
 		cancel()
 		if err != nil {
-			logger.Error("Failed to create VNet in Proxmox", "vnet", v.Name, "error", err)
+			netAttemptFailed(&v, VNetStatusPreCreating, "creation", err)
 			continue
 		}
 
@@ -206,44 +325,48 @@ func createVNets(cluster *gprox.Cluster) {
 			logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusCreating, "err", err)
 			continue
 		}
+		created = append(created, v)
+	}
+
+	if len(created) == 0 {
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	task, err := cluster.SDNApply(ctx)
 	cancel()
 	if err != nil {
-		logger.Error("Failed to apply SDN changes in Proxmox", "error", err)
+		// The VNets are already in the SDN config, so the creation can't be
+		// retried
+		for _, v := range created {
+			netFailed(&v, "creation", fmt.Errorf("failed to apply SDN changes: %w", err))
+		}
 		return
 	}
 
-	isSuccessful, err := waitForProxmoxTaskCompletion(task)
-	if err != nil {
-		logger.Error("Failed to wait for Proxmox task completion", "error", err)
+	if _, err := waitForProxmoxTaskCompletion(workerContext, task); err != nil {
+		// The wait ends without a result if the leadership is lost
+		if workerContext.Err() != nil {
+			return
+		}
+		logger.Error("Failed to apply SDN changes in Proxmox", "error", err)
+		for _, v := range created {
+			netFailed(&v, "creation", fmt.Errorf("the SDN apply task failed: %w", err))
+		}
 		return
 	}
 
-	if !isSuccessful {
-		logger.Error("Failed to apply SDN changes in Proxmox")
-		// Set all VNets status to 'unknown'
-		for _, v := range vnets {
-			err = db.UpdateVNetStatus(v.ID, string(VNetStatusUnknown))
-			if err != nil {
-				logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusUnknown, "err", err)
-			}
-		}
-		return
-	} else {
-		logger.Debug("SDN changes applied successfully")
-		for _, v := range vnets {
-			err = db.UpdateVNetStatus(v.ID, string(VNetStatusReady))
-			if err != nil {
-				logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusReady, "err", err)
-			}
+	logger.Debug("SDN changes applied successfully")
+	for _, v := range created {
+		err = db.UpdateVNetStatus(v.ID, string(VNetStatusReady))
+		if err != nil {
+			logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusReady, "err", err)
 		}
+		netAttemptSucceeded(&v)
 	}
 }
 
-func deleteVNets(cluster *gprox.Cluster) {
+func deleteVNets(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Deleting VNets in worker")
 
 	vnets, err := db.GetVNetsWithStatus(string(VNetStatusPreDeleting))
@@ -251,17 +374,24 @@ func deleteVNets(cluster *gprox.Cluster) {
 		logger.Error("Failed to get VNets with 'pre-deleting' status", "error", err)
 		return
 	}
+	vnets = slices.DeleteFunc(vnets, func(n db.Net) bool { return n.Cluster != pc.name })
 
 	if len(vnets) == 0 {
 		return
 	}
 
+	// Only the VNets deleted in this cycle are waiting for the SDN apply
+	deleted := make([]db.Net, 0, len(vnets))
 	for _, v := range vnets {
+		if waitingForRetry(v.NextRetryAt) {
+			continue
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		err := cluster.DeleteSDNVNet(ctx, v.Name)
 		cancel()
 		if err != nil {
-			logger.Error("Failed to delete VNet from Proxmox", "vnet", v.Name, "error", err)
+			netAttemptFailed(&v, VNetStatusPreDeleting, "deletion", err)
 			continue
 		}
 
@@ -270,20 +400,27 @@ func deleteVNets(cluster *gprox.Cluster) {
 			logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusDeleting, "err", err)
 			continue
 		}
+		deleted = append(deleted, v)
+	}
+
+	if len(deleted) == 0 {
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	task, err := cluster.SDNApply(ctx)
 	cancel()
 	if err != nil {
-		logger.Error("Failed to apply SDN changes in Proxmox", "error", err)
+		for _, v := range deleted {
+			netFailed(&v, "deletion", fmt.Errorf("failed to apply SDN changes: %w", err))
+		}
 		return
 	}
 
-	isSuccessful, err := waitForProxmoxTaskCompletion(task)
+	isSuccessful, err := waitForProxmoxTaskCompletion(workerContext, task)
 	if isSuccessful {
 		logger.Debug("SDN changes applied successfully")
-		for _, v := range vnets {
+		for _, v := range deleted {
 			err = db.DeleteNetByID(v.ID)
 			if err != nil {
 				logger.Error("Failed to delete VNet from DB", "vnet", v.Name, "err", err)
@@ -291,17 +428,19 @@ func deleteVNets(cluster *gprox.Cluster) {
 		}
 	} else {
 		logger.Error("Failed to apply SDN changes in Proxmox")
-		for _, v := range vnets {
-			err = db.UpdateVNetStatus(v.ID, string(VNetStatusUnknown))
-			if err != nil {
-				logger.Error("Failed to update status of VNet", "vnet", v.Name, "new_status", VNetStatusUnknown, "err", err)
-			}
+		cause := errors.New("the SDN apply task failed")
+		if err != nil {
+			cause = err
+		}
+		for _, v := range deleted {
+			netFailed(&v, "deletion", cause)
 		}
 	}
 }
 
 // createVMs creates VMs from proxmox that are in the 'pre-creating' status.
-func createVMs() {
+// The node of every VM is chosen with the configured placement strategy.
+func createVMs(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Creating VMs in worker")
 
 	vms, err := db.GetVMsWithStatus(string(VMStatusPreCreating))
@@ -309,21 +448,28 @@ func createVMs() {
 		logger.Error("Failed to get VMs with 'creating' status", "error", err)
 		return
 	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
 
 	if len(vms) == 0 {
 		return
 	}
 
-	node, err := getProxmoxNode(client, cTemplate.Node)
+	node, err := getProxmoxNode(pc.client, pc.template.Node)
 	if err != nil {
 		return
 	}
 
-	templateVm, err := getProxmoxVM(node, cTemplate.VMID)
+	templateVm, err := getProxmoxVM(node, pc.template.VMID)
 	if err != nil {
 		return
 	}
 
+	candidates, err := getNodeCandidates(pc, cluster)
+	if err != nil {
+		logger.Error("Failed to get placement candidates", "error", err)
+		return
+	}
+
 	// https://github.com/luthermonson/go-proxmox/issues/102
 	var optionFull uint8
 	if cClone.Full {
@@ -332,65 +478,122 @@ func createVMs() {
 		optionFull = 0
 	}
 
+	// Only needed for the VMs that are imported with a new VMID
+	var vmNodes map[uint64]string
+
+	// Nodes are selected one VM at a time, while the clones run in the pool
+	run := pc.newStageRun("create_vms")
 	for _, v := range vms {
-		if v.Status != string(VMStatusPreCreating) {
+		if v.Status != string(VMStatusPreCreating) || waitingForRetry(v.NextRetryAt) {
 			continue
 		}
 		logger.Debug("Cloning VM", "vmid", v.ID)
 
-		var vmName string
-		if cClone.UserVMNames {
-			vmName = v.Name
-		} else {
-			s := "sasso-%0" + strconv.Itoa(cClone.VMIDVMDigits) + "d"
-			uniqueID, err := getUniqueOwnerIDInVM(uint(v.ID))
+		vmName, err := proxmoxVMName(&v)
+		if err != nil {
+			logger.Error("Failed to get unique owner ID for VM naming", "vmid", v.ID, "err", err)
+			continue
+		}
+
+		if v.ImportedFromVMID != nil {
+			if vmNodes == nil {
+				vmNodes, err = mapVMIDToProxmoxNodes(cluster)
+				if err != nil {
+					continue
+				}
+			}
+
+			// The original VM is cloned in full on its own node
+			sourceNode, ok := vmNodes[*v.ImportedFromVMID]
+			if !ok {
+				vmFailed(&v, "import", fmt.Errorf("VM %d to import not found", *v.ImportedFromVMID))
+				continue
+			}
+			node, err := getProxmoxNode(pc.client, sourceNode)
+			if err != nil {
+				continue
+			}
+			sourceVm, err := getProxmoxVM(node, int(*v.ImportedFromVMID))
 			if err != nil {
-				logger.Error("Failed to get unique owner ID for VM naming", "vmid", v.ID, "err", err)
 				continue
 			}
-			vmName = fmt.Sprintf(s, uniqueID)
-		}
 
-		cloningOptions := gprox.VirtualMachineCloneOptions{
-			Full:   optionFull,
-			Target: cClone.TargetNode,
-			Name:   vmName,
+			run.Go(sourceNode, v.ID, func() {
+				cloneVM(&v, sourceVm, &gprox.VirtualMachineCloneOptions{Full: 1, Target: sourceNode, Name: vmName})
+			})
+			continue
 		}
 
-		// Create the VM in Proxmox
-		// Creation implies cloning a template
-		cloningOptions.NewID = int(v.ID)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		_, task, err := templateVm.Clone(ctx, &cloningOptions)
-		cancel()
+		targetNode, err := selectNodeForVM(pc, candidates, &v)
 		if err != nil {
-			logger.Error("Failed to clone VM", "vmid", v.ID, "error", err)
+			if errors.Is(err, ErrNoSuitableNode) {
+				logger.Warn("No suitable node for VM, retrying later", "vmid", v.ID, "strategy", pc.placement.Strategy)
+			} else {
+				logger.Error("Failed to select node for VM", "vmid", v.ID, "error", err)
+			}
 			continue
 		}
-		err = db.UpdateVMStatus(v.ID, string(VMStatusCreating))
-		if err != nil {
-			logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusCreating, "err", err)
-		}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(task)
-		if isSuccessful {
-			err = db.UpdateVMStatus(v.ID, string(VMStatusPreConfiguring))
-			if err != nil {
-				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusStopped, "err", err)
-			}
-		} else {
-			// We could set the status as pre-creating to trigger a recreation, but
-			// for now we just set it to unknown
-			err = db.UpdateVMStatus(v.ID, string(VMStatusUnknown))
+		sourceVm := templateVm
+		if v.TemplateID != nil {
+			sourceVm, err = getPrivateTemplateVM(pc, *v.TemplateID)
 			if err != nil {
-				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusUnknown, "err", err)
+				if errors.Is(err, ErrTemplateNotFound) {
+					vmFailed(&v, "creation", err)
+				}
+				continue
 			}
 		}
+
+		run.Go(targetNode, v.ID, func() {
+			// Creation implies cloning a template
+			cloneVM(&v, sourceVm, &gprox.VirtualMachineCloneOptions{
+				Full:   optionFull,
+				Target: targetNode,
+				Name:   vmName,
+			})
+		})
+	}
+	run.Wait()
+}
+
+// cloneVM creates the VM in Proxmox by cloning sourceVm to its VMID
+func cloneVM(v *db.VM, sourceVm *gprox.VirtualMachine, cloningOptions *gprox.VirtualMachineCloneOptions) {
+	cloningOptions.NewID = int(v.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, task, err := sourceVm.Clone(ctx, cloningOptions)
+	cancel()
+	if err != nil {
+		vmAttemptFailed(v, VMStatusPreCreating, "creation", err)
+		return
+	}
+	// The task is tracked by pollTasks
+	err = db.SetVMTask(v.ID, string(VMStatusCreating), string(task.UPID), cloningOptions.Target)
+	if err != nil {
+		logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusCreating, "err", err)
+	}
+	err = db.UpdateVMNode(v.ID, cloningOptions.Target)
+	if err != nil {
+		logger.Error("Failed to update node of VM", "vmid", v.ID, "node", cloningOptions.Target, "err", err)
+	}
+}
+
+// proxmoxVMName returns the name of the VM on Proxmox
+func proxmoxVMName(v *db.VM) (string, error) {
+	if cClone.UserVMNames {
+		return v.Name, nil
+	}
+
+	s := "sasso-%0" + strconv.Itoa(cClone.VMIDVMDigits) + "d"
+	uniqueID, err := getUniqueOwnerIDInVM(uint(v.ID))
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf(s, uniqueID), nil
 }
 
 // deleteVMs deletes VMs from proxmox that are in the 'pre-deleting' status.
-func deleteVMs(VMLocation map[uint64]string) {
+func deleteVMs(pc *pveCluster, VMLocation map[uint64]string) {
 	logger.Debug("Deleting VMs in worker")
 
 	vms, err := db.GetVMsWithStatus(string(VMStatusPreDeleting))
@@ -398,87 +601,80 @@ func deleteVMs(VMLocation map[uint64]string) {
 		logger.Error("Failed to get VMs with 'deleting' status", "error", err)
 		return
 	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
 
+	run := pc.newStageRun("delete_vms")
 	for _, v := range vms {
-		logger.Debug("Deleting VM", "vmid", v.ID)
-
-		err := db.DeleteAllInterfacesByVMID(v.ID)
-		if err != nil {
-			logger.Error("Failed to delete interfaces for VM", "vmid", v.ID, "err", err)
+		if waitingForRetry(v.NextRetryAt) {
+			continue
 		}
 
-		nodeName, ok := VMLocation[v.ID]
-		if !ok {
-			logger.Error("Can't delete VM. Not found on cluster resources", "vmid", v.ID)
+		run.Go(VMLocation[v.ID], v.ID, func() {
+			logger.Debug("Deleting VM", "vmid", v.ID)
 
-			// If the VM is not found on Proxmox, we just delete it from the DB
-			err = db.DeleteVMByID(v.ID)
+			err := db.DeleteAllInterfacesByVMID(v.ID)
 			if err != nil {
-				logger.Error("Failed to delete VM", "vmid", v.ID, "err", err)
+				logger.Error("Failed to delete interfaces for VM", "vmid", v.ID, "err", err)
 			}
-			continue
-		}
 
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			continue
-		}
+			nodeName, ok := VMLocation[v.ID]
+			if !ok {
+				logger.Error("Can't delete VM. Not found on cluster resources", "vmid", v.ID)
 
-		vm, err := getProxmoxVM(node, int(v.ID))
-		if err != nil {
-			continue
-		}
+				// If the VM is not found on Proxmox, we just delete it from the DB
+				err = db.DeleteVMByID(v.ID)
+				if err != nil {
+					logger.Error("Failed to delete VM", "vmid", v.ID, "err", err)
+				}
+				return
+			}
 
-		if vm.Status == "running" {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			task, err := vm.Stop(ctx)
-			cancel()
+			node, err := getProxmoxNode(pc.client, nodeName)
 			if err != nil {
-				logger.Error("Can't stop VM before deletion", "err", err, "vmid", v.ID)
-				continue
+				return
 			}
-			isSuccessful, err := waitForProxmoxTaskCompletion(task)
+
+			vm, err := getProxmoxVM(node, int(v.ID))
 			if err != nil {
-				logger.Error("Can't wait for stop VM task completion", "err", err, "vmid", v.ID)
-				continue
-			}
-			if !isSuccessful {
-				logger.Error("Can't stop VM before deletion", "vmid", v.ID)
-				continue
+				return
 			}
-		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		task, err := vm.Delete(ctx)
-		cancel()
-		if err != nil {
-			logger.Error("Can't delete VM", "err", err, "vmid", v.ID)
-			continue
-		}
-		err = db.UpdateVMStatus(v.ID, string(VMStatusDeleting))
-		if err != nil {
-			logger.Warn("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusDeleting, "err", err)
-		}
+			// Stopping an hibernated VM discards the saved state and removes the
+			// lock, so that it can be deleted
+			if vm.Status == "running" || isHibernatedOnProxmox(vm) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				task, err := vm.Stop(ctx)
+				cancel()
+				if err != nil {
+					vmAttemptFailed(&v, VMStatusPreDeleting, "deletion", fmt.Errorf("can't stop VM: %w", err))
+					return
+				}
+				if _, err := waitForProxmoxTaskCompletion(workerContext, task); err != nil {
+					if workerContext.Err() == nil {
+						vmAttemptFailed(&v, VMStatusPreDeleting, "deletion", fmt.Errorf("the stop task failed: %w", err))
+					}
+					return
+				}
+			}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(task)
-		cancel()
-		if isSuccessful {
-			err = db.DeleteVMByID(v.ID)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			task, err := vm.Delete(ctx)
+			cancel()
 			if err != nil {
-				logger.Error("Failed to delete VM", "vmid", v.ID, "err", err)
+				vmAttemptFailed(&v, VMStatusPreDeleting, "deletion", err)
+				return
 			}
-		} else {
-			// We could set the status as pre-creating to trigger a recreation, but
-			// for now we just set it to unknown
-			err = db.UpdateVMStatus(v.ID, string(VMStatusUnknown))
+			// The task is tracked by pollTasks
+			err = db.SetVMTask(v.ID, string(VMStatusDeleting), string(task.UPID), nodeName)
 			if err != nil {
-				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusUnknown, "err", err)
+				logger.Warn("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusDeleting, "err", err)
 			}
-		}
+		})
 	}
+	run.Wait()
 }
 
-func configureVNets(cluster *gprox.Cluster) {
+func configureVNets(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Configuring VNets in worker")
 
 	vnets, err := db.GetVNetsWithStatus(string(VNetStatusReconfiguring))
@@ -486,6 +682,7 @@ func configureVNets(cluster *gprox.Cluster) {
 		logger.Error("Failed to get VNets with status", "status", VNetStatusReconfiguring, "error", err)
 		return
 	}
+	vnets = slices.DeleteFunc(vnets, func(n db.Net) bool { return n.Cluster != pc.name })
 
 	if len(vnets) == 0 {
 		return
@@ -523,7 +720,7 @@ func configureVNets(cluster *gprox.Cluster) {
 		return
 	}
 
-	isSuccessful, err := waitForProxmoxTaskCompletion(task)
+	isSuccessful, err := waitForProxmoxTaskCompletion(workerContext, task)
 	if isSuccessful {
 		logger.Debug("SDN changes applied successfully")
 		for _, v := range vnets {
@@ -543,7 +740,7 @@ func configureVNets(cluster *gprox.Cluster) {
 	}
 }
 
-func updateVNets(cluster *gprox.Cluster) {
+func updateVNets(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Updating VNets in worker")
 
 	dbVNets, err := db.GetVNetsWithStatus(string(VNetStatusReady))
@@ -551,6 +748,7 @@ func updateVNets(cluster *gprox.Cluster) {
 		logger.Error("Failed to get VNets with 'pre-creating' status", "error", err)
 		return
 	}
+	dbVNets = slices.DeleteFunc(dbVNets, func(n db.Net) bool { return n.Cluster != pc.name })
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	pVNets, err := cluster.SDNVNets(ctx)
@@ -610,7 +808,7 @@ func updateVNets(cluster *gprox.Cluster) {
 
 // This function configures VMs that are in the 'pre-configuring' status.
 // Configuration includes setting the number of cores, RAM and disk size
-func configureVMs(vmNodes map[uint64]string) {
+func configureVMs(pc *pveCluster, vmNodes map[uint64]string) {
 	logger.Debug("Configuring VMs in worker")
 
 	vms, err := db.GetVMsWithStatus(string(VMStatusPreConfiguring))
@@ -618,111 +816,126 @@ func configureVMs(vmNodes map[uint64]string) {
 		logger.Error("Failed to get VMs with 'pre-configuring' status", "error", err)
 		return
 	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
 
+	run := pc.newStageRun("configure_vms")
 	for _, v := range vms {
 		nodeName, ok := vmNodes[v.ID]
 		if !ok {
 			logger.Error("Can't configure VM. Not found on cluster resources", "vmid", v.ID)
 			continue
 		}
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			continue
-		}
-
-		vm, err := getProxmoxVM(node, int(v.ID))
-		if err != nil {
-			continue
-		}
-		logger.Debug("Configuring VM", "vmid", v.ID)
-
-		if vm.VirtualMachineConfig.Cores != int(v.Cores) {
-			coresOption := gprox.VirtualMachineOption{
-				Name:  "cores",
-				Value: v.Cores,
+		run.Go(nodeName, v.ID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
 			}
-			isSuccessful, err := configureVM(vm, coresOption)
+
+			vm, err := getProxmoxVM(node, int(v.ID))
 			if err != nil {
-				logger.Error("Failed to set cores on VM", "vmid", v.ID, "err", err)
 				return
 			}
-			logger.Debug("Task finished", "isSuccessful", isSuccessful)
-			if !isSuccessful {
-				logger.Error("Failed to set cores on VM", "vmid", v.ID)
+
+			// The config of an hibernated VM is locked, it is configured when
+			// the VM is started or stopped
+			if isHibernatedOnProxmox(vm) {
+				logger.Debug("VM is hibernated, configuration postponed", "vmid", v.ID)
+				if err := db.UpdateVMStatus(v.ID, string(VMStatusHibernated)); err != nil {
+					logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusHibernated, "err", err)
+				}
+				return
+			}
+			logger.Debug("Configuring VM", "vmid", v.ID)
+
+			if vm.VirtualMachineConfig.Cores != int(v.Cores) {
+				coresOption := gprox.VirtualMachineOption{
+					Name:  "cores",
+					Value: v.Cores,
+				}
+				isSuccessful, err := configureVM(workerContext, vm, coresOption)
+				if err != nil {
+					logger.Error("Failed to set cores on VM", "vmid", v.ID, "err", err)
+					return
+				}
+				logger.Debug("Task finished", "isSuccessful", isSuccessful)
+				if !isSuccessful {
+					logger.Error("Failed to set cores on VM", "vmid", v.ID)
+				}
 			}
-		}
 
-		if uint(vm.VirtualMachineConfig.Memory) != v.RAM {
-			ramOption := gprox.VirtualMachineOption{
-				Name:  "memory",
-				Value: v.RAM,
+			if uint(vm.VirtualMachineConfig.Memory) != v.RAM {
+				ramOption := gprox.VirtualMachineOption{
+					Name:  "memory",
+					Value: v.RAM,
+				}
+				isSuccessful, err := configureVM(workerContext, vm, ramOption)
+				if err != nil {
+					logger.Error("Failed to set ram on VM", "vmid", v.ID, "err", err)
+					return
+				}
+				logger.Debug("Task finished", "isSuccessful", isSuccessful)
+				if !isSuccessful {
+					logger.Error("Failed to set ram on VM", "vmid", v.ID)
+				}
 			}
-			isSuccessful, err := configureVM(vm, ramOption)
-			if err != nil {
-				logger.Error("Failed to set ram on VM", "vmid", v.ID, "err", err)
-				continue
+
+			scsi0, ok := vm.VirtualMachineConfig.SCSIs["scsi0"]
+			if !ok {
+				logger.Error("Failed to find SCSI0 on VM", "vmid", v.ID)
+				return
 			}
-			logger.Debug("Task finished", "isSuccessful", isSuccessful)
-			if !isSuccessful {
-				logger.Error("Failed to set ram on VM", "vmid", v.ID)
+			size, err := getSizeFromStorageString(scsi0)
+			if err != nil {
+				logger.Error("Failed to parse storage on SCSI0", "vmid", v.ID, "scsi0", scsi0, "error", err)
+				return
 			}
-		}
 
-		scsi0, ok := vm.VirtualMachineConfig.SCSIs["scsi0"]
-		if !ok {
-			logger.Error("Failed to find SCSI0 on VM", "vmid", v.ID)
-			continue
-		}
-		size, err := getSizeFromStorageString(scsi0)
-		if err != nil {
-			logger.Error("Failed to parse storage on SCSI0", "vmid", v.ID, "scsi0", scsi0, "error", err)
-			continue
-		}
+			if size < uint(v.Disk) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				diff := uint(v.Disk) - size
+				t, err := vm.ResizeDisk(ctx, "scsi0", fmt.Sprintf("+%dG", diff))
+				cancel()
+				if err != nil {
+					logger.Error("Failed to set resize disk on VM", "vmid", v.ID, "error", err)
+					return
+				}
 
-		if size < uint(v.Disk) {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			diff := uint(v.Disk) - size
-			t, err := vm.ResizeDisk(ctx, "scsi0", fmt.Sprintf("+%dG", diff))
-			cancel()
-			if err != nil {
-				logger.Error("Failed to set resize disk on VM", "vmid", v.ID, "error", err)
-				continue
+				isSuccessful, err := waitForProxmoxTaskCompletion(workerContext, t)
+				logger.Debug("Task finished", "isSuccessful", isSuccessful)
+				if !isSuccessful {
+					logger.Error("Failed to resize disk on VM", "vmid", v.ID)
+				}
 			}
 
-			isSuccessful, err := waitForProxmoxTaskCompletion(t)
-			logger.Debug("Task finished", "isSuccessful", isSuccessful)
-			if !isSuccessful {
-				logger.Error("Failed to resize disk on VM", "vmid", v.ID)
-			}
-		}
-
-		// If a VM needs to be reconfigured (for example changing cores, RAM or disk),
-		// it is put in the 'pre-configuring' status. After the configuration is done,
-		// the vm must be set to the old status, but we don't save it anywhere.
-		// For new created VMs, we just set the status to 'stopped'.
-		// For other VMs, we try to set it to the acctual status in Proxmox, but
-		// if the status is not recognised, we set it to 'stopped'.
-		// (This is not a huge issue, because the updateVMs function will eventually
-		// correct the status)
-		vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused)}
-		var newStatus string
-		if slices.Contains(vmStates, vm.Status) {
-			newStatus = vm.Status
-		} else {
-			newStatus = string(VMStatusStopped)
-		}
+			// If a VM needs to be reconfigured (for example changing cores, RAM or disk),
+			// it is put in the 'pre-configuring' status. After the configuration is done,
+			// the vm must be set to the old status, but we don't save it anywhere.
+			// For new created VMs, we just set the status to 'stopped'.
+			// For other VMs, we try to set it to the acctual status in Proxmox, but
+			// if the status is not recognised, we set it to 'stopped'.
+			// (This is not a huge issue, because the updateVMs function will eventually
+			// correct the status). Hibernated VMs are not configured, see above.
+			vmStates := []string{string(VMStatusRunning), string(VMStatusStopped), string(VMStatusPaused)}
+			var newStatus string
+			if slices.Contains(vmStates, vm.Status) {
+				newStatus = vm.Status
+			} else {
+				newStatus = string(VMStatusStopped)
+			}
 
-		err = db.UpdateVMStatus(v.ID, string(newStatus))
-		if err != nil {
-			logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusStopped, "err", err)
-		}
+			err = db.UpdateVMStatus(v.ID, string(newStatus))
+			if err != nil {
+				logger.Error("Failed to update status of VM", "vmid", v.ID, "new_status", VMStatusStopped, "err", err)
+			}
 
-		logger.Debug("VM configured", "vm", vm)
+			logger.Debug("VM configured", "vm", vm)
+		})
 	}
+	run.Wait()
 }
 
 // updateVMs updates the status of VMs in the database based on their current status in Proxmox.
-func updateVMs(cluster *gprox.Cluster) {
+func updateVMs(pc *pveCluster, cluster *gprox.Cluster) {
 	logger.Debug("Updating VMs in worker")
 
 	resources, err := getProxmoxResources(cluster, "vm")
@@ -737,6 +950,7 @@ func updateVMs(cluster *gprox.Cluster) {
 		logger.Error("Can't get active VMs from DB", "err", err)
 		return
 	}
+	activeVMs = slices.DeleteFunc(activeVMs, func(v db.VM) bool { return v.Cluster != pc.name })
 
 	// Map all vms to a map
 	vmMap := make(map[uint64]*db.VM)
@@ -744,6 +958,14 @@ func updateVMs(cluster *gprox.Cluster) {
 		vmMap[activeVMs[i].ID] = &activeVMs[i]
 	}
 
+	// VMs being migrated can be in odd states or briefly missing, so they are
+	// skipped until the migration is over
+	migratingVMs, err := db.GetVMIDsWithActiveMigration()
+	if err != nil {
+		logger.Error("Can't get migrating VMs from DB", "err", err)
+		return
+	}
+
 	// Updates all DB VM's status
 	for _, r := range resources {
 		if r.Type != "qemu" {
@@ -755,38 +977,43 @@ func updateVMs(cluster *gprox.Cluster) {
 		if !ok {
 			continue
 		}
-
-		statusInSlices := slices.Contains(allVMStatus, r.Status)
-		// If the VMs status becomes normal we need to delete it from the map
-		if _, exists := vmStatusTimeMap[r.VMID]; exists {
-			delete(vmStatusTimeMap, r.VMID)
+		if slices.Contains(migratingVMs, r.VMID) {
+			continue
 		}
 
-		lastTimeVMWasPrelaunch, hasLastTimeVMWasPrelaunch := vmLastTimePrelaunchMap[r.VMID]
+		// Keep track of the node, the VM could have been migrated
+		if vm.Node != r.Node {
+			err := db.UpdateVMNode(r.VMID, r.Node)
+			if err != nil {
+				logger.Error("Failed to update node of VM", "vmid", r.VMID, "node", r.Node, "err", err)
+			}
+		}
+
+		statusInSlices := slices.Contains(allVMStatus, r.Status)
+		// If the VMs status becomes normal we need to delete it from the map
+		if _, exists := pc.vmStatusTimeMap[r.VMID]; exists {
+			delete(pc.vmStatusTimeMap, r.VMID)
+		}
+
+		lastTimeVMWasPrelaunch, hasLastTimeVMWasPrelaunch := pc.vmLastTimePrelaunchMap[r.VMID]
 		if !hasLastTimeVMWasPrelaunch {
-			lastTimeVMWasPrelaunch = time.Time{}
+			lastTimeVMWasPrelaunch = pc.workerStartTime
 		}
 
 		if vm.Status == string(VMStatusUnknown) && statusInSlices {
-			logger.Warn("VM changed status from unknown to a known status", "vmid", r.VMID, "new_status", r.Status)
-			err := db.UpdateVMStatus(r.VMID, r.Status)
+			status := stoppedVMStatus(pc, r.Node, r.VMID, r.Status)
+			logger.Warn("VM changed status from unknown to a known status", "vmid", r.VMID, "new_status", status)
+			err := db.UpdateVMStatus(r.VMID, status)
 			if err != nil {
-				logger.Error("Failed to update status of VM", "vmid", r.VMID, "new_status", r.Status, "err", err)
+				logger.Error("Failed to update status of VM", "vmid", r.VMID, "new_status", status, "err", err)
 			}
 
-			if vm.OwnerType == "Group" {
-				err = notify.SendVMStatusUpdateNotificationToGroup(vm.OwnerID, vm.Name, r.Status)
-			} else {
-				err = notify.SendVMStatusUpdateNotification(vm.OwnerID, vm.Name, r.Status)
-			}
-			if err != nil {
-				logger.Error("Failed to send VM status update notification", "vmid", r.VMID, "new_status", r.Status, "err", err)
-			}
+			sendVMStatusUpdateNotification(vm, status)
 
-			delete(vmStatusTimeMap, r.VMID)
+			delete(pc.vmStatusTimeMap, r.VMID)
 
 		} else if !statusInSlices {
-			vmStatusTimeMapEntry, exists := vmStatusTimeMap[r.VMID]
+			vmStatusTimeMapEntry, exists := pc.vmStatusTimeMap[r.VMID]
 
 			timeToWait := 1 * time.Minute
 			// VMs can be in the 'prelaunch' status during a backup, so we give it more time
@@ -796,7 +1023,7 @@ func updateVMs(cluster *gprox.Cluster) {
 			}
 
 			if r.Status == "prelaunch" {
-				vmLastTimePrelaunchMap[r.VMID] = time.Now()
+				pc.vmLastTimePrelaunchMap[r.VMID] = time.Now()
 			}
 
 			if exists && time.Since(vmStatusTimeMapEntry.Time) > timeToWait && vmStatusTimeMapEntry.Value == r.Status {
@@ -807,32 +1034,25 @@ func updateVMs(cluster *gprox.Cluster) {
 					logger.Error("Failed to update status of VM", "vmid", r.VMID, "new_status", VMStatusUnknown, "err", err)
 				}
 
-				if vm.OwnerType == "Group" {
-					err = notify.SendVMStatusUpdateNotificationToGroup(vm.OwnerID, vm.Name, string(VMStatusUnknown))
-				} else {
-					err = notify.SendVMStatusUpdateNotification(vm.OwnerID, vm.Name, string(VMStatusUnknown))
-				}
-				if err != nil {
-					logger.Error("Failed to send VM status update notification", "vmid", r.VMID, "new_status", VMStatusUnknown, "err", err)
-				}
+				sendVMStatusUpdateNotification(vm, string(VMStatusUnknown))
 
-				delete(vmStatusTimeMap, r.VMID)
+				delete(pc.vmStatusTimeMap, r.VMID)
 			} else if !exists || vmStatusTimeMapEntry.Value != r.Status {
 				t := time.Now()
 				// if exists {
 				// 	t = vmStatusTimeMapEntry.Time
 				// }
-				vmStatusTimeMap[r.VMID] = stringTime{
+				pc.vmStatusTimeMap[r.VMID] = stringTime{
 					Value: r.Status,
 					Time:  t,
 				}
 			}
-		} else if r.Status != vm.Status &&
+		} else if !proxmoxStatusMatches(vm.Status, r.Status) &&
 			vm.UpdatedAt.Before(time.Now().Add(-1*time.Minute)) && // Avoid status flapping right after a status change from the APIs
 			lastTimeVMWasPrelaunch.Before(time.Now().Add(-5*time.Minute)) { // Avoid status flapping right after a prelaunch
 			logger.Warn("VM changed status on proxmox unexpectedly", "vmid", r.VMID, "new_status", r.Status, "old_status", vm.Status)
 
-			status := r.Status
+			status := stoppedVMStatus(pc, r.Node, r.VMID, r.Status)
 			if !statusInSlices {
 				logger.Error("VM status not recognised, setting status to unknown", "vmid", r.VMID, "new_status", r.Status, "old_status", vm.Status)
 				status = string(VMStatusUnknown)
@@ -843,16 +1063,9 @@ func updateVMs(cluster *gprox.Cluster) {
 				logger.Error("Failed to update status of VM", "vmid", r.VMID, "new_status", status, "err", err)
 			}
 
-			if vm.OwnerType == "Group" {
-				err = notify.SendVMStatusUpdateNotificationToGroup(vm.OwnerID, vm.Name, status)
-			} else {
-				err = notify.SendVMStatusUpdateNotification(vm.OwnerID, vm.Name, status)
-			}
-			if err != nil {
-				logger.Error("Failed to send VM status update notification", "vmid", r.VMID, "new_status", status, "err", err)
-			}
+			sendVMStatusUpdateNotification(vm, status)
 
-			delete(vmStatusTimeMap, r.VMID)
+			delete(pc.vmStatusTimeMap, r.VMID)
 		}
 	}
 
@@ -870,7 +1083,7 @@ func updateVMs(cluster *gprox.Cluster) {
 		if found {
 			continue
 		}
-		if activeVMs[i].Status == string(VMStatusUnknown) {
+		if activeVMs[i].Status == string(VMStatusUnknown) || slices.Contains(migratingVMs, vmid) {
 			continue
 		}
 
@@ -883,168 +1096,355 @@ func updateVMs(cluster *gprox.Cluster) {
 	}
 }
 
-func createInterfaces(vmNodes map[uint64]string) {
-	logger.Debug("Creating interfaces in worker")
+// proxmoxStatusMatches reports if the status of a VM on Proxmox is the one
+// expected for the status in the DB. A paused VM is still running on Proxmox,
+// and an hibernated VM is stopped.
+func proxmoxStatusMatches(dbStatus, proxmoxStatus string) bool {
+	switch {
+	case dbStatus == proxmoxStatus:
+		return true
+	case dbStatus == string(VMStatusPaused) && proxmoxStatus == string(VMStatusRunning):
+		return true
+	case dbStatus == string(VMStatusHibernated) && proxmoxStatus == string(VMStatusStopped):
+		return true
+	}
+	return false
+}
 
-	interfaces, err := db.GetInterfacesWithStatus(string(InterfaceStatusPreCreating))
+// isHibernatedOnProxmox reports if the VM is hibernated. Proxmox shows it as
+// stopped, with the config locked until the VM is started or stopped.
+func isHibernatedOnProxmox(vm *gprox.VirtualMachine) bool {
+	return vm.Status == string(VMStatusStopped) && vm.VirtualMachineConfig.Lock == "suspended"
+}
+
+// stoppedVMStatus returns the status in sasso of a VM with the given status on
+// Proxmox. The resources of the cluster don't tell apart stopped and
+// hibernated VMs, so the config of the stopped VMs is checked.
+func stoppedVMStatus(pc *pveCluster, nodeName string, vmID uint64, status string) string {
+	if status != string(VMStatusStopped) {
+		return status
+	}
+
+	node, err := getProxmoxNode(pc.client, nodeName)
 	if err != nil {
-		logger.Error("Failed to get interfaces with 'pre-creating' status", "error", err)
+		return status
+	}
+	vm, err := getProxmoxVM(node, int(vmID))
+	if err != nil {
+		return status
+	}
+	if isHibernatedOnProxmox(vm) {
+		return string(VMStatusHibernated)
+	}
+	return status
+}
+
+// isVMHibernated reports if the changes to the config of the VM must wait,
+// as Proxmox locks the config of the hibernated VMs. They are configured when
+// the VM is started or stopped.
+func isVMHibernated(vm *db.VM) bool {
+	if vm.Status != string(VMStatusHibernated) {
+		return false
+	}
+	logger.Debug("VM is hibernated, waiting to configure it", "vmid", vm.ID)
+	return true
+}
+
+// vmStatusFromProxmox returns the status of a VM that is not yet managed by
+// sasso
+func vmStatusFromProxmox(vm *gprox.VirtualMachine) VMStatus {
+	if isHibernatedOnProxmox(vm) {
+		return VMStatusHibernated
+	}
+	vmStates := []VMStatus{VMStatusRunning, VMStatusStopped, VMStatusPaused}
+	if slices.Contains(vmStates, VMStatus(vm.Status)) {
+		return VMStatus(vm.Status)
+	}
+	return VMStatusUnknown
+}
+
+// sendVMStatusUpdateNotification notifies the owner of the VM about a status
+// change, unless the notifications are suppressed by the maintenance mode
+func sendVMStatusUpdateNotification(vm *db.VM, status string) {
+	if statusNotificationsSuppressed() {
+		logger.Debug("Status notification suppressed by maintenance", "vmid", vm.ID, "new_status", status)
 		return
 	}
 
-	for _, iface := range interfaces {
-		dbVM, err := db.GetVMByID(uint64(iface.VMID))
-		if err != nil {
-			logger.Error("Failed to get VM by ID for interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
-			continue
-		}
+	var err error
+	if vm.OwnerType == "Group" {
+		err = notify.SendVMStatusUpdateNotificationToGroup(vm.OwnerID, vm.Name, status)
+	} else {
+		err = notify.SendVMStatusUpdateNotification(vm.OwnerID, vm.Name, status)
+	}
+	if err != nil {
+		logger.Error("Failed to send VM status update notification", "vmid", vm.ID, "new_status", status, "err", err)
+	}
+}
 
-		if !slices.Contains(goodVMStatesForInterfacesManipulation, VMStatus(dbVM.Status)) {
-			logger.Warn("Can't create configure interface. VM not in a good state for interface manipulation", "vmid", iface.VMID, "interface_id", iface.ID, "vm_status", dbVM.Status)
-			continue
-		}
+// renameVMs propagates the names of the VMs to Proxmox. It's needed only if
+// the VMs on Proxmox use the names chosen by the users.
+func renameVMs(pc *pveCluster, cluster *gprox.Cluster) {
+	if !cClone.UserVMNames {
+		return
+	}
 
-		nodeName, ok := vmNodes[uint64(iface.VMID)]
-		if !ok {
-			logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
-			continue
-		}
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
+	logger.Debug("Renaming VMs in worker")
+
+	resources, err := getProxmoxResources(cluster, "vm")
+	if err != nil {
+		return
+	}
+
+	activeVMs, err := db.GetAllActiveVMs()
+	if err != nil {
+		logger.Error("Can't get active VMs from DB", "err", err)
+		return
+	}
+	activeVMs = slices.DeleteFunc(activeVMs, func(v db.VM) bool { return v.Cluster != pc.name })
+
+	vmMap := make(map[uint64]*db.VM)
+	for i := range activeVMs {
+		vmMap[activeVMs[i].ID] = &activeVMs[i]
+	}
+
+	run := pc.newStageRun("rename_vms")
+	for _, r := range resources {
+		if r.Type != "qemu" {
 			continue
 		}
 
-		vm, err := getProxmoxVM(node, int(iface.VMID))
-		if err != nil {
-			logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
+		v, ok := vmMap[r.VMID]
+		if !ok || v.Name == r.Name {
 			continue
 		}
 
-		mnets := vm.VirtualMachineConfig.Nets
-		// mnets := map[net0:virtio=BC:24:11:D2:FA:F0,bridge=vmbr0,firewall=1 net1:virtio=BC:24:11:B6:1C:2A,bridge=sassoint,firewall=1]
+		run.Go(r.Node, v.ID, func() {
+			node, err := getProxmoxNode(pc.client, r.Node)
+			if err != nil {
+				return
+			}
 
-		// To avoid increasing the netX index indefinitely, we find the first
-		// empty index
-		var snet = make([]int, len(mnets))
-		var i int = 0
-		for k := range mnets {
-			tmp := strings.TrimPrefix(k, "net")
-			tmpN, err := strconv.Atoi(tmp)
+			vm, err := getProxmoxVM(node, int(r.VMID))
 			if err != nil {
-				continue
+				return
 			}
-			snet[i] = tmpN
-			i++
-		}
-		slices.Sort(snet)
-		logger.Debug("Current network interfaces on Proxmox VM", "mnets", mnets, "snet", snet)
-		var firstEmptyIndex int = -1
-		for i := range snet {
-			if snet[i] != i {
-				firstEmptyIndex = i
-				break
+
+			// The config of an hibernated VM is locked, it is renamed when the
+			// VM is started or stopped
+			if isHibernatedOnProxmox(vm) {
+				logger.Debug("VM is hibernated, rename postponed", "vmid", v.ID)
+				return
 			}
-		}
-		if firstEmptyIndex == -1 {
-			firstEmptyIndex = len(snet)
-		}
 
-		vnet, err := db.GetNetByID(iface.VNetID)
-		if err != nil {
-			logger.Error("Failed to get net by ID", "interface_id", iface.ID, "net_id", iface.VNetID, "err", err)
+			logger.Debug("Renaming VM", "vmid", v.ID, "old_name", r.Name, "new_name", v.Name)
+
+			nameOption := gprox.VirtualMachineOption{
+				Name:  "name",
+				Value: v.Name,
+			}
+			isSuccessful, err := configureVM(workerContext, vm, nameOption)
+			if err != nil {
+				logger.Error("Failed to rename VM", "vmid", v.ID, "err", err)
+				return
+			}
+			if !isSuccessful {
+				logger.Error("Failed to rename VM", "vmid", v.ID)
+			}
+		})
+	}
+	run.Wait()
+}
+
+func createInterfaces(pc *pveCluster, vmNodes map[uint64]string) {
+	logger.Debug("Creating interfaces in worker")
+
+	interfaces, err := db.GetInterfacesWithStatus(string(InterfaceStatusPreCreating))
+	if err != nil {
+		logger.Error("Failed to get interfaces with 'pre-creating' status", "error", err)
+		return
+	}
+
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	interfaces = slices.DeleteFunc(interfaces, func(i db.Interface) bool { return !vmIDs[uint64(i.VMID)] })
+
+	run := pc.newStageRun("create_interfaces")
+	for _, iface := range interfaces {
+		if waitingForRetry(iface.NextRetryAt) {
 			continue
 		}
 
-		v := fmt.Sprintf("virtio,bridge=%s", vnet.Name)
+		run.Go(vmNodes[uint64(iface.VMID)], uint64(iface.VMID), func() {
+			dbVM, err := db.GetVMByID(uint64(iface.VMID))
+			if err != nil {
+				logger.Error("Failed to get VM by ID for interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
+				return
+			}
 
-		if cClone.EnableFirewall {
-			v = fmt.Sprintf("%s,firewall=1", v)
-		}
+			if !slices.Contains(goodVMStatesForInterfacesManipulation, VMStatus(dbVM.Status)) {
+				logger.Warn("Can't create configure interface. VM not in a good state for interface manipulation", "vmid", iface.VMID, "interface_id", iface.ID, "vm_status", dbVM.Status)
+				return
+			}
+			if isVMHibernated(dbVM) {
+				return
+			}
 
-		if cClone.MTU.Set {
-			value := cClone.MTU.MTU
-			if cClone.MTU.SameAsBridge {
-				value = 1
+			nodeName, ok := vmNodes[uint64(iface.VMID)]
+			if !ok {
+				logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
+				return
+			}
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
+				return
 			}
-			v = fmt.Sprintf("%s,mtu=%d", v, value)
-		}
 
-		if iface.VlanTag != 0 {
-			v = fmt.Sprintf("%s,tag=%d", v, iface.VlanTag)
-		}
-		o := gprox.VirtualMachineOption{
-			Name:  "net" + strconv.Itoa(firstEmptyIndex),
-			Value: v,
-		}
+			vm, err := getProxmoxVM(node, int(iface.VMID))
+			if err != nil {
+				logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
+				return
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := vm.Config(ctx, o)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to add network interface to Proxmox VM", "error", err)
-			continue
-		}
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			continue
-		}
+			mnets := vm.VirtualMachineConfig.Nets
+			// mnets := map[net0:virtio=BC:24:11:D2:FA:F0,bridge=vmbr0,firewall=1 net1:virtio=BC:24:11:B6:1C:2A,bridge=sassoint,firewall=1]
 
-		if !isSuccessful {
-			logger.Error("Failed to add network interface to Proxmox VM")
-			continue
-		}
+			// To avoid increasing the netX index indefinitely, we find the first
+			// empty index
+			var snet = make([]int, len(mnets))
+			var i int = 0
+			for k := range mnets {
+				tmp := strings.TrimPrefix(k, "net")
+				tmpN, err := strconv.Atoi(tmp)
+				if err != nil {
+					continue
+				}
+				snet[i] = tmpN
+				i++
+			}
+			slices.Sort(snet)
+			logger.Debug("Current network interfaces on Proxmox VM", "mnets", mnets, "snet", snet)
+			var firstEmptyIndex int = -1
+			for i := range snet {
+				if snet[i] != i {
+					firstEmptyIndex = i
+					break
+				}
+			}
+			if firstEmptyIndex == -1 {
+				firstEmptyIndex = len(snet)
+			}
 
-		gatewayIpAddress := ipaddr.NewIPAddressString(iface.Gateway)
-		gatewayIpAddressNoMask := gatewayIpAddress.GetAddress().WithoutPrefixLen().String()
+			vnet, err := db.GetNetByID(iface.VNetID)
+			if err != nil {
+				logger.Error("Failed to get net by ID", "interface_id", iface.ID, "net_id", iface.VNetID, "err", err)
+				return
+			}
 
-		o2 := gprox.VirtualMachineOption{
-			Name:  "ipconfig" + strconv.Itoa(firstEmptyIndex),
-			Value: fmt.Sprintf("ip=%s", iface.IPAdd),
-		}
+			v := fmt.Sprintf("virtio,bridge=%s", vnet.Name)
 
-		if iface.Gateway != "" {
-			o2.Value = fmt.Sprintf("%s,gw=%s", o2.Value, gatewayIpAddressNoMask)
-		}
+			if cClone.EnableFirewall {
+				v = fmt.Sprintf("%s,firewall=1", v)
+			}
 
-		logger.Debug("Configuring network interface on Proxmox VM", "option", o2)
+			if cClone.MTU.Set {
+				value := cClone.MTU.MTU
+				if cClone.MTU.SameAsBridge {
+					value = 1
+				}
+				v = fmt.Sprintf("%s,mtu=%d", v, value)
+			}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		t, err = vm.Config(ctx, o2)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to configure network interface on Proxmox VM", "error", err)
-			continue
-		}
-		isSuccessful, err = waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			continue
-		}
-		if !isSuccessful {
-			logger.Error("Failed to configure network interface on Proxmox VM")
-			continue
-		}
+			if iface.VlanTag != 0 {
+				v = fmt.Sprintf("%s,tag=%d", v, iface.VlanTag)
+			}
+			o := gprox.VirtualMachineOption{
+				Name:  "net" + strconv.Itoa(firstEmptyIndex),
+				Value: v,
+			}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		err = vm.RegenerateCloudInitImage(ctx)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to regenerate cloud-init image on Proxmox VM", "error", err)
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := vm.Config(ctx, o)
+			cancel()
+			if err != nil {
+				interfaceAttemptFailed(&iface, InterfaceStatusPreCreating, "interface creation", err)
+				return
+			}
+			if _, err := waitForProxmoxTaskCompletion(workerContext, t); err != nil {
+				if workerContext.Err() == nil {
+					interfaceAttemptFailed(&iface, InterfaceStatusPreCreating, "interface creation", fmt.Errorf("failed to add the network interface to the VM: %w", err))
+				}
+				return
+			}
 
-		iface.LocalID = uint(firstEmptyIndex)
-		iface.Status = string(InterfaceStatusReady)
-		err = db.UpdateInterface(&iface)
-		if err != nil {
-			logger.Error("Failed to update interface status to ready", "interface", iface, "err", err)
-			continue
-		}
+			// From now on the interface exists on the VM, so a failure is retried
+			// by configureInterfaces
+			iface.LocalID = uint(firstEmptyIndex)
+
+			gatewayIpAddress := ipaddr.NewIPAddressString(iface.Gateway)
+			gatewayIpAddressNoMask := gatewayIpAddress.GetAddress().WithoutPrefixLen().String()
+
+			o2 := gprox.VirtualMachineOption{
+				Name:  "ipconfig" + strconv.Itoa(firstEmptyIndex),
+				Value: fmt.Sprintf("ip=%s", iface.IPAdd),
+			}
+
+			if iface.Gateway != "" {
+				o2.Value = fmt.Sprintf("%s,gw=%s", o2.Value, gatewayIpAddressNoMask)
+			}
+
+			logger.Debug("Configuring network interface on Proxmox VM", "option", o2)
+
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			t, err = vm.Config(ctx, o2)
+			cancel()
+			if err != nil {
+				createdInterfaceAttemptFailed(&iface, err)
+				return
+			}
+			if _, err := waitForProxmoxTaskCompletion(workerContext, t); err != nil {
+				if workerContext.Err() == nil {
+					createdInterfaceAttemptFailed(&iface, fmt.Errorf("failed to configure the IP address of the network interface: %w", err))
+				}
+				return
+			}
+
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			err = vm.RegenerateCloudInitImage(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("Failed to regenerate cloud-init image on Proxmox VM", "error", err)
+			}
+
+			iface.Status = string(InterfaceStatusReady)
+			iface.LastError = ""
+			iface.Attempts = 0
+			iface.NextRetryAt = nil
+			err = db.UpdateInterface(&iface)
+			if err != nil {
+				logger.Error("Failed to update interface status to ready", "interface", iface, "err", err)
+				return
+			}
+		})
 	}
+	run.Wait()
 }
 
-func deleteInterfaces(vmNodes map[uint64]string) {
+// createdInterfaceAttemptFailed records a failed attempt on an interface
+// already added to the VM. The local ID is saved, so the interface is
+// configured again instead of being added twice.
+func createdInterfaceAttemptFailed(iface *db.Interface, cause error) {
+	err := db.UpdateInterface(iface)
+	if err != nil {
+		logger.Error("Failed to save local ID of interface", "interface_id", iface.ID, "err", err)
+	}
+	interfaceAttemptFailed(iface, InterfaceStatusPreConfiguring, "interface configuration", cause)
+}
+
+func deleteInterfaces(pc *pveCluster, vmNodes map[uint64]string) {
 	logger.Debug("Configuring interfaces in worker")
 
 	interfaces, err := db.GetInterfacesWithStatus(string(InterfaceStatusPreDeleting))
@@ -1053,64 +1453,72 @@ func deleteInterfaces(vmNodes map[uint64]string) {
 		return
 	}
 
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	interfaces = slices.DeleteFunc(interfaces, func(i db.Interface) bool { return !vmIDs[uint64(i.VMID)] })
+
+	run := pc.newStageRun("delete_interfaces")
 	for _, iface := range interfaces {
-		nodeName, ok := vmNodes[uint64(iface.VMID)]
-		if !ok {
-			logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
-			continue
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		node, err := client.Node(ctx, nodeName)
-		cancel()
-		if err != nil {
-			logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
+		if waitingForRetry(iface.NextRetryAt) {
 			continue
 		}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		vm, err := node.VirtualMachine(ctx, int(iface.VMID))
-		cancel()
-		if err != nil {
-			logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
-			continue
-		}
+		run.Go(vmNodes[uint64(iface.VMID)], uint64(iface.VMID), func() {
+			dbVM, err := db.GetVMByID(uint64(iface.VMID))
+			if err != nil {
+				logger.Error("Failed to get VM by ID for interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
+				return
+			}
+			if isVMHibernated(dbVM) {
+				return
+			}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := vm.Config(ctx, gprox.VirtualMachineOption{
-			Name:  "delete",
-			Value: fmt.Sprintf("net%d", iface.LocalID),
-		})
-		cancel()
-		if err != nil {
-			logger.Error("Failed to remove network interface from Proxmox VM", "error", err)
-			continue
-		}
+			nodeName, ok := vmNodes[uint64(iface.VMID)]
+			if !ok {
+				logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			node, err := pc.client.Node(ctx, nodeName)
+			cancel()
+			if err != nil {
+				logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
+				return
+			}
 
-		err = db.UpdateInterfaceStatus(iface.ID, string(InterfaceStatusDeleting))
-		if err != nil {
-			logger.Error("Failed to update interface status to deleting", "interface", iface, "err", err)
-			continue
-		}
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			vm, err := node.VirtualMachine(ctx, int(iface.VMID))
+			cancel()
+			if err != nil {
+				logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
+				return
+			}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			continue
-		}
-		if !isSuccessful {
-			logger.Error("Failed to remove network interface from Proxmox VM")
-			continue
-		}
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := vm.Config(ctx, gprox.VirtualMachineOption{
+				Name:  "delete",
+				Value: fmt.Sprintf("net%d", iface.LocalID),
+			})
+			cancel()
+			if err != nil {
+				interfaceAttemptFailed(&iface, InterfaceStatusPreDeleting, "interface deletion", err)
+				return
+			}
 
-		err = db.DeleteInterfaceByID(iface.ID)
-		if err != nil {
-			logger.Error("Failed to delete interface from DB", "interface", iface, "err", err)
-			continue
-		}
+			// The task is tracked by pollTasks
+			err = db.SetInterfaceTask(iface.ID, string(InterfaceStatusDeleting), string(t.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to update interface status to deleting", "interface", iface, "err", err)
+				return
+			}
+		})
 	}
+	run.Wait()
 }
 
-func configureInterfaces(vmNodes map[uint64]string) {
+func configureInterfaces(pc *pveCluster, vmNodes map[uint64]string) {
 	logger.Debug("Configuring interfaces in worker")
 
 	interfaces, err := db.GetInterfacesWithStatus(string(InterfaceStatusPreConfiguring))
@@ -1119,127 +1527,138 @@ func configureInterfaces(vmNodes map[uint64]string) {
 		return
 	}
 
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	interfaces = slices.DeleteFunc(interfaces, func(i db.Interface) bool { return !vmIDs[uint64(i.VMID)] })
+
+	run := pc.newStageRun("configure_interfaces")
 	for _, iface := range interfaces {
-		dbVM, err := db.GetVMByID(uint64(iface.VMID))
-		if err != nil {
-			logger.Error("Failed to get VM by ID for interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
+		if waitingForRetry(iface.NextRetryAt) {
 			continue
 		}
 
-		err = db.UpdateInterfaceStatus(iface.ID, string(InterfaceStatusConfiguring))
-		if err != nil {
-			logger.Error("Failed to update interface status to configuring", "interface", iface, "err", err)
-			continue
-		}
+		run.Go(vmNodes[uint64(iface.VMID)], uint64(iface.VMID), func() {
+			dbVM, err := db.GetVMByID(uint64(iface.VMID))
+			if err != nil {
+				logger.Error("Failed to get VM by ID for interface", "interface_id", iface.ID, "vmid", iface.VMID, "err", err)
+				return
+			}
+			if isVMHibernated(dbVM) {
+				return
+			}
 
-		if !slices.Contains(goodVMStatesForInterfacesManipulation, VMStatus(dbVM.Status)) {
-			logger.Warn("Can't configure interface. VM not in a good state for interface manipulation", "vmid", iface.VMID, "interface_id", iface.ID, "vm_status", dbVM.Status)
-			continue
-		}
+			err = db.UpdateInterfaceStatus(iface.ID, string(InterfaceStatusConfiguring))
+			if err != nil {
+				logger.Error("Failed to update interface status to configuring", "interface", iface, "err", err)
+				return
+			}
 
-		dbNet, err := db.GetNetByID(iface.VNetID)
-		if err != nil {
-			logger.Error("Failed to get net by ID", "interface_id", iface.ID, "net_id", iface.VNetID, "err", err)
-			continue
-		}
+			if !slices.Contains(goodVMStatesForInterfacesManipulation, VMStatus(dbVM.Status)) {
+				logger.Warn("Can't configure interface. VM not in a good state for interface manipulation", "vmid", iface.VMID, "interface_id", iface.ID, "vm_status", dbVM.Status)
+				return
+			}
 
-		nodeName, ok := vmNodes[uint64(iface.VMID)]
-		if !ok {
-			logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
-			continue
-		}
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
-			continue
-		}
+			dbNet, err := db.GetNetByID(iface.VNetID)
+			if err != nil {
+				logger.Error("Failed to get net by ID", "interface_id", iface.ID, "net_id", iface.VNetID, "err", err)
+				return
+			}
 
-		vm, err := getProxmoxVM(node, int(iface.VMID))
-		if err != nil {
-			logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
-			continue
-		}
+			nodeName, ok := vmNodes[uint64(iface.VMID)]
+			if !ok {
+				logger.Error("Can't configure interface. VM not found on cluster resources", "vmid", iface.VMID, "interface_id", iface.ID)
+				return
+			}
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				logger.Error("Can't get node. Can't configure interface", "err", err, "vmid", iface.VMID, "interface_id", iface.ID)
+				return
+			}
 
-		mnets := vm.VirtualMachineConfig.Nets
-		// We just check that a network exists for the local_id of the interface
-		s := fmt.Sprintf("net%d", iface.LocalID)
-		pnet, ok := mnets[s]
-		if !ok {
-			logger.Error("Can't configure interface. Network not found on Proxmox VM", "interface_id", iface.ID, "vmid", iface.VMID, "local_id", iface.LocalID)
-			continue
-		}
+			vm, err := getProxmoxVM(node, int(iface.VMID))
+			if err != nil {
+				logger.Error("Can't get VM. Can't configure VM", "err", err, "vmid", iface.VMID)
+				return
+			}
 
-		if dbNet.VlanAware {
-			pnet = substituteVlanTag(pnet, iface.VlanTag)
-		}
+			mnets := vm.VirtualMachineConfig.Nets
+			// We just check that a network exists for the local_id of the interface
+			s := fmt.Sprintf("net%d", iface.LocalID)
+			pnet, ok := mnets[s]
+			if !ok {
+				logger.Error("Can't configure interface. Network not found on Proxmox VM", "interface_id", iface.ID, "vmid", iface.VMID, "local_id", iface.LocalID)
+				return
+			}
 
-		o := gprox.VirtualMachineOption{
-			Name:  s,
-			Value: pnet,
-		}
+			if dbNet.VlanAware {
+				pnet = substituteVlanTag(pnet, iface.VlanTag)
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := vm.Config(ctx, o)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to add network interface to Proxmox VM", "error", err)
-			continue
-		}
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			continue
-		}
+			o := gprox.VirtualMachineOption{
+				Name:  s,
+				Value: pnet,
+			}
 
-		if !isSuccessful {
-			logger.Error("Failed to add network interface to Proxmox VM")
-			continue
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := vm.Config(ctx, o)
+			cancel()
+			if err != nil {
+				interfaceAttemptFailed(&iface, InterfaceStatusPreConfiguring, "interface configuration", err)
+				return
+			}
+			if _, err := waitForProxmoxTaskCompletion(workerContext, t); err != nil {
+				if workerContext.Err() == nil {
+					interfaceAttemptFailed(&iface, InterfaceStatusPreConfiguring, "interface configuration", fmt.Errorf("failed to update the network interface of the VM: %w", err))
+				}
+				return
+			}
 
-		o2 := gprox.VirtualMachineOption{
-			Name:  fmt.Sprintf("ipconfig%d", iface.LocalID),
-			Value: fmt.Sprintf("ip=%s", iface.IPAdd),
-		}
+			o2 := gprox.VirtualMachineOption{
+				Name:  fmt.Sprintf("ipconfig%d", iface.LocalID),
+				Value: fmt.Sprintf("ip=%s", iface.IPAdd),
+			}
 
-		if iface.Gateway != "" {
-			o2.Value = fmt.Sprintf("%s,gw=%s", o2.Value, iface.Gateway)
-		}
+			if iface.Gateway != "" {
+				o2.Value = fmt.Sprintf("%s,gw=%s", o2.Value, iface.Gateway)
+			}
 
-		logger.Debug("Configuring network interface on Proxmox VM", "option", o2)
+			logger.Debug("Configuring network interface on Proxmox VM", "option", o2)
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		t, err = vm.Config(ctx, o2)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to configure network interface on Proxmox VM", "error", err)
-			continue
-		}
-		isSuccessful, err = waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			continue
-		}
-		if !isSuccessful {
-			logger.Error("Failed to configure network interface on Proxmox VM")
-			continue
-		}
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			t, err = vm.Config(ctx, o2)
+			cancel()
+			if err != nil {
+				interfaceAttemptFailed(&iface, InterfaceStatusPreConfiguring, "interface configuration", err)
+				return
+			}
+			if _, err := waitForProxmoxTaskCompletion(workerContext, t); err != nil {
+				if workerContext.Err() == nil {
+					interfaceAttemptFailed(&iface, InterfaceStatusPreConfiguring, "interface configuration", fmt.Errorf("failed to configure the IP address of the network interface: %w", err))
+				}
+				return
+			}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		err = vm.RegenerateCloudInitImage(ctx)
-		cancel()
-		if err != nil {
-			logger.Error("Failed to regenerate cloud-init image on Proxmox VM", "error", err)
-		}
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			err = vm.RegenerateCloudInitImage(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("Failed to regenerate cloud-init image on Proxmox VM", "error", err)
+			}
 
-		err = db.UpdateInterfaceStatus(iface.ID, string(InterfaceStatusReady))
-		if err != nil {
-			logger.Error("Failed to update interface status to ready", "interface", iface, "err", err)
-			continue
-		}
+			err = db.UpdateInterfaceStatus(iface.ID, string(InterfaceStatusReady))
+			if err != nil {
+				logger.Error("Failed to update interface status to ready", "interface", iface, "err", err)
+				return
+			}
+			interfaceAttemptSucceeded(&iface)
+		})
 	}
+	run.Wait()
 }
 
-func deleteBackups(mapVMContent map[uint64]string) {
+func deleteBackups(pc *pveCluster, mapVMContent map[uint64]string) {
 	logger.Debug("Deleting backups in worker")
 
 	bkr, err := db.GetBackupRequestWithStatusAndType(BackupRequestStatusPending, BackupRequestTypeDelete)
@@ -1248,64 +1667,64 @@ func deleteBackups(mapVMContent map[uint64]string) {
 		return
 	}
 
-	for _, r := range bkr {
-		slog.Debug("Deleting backup", "id", r.ID)
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	bkr = slices.DeleteFunc(bkr, func(r db.BackupRequest) bool { return !vmIDs[uint64(r.VMID)] })
 
-		if r.Volid == nil {
-			slog.Error("Can't delete backup. Volid is nil", "id", r.ID)
+	run := pc.newStageRun("delete_backups")
+	for _, r := range bkr {
+		// The task of the request is already running
+		if r.TaskUPID != "" || waitingForRetry(r.NextRetryAt) {
 			continue
 		}
 
-		nodeName, ok := mapVMContent[uint64(r.VMID)]
-		if !ok {
-			logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
-			continue
-		}
+		run.Go(mapVMContent[uint64(r.VMID)], uint64(r.VMID), func() {
+			slog.Debug("Deleting backup", "id", r.ID)
 
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
-			continue
-		}
+			if r.Volid == nil {
+				slog.Error("Can't delete backup. Volid is nil", "id", r.ID)
+				return
+			}
 
-		storage, err := getProxmoxStorage(node, cBackup.Storage)
-		if err != nil {
-			logger.Error("Failed to get Proxmox storage", "storage", cBackup.Storage, "error", err)
-			continue
-		}
+			nodeName, ok := mapVMContent[uint64(r.VMID)]
+			if !ok {
+				logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
+				return
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := storage.DeleteContent(ctx, *r.Volid)
-		defer cancel()
-		if err != nil {
-			logger.Error("failed to delete content", "error", err)
-			continue
-		}
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
+				return
+			}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			err = db.UpdateBackupRequestStatus(r.ID, BackupRequestStatusFailed)
+			storage, err := getProxmoxStorage(node, pc.backup.Storage)
 			if err != nil {
-				logger.Error("Failed to update backup request status to failed", "id", r.ID, "error", err)
+				logger.Error("Failed to get Proxmox storage", "storage", pc.backup.Storage, "error", err)
+				return
 			}
-			continue
-		}
 
-		var status string
-		if isSuccessful {
-			status = BackupRequestStatusCompleted
-		} else {
-			status = BackupRequestStatusFailed
-		}
-		err = db.UpdateBackupRequestStatus(r.ID, status)
-		if err != nil {
-			logger.Error("Failed to update backup request status", "status", status, "id", r.ID, "error", err)
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := storage.DeleteContent(ctx, *r.Volid)
+			defer cancel()
+			if err != nil {
+				backupRequestAttemptFailed(&r, err)
+				return
+			}
+
+			// The task is tracked by pollTasks
+			err = db.SetBackupRequestTask(r.ID, BackupRequestStatusPending, string(t.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to save task of backup request", "id", r.ID, "error", err)
+			}
+		})
 	}
+	run.Wait()
 }
 
-func restoreBackups(mapVMContent map[uint64]string) {
+func restoreBackups(pc *pveCluster, mapVMContent map[uint64]string) {
 	logger.Debug("Restoring backups in worker")
 
 	bkr, err := db.GetBackupRequestWithStatusAndType(BackupRequestStatusPending, BackupRequestTypeRestore)
@@ -1314,67 +1733,67 @@ func restoreBackups(mapVMContent map[uint64]string) {
 		return
 	}
 
-	for _, r := range bkr {
-		slog.Debug("Restoring backup", "id", r.ID)
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	bkr = slices.DeleteFunc(bkr, func(r db.BackupRequest) bool { return !vmIDs[uint64(r.VMID)] })
 
-		if r.Volid == nil {
-			slog.Error("Can't restore backup. Volid is nil", "id", r.ID)
+	run := pc.newStageRun("restore_backups")
+	for _, r := range bkr {
+		// The task of the request is already running
+		if r.TaskUPID != "" || waitingForRetry(r.NextRetryAt) {
 			continue
 		}
 
-		nodeName, ok := mapVMContent[uint64(r.VMID)]
-		if !ok {
-			logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
-			continue
-		}
+		run.Go(mapVMContent[uint64(r.VMID)], uint64(r.VMID), func() {
+			slog.Debug("Restoring backup", "id", r.ID)
 
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
-			continue
-		}
+			if r.Volid == nil {
+				slog.Error("Can't restore backup. Volid is nil", "id", r.ID)
+				return
+			}
 
-		o1 := gprox.VirtualMachineOption{
-			Name:  "force",
-			Value: "1",
-		}
-		o2 := gprox.VirtualMachineOption{
-			Name:  "archive",
-			Value: r.Volid,
-		}
+			nodeName, ok := mapVMContent[uint64(r.VMID)]
+			if !ok {
+				logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
+				return
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := node.NewVirtualMachine(ctx, int(r.VMID), o1, o2)
-		defer cancel()
-		if err != nil {
-			logger.Error("failed to create new vm", "error", err)
-			continue
-		}
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
+				return
+			}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			err = db.UpdateBackupRequestStatus(r.ID, BackupRequestStatusFailed)
+			o1 := gprox.VirtualMachineOption{
+				Name:  "force",
+				Value: "1",
+			}
+			o2 := gprox.VirtualMachineOption{
+				Name:  "archive",
+				Value: r.Volid,
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := node.NewVirtualMachine(ctx, int(r.VMID), o1, o2)
+			defer cancel()
 			if err != nil {
-				logger.Error("Failed to update backup request status to failed", "id", r.ID, "error", err)
+				backupRequestAttemptFailed(&r, err)
+				return
 			}
-			continue
-		}
 
-		var status string
-		if isSuccessful {
-			status = BackupRequestStatusCompleted
-		} else {
-			status = BackupRequestStatusFailed
-		}
-		err = db.UpdateBackupRequestStatus(r.ID, status)
-		if err != nil {
-			logger.Error("Failed to update backup request status", "status", status, "id", r.ID, "error", err)
-		}
+			// The task is tracked by pollTasks
+			err = db.SetBackupRequestTask(r.ID, BackupRequestStatusPending, string(t.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to save task of backup request", "id", r.ID, "error", err)
+			}
+		})
 	}
+	run.Wait()
 }
 
-func createBackups(mapVMContent map[uint64]string) {
+func createBackups(pc *pveCluster, mapVMContent map[uint64]string) {
 	logger.Debug("Creating backups in worker")
 
 	bkr, err := db.GetBackupRequestWithStatusAndType(BackupRequestStatusPending, BackupRequestTypeCreate)
@@ -1383,66 +1802,66 @@ func createBackups(mapVMContent map[uint64]string) {
 		return
 	}
 
-	for _, r := range bkr {
-		slog.Debug("Creating backup", "id", r.ID)
+	vmIDs, err := pc.vmIDs()
+	if err != nil {
+		return
+	}
+	bkr = slices.DeleteFunc(bkr, func(r db.BackupRequest) bool { return !vmIDs[uint64(r.VMID)] })
 
-		nodeName, ok := mapVMContent[uint64(r.VMID)]
-		if !ok {
-			logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
+	run := pc.newStageRun("create_backups")
+	for _, r := range bkr {
+		// The task of the request is already running
+		if r.TaskUPID != "" || waitingForRetry(r.NextRetryAt) {
 			continue
 		}
 
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
-			continue
-		}
+		run.Go(mapVMContent[uint64(r.VMID)], uint64(r.VMID), func() {
+			slog.Debug("Creating backup", "id", r.ID)
 
-		notes, err := generateBackNotes(r.Name, r.Notes, r.OwnerID, r.OwnerType)
-		if err != nil {
-			logger.Error("Failed to generate backup notes", "error", err)
-			continue
-		}
+			nodeName, ok := mapVMContent[uint64(r.VMID)]
+			if !ok {
+				logger.Error("Can't delete backup. Not found on cluster resources", "vmid", r.VMID)
+				return
+			}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		t, err := node.Vzdump(ctx, &gprox.VirtualMachineBackupOptions{
-			Storage:       cBackup.Storage,
-			VMID:          uint64(r.VMID),
-			Mode:          "snapshot",
-			Remove:        false,
-			Compress:      "zstd",
-			NotesTemplate: notes,
-		})
-		cancel()
-		if err != nil {
-			slog.Error("failed to create vzdump", "error", err)
-			continue
-		}
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				logger.Error("Failed to get Proxmox node", "node", nodeName, "error", err)
+				return
+			}
 
-		isSuccessful, err := waitForProxmoxTaskCompletion(t)
-		if err != nil {
-			logger.Error("Failed to wait for Proxmox task completion", "error", err)
-			err = db.UpdateBackupRequestStatus(r.ID, BackupRequestStatusFailed)
+			notes, err := generateBackNotes(r.Name, r.Notes, r.OwnerID, r.OwnerType)
 			if err != nil {
-				logger.Error("Failed to update backup request status to failed", "id", r.ID, "error", err)
+				logger.Error("Failed to generate backup notes", "error", err)
+				return
 			}
-			continue
-		}
 
-		var status string
-		if isSuccessful {
-			status = BackupRequestStatusCompleted
-		} else {
-			status = BackupRequestStatusFailed
-		}
-		err = db.UpdateBackupRequestStatus(r.ID, status)
-		if err != nil {
-			logger.Error("Failed to update backup request status", "status", status, "id", r.ID, "error", err)
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t, err := node.Vzdump(ctx, &gprox.VirtualMachineBackupOptions{
+				Storage:       pc.backup.Storage,
+				VMID:          uint64(r.VMID),
+				Mode:          "snapshot",
+				Remove:        false,
+				Compress:      "zstd",
+				NotesTemplate: notes,
+			})
+			cancel()
+			if err != nil {
+				backupRequestAttemptFailed(&r, err)
+				return
+			}
+
+			// The task is tracked by pollTasks
+			err = db.SetBackupRequestTask(r.ID, BackupRequestStatusPending, string(t.UPID), nodeName)
+			if err != nil {
+				logger.Error("Failed to save task of backup request", "id", r.ID, "error", err)
+			}
+		})
 	}
+	run.Wait()
 }
 
-func configureSSHKeys(vmNodes map[uint64]string) {
+func configureSSHKeys(pc *pveCluster, vmNodes map[uint64]string) {
 	logger.Debug("Configuring SSH keys in worker")
 
 	states := []string{string(VMStatusStopped), string(VMStatusRunning), string(VMStatusPaused)}
@@ -1457,10 +1876,10 @@ func configureSSHKeys(vmNodes map[uint64]string) {
 	groupt := db.GetLastUserGroupUpdate()
 
 	// Every 6 hours we force a reconfiguration of SSH keys
-	if !lastConfigureSSHKeysTime.Before(time.Now().Add(-6*time.Hour)) &&
-		lastConfigureSSHKeysTime.After(ssht) &&
-		lastConfigureSSHKeysTime.After(vmt) &&
-		lastConfigureSSHKeysTime.After(groupt) {
+	if !pc.lastConfigureSSHKeysTime.Before(time.Now().Add(-6*time.Hour)) &&
+		pc.lastConfigureSSHKeysTime.After(ssht) &&
+		pc.lastConfigureSSHKeysTime.After(vmt) &&
+		pc.lastConfigureSSHKeysTime.After(groupt) {
 		logger.Debug("No need to configure SSH keys. No new SSH keys or VMs")
 		return
 	}
@@ -1474,94 +1893,125 @@ func configureSSHKeys(vmNodes map[uint64]string) {
 		logger.Error("Failed to get VMs with 'stopped' status", "error", err)
 		return
 	}
+	vms = slices.DeleteFunc(vms, func(v db.VM) bool { return v.Cluster != pc.name })
 
+	run := pc.newStageRun("configure_ssh_keys")
 	for _, v := range vms {
 		nodeName, ok := vmNodes[v.ID]
 		if !ok {
 			logger.Error("Can't configure VM. Not found on cluster resources", "vmid", v.ID)
 			continue
 		}
-		node, err := getProxmoxNode(client, nodeName)
-		if err != nil {
-			continue
-		}
+		run.Go(nodeName, v.ID, func() {
+			node, err := getProxmoxNode(pc.client, nodeName)
+			if err != nil {
+				return
+			}
 
-		vm, err := getProxmoxVM(node, int(v.ID))
-		if err != nil {
-			continue
-		}
+			vm, err := getProxmoxVM(node, int(v.ID))
+			if err != nil {
+				return
+			}
 
-		var sshKeys []db.SSHKey
-		if v.OwnerType == "Group" {
-			sshKeys, err = db.GetSSHKeysByGroupID(v.OwnerID)
-		} else {
-			sshKeys, err = db.GetSSHKeysByUserID(v.OwnerID)
-		}
-		if err != nil {
-			logger.Error("Failed to get SSH keys for user", "vmid", v.ID, "ownerID", v.OwnerID, "ownerType", v.OwnerType, "err", err)
-			continue
-		}
+			cloudInitKeys, err := getVMCloudInitSSHKeys(&v)
+			if err != nil {
+				return
+			}
+
+			if vm.VirtualMachineConfig.SSHKeys == cloudInitKeys {
+				return
+			}
 
-		if v.IncludeGlobalSSHKeys {
-			globalKeys, err := db.GetGlobalSSHKeys()
+			sshOption := gprox.VirtualMachineOption{
+				Name:  "sshkeys",
+				Value: cloudInitKeys,
+			}
+			isSuccessful, err := configureVM(workerContext, vm, sshOption)
 			if err != nil {
-				logger.Error("Failed to get global SSH keys", "vmid", v.ID, "err ", err)
-				continue
+				logger.Error("Failed to set ssh keys on VM", "vmid", v.ID, "err", err)
+				return
+			}
+			logger.Debug("Task finished", "isSuccessful", isSuccessful)
+			if !isSuccessful {
+				logger.Error("Failed to set ssh keys on VM", "vmid", v.ID)
+				return
 			}
 
-			sshKeys = append(sshKeys, globalKeys...)
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = vm.RegenerateCloudInitImage(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("Failed to regenerate cloud init image on VM", "vmid", v.ID, "err", err)
+			}
 
-		var keys strings.Builder
-		for i := range sshKeys {
-			keys.WriteString(sshKeys[i].Key)
-			keys.WriteString("\n")
-		}
-		cloudInitKeys := strings.ReplaceAll(url.QueryEscape(keys.String()), "+", "%20")
+			if v.OwnerType == "Group" && pc.lastConfigureSSHKeysTime.After(v.CreatedAt) {
+				err = notify.SendSSHKeysChangedOnVMToGroup(v.OwnerID, v.Name)
+				if err != nil {
+					logger.Error("Failed to send SSH keys changed notification to group", "vmid", v.ID, "err", err)
+				}
+			}
+		})
+	}
+	run.Wait()
 
-		if vm.VirtualMachineConfig.SSHKeys == cloudInitKeys {
-			continue
-		}
+	pc.lastConfigureSSHKeysTime = time.Now()
+}
 
-		sshOption := gprox.VirtualMachineOption{
-			Name:  "sshkeys",
-			Value: cloudInitKeys,
-		}
-		isSuccessful, err := configureVM(vm, sshOption)
-		if err != nil {
-			logger.Error("Failed to set ssh keys on VM", "vmid", v.ID, "err", err)
-			return
-		}
-		logger.Debug("Task finished", "isSuccessful", isSuccessful)
-		if !isSuccessful {
-			logger.Error("Failed to set ssh keys on VM", "vmid", v.ID)
-			continue
-		}
+// getVMCloudInitSSHKeys returns the SSH keys of a VM, encoded as the sshkeys
+// option of cloud-init on Proxmox
+func getVMCloudInitSSHKeys(v *db.VM) (string, error) {
+	keys, err := ownerSSHKeys(v.OwnerID, v.OwnerType, v.IncludeGlobalSSHKeys)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(url.QueryEscape(keys), "+", "%20"), nil
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		err = vm.RegenerateCloudInitImage(ctx)
-		cancel()
+// ownerSSHKeys returns the SSH keys of a user or a group, one per line
+func ownerSSHKeys(ownerID uint, ownerType string, includeGlobal bool) (string, error) {
+	var sshKeys []db.SSHKey
+	var err error
+	if ownerType == "Group" {
+		sshKeys, err = db.GetSSHKeysByGroupID(ownerID)
+	} else {
+		sshKeys, err = db.GetSSHKeysByUserID(ownerID)
+	}
+	if err != nil {
+		logger.Error("Failed to get SSH keys for user", "ownerID", ownerID, "ownerType", ownerType, "err", err)
+		return "", err
+	}
+
+	if includeGlobal {
+		globalKeys, err := db.GetGlobalSSHKeys()
 		if err != nil {
-			logger.Error("Failed to regenerate cloud init image on VM", "vmid", v.ID, "err", err)
+			logger.Error("Failed to get global SSH keys", "err ", err)
+			return "", err
 		}
 
-		if v.OwnerType == "Group" && lastConfigureSSHKeysTime.After(v.CreatedAt) {
-			err = notify.SendSSHKeysChangedOnVMToGroup(v.OwnerID, v.Name)
-			if err != nil {
-				logger.Error("Failed to send SSH keys changed notification to group", "vmid", v.ID, "err", err)
-			}
-		}
+		sshKeys = append(sshKeys, globalKeys...)
 	}
 
-	lastConfigureSSHKeysTime = time.Now()
+	var keys strings.Builder
+	for i := range sshKeys {
+		keys.WriteString(sshKeys[i].Key)
+		keys.WriteString("\n")
+	}
+	return keys.String(), nil
 }
 
 func enforceVMLifetimes() {
-	t := time.Now().AddDate(0, 3, 0) // 3 months from now
+	maxReminder, err := db.GetMaxLifetimeReminderDays()
+	if err != nil {
+		logger.Error("Failed to get max lifetime reminder days", "error", err)
+		return
+	}
+
+	t := time.Now().AddDate(0, 0, int(maxReminder))
 	vms, err := db.GetVMsWithLifetimesLessThanAndStatusIN(t, []string{
 		string(VMStatusRunning),
 		string(VMStatusStopped),
 		string(VMStatusPaused),
+		string(VMStatusHibernated),
 	})
 	if err != nil {
 		logger.Error("Failed to get VMs with lifetimes less than", "time", t, "error", err)
@@ -1574,15 +2024,29 @@ func enforceVMLifetimes() {
 		}
 	}
 
+	// Policies are cached for the cycle, as many VMs share the same owner
+	policies := make(map[string]*db.LifetimePolicy)
+
 	for _, v := range vms {
+		key := fmt.Sprintf("%s-%d", v.OwnerType, v.OwnerID)
+		policy, ok := policies[key]
+		if !ok {
+			policy, err = getLifetimePolicy(v.OwnerID, v.OwnerType)
+			if err != nil {
+				continue
+			}
+			policies[key] = policy
+		}
+
 		notifications, err := db.GetVMExpirationNotificationsByVMID(v.ID)
 		if err != nil {
 			logger.Error("Failed to get VM expiration notifications for VM", "vmid", v.ID, "error", err)
 			continue
 		}
 
-		if v.LifeTime.Before(time.Now().Add(-7 * 24 * time.Hour)) {
-			// The VM expired more than 7 days ago, we delete it
+		gracePeriod := time.Duration(policy.GracePeriod) * 24 * time.Hour
+		if v.LifeTime.Before(time.Now().Add(-gracePeriod)) {
+			// The VM expired more than the grace period ago, we delete it
 			err := deleteVMBypass(v.ID)
 			if err != nil {
 				logger.Error("Failed to delete expired VM", "vmid", v.ID, "error", err)
@@ -1617,19 +2081,20 @@ func enforceVMLifetimes() {
 				continue
 			}
 
-			lastTimeFailed, exists := vmFailedChangeStatus[v.ID]
-			if exists && lastTimeFailed.After(time.Now().Add(-30*time.Hour)) {
+			if v.LifetimeStopFailedAt != nil && v.LifetimeStopFailedAt.After(time.Now().Add(-30*time.Hour)) {
 				// We failed to stop the VM less than an hour ago, we skip it
 				continue
 			}
 
-			// The VM expired, but less than 7 days ago, we send the last notification
+			// The VM expired, but less than the grace period ago, we send the last notification
 			// and stop the VM if it is running
 			if v.Status != string(VMStatusStopped) {
 				err := changeVMStatusBypass(v.ID, "stop")
 				if err != nil {
-					vmFailedChangeStatus[v.ID] = time.Now()
 					logger.Error("Failed to stop expired VM", "vmid", v.ID, "error", err)
+					if err := db.UpdateVMLifetimeStopFailedAt(v.ID, time.Now()); err != nil {
+						logger.Error("Failed to save failed stop of expired VM", "vmid", v.ID, "error", err)
+					}
 					continue
 				}
 			}
@@ -1649,7 +2114,13 @@ func enforceVMLifetimes() {
 				logger.Error("Failed to create VM expiration notification", "vmid", v.ID, "days_before", 0, "error", err)
 			}
 		} else {
-			for _, i := range []int64{1, 2, 4, 7, 15, 30, 60, 90} {
+			reminders := make([]int64, len(policy.ReminderDays))
+			for j, d := range policy.ReminderDays {
+				reminders[j] = int64(d)
+			}
+			slices.Sort(reminders)
+
+			for _, i := range reminders {
 				if slices.ContainsFunc(notifications, fn(i)) {
 					break
 				}